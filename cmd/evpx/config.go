@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+
+	"github.com/ryankurte/evilproxy/lib/config"
+	"github.com/ryankurte/evilproxy/lib/core"
+	"github.com/ryankurte/evilproxy/lib/ingress"
+	"github.com/ryankurte/evilproxy/lib/plugins"
+)
+
+const (
+	// configPollInterval is the interval at which the configuration file is checked for changes
+	configPollInterval = 2 * time.Second
+	// reloadGracePeriod is the time after reloading at which replaced plugins are closed
+	reloadGracePeriod = 30 * time.Second
+)
+
+// loadConfig loads the configuration file and profile named in the arguments (or environment)
+// An empty configuration is returned where no file is provided.
+func loadConfig(args []string) (*config.Config, error) {
+	path, profile := os.Getenv("EVPX_CONFIG"), os.Getenv("EVPX_PROFILE")
+
+	// Arguments are scanned prior to parsing so configured options may be applied first
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			break
+		}
+		for _, name := range []string{"--config", "--profile"} {
+			value := ""
+			if strings.HasPrefix(a, name+"=") {
+				value = strings.TrimPrefix(a, name+"=")
+			} else if a == name && i+1 < len(args) {
+				i++
+				value = args[i]
+			} else {
+				continue
+			}
+			if name == "--config" {
+				path = value
+			} else {
+				profile = value
+			}
+		}
+	}
+
+	if path == "" && profile != "" {
+		return nil, fmt.Errorf("--profile requires a configuration file (--config)")
+	} else if path == "" {
+		return &config.Config{}, nil
+	}
+	return config.Load(path, profile)
+}
+
+// watchConfig reloads the plugin chain, passthrough hosts and replacement rules
+// on SIGHUP or when the configuration file is modified. Active connections are
+// unaffected, with flows in progress completing using the previous plugins.
+func watchConfig(o core.Options, p *core.Proxy, retained *retainedPlugins, passthrough *ingress.Passthrough) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	modified := modTime(o.Config)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			log.Printf("Reloading configuration (SIGHUP)")
+		case <-ticker.C:
+			m := modTime(o.Config)
+			if m.Equal(modified) {
+				continue
+			}
+			modified = m
+			log.Printf("Reloading configuration (%s modified)", o.Config)
+		}
+
+		next, err := reload(p, retained, passthrough)
+		if err != nil {
+			log.Printf("Error reloading configuration (previous configuration retained): %s", err)
+			continue
+		}
+		if !reloadable(o, *next) {
+			log.Printf("Configuration reloaded, changes to listener, backend and capture options take effect on restart")
+		} else {
+			log.Printf("Configuration reloaded")
+		}
+	}
+}
+
+// reload re-parses the configuration file and command line, then replaces the plugin chain
+// passthrough hosts and replacement rules. Nothing is changed if the configuration is invalid.
+func reload(p *core.Proxy, retained *retainedPlugins, passthrough *ingress.Passthrough) (*core.Options, error) {
+	o := core.Options{}
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	parser := flags.NewParser(&o, flags.None)
+	if err := cfg.Apply(parser); err != nil {
+		return nil, err
+	}
+	if _, err := parser.Parse(); err != nil {
+		return nil, err
+	}
+
+	if err := (&ingress.Passthrough{}).Set(append(o.Passthrough, cfg.Passthrough...)); err != nil {
+		return nil, err
+	}
+	rules, err := replaceRules(o, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Plugins are bound to a new manager, then swapped in once the configuration is validated
+	pm := &plugins.PluginManager{}
+	if err := bindPlugins(pm, o, cfg, retained); err != nil {
+		release(pm, retained)
+		return nil, err
+	}
+	if err := retained.replace.SetRules(rules); err != nil {
+		release(pm, retained)
+		return nil, err
+	}
+
+	passthrough.Set(append(o.Passthrough, cfg.Passthrough...))
+	removed := p.Plugins().Swap(pm)
+
+	// Plugins holding resources (ie. external plugins) are closed once in-flight calls complete
+	go func() {
+		time.Sleep(reloadGracePeriod)
+		for _, h := range removed {
+			if c, ok := h.(io.Closer); ok {
+				c.Close()
+			}
+		}
+	}()
+
+	return &o, nil
+}
+
+// release closes plugins holding resources (ie. external plugins) bound to a plugin manager
+// that is not swapped in, other than retained plugins
+func release(pm *plugins.PluginManager, retained *retainedPlugins) {
+	for _, h := range pm.Swap(&plugins.PluginManager{}) {
+		if h == retained.replace || h == retained.sslStrip {
+			continue
+		}
+		if c, ok := h.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// restartOptions lists the options that only take effect on restart
+func restartOptions(o core.Options) []interface{} {
+	return []interface{}{
+		o.Address, o.Port, o.Mode, o.CACert, o.CAKey, o.CertDir,
+		o.DisableHTTP2, o.HTTP2MatchUpstream, o.HTTP2Push, o.PreserveHeaders,
+		o.ViaPolicy, o.ViaValue, o.ForwardedPolicy, o.ForwardedSpoofAddr,
+		o.StreamTypes, o.StreamDelay, o.StreamSize,
+		o.TUI, o.AdminAddress, o.AdminToken, o.CaptureLimit, o.CaptureMaxBytes, o.Session,
+		o.LogFile, o.LogFilter, o.LogBodies,
+		o.Breakpoints, o.InterceptTimeout, o.InterceptDefault,
+	}
+}
+
+// reloadable checks whether the differences between two sets of options can be applied by reloading
+func reloadable(a, b core.Options) bool {
+	return reflect.DeepEqual(restartOptions(a), restartOptions(b))
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
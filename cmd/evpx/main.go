@@ -1,16 +1,31 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
 
+	"github.com/ryankurte/evilproxy/lib/admin"
+	"github.com/ryankurte/evilproxy/lib/config"
 	"github.com/ryankurte/evilproxy/lib/core"
+	"github.com/ryankurte/evilproxy/lib/external"
+	"github.com/ryankurte/evilproxy/lib/filter"
+	"github.com/ryankurte/evilproxy/lib/flow"
 	"github.com/ryankurte/evilproxy/lib/ingress"
+	"github.com/ryankurte/evilproxy/lib/intercept"
 	"github.com/ryankurte/evilproxy/lib/plugins"
+	"github.com/ryankurte/evilproxy/lib/session"
+	"github.com/ryankurte/evilproxy/lib/tui"
 )
 
 var version = "undefined"
@@ -18,18 +33,42 @@ var version = "undefined"
 func main() {
 	log.Printf("☭ EvilProxy (version: %s) ☭", version)
 
-	// Parse proxy options
+	// Parse proxy options from the configuration file and command line,
+	// commands (ie. session open) run in place of the proxy
 	o := core.Options{}
-	_, err := flags.Parse(&o)
+	cfg, err := loadConfig(os.Args[1:])
 	if err != nil {
-		os.Exit(0)
+		log.Printf("Error loading configuration: %s", err)
+		os.Exit(1)
 	}
 
-	// Create the core proxy instance
-	p := core.NewProxy(o)
+	parser := flags.NewParser(&o, flags.Default)
+	parser.SubcommandsOptional = true
+	parser.AddCommand("session", "Work with saved sessions", "Browse, filter and export sessions saved with --session", &sessionCommand{})
+	parser.AddCommand("replay", "Replay and fuzz captured flows", replayDescription, &replayCommand{options: &o, config: cfg})
+	parser.AddCommand("plugin", "Run a plugin as an external plugin", "Run a built-in plugin as an external plugin over stdio, see --external", &pluginCommand{})
 
-	// Bind the http backend into the proxy
-	p.BindBackend(&core.HTTPBackend{})
+	if err := cfg.Apply(parser); err != nil {
+		log.Printf("Error loading configuration: %s", err)
+		os.Exit(1)
+	}
+
+	_, err = parser.Parse()
+	if e, ok := err.(*flags.Error); ok && e.Type == flags.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(1)
+	}
+	if parser.Active != nil {
+		return
+	}
+
+	// Create the core proxy instance with the enabled plugins
+	p, retained, err := newProxy(o, cfg)
+	if err != nil {
+		log.Printf("Error creating proxy: %s", err)
+		os.Exit(1)
+	}
 
 	// Create the frontend
 	h, err := ingress.NewHTTPFrontend(o.Address, o.Port, o.CACert, o.CAKey, o.CertDir)
@@ -38,28 +77,341 @@ func main() {
 		os.Exit(1)
 	}
 
+	h.ConfigureHTTP2(ingress.HTTP2Options{
+		Enabled:       !o.DisableHTTP2,
+		MatchUpstream: o.HTTP2MatchUpstream,
+		ForwardPush:   o.HTTP2Push == "forward",
+	})
+	h.PreserveHeaders(o.PreserveHeaders)
+	if o.PreserveHeaders {
+		log.Printf("Warning: preserving headers forwards Accept-Encoding, so body plugins see compressed response bodies")
+	}
+	h.SetForwardPolicy(ingress.ForwardPolicy{
+		Via:          o.ViaPolicy,
+		ViaValue:     o.ViaValue,
+		Forwarded:    o.ForwardedPolicy,
+		ForwardedFor: o.ForwardedSpoofAddr,
+	})
+
 	// Bind the proxy instance to the frontend
 	h.BindProxy(p)
+	h.BindUpgrader(retained.sslStrip)
 
-	// Bind enabled plugins
-	if o.BlockAll || o.BlockHSTS {
-		p.BindPlugin(plugins.NewHSTS())
+	// Bind the interceptor, breakpoints may be added here or via the control API
+	interceptor := intercept.NewInterceptor(o.InterceptTimeout, intercept.Action(o.InterceptDefault))
+	for _, s := range o.Breakpoints {
+		b, err := intercept.ParseBreakpoint(s)
+		if err != nil {
+			log.Printf("Error parsing breakpoint: %s", err)
+			os.Exit(1)
+		}
+		interceptor.AddBreakpoint(*b)
 	}
-	if o.BlockAll || o.BlockCORS {
-		p.BindPlugin(plugins.NewCORS("*"))
+	p.BindInterceptor(interceptor)
+
+	// Configure passthrough hosts
+	if err := h.Passthrough().Set(append(o.Passthrough, cfg.Passthrough...)); err != nil {
+		log.Printf("Error parsing passthrough host: %s", err)
+		os.Exit(1)
 	}
-	if o.BlockAll || o.BlockSRI {
-		p.BindPlugin(plugins.NewSRI())
+
+	// Capture completed flows for the admin API and terminal interface
+	var store *flow.Store
+	if o.AdminAddress != "" || o.TUI {
+		store = flow.NewStore(o.CaptureLimit, o.CaptureMaxBytes)
+		p.BindRecorder(store)
+	}
+
+	// Save completed flows to the session file
+	if o.Session != "" {
+		s, err := session.Create(o.Session, version)
+		if err != nil {
+			log.Printf("Error opening session file: %s", err)
+			os.Exit(1)
+		}
+		defer s.Close()
+		p.BindRecorder(s)
+	}
+
+	// Write completed flows to the log file
+	if o.LogFile != "" {
+		match, err := filter.Parse(o.LogFilter)
+		if err != nil {
+			log.Printf("Error parsing log filter: %s", err)
+			os.Exit(1)
+		}
+		file, err := os.OpenFile(o.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Printf("Error opening log file: %s", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		p.BindRecorder(flow.NewLogExporter(file, match, o.LogBodies))
+	}
+
+	// Create the terminal interface, log output is redirected while this is running
+	var t *tui.TUI
+	if o.TUI {
+		t = tui.NewTUI(store, interceptor)
+		log.SetOutput(t.Writer())
+		logrus.SetOutput(t.Writer())
+	}
+
+	// Run the admin API
+	if o.AdminAddress != "" {
+		a, err := admin.NewServer(o.AdminToken, version)
+		if err != nil {
+			log.Printf("Error creating admin API: %s", err)
+			os.Exit(1)
+		}
+
+		a.BindPlugins(p.Plugins())
+		a.BindReplace(retained.replace)
+		a.BindPassthrough(h.Passthrough())
+		a.BindCertificates(h)
+		a.BindStore(store)
+		a.BindReplayer(p)
+		a.Handle("/intercept", interceptor)
+
+		if o.AdminToken == "" {
+			log.Printf("Admin API token: %s (UI: http://%s/ui/)", a.Token(), o.AdminAddress)
+		}
+
+		a.Run(o.AdminAddress)
+		defer a.Stop()
+	}
+
+	// Reload the plugin chain and rules when the configuration changes
+	if o.Config != "" {
+		go watchConfig(o, p, retained, h.Passthrough())
 	}
 
 	// Run the frontend
 	go h.Run()
 
-	// Wait for exit signal
+	// Wait for exit signal, or for the terminal interface to exit
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
+
+	if t != nil {
+		go func() {
+			<-c
+			t.Stop()
+		}()
+		if err := t.Run(); err != nil {
+			log.SetOutput(os.Stderr)
+			log.Printf("Error running terminal interface: %s", err)
+		}
+	} else {
+		<-c
+	}
 
 	// Shutdown the ingress server
 	h.Stop()
 }
+
+// newBackend creates the backend for upstream requests
+func newBackend(o core.Options) core.Backend {
+	if o.PreserveHeaders {
+		return &core.RawBackend{}
+	}
+	return &core.HTTPBackend{}
+}
+
+// retainedPlugins are created once and bound to each plugin chain, so state is retained across reloads
+type retainedPlugins struct {
+	replace  *plugins.Replace
+	sslStrip *plugins.SSLStrip
+	// fetcher makes requests through the proxy on behalf of plugins
+	fetcher plugins.Fetcher
+}
+
+// newProxy creates a proxy with the http backend and enabled plugins bound
+// Replacement rules are always bound, as these may also be managed via the admin API.
+func newProxy(o core.Options, cfg *config.Config) (*core.Proxy, *retainedPlugins, error) {
+	p := core.NewProxy(o)
+
+	// Bind the http backend into the proxy
+	p.BindBackend(newBackend(o))
+
+	retained := &retainedPlugins{
+		replace:  plugins.NewReplace(),
+		sslStrip: plugins.NewSSLStrip(),
+		fetcher:  p,
+	}
+	rules, err := replaceRules(o, cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing replacement: %s", err)
+	}
+	if err := retained.replace.SetRules(rules); err != nil {
+		return nil, nil, fmt.Errorf("parsing replacement: %s", err)
+	}
+	if err := bindPlugins(p.Plugins(), o, cfg, retained); err != nil {
+		return nil, nil, err
+	}
+
+	return p, retained, nil
+}
+
+// newInject creates the inject plugin from options, reading content from a file where prefixed with @
+func newInject(o core.Options, nonce string) (*plugins.Inject, error) {
+	content := o.Inject
+	if strings.HasPrefix(content, "@") {
+		data, err := ioutil.ReadFile(content[1:])
+		if err != nil {
+			return nil, fmt.Errorf("reading inject content: %s", err)
+		}
+		content = string(data)
+	}
+	if content == "" {
+		content = fmt.Sprintf(`<script src="%s"></script>`, html.EscapeString(o.InjectPath))
+	}
+
+	inject, err := plugins.NewInject(content, plugins.InjectAnchor(o.InjectAnchor), nonce)
+	if err != nil {
+		return nil, fmt.Errorf("creating inject plugin: %s", err)
+	}
+	if o.InjectAsset != "" {
+		if _, err := os.Stat(o.InjectAsset); err != nil {
+			return nil, fmt.Errorf("reading inject asset: %s", err)
+		}
+		inject.Serve(o.InjectPath, o.InjectAsset)
+	}
+	return inject, nil
+}
+
+func randomNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("error generating nonce: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// bindPlugins binds plugins enabled by options, followed by those in the configuration file
+// and the replace plugin, then applies plugin scopes and orders.
+func bindPlugins(pm *plugins.PluginManager, o core.Options, cfg *config.Config, retained *retainedPlugins) error {
+	if o.BlockAll || o.BlockHSTS || o.SSLStrip {
+		pm.Bind(plugins.NewHSTS())
+	}
+	if o.BlockAll || o.BlockCORS {
+		pm.Bind(plugins.NewCORSWithOptions(plugins.CORSOptions{
+			Origin:      o.CORSOrigin,
+			Credentials: !o.CORSNoCredentials,
+			Methods:     o.CORSMethods,
+			Headers:     o.CORSHeaders,
+			Expose:      o.CORSExpose,
+			MaxAge:      o.CORSMaxAge,
+			Preflight:   o.CORSPreflight == "respond",
+		}))
+	}
+	if o.BlockAll || o.BlockSRI {
+		sri := plugins.NewSRI(plugins.SRIMode(o.SRIMode))
+		sri.BindFetcher(retained.fetcher)
+		pm.Bind(sri)
+	}
+	// Injected scripts share a nonce with the CSP plugin so they are allowed by relaxed policies
+	nonce := o.CSPNonce
+	if (o.BlockAll || o.BlockCSP) && nonce == "" && (o.Inject != "" || o.InjectAsset != "") {
+		nonce = randomNonce()
+	}
+	if o.BlockAll || o.BlockCSP {
+		pm.Bind(plugins.NewCSP(o.CSPOrigins, nonce))
+	}
+	if o.SSLStrip {
+		pm.Bind(retained.sslStrip)
+	}
+	if len(o.CookieRules) > 0 || o.CookieLog {
+		rules := make([]plugins.CookieRule, len(o.CookieRules))
+		for i, spec := range o.CookieRules {
+			rule, err := plugins.ParseCookieRule(spec)
+			if err != nil {
+				return fmt.Errorf("parsing cookie rule: %s", err)
+			}
+			rules[i] = *rule
+		}
+		pm.Bind(plugins.NewCookies(rules, o.CookieLog))
+	}
+	if o.GRPCLog {
+		var registry *plugins.ProtoRegistry
+		if len(o.ProtoDescriptors) > 0 {
+			var err error
+			registry, err = plugins.LoadProtoDescriptors(o.ProtoDescriptors...)
+			if err != nil {
+				return fmt.Errorf("loading protobuf descriptors: %s", err)
+			}
+		}
+		pm.Bind(plugins.NewGRPCLogger(registry))
+	}
+
+	if o.Inject != "" || o.InjectAsset != "" {
+		inject, err := newInject(o, nonce)
+		if err != nil {
+			return err
+		}
+		pm.Bind(inject)
+	}
+
+	for _, path := range o.Scripts {
+		script, err := plugins.NewScript(path, plugins.ScriptLimits{Timeout: o.ScriptTimeout, MaxMemory: o.ScriptMemory})
+		if err != nil {
+			return fmt.Errorf("loading script %s: %s", path, err)
+		}
+		pm.Bind(script)
+	}
+
+	for _, address := range o.External {
+		dial, err := external.Address(address)
+		if err != nil {
+			return fmt.Errorf("parsing external plugin %s: %s", address, err)
+		}
+		plugin, err := external.New(dial, external.Options{Timeout: o.ExternalTimeout, Policy: external.Policy(o.ExternalPolicy)})
+		if err != nil {
+			return fmt.Errorf("starting external plugin %s: %s", address, err)
+		}
+		pm.Bind(plugin)
+	}
+
+	if err := cfg.BindPlugins(pm); err != nil {
+		return err
+	}
+
+	pm.Bind(retained.replace)
+
+	// Apply plugin scopes, overriding any plugin defaults
+	for name, spec := range o.Scopes {
+		scope, err := plugins.ParseScope(spec)
+		if err != nil {
+			return fmt.Errorf("parsing scope for %s: %s", name, err)
+		}
+		if err := pm.SetScope(name, *scope); err != nil {
+			return fmt.Errorf("setting scope for %s: %s", name, err)
+		}
+	}
+
+	// Apply plugin orders, overriding any plugin defaults
+	for name, spec := range o.Orders {
+		order, err := plugins.ParseOrder(spec)
+		if err != nil {
+			return fmt.Errorf("parsing order for %s: %s", name, err)
+		}
+		if err := pm.SetOrder(name, *order); err != nil {
+			return fmt.Errorf("setting order for %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// replaceRules collects replacement rules from options and the configuration file, in the order provided
+func replaceRules(o core.Options, cfg *config.Config) ([]plugins.ReplaceRule, error) {
+	rules := make([]plugins.ReplaceRule, 0, len(o.Replacements)+len(cfg.Replace))
+	for _, r := range o.Replacements {
+		rule, err := plugins.ParseReplaceRule(r)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, *rule)
+	}
+	return append(rules, cfg.Replace...), nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/ryankurte/evilproxy/lib/external"
+	"github.com/ryankurte/evilproxy/lib/plugins"
+)
+
+// pluginCommand runs a registered plugin out of process, using the external plugin protocol over stdio
+// This allows plugins to be isolated from the proxy (ie. evpx --external 'evpx plugin sri').
+type pluginCommand struct {
+	Params map[string]string `long:"param" description:"Plugin parameter(s) as key:value"`
+
+	Args struct {
+		Type string `positional-arg-name:"type" description:"Plugin type (ie. hsts, cors, sri)"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Execute runs the plugin command
+func (c *pluginCommand) Execute(args []string) error {
+	p, err := plugins.New(c.Args.Type, c.Params)
+	if err != nil {
+		return err
+	}
+
+	// Stdout is used by the protocol, so logs are written to stderr
+	log.SetOutput(os.Stderr)
+
+	return external.ServeStdio(p)
+}
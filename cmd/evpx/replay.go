@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
+
+	"github.com/ryankurte/evilproxy/lib/config"
+	"github.com/ryankurte/evilproxy/lib/core"
+	"github.com/ryankurte/evilproxy/lib/filter"
+	"github.com/ryankurte/evilproxy/lib/flow"
+	"github.com/ryankurte/evilproxy/lib/replay"
+)
+
+const replayDescription = `Resend captured flows from a session, HAR or JSON export file.
+
+Payload positions are delimited by markers in the URL, header values or body of a captured request (ie. "id=§123§"), or marked with --mark. Where positions are marked and wordlists are provided, the unmodified request is sent as a baseline followed by the payloads of the selected attack:
+
+  sniper     one position at a time, with each word from a single wordlist
+  ram        every position, with each word from a single wordlist
+  pitchfork  a wordlist per position, iterated in parallel
+  cluster    a wordlist per position, trying every combination
+
+Without --mark or --wordlist, captured requests are resent verbatim (including any markers). Payloads are inserted verbatim, so should be encoded as required by their position. Proxy plugin options (ie. --block-all, --replace) apply where --plugins is set.`
+
+// replayCommand resends captured flows, optionally mutating marked positions
+type replayCommand struct {
+	options *core.Options
+	config  *config.Config
+
+	IDs         []uint64 `long:"id" description:"Flow ID(s) to replay (defaults to all flows)"`
+	Filter      string   `short:"f" long:"filter" description:"Filter expression selecting flows to replay"`
+	Plugins     bool     `long:"plugins" description:"Apply the proxy plugin chain to replayed flows"`
+	Marker      string   `long:"marker" description:"Payload position delimiter" default:"§"`
+	Marks       []string `long:"mark" description:"Regular expression(s) marking payload positions (the first capture group, or the entire match)"`
+	Wordlists   []string `short:"w" long:"wordlist" description:"Wordlist file(s) with one payload per line"`
+	Attack      string   `long:"attack" description:"Attack type for combining wordlists with positions" default:"sniper" choice:"sniper" choice:"ram" choice:"pitchfork" choice:"cluster"`
+	Concurrency int      `long:"concurrency" description:"Number of concurrent requests" default:"4"`
+	Rate        float64  `long:"rate" description:"Maximum requests per second (0 for unlimited)" default:"0"`
+	Tolerance   int      `long:"tolerance" description:"Response length difference (in bytes) considered equal to the baseline" default:"0"`
+	Output      string   `short:"o" long:"output" description:"File to which results are written as JSON"`
+
+	Args struct {
+		File string `positional-arg-name:"file" description:"Session, HAR or JSON export file"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Execute runs the replay command
+func (c *replayCommand) Execute(args []string) error {
+	records, err := c.load()
+	if err != nil {
+		return err
+	}
+
+	plan := replay.Plan{Marker: c.Marker, Attack: replay.Attack(c.Attack)}
+	for _, m := range c.Marks {
+		exp, err := regexp.Compile(m)
+		if err != nil {
+			return fmt.Errorf("invalid mark: %s", err)
+		}
+		plan.Marks = append(plan.Marks, exp)
+	}
+	for _, path := range c.Wordlists {
+		words, err := replay.LoadWordlist(path)
+		if err != nil {
+			return err
+		}
+		plan.Wordlists = append(plan.Wordlists, words)
+	}
+
+	total, err := plan.Count(records)
+	if err != nil {
+		return err
+	}
+
+	// Requests are sent directly via the backend unless plugins are applied
+	var sender replay.Sender = &replay.BackendSender{Backend: newBackend(*c.options)}
+	if c.Plugins {
+		p, _, err := newProxy(*c.options, c.config)
+		if err != nil {
+			return err
+		}
+		sender = p
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.Printf("Stopping replay")
+		cancel()
+	}()
+
+	log.Printf("Replaying %d flow(s) (%d requests)", len(records), total)
+
+	done := 0
+	runner := replay.NewRunner(sender, c.Concurrency, c.Rate)
+	results := runner.Run(ctx, plan.Jobs(ctx, records), func(r replay.Result) {
+		done++
+		if done%100 == 0 || done == total {
+			log.Printf("Sent %d/%d requests", done, total)
+		}
+	})
+
+	summary := replay.Summarise(results, records, c.Tolerance)
+	summary.Write(os.Stdout)
+
+	if c.Output != "" {
+		file, err := os.Create(c.Output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		enc := json.NewEncoder(file)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]interface{}{"summary": summary, "results": results})
+	}
+
+	return nil
+}
+
+// load loads the flows selected for replay
+func (c *replayCommand) load() ([]*flow.Record, error) {
+	all, err := replay.Load(c.Args.File)
+	if err != nil {
+		return nil, err
+	}
+
+	match, err := filter.Parse(c.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[uint64]bool)
+	for _, id := range c.IDs {
+		ids[id] = true
+	}
+
+	records := []*flow.Record{}
+	for _, r := range all {
+		if (len(ids) == 0 || ids[r.ID]) && match.Match(r) {
+			records = append(records, r)
+		}
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no flows selected for replay")
+	}
+
+	return records, nil
+}
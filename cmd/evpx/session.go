@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/ryankurte/evilproxy/lib/admin"
+	"github.com/ryankurte/evilproxy/lib/filter"
+	"github.com/ryankurte/evilproxy/lib/flow"
+	"github.com/ryankurte/evilproxy/lib/session"
+	"github.com/ryankurte/evilproxy/lib/tui"
+)
+
+// sessionCommand groups commands for saved session files
+type sessionCommand struct {
+	Open sessionOpenCommand `command:"open" description:"Browse, filter and export a saved session"`
+}
+
+// sessionOpenCommand loads a session file without running the proxy
+// Matching flows are listed unless a flow is shown, the session is exported, or an interface is started.
+type sessionOpenCommand struct {
+	Filter       string `short:"f" long:"filter" description:"Filter expression selecting flows (ie. host ~ \"api\" && status >= 400)"`
+	Show         uint64 `long:"show" description:"Print the request and response for a flow ID"`
+	Export       string `long:"export" description:"Export matching flows" choice:"json" choice:"har"`
+	Output       string `short:"o" long:"output" description:"Export output file (defaults to stdout)"`
+	TUI          bool   `long:"tui" description:"Browse the session in the terminal interface"`
+	AdminAddress string `long:"admin-address" description:"Browse the session in the web UI at the provided address"`
+	AdminToken   string `long:"admin-token" description:"Token required to access the admin API (generated if unset)" env:"EVPX_ADMIN_TOKEN"`
+
+	Args struct {
+		File string `positional-arg-name:"file" description:"Session file"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Execute runs the session open command
+func (c *sessionOpenCommand) Execute(args []string) error {
+	s, err := session.Open(c.Args.File)
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded session %s (%d flows, created %s by version %s)",
+		c.Args.File, len(s.Records), s.Created.Format("2006-01-02 15:04:05"), s.Version)
+
+	match, err := filter.Parse(c.Filter)
+	if err != nil {
+		return err
+	}
+	records := make([]*flow.Record, 0, len(s.Records))
+	for _, r := range s.Records {
+		if match.Match(r) {
+			records = append(records, r)
+		}
+	}
+
+	switch {
+	case c.Show != 0:
+		for _, r := range s.Records {
+			if r.ID == c.Show {
+				printRecord(os.Stdout, r)
+				return nil
+			}
+		}
+		return fmt.Errorf("flow %d not found in session", c.Show)
+
+	case c.Export != "":
+		return c.export(records)
+
+	case c.TUI || c.AdminAddress != "":
+		return c.browse(records)
+	}
+
+	listRecords(os.Stdout, records)
+	return nil
+}
+
+// export writes records in the selected format
+func (c *sessionOpenCommand) export(records []*flow.Record) error {
+	w := io.Writer(os.Stdout)
+	if c.Output != "" {
+		file, err := os.Create(c.Output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	var v interface{} = records
+	if c.Export == "har" {
+		v = flow.NewHAR("evilproxy", version, records)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// browse serves records via the terminal interface and / or web UI until exit
+func (c *sessionOpenCommand) browse(records []*flow.Record) error {
+	store := flow.NewStore(0, 0)
+	for _, r := range records {
+		store.Add(r)
+	}
+
+	if c.AdminAddress != "" {
+		a, err := admin.NewServer(c.AdminToken, version)
+		if err != nil {
+			return err
+		}
+		a.BindStore(store)
+
+		if c.AdminToken == "" {
+			log.Printf("Admin API token: %s (UI: http://%s/ui/)", a.Token(), c.AdminAddress)
+		}
+
+		a.Run(c.AdminAddress)
+		defer a.Stop()
+	}
+
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+
+	if !c.TUI {
+		<-ch
+		return nil
+	}
+
+	t := tui.NewTUI(store, nil)
+	log.SetOutput(t.Writer())
+	defer log.SetOutput(os.Stderr)
+
+	go func() {
+		<-ch
+		t.Stop()
+	}()
+	return t.Run()
+}
+
+// listRecords writes a summary line for each record
+func listRecords(w io.Writer, records []*flow.Record) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tMETHOD\tSTATUS\tURL\tSIZE\tTIME\tNOTES")
+	for _, r := range records {
+		status := fmt.Sprintf("%d", r.Status)
+		if r.Error != "" {
+			status = "error"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%dms\t%d\n",
+			r.ID, r.Method, status, r.URL, len(r.ResponseBody), r.Duration, len(r.Annotations))
+	}
+	tw.Flush()
+}
+
+// printRecord writes the full request and response for a record
+func printRecord(w io.Writer, r *flow.Record) {
+	fmt.Fprintf(w, "Flow %d started %s (%dms)\n", r.ID, r.Started.Format("2006-01-02 15:04:05.000"), r.Duration)
+	printTLS(w, "Client TLS", r.ClientTLS)
+	printTLS(w, "Server TLS", r.ServerTLS)
+	for _, a := range r.Annotations {
+		fmt.Fprintf(w, "[%s] %s\n", a.Source, a.Message)
+	}
+	if r.Error != "" {
+		fmt.Fprintf(w, "Error: %s\n", r.Error)
+	}
+
+	fmt.Fprintf(w, "\n%s %s %s\n", r.Method, r.URL, r.Proto)
+	printHeader(w, r.RequestHeader)
+	fmt.Fprintf(w, "\n%s\n", r.RequestBody)
+
+	if r.Status != 0 {
+		fmt.Fprintf(w, "\n%d\n", r.Status)
+		printHeader(w, r.ResponseHeader)
+		fmt.Fprintf(w, "\n%s\n", r.ResponseBody)
+	}
+}
+
+func printTLS(w io.Writer, name string, t *flow.TLSInfo) {
+	if t == nil {
+		return
+	}
+	fmt.Fprintf(w, "%s: %s %s", name, t.Version, t.CipherSuite)
+	if t.NegotiatedProtocol != "" {
+		fmt.Fprintf(w, " (%s)", t.NegotiatedProtocol)
+	}
+	fmt.Fprintln(w)
+	for _, c := range t.Certificates {
+		fmt.Fprintf(w, "  %s\n", c)
+	}
+}
+
+func printHeader(w io.Writer, h map[string][]string) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s: %s\n", k, strings.Join(h[k], ", "))
+	}
+}
@@ -0,0 +1,260 @@
+/**
+ * Admin package provides an HTTP API for runtime control of the proxy
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+	"github.com/ryankurte/evilproxy/lib/ingress"
+	"github.com/ryankurte/evilproxy/lib/plugins"
+)
+
+// CertificateLister interface provides the state of the bump certificate cache
+type CertificateLister interface {
+	Certificates() []ingress.CertInfo
+}
+
+// Replayer interface resubmits requests through the proxy
+type Replayer interface {
+	HandleRequest(req *http.Request) (*http.Response, error)
+}
+
+// ErrNotEnabled is returned for endpoints where the underlying component is not bound
+var ErrNotEnabled = errors.New("not enabled")
+
+// ticketLifetime is the period for which event stream tickets may be redeemed
+const ticketLifetime = 30 * time.Second
+
+// Server is the admin API server
+// All requests must provide the token as a bearer token. As browsers cannot set headers on
+// event streams, these may instead use a single use `ticket` query parameter issued by /tickets.
+type Server struct {
+	token   string
+	version string
+	mux     *http.ServeMux
+	srv     *http.Server
+
+	ticketLock sync.Mutex
+	tickets    map[string]time.Time
+
+	plugins     *plugins.PluginManager
+	replace     *plugins.Replace
+	passthrough *ingress.Passthrough
+	certs       CertificateLister
+	store       *flow.Store
+	replayer    Replayer
+}
+
+// NewServer creates an admin server with the provided token, if empty a random token is generated
+func NewServer(token, version string) (*Server, error) {
+	if token == "" {
+		var err error
+		if token, err = randomToken(); err != nil {
+			return nil, err
+		}
+	}
+
+	s := Server{
+		token:   token,
+		version: version,
+		mux:     http.NewServeMux(),
+		tickets: make(map[string]time.Time),
+	}
+
+	s.mux.HandleFunc("/tickets", s.handleTickets)
+	s.mux.HandleFunc("/plugins", s.handlePlugins)
+	s.mux.HandleFunc("/plugins/", s.handlePlugin)
+	s.mux.HandleFunc("/passthrough", s.handlePassthrough)
+	s.mux.HandleFunc("/passthrough/", s.handlePassthroughHost)
+	s.mux.HandleFunc("/replace", s.handleReplace)
+	s.mux.HandleFunc("/replace/", s.handleReplaceRule)
+	s.mux.HandleFunc("/certs", s.handleCerts)
+	s.mux.HandleFunc("/flows", s.handleFlows)
+	s.mux.HandleFunc("/flows/", s.handleFlow)
+	s.mux.Handle("/ui/", http.StripPrefix("/ui", uiHandler()))
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, "/ui/", http.StatusFound)
+	})
+
+	return &s, nil
+}
+
+// Token fetches the token required to access the admin API
+func (s *Server) Token() string {
+	return s.token
+}
+
+// BindPlugins binds the plugin manager for listing, enabling, disabling and reordering plugins
+func (s *Server) BindPlugins(pm *plugins.PluginManager) {
+	s.plugins = pm
+}
+
+// BindReplace binds the replace plugin for managing replacement rules
+func (s *Server) BindReplace(r *plugins.Replace) {
+	s.replace = r
+}
+
+// BindPassthrough binds passthrough hosts for management
+func (s *Server) BindPassthrough(p *ingress.Passthrough) {
+	s.passthrough = p
+}
+
+// BindCertificates binds the certificate cache for inspection
+func (s *Server) BindCertificates(c CertificateLister) {
+	s.certs = c
+}
+
+// BindStore binds the flow store for listing and exporting captured flows
+func (s *Server) BindStore(st *flow.Store) {
+	s.store = st
+}
+
+// BindReplayer binds the proxy for replaying captured flows
+func (s *Server) BindReplayer(r Replayer) {
+	s.replayer = r
+}
+
+// Handle mounts an additional handler under the provided prefix (ie. "/intercept")
+func (s *Server) Handle(prefix string, h http.Handler) {
+	s.mux.Handle(prefix+"/", http.StripPrefix(prefix, h))
+}
+
+// ServeHTTP authenticates and routes admin requests
+// The UI is static so may be loaded without the token, this is then required for API requests.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" || strings.HasPrefix(r.URL.Path, "/ui/") {
+		s.mux.ServeHTTP(w, r)
+		return
+	}
+
+	auth := r.Header.Get("Authorization")
+	authorised := strings.HasPrefix(auth, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.token)) == 1
+	if !authorised && r.URL.Path == "/flows/events" {
+		authorised = s.redeemTicket(r.URL.Query().Get("ticket"))
+	}
+
+	if !authorised {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleTickets issues a ticket for connecting to the event stream
+func (s *Server) handleTickets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+
+	ticket, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.ticketLock.Lock()
+	now := time.Now()
+	for t, expires := range s.tickets {
+		if now.After(expires) {
+			delete(s.tickets, t)
+		}
+	}
+	s.tickets[ticket] = now.Add(ticketLifetime)
+	s.ticketLock.Unlock()
+
+	writeJSON(w, map[string]string{"ticket": ticket}, nil)
+}
+
+// redeemTicket checks whether a ticket was issued and has not expired, tickets may only be used once
+func (s *Server) redeemTicket(ticket string) bool {
+	s.ticketLock.Lock()
+	defer s.ticketLock.Unlock()
+
+	expires, ok := s.tickets[ticket]
+	delete(s.tickets, ticket)
+	return ok && time.Now().Before(expires)
+}
+
+// Run launches the admin server on the provided address
+func (s *Server) Run(address string) {
+	s.srv = &http.Server{Addr: address, Handler: s}
+
+	log.Printf("Starting admin API at: http://%s", address)
+
+	go func() {
+		if err := s.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Admin: ListenAndServe() error: %s", err)
+		}
+	}()
+}
+
+// Stop shuts down the admin server
+func (s *Server) Stop() {
+	if s.srv != nil {
+		s.srv.Close()
+	}
+}
+
+// randomToken generates a random hex encoded token
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// writeJSON writes a JSON result or error response
+func writeJSON(w http.ResponseWriter, v interface{}, err error) {
+	switch err {
+	case nil:
+	case ErrNotEnabled, plugins.ErrUnknownPlugin, plugins.ErrUnknownRule, ingress.ErrUnknownPassthrough:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if v == nil {
+		v = map[string]string{"result": "ok"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// readJSON decodes a JSON request body
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func methodNotAllowed(w http.ResponseWriter) {
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,428 @@
+package admin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/core"
+	"github.com/ryankurte/evilproxy/lib/flow"
+	"github.com/ryankurte/evilproxy/lib/ingress"
+	"github.com/ryankurte/evilproxy/lib/plugins"
+)
+
+const testToken = "token"
+
+// testBackend responds to requests with the request path, and an HSTS header for the HSTS plugin to remove
+// Requests to /error fail.
+type testBackend struct{}
+
+func (b *testBackend) Request(ctx interface{}, req *http.Request) (*http.Response, error) {
+	if req.URL.Path == "/error" {
+		return nil, errors.New("backend error")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/plain"}, "Strict-Transport-Security": {"max-age=1"}},
+		Body:       ioutil.NopCloser(strings.NewReader("path " + req.URL.Path)),
+		Request:    req,
+	}, nil
+}
+
+// testAdmin is an admin server bound to a proxy with the HSTS and replace plugins
+type testAdmin struct {
+	*testing.T
+	proxy       *core.Proxy
+	replace     *plugins.Replace
+	passthrough *ingress.Passthrough
+	store       *flow.Store
+	srv         *httptest.Server
+}
+
+func newTestAdmin(t *testing.T) *testAdmin {
+	a := &testAdmin{
+		T:           t,
+		proxy:       core.NewProxy(core.Options{}),
+		replace:     plugins.NewReplace(),
+		passthrough: &ingress.Passthrough{},
+		store:       flow.NewStore(10, 0),
+	}
+	a.proxy.BindBackend(&testBackend{})
+	a.proxy.BindPlugin(plugins.NewHSTS())
+	a.proxy.BindPlugin(a.replace)
+	a.proxy.BindRecorder(a.store)
+
+	s, err := NewServer(testToken, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.BindPlugins(a.proxy.Plugins())
+	s.BindReplace(a.replace)
+	s.BindPassthrough(a.passthrough)
+	s.BindStore(a.store)
+	s.BindReplayer(a.proxy)
+
+	a.srv = httptest.NewServer(s)
+	t.Cleanup(a.srv.Close)
+
+	return a
+}
+
+// call makes an authenticated API request, decoding the response into v where provided
+func (a *testAdmin) call(method, path, body string, v interface{}) int {
+	req, _ := http.NewRequest(method, a.srv.URL+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		a.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil && resp.StatusCode == http.StatusOK {
+		assert.Nil(a, json.NewDecoder(resp.Body).Decode(v), path)
+	}
+	return resp.StatusCode
+}
+
+// get makes a request through the proxy, returning the response body
+func (a *testAdmin) get(url string) (*http.Response, string) {
+	return a.do(httptest.NewRequest("GET", url, nil))
+}
+
+// do makes a request through the proxy, returning the response body
+func (a *testAdmin) do(req *http.Request) (*http.Response, string) {
+	resp, err := a.proxy.HandleRequest(req)
+	if err != nil {
+		a.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestAdmin(t *testing.T) {
+
+	t.Run("Requires the token for API requests", func(t *testing.T) {
+		a := newTestAdmin(t)
+
+		for _, c := range []struct {
+			path   string
+			header string
+			status int
+		}{
+			{"/plugins", "", http.StatusUnauthorized},
+			{"/plugins", "Bearer wrong", http.StatusUnauthorized},
+			{"/plugins?token=" + testToken, "", http.StatusUnauthorized},
+			{"/plugins", "Bearer " + testToken, http.StatusOK},
+			{"/ui/", "", http.StatusOK},
+		} {
+			req, _ := http.NewRequest("GET", a.srv.URL+c.path, nil)
+			if c.header != "" {
+				req.Header.Set("Authorization", c.header)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if assert.Nil(t, err) {
+				resp.Body.Close()
+				assert.Equal(t, c.status, resp.StatusCode, "%s %s", c.path, c.header)
+			}
+		}
+
+		s, err := NewServer("", "test")
+		assert.Nil(t, err)
+		assert.Len(t, s.Token(), 32)
+	})
+
+	t.Run("Accepts single use tickets for event streams", func(t *testing.T) {
+		a := newTestAdmin(t)
+
+		ticket := struct {
+			Ticket string `json:"ticket"`
+		}{}
+		assert.Equal(t, http.StatusOK, a.call("POST", "/tickets", "", &ticket))
+		assert.Equal(t, http.StatusMethodNotAllowed, a.call("GET", "/tickets", "", nil))
+
+		get := func(path string) int {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, "GET", a.srv.URL+path, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		// Tickets are not accepted for other endpoints, and may only be used once
+		assert.Equal(t, http.StatusUnauthorized, get("/flows?ticket="+ticket.Ticket))
+		assert.Equal(t, http.StatusOK, get("/flows/events?ticket="+ticket.Ticket))
+		assert.Equal(t, http.StatusUnauthorized, get("/flows/events?ticket="+ticket.Ticket))
+		assert.Equal(t, http.StatusUnauthorized, get("/flows/events?ticket="))
+
+		// Expired tickets are rejected
+		assert.Equal(t, http.StatusOK, a.call("POST", "/tickets", "", &ticket))
+		s := a.srv.Config.Handler.(*Server)
+		s.ticketLock.Lock()
+		s.tickets[ticket.Ticket] = time.Now().Add(-time.Second)
+		s.ticketLock.Unlock()
+		assert.Equal(t, http.StatusUnauthorized, get("/flows/events?ticket="+ticket.Ticket))
+	})
+
+	t.Run("Enables and disables plugins", func(t *testing.T) {
+		a := newTestAdmin(t)
+
+		assert.Equal(t, http.StatusOK, a.call("POST", "/plugins/hsts/disable", "", nil))
+		resp, _ := a.get("http://example.com/")
+		assert.Equal(t, "max-age=1", resp.Header.Get("Strict-Transport-Security"))
+
+		assert.Equal(t, http.StatusOK, a.call("POST", "/plugins/hsts/enable", "", nil))
+		resp, _ = a.get("http://example.com/")
+		assert.Equal(t, "", resp.Header.Get("Strict-Transport-Security"))
+
+		assert.Equal(t, http.StatusNotFound, a.call("POST", "/plugins/unknown/enable", "", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, a.call("GET", "/plugins/hsts/enable", "", nil))
+	})
+
+	t.Run("Reorders plugins", func(t *testing.T) {
+		a := newTestAdmin(t)
+
+		info := []plugins.PluginInfo{}
+		assert.Equal(t, http.StatusOK, a.call("PUT", "/plugins", `["replace", "hsts"]`, &info))
+		if assert.Len(t, info, 2) {
+			assert.Equal(t, "replace", info[0].Name)
+			assert.Equal(t, "hsts", info[1].Name)
+		}
+
+		assert.Equal(t, http.StatusBadRequest, a.call("PUT", "/plugins", `["unknown"]`, nil))
+		assert.Equal(t, http.StatusBadRequest, a.call("PUT", "/plugins", `{`, nil))
+	})
+
+	t.Run("Sets plugin scopes and orders", func(t *testing.T) {
+		a := newTestAdmin(t)
+
+		assert.Equal(t, http.StatusOK, a.call("PUT", "/plugins/hsts/scope", `{"hosts":["other.com"],"filter":"status == 2xx"}`, nil))
+		resp, _ := a.get("http://example.com/")
+		assert.Equal(t, "max-age=1", resp.Header.Get("Strict-Transport-Security"))
+		resp, _ = a.get("http://other.com/")
+		assert.Equal(t, "", resp.Header.Get("Strict-Transport-Security"))
+
+		info := []plugins.PluginInfo{}
+		assert.Equal(t, http.StatusOK, a.call("PUT", "/plugins/replace/order", `{"priority":-10}`, nil))
+		assert.Equal(t, http.StatusOK, a.call("GET", "/plugins", "", &info))
+		for _, p := range info {
+			if p.Name == "hsts" {
+				assert.Equal(t, "status == 2xx", p.Scope.Filter.String())
+			}
+			if p.Name == "replace" {
+				assert.Equal(t, -10, p.Order.Priority)
+			}
+		}
+
+		assert.Equal(t, http.StatusBadRequest, a.call("PUT", "/plugins/hsts/scope", `{"filter":"status =="}`, nil))
+		assert.Equal(t, http.StatusNotFound, a.call("PUT", "/plugins/unknown/scope", `{}`, nil))
+	})
+
+	t.Run("Manages passthrough hosts", func(t *testing.T) {
+		a := newTestAdmin(t)
+
+		assert.Equal(t, http.StatusOK, a.call("POST", "/passthrough", `{"host":"*.bank.com"}`, nil))
+		assert.True(t, a.passthrough.Matches("www.bank.com"))
+
+		hosts := []string{}
+		assert.Equal(t, http.StatusOK, a.call("GET", "/passthrough", "", &hosts))
+		assert.Equal(t, []string{"*.bank.com"}, hosts)
+
+		assert.Equal(t, http.StatusBadRequest, a.call("POST", "/passthrough", `{}`, nil))
+		assert.Equal(t, http.StatusOK, a.call("DELETE", "/passthrough/*.bank.com", "", nil))
+		assert.False(t, a.passthrough.Matches("www.bank.com"))
+		assert.Equal(t, http.StatusNotFound, a.call("DELETE", "/passthrough/*.bank.com", "", nil))
+	})
+
+	t.Run("Manages replacement rules", func(t *testing.T) {
+		a := newTestAdmin(t)
+
+		created := map[string]uint64{}
+		assert.Equal(t, http.StatusOK, a.call("POST", "/replace", `{"match":"path","replace":"replaced"}`, &created))
+		_, body := a.get("http://example.com/a")
+		assert.Equal(t, "replaced /a", body)
+
+		rules := []plugins.ReplaceRule{}
+		assert.Equal(t, http.StatusOK, a.call("GET", "/replace", "", &rules))
+		if assert.Len(t, rules, 1) {
+			assert.Equal(t, created["id"], rules[0].ID)
+		}
+
+		assert.Equal(t, http.StatusBadRequest, a.call("POST", "/replace", `{"match":"(","replace":""}`, nil))
+		assert.Equal(t, http.StatusOK, a.call("DELETE", "/replace/1", "", nil))
+		assert.Equal(t, http.StatusNotFound, a.call("DELETE", "/replace/1", "", nil))
+		assert.Equal(t, http.StatusBadRequest, a.call("DELETE", "/replace/abc", "", nil))
+
+		_, body = a.get("http://example.com/a")
+		assert.Equal(t, "path /a", body)
+	})
+
+	t.Run("Lists and exports flows", func(t *testing.T) {
+		a := newTestAdmin(t)
+		a.get("http://example.com/a")
+		a.get("http://other.com/b")
+
+		summaries := []flowSummary{}
+		assert.Equal(t, http.StatusOK, a.call("GET", "/flows?filter=host+%3D%3D+other.com", "", &summaries))
+		if assert.Len(t, summaries, 1) {
+			assert.Equal(t, "http://other.com/b", summaries[0].URL)
+			assert.Equal(t, "other.com", summaries[0].Host)
+		}
+
+		record := flow.Record{}
+		assert.Equal(t, http.StatusOK, a.call("GET", "/flows/"+strconv.FormatUint(summaries[0].ID, 10), "", &record))
+		assert.Equal(t, "path /b", record.ResponseBody)
+
+		records := []flow.Record{}
+		assert.Equal(t, http.StatusOK, a.call("GET", "/flows/export?format=json", "", &records))
+		assert.Len(t, records, 2)
+
+		assert.Equal(t, http.StatusBadRequest, a.call("GET", "/flows/export?format=xml", "", nil))
+		assert.Equal(t, http.StatusBadRequest, a.call("GET", "/flows?filter=nope", "", nil))
+		assert.Equal(t, http.StatusNotFound, a.call("GET", "/flows/1000", "", nil))
+
+		assert.Equal(t, http.StatusOK, a.call("DELETE", "/flows", "", nil))
+		assert.Equal(t, http.StatusOK, a.call("GET", "/flows", "", &summaries))
+		assert.Empty(t, summaries)
+	})
+
+	t.Run("Reports components that are not enabled", func(t *testing.T) {
+		s, _ := NewServer(testToken, "test")
+		srv := httptest.NewServer(s)
+		defer srv.Close()
+
+		for _, path := range []string{"/plugins", "/replace", "/passthrough", "/certs", "/flows"} {
+			req, _ := http.NewRequest("GET", srv.URL+path, nil)
+			req.Header.Set("Authorization", "Bearer "+testToken)
+			resp, err := http.DefaultClient.Do(req)
+			if assert.Nil(t, err) {
+				resp.Body.Close()
+				assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+			}
+		}
+	})
+}
+
+func TestFlows(t *testing.T) {
+
+	t.Run("Replays flows as new flows", func(t *testing.T) {
+		a := newTestAdmin(t)
+		req := httptest.NewRequest("POST", "http://example.com/login", strings.NewReader("user=admin"))
+		req.Header.Set("X-Replayed", "1")
+		a.do(req)
+		original := a.store.Records()[0]
+
+		result := struct {
+			ID     uint64 `json:"id"`
+			Status int    `json:"status"`
+		}{}
+		assert.Equal(t, http.StatusOK, a.call("POST", fmt.Sprintf("/flows/%d/replay", original.ID), "", &result))
+		assert.Equal(t, http.StatusOK, result.Status)
+		assert.NotEqual(t, original.ID, result.ID)
+
+		replayed := flow.Record{}
+		assert.Equal(t, http.StatusOK, a.call("GET", fmt.Sprintf("/flows/%d", result.ID), "", &replayed))
+		assert.Equal(t, "POST", replayed.Method)
+		assert.Equal(t, "http://example.com/login", replayed.URL)
+		assert.Equal(t, "user=admin", replayed.RequestBody)
+		assert.Equal(t, "1", replayed.RequestHeader.Get("X-Replayed"))
+		assert.Equal(t, "path /login", replayed.ResponseBody)
+		assert.Len(t, a.store.Records(), 2)
+
+		assert.Equal(t, http.StatusNotFound, a.call("POST", "/flows/1000/replay", "", nil))
+		assert.Equal(t, http.StatusNotFound, a.call("GET", fmt.Sprintf("/flows/%d/replay", original.ID), "", nil))
+	})
+
+	t.Run("Reports replay failures", func(t *testing.T) {
+		a := newTestAdmin(t)
+		a.proxy.HandleRequest(httptest.NewRequest("GET", "http://example.com/error", nil))
+		records := a.store.Records()
+		if assert.Len(t, records, 1) {
+			assert.Equal(t, http.StatusBadGateway, a.call("POST", fmt.Sprintf("/flows/%d/replay", records[0].ID), "", nil))
+		}
+	})
+
+	t.Run("Streams filtered flows as server-sent events", func(t *testing.T) {
+		a := newTestAdmin(t)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, "GET", a.srv.URL+"/flows/events?filter=host+%3D%3D+other.com", nil)
+		req.Header.Set("Authorization", "Bearer "+testToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		// The subscription is active once the response headers are sent
+		a.get("http://example.com/a")
+		a.get("http://other.com/b")
+
+		r := bufio.NewReader(resp.Body)
+		lines := []string{}
+		for len(lines) < 4 {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("error reading event: %s", err)
+			}
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		}
+
+		assert.Equal(t, "event: flow", lines[1])
+		assert.Equal(t, "", lines[3])
+		summary := flowSummary{}
+		if assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &summary)) {
+			assert.Equal(t, fmt.Sprintf("id: %d", summary.ID), lines[0])
+			assert.Equal(t, "http://other.com/b", summary.URL)
+		}
+
+		assert.Equal(t, http.StatusBadRequest, a.call("GET", "/flows/events?filter=nope", "", nil))
+	})
+
+	t.Run("Exports flows as HAR", func(t *testing.T) {
+		a := newTestAdmin(t)
+		a.get("http://example.com/a?q=1")
+		a.get("http://other.com/b")
+
+		req, _ := http.NewRequest("GET", a.srv.URL+"/flows/export?format=har&filter=host+%3D%3D+example.com", nil)
+		req.Header.Set("Authorization", "Bearer "+testToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, `attachment; filename="evpx-flows.har"`, resp.Header.Get("Content-Disposition"))
+
+		har := flow.HAR{}
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&har))
+		assert.Equal(t, "1.2", har.Log.Version)
+		assert.Equal(t, flow.HARCreator{Name: "evilproxy", Version: "test"}, har.Log.Creator)
+		if assert.Len(t, har.Log.Entries, 1) {
+			e := har.Log.Entries[0]
+			assert.Equal(t, "GET", e.Request.Method)
+			assert.Equal(t, "http://example.com/a?q=1", e.Request.URL)
+			assert.Equal(t, []flow.HARNameValue{{Name: "q", Value: "1"}}, e.Request.QueryString)
+			assert.Equal(t, http.StatusOK, e.Response.Status)
+			assert.Equal(t, "path /a", e.Response.Content.Text)
+		}
+	})
+}
@@ -0,0 +1,421 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ryankurte/evilproxy/lib/filter"
+	"github.com/ryankurte/evilproxy/lib/flow"
+	"github.com/ryankurte/evilproxy/lib/plugins"
+)
+
+// handlePlugins lists plugins (GET) or sets the plugin order (PUT with a list of names)
+func (s *Server) handlePlugins(w http.ResponseWriter, r *http.Request) {
+	if s.plugins == nil {
+		writeJSON(w, nil, ErrNotEnabled)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.plugins.Plugins(), nil)
+
+	case http.MethodPut:
+		names := []string{}
+		if !readJSON(w, r, &names) {
+			return
+		}
+		// The order is listed once applied
+		err := s.plugins.Reorder(names)
+		writeJSON(w, s.plugins.Plugins(), err)
+
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// handlePlugin enables (POST /plugins/{name}/enable), disables (POST /plugins/{name}/disable),
+// sets the scope of (PUT /plugins/{name}/scope with plugins.Scope) or sets the order of
+// (PUT /plugins/{name}/order with plugins.Order) a plugin
+func (s *Server) handlePlugin(w http.ResponseWriter, r *http.Request) {
+	if s.plugins == nil {
+		writeJSON(w, nil, ErrNotEnabled)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/plugins/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case parts[1] == "scope" && r.Method == http.MethodPut:
+		scope := plugins.Scope{}
+		if !readJSON(w, r, &scope) {
+			return
+		}
+		writeJSON(w, nil, s.plugins.SetScope(parts[0], scope))
+	case parts[1] == "order" && r.Method == http.MethodPut:
+		order := plugins.Order{}
+		if !readJSON(w, r, &order) {
+			return
+		}
+		writeJSON(w, nil, s.plugins.SetOrder(parts[0], order))
+	case r.Method != http.MethodPost:
+		methodNotAllowed(w)
+	case parts[1] == "enable":
+		writeJSON(w, nil, s.plugins.SetEnabled(parts[0], true))
+	case parts[1] == "disable":
+		writeJSON(w, nil, s.plugins.SetEnabled(parts[0], false))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handlePassthrough lists (GET) or adds (POST {"host": pattern}) passthrough hosts
+func (s *Server) handlePassthrough(w http.ResponseWriter, r *http.Request) {
+	if s.passthrough == nil {
+		writeJSON(w, nil, ErrNotEnabled)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.passthrough.Hosts(), nil)
+
+	case http.MethodPost:
+		req := struct {
+			Host string `json:"host"`
+		}{}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Host == "" {
+			http.Error(w, "host is required", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, nil, s.passthrough.Add(req.Host))
+
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// handlePassthroughHost removes a passthrough host (DELETE /passthrough/{host})
+func (s *Server) handlePassthroughHost(w http.ResponseWriter, r *http.Request) {
+	if s.passthrough == nil {
+		writeJSON(w, nil, ErrNotEnabled)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w)
+		return
+	}
+
+	writeJSON(w, nil, s.passthrough.Remove(strings.TrimPrefix(r.URL.Path, "/passthrough/")))
+}
+
+// handleReplace lists (GET) or adds (POST plugins.ReplaceRule) replacement rules
+func (s *Server) handleReplace(w http.ResponseWriter, r *http.Request) {
+	if s.replace == nil {
+		writeJSON(w, nil, ErrNotEnabled)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.replace.Rules(), nil)
+
+	case http.MethodPost:
+		rule := plugins.ReplaceRule{}
+		if !readJSON(w, r, &rule) {
+			return
+		}
+		id, err := s.replace.AddRule(rule)
+		writeJSON(w, map[string]uint64{"id": id}, err)
+
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// handleReplaceRule removes a replacement rule (DELETE /replace/{id})
+func (s *Server) handleReplaceRule(w http.ResponseWriter, r *http.Request) {
+	if s.replace == nil {
+		writeJSON(w, nil, ErrNotEnabled)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w)
+		return
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/replace/"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid rule ID", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, nil, s.replace.RemoveRule(id))
+}
+
+// handleCerts lists the bump certificate cache
+func (s *Server) handleCerts(w http.ResponseWriter, r *http.Request) {
+	if s.certs == nil {
+		writeJSON(w, nil, ErrNotEnabled)
+		return
+	}
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+
+	writeJSON(w, s.certs.Certificates(), nil)
+}
+
+// flowSummary is a flow record without headers or bodies, for listing
+type flowSummary struct {
+	ID          uint64    `json:"id"`
+	Started     time.Time `json:"started"`
+	Duration    int64     `json:"duration_ms"`
+	Method      string    `json:"method"`
+	URL         string    `json:"url"`
+	Host        string    `json:"host"`
+	Status      int       `json:"status,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int       `json:"size"`
+	Error       string    `json:"error,omitempty"`
+}
+
+func summarise(f *flow.Record) flowSummary {
+	host := ""
+	if u, err := url.Parse(f.URL); err == nil {
+		host = u.Host
+	}
+
+	return flowSummary{
+		ID:          f.ID,
+		Started:     f.Started,
+		Duration:    f.Duration,
+		Method:      f.Method,
+		URL:         f.URL,
+		Host:        host,
+		Status:      f.Status,
+		ContentType: f.ResponseHeader.Get("Content-Type"),
+		Size:        len(f.ResponseBody),
+		Error:       f.Error,
+	}
+}
+
+// requestFilter parses the filter expression provided with a request, if any
+func requestFilter(w http.ResponseWriter, r *http.Request) (*filter.Filter, bool) {
+	f, err := filter.Parse(r.URL.Query().Get("filter"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return f, true
+}
+
+// filterRecords fetches stored records matching the filter provided with a request
+func (s *Server) filterRecords(w http.ResponseWriter, r *http.Request) ([]*flow.Record, bool) {
+	f, ok := requestFilter(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	records := []*flow.Record{}
+	for _, rec := range s.store.Records() {
+		if f.Match(rec) {
+			records = append(records, rec)
+		}
+	}
+	return records, true
+}
+
+// handleFlows lists (GET, with an optional ?filter= expression) or clears (DELETE) captured flows
+func (s *Server) handleFlows(w http.ResponseWriter, r *http.Request) {
+	if s.store == nil {
+		writeJSON(w, nil, ErrNotEnabled)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		records, ok := s.filterRecords(w, r)
+		if !ok {
+			return
+		}
+		summaries := make([]flowSummary, len(records))
+		for i, f := range records {
+			summaries[i] = summarise(f)
+		}
+		writeJSON(w, summaries, nil)
+
+	case http.MethodDelete:
+		s.store.Clear()
+		writeJSON(w, nil, nil)
+
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// handleFlow routes requests for individual flows
+//
+//	GET  /flows/{id}          fetches a captured flow
+//	POST /flows/{id}/replay   resubmits a captured request through the proxy
+//	GET  /flows/events        streams flow summaries as server-sent events (?filter=)
+//	GET  /flows/export        exports captured flows (?format=json|har&filter=)
+func (s *Server) handleFlow(w http.ResponseWriter, r *http.Request) {
+	if s.store == nil {
+		writeJSON(w, nil, ErrNotEnabled)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/flows/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "events" && r.Method == http.MethodGet:
+		s.streamFlows(w, r)
+		return
+	case len(parts) == 1 && parts[0] == "export" && r.Method == http.MethodGet:
+		s.exportFlows(w, r)
+		return
+	}
+
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid flow ID", http.StatusBadRequest)
+		return
+	}
+
+	f, ok := s.store.Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, f, nil)
+	case len(parts) == 2 && parts[1] == "replay" && r.Method == http.MethodPost:
+		s.replayFlow(w, f)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// streamFlows streams summaries of flows as they complete
+func (s *Server) streamFlows(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	match, ok := requestFilter(w, r)
+	if !ok {
+		return
+	}
+
+	records, unsubscribe := s.store.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Keepalives stop idle connections being closed by intermediaries
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case f := <-records:
+			if !match.Match(f) {
+				continue
+			}
+			data, err := json.Marshal(summarise(f))
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: flow\ndata: %s\n\n", f.ID, data)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// replayFlow resubmits a captured request through the proxy
+// The replayed flow is captured as a new flow, the ID of which is returned
+func (s *Server) replayFlow(w http.ResponseWriter, f *flow.Record) {
+	if s.replayer == nil {
+		writeJSON(w, nil, ErrNotEnabled)
+		return
+	}
+
+	req, err := http.NewRequest(f.Method, f.URL, strings.NewReader(f.RequestBody))
+	if err != nil {
+		writeJSON(w, nil, err)
+		return
+	}
+	for k, v := range f.RequestHeader {
+		req.Header[k] = append([]string(nil), v...)
+	}
+
+	resp, err := s.replayer.HandleRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	result := map[string]interface{}{"status": resp.StatusCode}
+	if resp.Request != nil {
+		if replayed, ok := flow.FromContext(resp.Request.Context()); ok {
+			result["id"] = replayed.ID
+		}
+	}
+
+	writeJSON(w, result, nil)
+}
+
+func (s *Server) exportFlows(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+
+	records, ok := s.filterRecords(w, r)
+	if !ok {
+		return
+	}
+
+	var v interface{}
+	switch format {
+	case "json":
+		v = records
+	case "har":
+		v = flow.NewHAR("evilproxy", s.version, records)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported export format: '%s'", format), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="evpx-flows.%s"`, format))
+	writeJSON(w, v, nil)
+}
@@ -0,0 +1,20 @@
+package admin
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// ui contains the static web UI, served at /ui/
+//
+//go:embed ui
+var ui embed.FS
+
+func uiHandler() http.Handler {
+	files, err := fs.Sub(ui, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(files))
+}
@@ -0,0 +1,292 @@
+// evilproxy live traffic UI
+// The admin token is requested on load and kept for the session
+
+(function () {
+  'use strict';
+
+  var token = sessionStorage.getItem('evpx-token');
+  if (!token) {
+    token = prompt('Admin API token');
+  }
+  sessionStorage.setItem('evpx-token', token || '');
+
+  var flows = [];
+  var selected = null;
+  var maxFlows = 5000;
+  var source = null;
+
+  var $ = function (id) { return document.getElementById(id); };
+
+  function api(method, path) {
+    return fetch('..' + path, {
+      method: method,
+      headers: { 'Authorization': 'Bearer ' + token }
+    }).then(function (resp) {
+      if (!resp.ok) {
+        return resp.text().then(function (t) { throw new Error(resp.status + ': ' + t); });
+      }
+      return resp.json();
+    });
+  }
+
+  // Filtering
+
+  function filters() {
+    return {
+      host: $('filter-host').value.trim().toLowerCase(),
+      method: $('filter-method').value.trim().toUpperCase(),
+      status: $('filter-status').value.trim().toLowerCase(),
+      type: $('filter-type').value.trim().toLowerCase()
+    };
+  }
+
+  // Status filters match exact codes or classes (ie. 4xx)
+  function matchStatus(filter, status) {
+    if (!filter) {
+      return true;
+    }
+    var s = String(status || '');
+    if (/^[1-5]xx$/.test(filter)) {
+      return s.charAt(0) === filter.charAt(0);
+    }
+    return s === filter;
+  }
+
+  function matches(f, flt) {
+    return (!flt.host || (f.host || '').toLowerCase().indexOf(flt.host) !== -1) &&
+      (!flt.method || f.method === flt.method) &&
+      matchStatus(flt.status, f.status) &&
+      (!flt.type || (f.content_type || '').toLowerCase().indexOf(flt.type) !== -1);
+  }
+
+  // Flow list
+
+  function cell(tr, text, cls) {
+    var td = document.createElement('td');
+    td.textContent = text;
+    if (cls) {
+      td.className = cls;
+    }
+    tr.appendChild(td);
+  }
+
+  function row(f) {
+    var tr = document.createElement('tr');
+    var path = f.url;
+    try {
+      var u = new URL(f.url);
+      path = u.pathname + u.search;
+    } catch (e) {}
+
+    tr.dataset.id = f.id;
+    if (f.error) {
+      tr.className = 'error';
+    }
+    if (selected === f.id) {
+      tr.classList.add('selected');
+    }
+
+    cell(tr, f.id);
+    cell(tr, f.method);
+    cell(tr, f.host);
+    cell(tr, path, 'path');
+    cell(tr, f.error ? 'error' : (f.status || ''));
+    cell(tr, (f.content_type || '').split(';')[0]);
+    cell(tr, f.size);
+    cell(tr, f.duration_ms + 'ms');
+
+    tr.addEventListener('click', function () { select(f.id); });
+    return tr;
+  }
+
+  function render() {
+    var flt = filters();
+    var tbody = $('flows');
+    var frag = document.createDocumentFragment();
+    flows.forEach(function (f) {
+      if (matches(f, flt)) {
+        frag.appendChild(row(f));
+      }
+    });
+    tbody.textContent = '';
+    tbody.appendChild(frag);
+  }
+
+  function add(f) {
+    flows.push(f);
+    if (flows.length > maxFlows) {
+      flows.shift();
+    }
+    if (matches(f, filters())) {
+      $('flows').appendChild(row(f));
+    }
+  }
+
+  // Flow detail
+
+  function formatHeader(first, header) {
+    var lines = [first];
+    Object.keys(header || {}).sort().forEach(function (k) {
+      header[k].forEach(function (v) { lines.push(k + ': ' + v); });
+    });
+    return lines.join('\n');
+  }
+
+  function contentType(header) {
+    var k = Object.keys(header || {}).find(function (k) { return k.toLowerCase() === 'content-type'; });
+    return k ? header[k][0].toLowerCase() : '';
+  }
+
+  // Indents markup by nesting depth, this is for readability only
+  function prettyHTML(body) {
+    var depth = 0;
+    var voids = /^<(area|base|br|col|embed|hr|img|input|link|meta|source|track|wbr|!)/i;
+    return body.replace(/>\s*</g, '>\n<').split('\n').map(function (line) {
+      line = line.trim();
+      if (/^<\//.test(line)) {
+        depth = Math.max(depth - 1, 0);
+      }
+      var out = '  '.repeat(depth) + line;
+      if (/^<[^/]/.test(line) && !voids.test(line) && !/\/>$/.test(line) && !/<\//.test(line)) {
+        depth++;
+      }
+      return out;
+    }).join('\n');
+  }
+
+  function prettyBody(header, body) {
+    if (!body) {
+      return '';
+    }
+    var t = contentType(header);
+    try {
+      if (t.indexOf('json') !== -1) {
+        return JSON.stringify(JSON.parse(body), null, 2);
+      }
+      if (t.indexOf('html') !== -1 || t.indexOf('xml') !== -1) {
+        return prettyHTML(body);
+      }
+    } catch (e) {}
+    return body;
+  }
+
+  // TLS connections and plugin annotations
+  function notes(f) {
+    var lines = [];
+    [['client', f.client_tls], ['server', f.server_tls]].forEach(function (t) {
+      if (t[1]) {
+        lines.push(t[0] + ' tls: ' + t[1].version + ' ' + t[1].cipher_suite + (t[1].negotiated_protocol ? ' (' + t[1].negotiated_protocol + ')' : ''));
+      }
+    });
+    (f.annotations || []).forEach(function (a) {
+      lines.push(a.source + ': ' + a.message);
+    });
+    return lines.join('\n');
+  }
+
+  function select(id) {
+    selected = id;
+    Array.prototype.forEach.call($('flows').children, function (tr) {
+      tr.classList.toggle('selected', Number(tr.dataset.id) === id);
+    });
+
+    api('GET', '/flows/' + id).then(function (f) {
+      $('detail').hidden = false;
+      $('detail-title').textContent = '#' + f.id + ' ' + f.method + ' ' + f.url;
+      $('request-header').textContent = formatHeader(f.method + ' ' + f.url + ' ' + f.proto, f.request_header);
+      $('request-body').textContent = prettyBody(f.request_header, f.request_body);
+      $('response-header').textContent = f.error ? f.error : formatHeader(f.proto + ' ' + f.status, f.response_header);
+      $('response-body').textContent = prettyBody(f.response_header, f.response_body);
+      $('notes').textContent = notes(f);
+      $('notes').hidden = !$('notes').textContent;
+    }).catch(function (err) {
+      $('detail-title').textContent = err.message;
+    });
+  }
+
+  $('replay').addEventListener('click', function () {
+    if (selected === null) {
+      return;
+    }
+    api('POST', '/flows/' + selected + '/replay').then(function (r) {
+      if (r.id) {
+        select(r.id);
+      }
+    }).catch(function (err) {
+      alert('Replay failed: ' + err.message);
+    });
+  });
+
+  // Live updates
+  // Filter expressions are evaluated by the server, so flows are reloaded when this changes
+
+  function expression() {
+    var expr = $('filter-expr').value.trim();
+    return expr ? 'filter=' + encodeURIComponent(expr) : '';
+  }
+
+  // Event streams cannot send the token, so use a single use ticket for each connection
+  function connect() {
+    if (source) {
+      source.close();
+      source = null;
+    }
+    api('POST', '/tickets').then(function (t) {
+      stream(t.ticket);
+    }).catch(function (err) {
+      $('status').textContent = err.message;
+      $('status').className = 'disconnected';
+    });
+  }
+
+  function stream(ticket) {
+    if (source) {
+      source.close();
+    }
+    var es = source = new EventSource('../flows/events?ticket=' + encodeURIComponent(ticket) + '&' + expression());
+    es.addEventListener('open', function () {
+      $('status').textContent = 'connected';
+      $('status').className = 'connected';
+    });
+    es.addEventListener('flow', function (e) {
+      var f = JSON.parse(e.data);
+      if (!flows.some(function (o) { return o.id === f.id; })) {
+        add(f);
+      }
+    });
+    es.addEventListener('error', function () {
+      $('status').textContent = 'disconnected';
+      $('status').className = 'disconnected';
+      // Reconnections reuse the redeemed ticket and are rejected, so reconnect with a new one
+      if (es.readyState === EventSource.CLOSED && source === es) {
+        setTimeout(function () {
+          if (source === es) {
+            connect();
+          }
+        }, 5000);
+      }
+    });
+  }
+
+  function load() {
+    api('GET', '/flows?' + expression()).then(function (list) {
+      flows = list.slice(-maxFlows);
+      render();
+      connect();
+    }).catch(function (err) {
+      $('status').textContent = err.message;
+      $('status').className = 'disconnected';
+    });
+  }
+
+  $('filters').addEventListener('input', render);
+  $('filters').addEventListener('submit', function (e) { e.preventDefault(); });
+  $('filter-expr').addEventListener('keydown', function (e) {
+    if (e.key === 'Enter') {
+      e.preventDefault();
+      load();
+    }
+  });
+
+  load();
+})();
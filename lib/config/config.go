@@ -0,0 +1,221 @@
+/**
+ * Config package loads proxy configuration files
+ * Files are YAML, and may set any command line option as well as plugin bindings,
+ * passthrough hosts and replacement rules. Named profiles extend the base configuration.
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v2"
+
+	"github.com/ryankurte/evilproxy/lib/plugins"
+)
+
+// Config is a proxy configuration file
+type Config struct {
+	// Options are command line options by long name (ie. block-hsts: true)
+	// Options set on the command line take precedence over those in the file.
+	Options map[string]interface{} `yaml:"options"`
+
+	// Plugins are bound in order after plugins enabled by options
+	Plugins []Plugin `yaml:"plugins"`
+
+	// Passthrough host patterns and replacement rules, in addition to those set by options
+	Passthrough []string              `yaml:"passthrough"`
+	Replace     []plugins.ReplaceRule `yaml:"replace"`
+
+	// Profiles are named configurations applied over the base configuration
+	Profiles map[string]*Config `yaml:"profiles"`
+}
+
+// Plugin is a plugin binding
+// Scope and Order use the formats of the --scope and --order options (see plugins.ParseScope, plugins.ParseOrder).
+type Plugin struct {
+	Type     string            `yaml:"type"`
+	Params   map[string]string `yaml:"params"`
+	Scope    string            `yaml:"scope"`
+	Order    string            `yaml:"order"`
+	Disabled bool              `yaml:"disabled"`
+}
+
+// Load reads a configuration file, applying the named profile where provided
+func Load(path, profile string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := Config{}
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+
+	return c.Profile(profile)
+}
+
+// Profile creates the configuration for a named profile
+// Profile options override those of the base configuration, while plugins,
+// passthrough hosts and replacement rules are appended.
+func (c *Config) Profile(name string) (*Config, error) {
+	out := Config{
+		Options:     map[string]interface{}{},
+		Plugins:     append([]Plugin{}, c.Plugins...),
+		Passthrough: append([]string{}, c.Passthrough...),
+		Replace:     append([]plugins.ReplaceRule{}, c.Replace...),
+	}
+	for k, v := range c.Options {
+		out.Options[k] = v
+	}
+
+	if name == "" {
+		return &out, nil
+	}
+
+	p, ok := c.Profiles[name]
+	if !ok || p == nil {
+		return nil, fmt.Errorf("unknown profile '%s' (available: %s)", name, strings.Join(c.ProfileNames(), ", "))
+	}
+	if len(p.Profiles) != 0 {
+		return nil, fmt.Errorf("profile '%s': profiles may not be nested", name)
+	}
+
+	for k, v := range p.Options {
+		out.Options[k] = v
+	}
+	out.Plugins = append(out.Plugins, p.Plugins...)
+	out.Passthrough = append(out.Passthrough, p.Passthrough...)
+	out.Replace = append(out.Replace, p.Replace...)
+
+	return &out, nil
+}
+
+// ProfileNames lists the available profiles
+func (c *Config) ProfileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for n := range c.Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Apply sets configured options on a parser, this must be called prior to parsing
+// command line arguments so these take precedence.
+func (c *Config) Apply(parser *flags.Parser) error {
+	ini, err := c.ini()
+	if err != nil {
+		return err
+	}
+	if err := flags.NewIniParser(parser).Parse(bytes.NewReader(ini)); err != nil {
+		return fmt.Errorf("applying options: %s", err)
+	}
+	return nil
+}
+
+// ini encodes options in the INI format understood by go-flags
+// Lists are encoded as repeated keys and maps as repeated key:value pairs.
+func (c *Config) ini() ([]byte, error) {
+	names := make([]string, 0, len(c.Options))
+	for n := range c.Options {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	b := bytes.NewBufferString("[Application Options]\n")
+	for _, n := range names {
+		switch v := c.Options[n].(type) {
+		case []interface{}:
+			for _, e := range v {
+				s, err := scalar(n, e)
+				if err != nil {
+					return nil, err
+				}
+				fmt.Fprintf(b, "%s = %s\n", n, strconv.Quote(s))
+			}
+		case map[interface{}]interface{}:
+			keys := make([]string, 0, len(v))
+			values := make(map[string]string, len(v))
+			for k, e := range v {
+				s, err := scalar(n, e)
+				if err != nil {
+					return nil, err
+				}
+				key := fmt.Sprint(k)
+				keys, values[key] = append(keys, key), s
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Fprintf(b, "%s = %s:%s\n", n, k, strconv.Quote(values[k]))
+			}
+		default:
+			s, err := scalar(n, v)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(b, "%s = %s\n", n, strconv.Quote(s))
+		}
+	}
+
+	return b.Bytes(), nil
+}
+
+func scalar(name string, v interface{}) (string, error) {
+	switch v.(type) {
+	case string, bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("option %s: unsupported value %v", name, v)
+	}
+}
+
+// BindPlugins creates and binds configured plugins
+// Plugins without a scope or order use their defaults, disabled plugins are bound but not enabled.
+func (c *Config) BindPlugins(pm *plugins.PluginManager) error {
+	for i, p := range c.Plugins {
+		h, err := plugins.New(p.Type, p.Params)
+		if err != nil {
+			return fmt.Errorf("plugin %d (%s): %s", i, p.Type, err)
+		}
+
+		if p.Scope != "" {
+			scope, err := plugins.ParseScope(p.Scope)
+			if err != nil {
+				return fmt.Errorf("plugin %d (%s): parsing scope: %s", i, p.Type, err)
+			}
+			pm.BindScoped(h, *scope)
+		} else {
+			pm.Bind(h)
+		}
+
+		bound := pm.Plugins()
+		name := bound[len(bound)-1].Name
+		if p.Order != "" {
+			order, err := plugins.ParseOrder(p.Order)
+			if err != nil {
+				return fmt.Errorf("plugin %d (%s): parsing order: %s", i, p.Type, err)
+			}
+			if err := pm.SetOrder(name, *order); err != nil {
+				return err
+			}
+		}
+		if p.Disabled {
+			if err := pm.SetEnabled(name, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/core"
+	"github.com/ryankurte/evilproxy/lib/plugins"
+)
+
+const testConfig = `
+options:
+  port: 9100
+  block-hsts: true
+  passthrough: [a.example.com]
+  scope:
+    cors: "host=*.example.com"
+plugins:
+  - type: cors
+    params:
+      value: https://evil.example.com
+replace:
+  - match: secure
+    replace: insecure
+profiles:
+  quiet:
+    options:
+      port: 9200
+      block-hsts: false
+    plugins:
+      - type: sri
+        disabled: true
+    passthrough: [b.example.com]
+`
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "evpx-config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(testConfig), 0600))
+
+	parse := func(c *Config, args ...string) core.Options {
+		o := core.Options{}
+		parser := flags.NewParser(&o, flags.None)
+		assert.Nil(t, c.Apply(parser))
+		_, err := parser.ParseArgs(args)
+		assert.Nil(t, err)
+		return o
+	}
+
+	t.Run("Loads options", func(t *testing.T) {
+		c, err := Load(path, "")
+		assert.Nil(t, err)
+
+		o := parse(c)
+		assert.Equal(t, "9100", o.Port)
+		assert.Equal(t, "localhost", o.Address)
+		assert.True(t, o.BlockHSTS)
+		assert.Equal(t, []string{"a.example.com"}, o.Passthrough)
+		assert.Equal(t, map[string]string{"cors": "host=*.example.com"}, o.Scopes)
+		assert.Equal(t, "insecure", c.Replace[0].Replace)
+	})
+
+	t.Run("Command line takes precedence", func(t *testing.T) {
+		c, err := Load(path, "")
+		assert.Nil(t, err)
+
+		o := parse(c, "--port", "9300", "--passthrough", "c.example.com")
+		assert.Equal(t, "9300", o.Port)
+		assert.Equal(t, []string{"c.example.com"}, o.Passthrough)
+	})
+
+	t.Run("Applies profiles", func(t *testing.T) {
+		c, err := Load(path, "quiet")
+		assert.Nil(t, err)
+
+		o := parse(c)
+		assert.Equal(t, "9200", o.Port)
+		assert.False(t, o.BlockHSTS)
+		assert.Equal(t, []string{"a.example.com"}, o.Passthrough)
+		assert.Equal(t, []string{"b.example.com"}, c.Passthrough)
+
+		pm := &plugins.PluginManager{}
+		assert.Nil(t, c.BindPlugins(pm))
+		info := pm.Plugins()
+		assert.Len(t, info, 2)
+		assert.Equal(t, "cors", info[0].Name)
+		assert.True(t, info[0].Enabled)
+		assert.Equal(t, "sri", info[1].Name)
+		assert.False(t, info[1].Enabled)
+
+		_, err = Load(path, "missing")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Rejects unknown options", func(t *testing.T) {
+		c := Config{Options: map[string]interface{}{"no-such-option": true}}
+		assert.NotNil(t, c.Apply(flags.NewParser(&core.Options{}, flags.None)))
+
+		c = Config{Plugins: []Plugin{{Type: "cors", Params: map[string]string{"unknown": "x"}}}}
+		assert.NotNil(t, c.BindPlugins(&plugins.PluginManager{}))
+	})
+}
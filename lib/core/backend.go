@@ -1,14 +1,235 @@
 package core
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
 )
 
 // HTTPBackend implements a simple http client backend
+// Redirects are returned to the client (and plugins) rather than followed by the proxy.
 type HTTPBackend struct {
 }
 
+var httpClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
 // Request forwards the provided request and returns the response
 func (b *HTTPBackend) Request(ctx interface{}, req *http.Request) (*http.Response, error) {
-	return http.DefaultClient.Do(req)
+	return httpClient.Do(req)
+}
+
+// Default RawBackend timeouts, matching those of the default HTTP transport where it has them
+const (
+	rawDialTimeout     = 30 * time.Second
+	rawTLSTimeout      = 10 * time.Second
+	rawResponseTimeout = time.Minute
+)
+
+// RawBackend implements an HTTP/1.1 client backend that writes requests directly,
+// preserving the header order and casing recorded in the request flow.
+// Each request is made on a new connection, which is closed with the response body.
+type RawBackend struct {
+	// TLSConfig used for upstream connections (optional)
+	TLSConfig *tls.Config
+
+	// Timeouts for connecting, for the TLS handshake, and for writing the request and reading the
+	// response head (defaults used where zero). Response bodies are not limited, so may be streamed.
+	DialTimeout     time.Duration
+	TLSTimeout      time.Duration
+	ResponseTimeout time.Duration
+}
+
+// Request forwards the provided request and returns the response
+func (b *RawBackend) Request(ctx interface{}, req *http.Request) (*http.Response, error) {
+	f, _ := ctx.(*flow.Flow)
+
+	conn, err := b.dial(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connections are closed where requests are cancelled before the response head is read
+	stop := context.AfterFunc(req.Context(), func() { conn.Close() })
+	defer stop()
+
+	conn.SetDeadline(time.Now().Add(timeoutOrDefault(b.ResponseTimeout, rawResponseTimeout)))
+
+	if err := b.writeRequest(conn, f, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReaderSize(conn, 64*1024)
+
+	order, err := flow.PeekHeaderOrder(br)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if f != nil {
+		f.ResponseHeaderOrder = order
+	}
+
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		resp.TLS = &state
+	}
+
+	// Protocol switches use the connection as the response body
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &rawConnBody{Reader: br, conn: conn}
+	} else {
+		resp.Body = &rawConnBody{Reader: resp.Body, conn: conn}
+	}
+
+	return resp, nil
+}
+
+// dial connects to the upstream server for a request
+func (b *RawBackend) dial(req *http.Request) (net.Conn, error) {
+	host, port := req.URL.Hostname(), req.URL.Port()
+	dialer := &net.Dialer{Timeout: timeoutOrDefault(b.DialTimeout, rawDialTimeout)}
+
+	if req.URL.Scheme != "https" {
+		if port == "" {
+			port = "80"
+		}
+		return dialer.DialContext(req.Context(), "tcp", net.JoinHostPort(host, port))
+	}
+
+	if port == "" {
+		port = "443"
+	}
+
+	conn, err := dialer.DialContext(req.Context(), "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{}
+	if b.TLSConfig != nil {
+		cfg = b.TLSConfig.Clone()
+	}
+	cfg.ServerName = host
+	cfg.NextProtos = []string{"http/1.1"}
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeoutOrDefault(b.TLSTimeout, rawTLSTimeout))
+	defer cancel()
+
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+func timeoutOrDefault(timeout, def time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	return def
+}
+
+// writeRequest writes the request head (in flow order where available) and body
+func (b *RawBackend) writeRequest(w io.Writer, f *flow.Flow, req *http.Request) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		req.Body.Close()
+	}
+
+	header := make(http.Header, len(req.Header)+2)
+	for k, v := range req.Header {
+		header[k] = v
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	header.Set("Host", host)
+
+	// Trailers (populated once the body has been read) require chunked encoding
+	header.Del("Transfer-Encoding")
+	header.Del("Trailer")
+	if len(req.Trailer) > 0 {
+		header.Del("Content-Length")
+		header.Set("Transfer-Encoding", "chunked")
+		for k := range req.Trailer {
+			header.Add("Trailer", k)
+		}
+	} else if len(body) > 0 || req.Method == http.MethodPost || req.Method == http.MethodPut || req.Method == http.MethodPatch {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	order := flow.HeaderOrder{"Host"}
+	if f != nil && f.RequestHeaderOrder != nil {
+		order = f.RequestHeaderOrder
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	if err := order.Write(bw, header); err != nil {
+		return err
+	}
+	bw.WriteString("\r\n")
+
+	if len(req.Trailer) == 0 {
+		bw.Write(body)
+		return bw.Flush()
+	}
+
+	cw := httputil.NewChunkedWriter(bw)
+	cw.Write(body)
+	cw.Close()
+	for k, v := range req.Trailer {
+		for _, value := range v {
+			fmt.Fprintf(bw, "%s: %s\r\n", k, value)
+		}
+	}
+	bw.WriteString("\r\n")
+
+	return bw.Flush()
+}
+
+// rawConnBody wraps a response body to close the underlying connection on close,
+// and to allow writes to the connection where the protocol has been switched
+type rawConnBody struct {
+	io.Reader
+	conn net.Conn
+}
+
+func (r *rawConnBody) Write(p []byte) (int, error) {
+	return r.conn.Write(p)
+}
+
+func (r *rawConnBody) Close() error {
+	return r.conn.Close()
 }
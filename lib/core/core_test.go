@@ -0,0 +1,360 @@
+package core
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/intercept"
+	"github.com/ryankurte/evilproxy/lib/plugins"
+)
+
+// testBackend returns responses from a function, recording forwarded request bodies
+type testBackend struct {
+	respond func(req *http.Request) *http.Response
+	body    string
+}
+
+func (b *testBackend) Request(ctx interface{}, req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		data, _ := ioutil.ReadAll(req.Body)
+		b.body = string(data)
+	}
+	resp := b.respond(req)
+	resp.Request = req
+	return resp, nil
+}
+
+// bodyRewriter replaces response bodies, and counts calls with bodies
+type bodyRewriter struct {
+	bodies int
+}
+
+func (r *bodyRewriter) ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	if body == "" {
+		return header, body
+	}
+	r.bodies++
+	return header, strings.ToUpper(body)
+}
+
+// grpcSuffixer appends to gRPC messages and rewrites status messages
+type grpcSuffixer struct{}
+
+func (g *grpcSuffixer) ProcessGRPCMessage(ctx interface{}, msg *plugins.GRPCMessage) []*plugins.GRPCMessage {
+	msg.Data = append(msg.Data, '!')
+	return []*plugins.GRPCMessage{msg}
+}
+
+func (g *grpcSuffixer) ProcessGRPCTrailer(ctx interface{}, method string, trailer http.Header) http.Header {
+	trailer.Set("Grpc-Message", "rewritten")
+	return trailer
+}
+
+func newTestResponse(header http.Header, body io.Reader, length int64) *http.Response {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          ioutil.NopCloser(body),
+		ContentLength: length,
+	}
+}
+
+func TestProxy(t *testing.T) {
+
+	t.Run("Buffers responses of unknown length completed within the stream delay", func(t *testing.T) {
+		p := NewProxy(Options{StreamDelay: time.Second})
+		p.BindBackend(&testBackend{respond: func(req *http.Request) *http.Response {
+			return newTestResponse(http.Header{"Content-Type": {"application/json"}}, strings.NewReader("{}"), -1)
+		}})
+		r := &bodyRewriter{}
+		p.BindPlugin(r)
+
+		resp, err := p.HandleRequest(httptest.NewRequest("GET", "http://example.com/", nil))
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "{}", string(body))
+		assert.Equal(t, 1, r.bodies)
+		assert.EqualValues(t, 2, resp.ContentLength)
+	})
+
+	t.Run("Streams responses of unknown length", func(t *testing.T) {
+		upstream, w := io.Pipe()
+		defer w.Close()
+
+		p := NewProxy(Options{StreamDelay: 50 * time.Millisecond})
+		p.BindBackend(&testBackend{respond: func(req *http.Request) *http.Response {
+			resp := newTestResponse(http.Header{"Content-Type": {"application/json"}}, upstream, -1)
+			resp.TransferEncoding = []string{"chunked"}
+			return resp
+		}})
+		r := &bodyRewriter{}
+		p.BindPlugin(r)
+
+		// A chunk is sent before the delay, then the upstream waits (ie. a long-poll)
+		go w.Write([]byte(`{"a":`))
+
+		done := make(chan *http.Response)
+		go func() {
+			resp, err := p.HandleRequest(httptest.NewRequest("GET", "http://example.com/poll", nil))
+			assert.Nil(t, err)
+			done <- resp
+		}()
+
+		var resp *http.Response
+		select {
+		case resp = <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for streamed response")
+		}
+		assert.Equal(t, 0, r.bodies)
+
+		buf := make([]byte, 64)
+		n, err := resp.Body.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, `{"a":`, string(buf[:n]))
+
+		// Later chunks are passed as they arrive
+		go w.Write([]byte(`1}`))
+		n, err = resp.Body.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, `1}`, string(buf[:n]))
+
+		w.Close()
+		_, err = resp.Body.Read(buf)
+		assert.Equal(t, io.EOF, err)
+		resp.Body.Close()
+	})
+
+	t.Run("Buffers markup, scripts and styles regardless of the stream delay", func(t *testing.T) {
+		for _, options := range []Options{{}, {StreamDelay: 20 * time.Millisecond}} {
+			for _, typ := range []string{"text/html; charset=utf-8", "application/javascript", "text/css"} {
+				upstream, w := io.Pipe()
+				p := NewProxy(options)
+				p.BindBackend(&testBackend{respond: func(req *http.Request) *http.Response {
+					resp := newTestResponse(http.Header{"Content-Type": {typ}}, upstream, -1)
+					resp.TransferEncoding = []string{"chunked"}
+					return resp
+				}})
+				r := &bodyRewriter{}
+				p.BindPlugin(r)
+
+				// The upstream is slower than the stream delay
+				go func() {
+					w.Write([]byte("slow "))
+					time.Sleep(60 * time.Millisecond)
+					w.Write([]byte("body"))
+					w.Close()
+				}()
+
+				resp, err := p.HandleRequest(httptest.NewRequest("GET", "http://example.com/", nil))
+				if assert.Nil(t, err) {
+					body, _ := ioutil.ReadAll(resp.Body)
+					assert.Equal(t, "SLOW BODY", string(body), typ)
+					assert.Equal(t, 1, r.bodies, typ)
+				}
+			}
+		}
+	})
+
+	t.Run("Streams responses over the stream size", func(t *testing.T) {
+		for _, length := range []int64{10, -1} {
+			p := NewProxy(Options{StreamSize: 4})
+			p.BindBackend(&testBackend{respond: func(req *http.Request) *http.Response {
+				return newTestResponse(http.Header{"Content-Type": {"text/html"}}, strings.NewReader("0123456789"), length)
+			}})
+			r := &bodyRewriter{}
+			p.BindPlugin(r)
+
+			resp, err := p.HandleRequest(httptest.NewRequest("GET", "http://example.com/", nil))
+			if assert.Nil(t, err) {
+				body, _ := ioutil.ReadAll(resp.Body)
+				assert.Equal(t, "0123456789", string(body))
+				assert.Equal(t, 0, r.bodies)
+			}
+		}
+	})
+
+	t.Run("Fails responses where the body cannot be read", func(t *testing.T) {
+		for _, options := range []Options{{}, {StreamDelay: time.Second}} {
+			upstream, w := io.Pipe()
+			p := NewProxy(options)
+			p.BindBackend(&testBackend{respond: func(req *http.Request) *http.Response {
+				return newTestResponse(http.Header{"Content-Type": {"application/json"}}, upstream, -1)
+			}})
+
+			go func() {
+				w.Write([]byte("{"))
+				w.CloseWithError(io.ErrUnexpectedEOF)
+			}()
+
+			resp, err := p.HandleRequest(httptest.NewRequest("GET", "http://example.com/", nil))
+			assert.Equal(t, io.ErrUnexpectedEOF, err)
+			assert.Nil(t, resp)
+		}
+	})
+
+	t.Run("Processes gRPC messages as they arrive", func(t *testing.T) {
+		upstream, w := io.Pipe()
+		defer w.Close()
+
+		trailer := http.Header{"Grpc-Status": nil, "Grpc-Message": nil}
+		b := &testBackend{respond: func(req *http.Request) *http.Response {
+			resp := newTestResponse(http.Header{"Content-Type": {"application/grpc"}}, upstream, -1)
+			resp.Trailer = trailer
+			return resp
+		}}
+		p := NewProxy(Options{})
+		p.BindBackend(b)
+		p.BindPlugin(&grpcSuffixer{})
+
+		req := httptest.NewRequest("POST", "http://example.com/test.Service/Stream", strings.NewReader(string(plugins.EncodeGRPCMessages([]*plugins.GRPCMessage{{Data: []byte("ping")}}))))
+		req.Header.Set("Content-Type", "application/grpc")
+
+		resp, err := p.HandleRequest(req)
+		assert.Nil(t, err)
+		assert.Equal(t, string(plugins.EncodeGRPCMessages([]*plugins.GRPCMessage{{Data: []byte("ping!")}})), b.body)
+
+		go w.Write(plugins.EncodeGRPCMessages([]*plugins.GRPCMessage{{Data: []byte("pong")}}))
+		buf := make([]byte, 64)
+		n, err := resp.Body.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, plugins.EncodeGRPCMessages([]*plugins.GRPCMessage{{Data: []byte("pong!")}}), buf[:n])
+
+		// Trailers are processed once populated at the end of the body
+		trailer.Set("Grpc-Status", "0")
+		trailer.Set("Grpc-Message", "ok")
+		w.Close()
+		_, err = ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, "rewritten", resp.Trailer.Get("Grpc-Message"))
+		assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	})
+	t.Run("Intercepts responses on every path", func(t *testing.T) {
+		upstream, w := io.Pipe()
+		defer w.Close()
+
+		responses := map[string]func() *http.Response{
+			"/buffered": func() *http.Response {
+				return newTestResponse(http.Header{"Content-Type": {"text/plain"}}, strings.NewReader("body"), 4)
+			},
+			"/empty": func() *http.Response {
+				resp := newTestResponse(http.Header{}, nil, 0)
+				resp.Body = nil
+				return resp
+			},
+			"/events": func() *http.Response {
+				return newTestResponse(http.Header{"Content-Type": {"text/event-stream"}}, upstream, -1)
+			},
+			"/grpc": func() *http.Response {
+				return newTestResponse(http.Header{"Content-Type": {"application/grpc"}, "Grpc-Status": {"0"}}, strings.NewReader(""), 0)
+			},
+		}
+
+		i := intercept.NewInterceptor(0, intercept.Drop)
+		i.AddBreakpoint(intercept.Breakpoint{Response: true})
+		p := NewProxy(Options{StreamTypes: []string{"text/event-stream"}})
+		p.BindBackend(&testBackend{respond: func(req *http.Request) *http.Response {
+			return responses[req.URL.Path]()
+		}})
+		p.BindInterceptor(i)
+
+		for _, path := range []string{"/buffered", "/empty", "/events", "/grpc"} {
+			done := make(chan *http.Response, 1)
+			go func() {
+				resp, err := p.HandleRequest(httptest.NewRequest("GET", "http://example.com"+path, nil))
+				assert.Nil(t, err)
+				done <- resp
+			}()
+
+			var paused []intercept.Paused
+			for start := time.Now(); len(paused) == 0 && time.Since(start) < 2*time.Second; paused = i.Paused() {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if !assert.Len(t, paused, 1, path) {
+				continue
+			}
+			assert.Equal(t, path == "/events" || path == "/grpc", paused[0].Streamed, path)
+			assert.Nil(t, i.Edit(paused[0].ID, intercept.Edit{Header: http.Header{"X-Edited": {"1"}}}))
+			assert.Nil(t, i.Resume(paused[0].ID, intercept.Forward))
+
+			resp := <-done
+			assert.Equal(t, "1", resp.Header.Get("X-Edited"), path)
+			if path == "/events" {
+				// Streamed bodies are passed through once forwarded
+				go func() {
+					w.Write([]byte("data: 1\n\n"))
+					w.Close()
+				}()
+				body, _ := ioutil.ReadAll(resp.Body)
+				assert.Equal(t, "data: 1\n\n", string(body))
+			}
+		}
+	})
+
+	t.Run("Intercepts gRPC requests before the body is sent", func(t *testing.T) {
+		upstream, w := io.Pipe()
+
+		i := intercept.NewInterceptor(0, intercept.Drop)
+		i.AddBreakpoint(intercept.Breakpoint{Request: true})
+		p := NewProxy(Options{})
+		backend := &testBackend{respond: func(req *http.Request) *http.Response {
+			return newTestResponse(http.Header{"Content-Type": {"application/grpc"}, "Grpc-Status": {"0"}}, strings.NewReader(""), 0)
+		}}
+		p.BindBackend(backend)
+		p.BindInterceptor(i)
+
+		done := make(chan error, 1)
+		go func() {
+			req := httptest.NewRequest("POST", "http://example.com/grpc", upstream)
+			req.Header.Set("Content-Type", "application/grpc")
+			_, err := p.HandleRequest(req)
+			done <- err
+		}()
+
+		var paused []intercept.Paused
+		for start := time.Now(); len(paused) == 0 && time.Since(start) < 2*time.Second; paused = i.Paused() {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if !assert.Len(t, paused, 1) {
+			return
+		}
+		assert.True(t, paused[0].Streamed)
+		assert.Nil(t, i.Resume(paused[0].ID, intercept.Forward))
+
+		// The body is passed through once forwarded
+		msg := []byte{0, 0, 0, 0, 2, 'h', 'i'}
+		go func() {
+			w.Write(msg)
+			w.Close()
+		}()
+		assert.Nil(t, <-done)
+		assert.Equal(t, string(msg), backend.body)
+	})
+
+	t.Run("Closes dropped streamed responses", func(t *testing.T) {
+		upstream, w := io.Pipe()
+
+		i := intercept.NewInterceptor(time.Millisecond, intercept.Drop)
+		i.AddBreakpoint(intercept.Breakpoint{Response: true})
+		p := NewProxy(Options{StreamTypes: []string{"text/event-stream"}})
+		p.BindBackend(&testBackend{respond: func(req *http.Request) *http.Response {
+			resp := newTestResponse(http.Header{"Content-Type": {"text/event-stream"}}, nil, -1)
+			resp.Body = upstream
+			return resp
+		}})
+		p.BindInterceptor(i)
+
+		_, err := p.HandleRequest(httptest.NewRequest("GET", "http://example.com/events", nil))
+		assert.Equal(t, intercept.ErrDropped, err)
+
+		_, err = w.Write([]byte("data: 1\n\n"))
+		assert.Equal(t, io.ErrClosedPipe, err)
+	})
+}
@@ -0,0 +1,156 @@
+package core
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamChunkSize is the size of reads from streamed bodies
+const streamChunkSize = 32 * 1024
+
+// isUnbounded checks whether a response body length is unknown until it has been read
+// ie. chunked responses, and those delimited by the connection closing
+func isUnbounded(resp *http.Response) bool {
+	if resp.ContentLength < 0 {
+		return true
+	}
+	for _, te := range resp.TransferEncoding {
+		if strings.EqualFold(te, "chunked") {
+			return true
+		}
+	}
+	return false
+}
+
+// readWithin reads a body until it is complete, the delay elapses or the size is exceeded (where
+// these are non-zero). This returns the data read and whether the body was complete, where the
+// body is incomplete the returned reader continues from the data read as it arrives from the upstream.
+func readWithin(body io.ReadCloser, delay time.Duration, size int64) ([]byte, io.ReadCloser, bool, error) {
+	s := &chunkReader{
+		upstream: body,
+		chunks:   make(chan chunk),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+
+	data := []byte{}
+	var elapsed <-chan time.Time
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		elapsed = timer.C
+	}
+
+	for {
+		select {
+		case c := <-s.chunks:
+			data = append(data, c.data...)
+			if c.err == io.EOF {
+				body.Close()
+				return data, nil, true, nil
+			} else if c.err != nil {
+				body.Close()
+				return data, nil, false, c.err
+			}
+			if size > 0 && int64(len(data)) > size {
+				s.pending = data
+				return data, s, false, nil
+			}
+		case <-elapsed:
+			s.pending = data
+			return data, s, false, nil
+		}
+	}
+}
+
+// chunk is data (or an error) read from a streamed body
+type chunk struct {
+	data []byte
+	err  error
+}
+
+// chunkReader passes data from a body being read in the background
+type chunkReader struct {
+	upstream io.ReadCloser
+	chunks   chan chunk
+	done     chan struct{}
+	once     sync.Once
+
+	pending []byte
+	err     error
+}
+
+// run reads the upstream body until an error, or the reader is closed
+func (s *chunkReader) run() {
+	for {
+		buf := make([]byte, streamChunkSize)
+		n, err := s.upstream.Read(buf)
+		select {
+		case s.chunks <- chunk{data: buf[:n], err: err}:
+		case <-s.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read reads data as it arrives from the upstream body
+func (s *chunkReader) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		c := <-s.chunks
+		s.pending, s.err = c.data, c.err
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+
+	return n, nil
+}
+
+// Close closes the upstream body and stops the background reader
+func (s *chunkReader) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return s.upstream.Close()
+}
+
+// streamedResponse returns a copy of a response continuing from the body returned by readWithin
+// The background reader populates trailers of the original response once the upstream body ends,
+// so the copy has the announced trailer keys, with values copied once the body has been read.
+func streamedResponse(resp *http.Response, body io.ReadCloser, announced http.Header) *http.Response {
+	streamed := *resp
+	streamed.Body = body
+	if len(announced) > 0 {
+		streamed.Trailer = announced
+		streamed.Body = &eofReader{ReadCloser: body, fn: func() {
+			for k, v := range resp.Trailer {
+				announced[k] = v
+			}
+		}}
+	}
+	return &streamed
+}
+
+// eofReader calls a function once a body has been read to the end
+// ie. to process trailers, which are only populated at this point
+type eofReader struct {
+	io.ReadCloser
+	once sync.Once
+	fn   func()
+}
+
+// Read reads from the body, calling the function at EOF
+func (r *eofReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		r.once.Do(r.fn)
+	}
+	return n, err
+}
@@ -0,0 +1,148 @@
+package external
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+	"github.com/ryankurte/evilproxy/lib/plugins"
+)
+
+// Serve runs a plugin as an external plugin, handling calls from the proxy until the reader is closed
+// The plugin may implement plugins.RequestHandler and plugins.ResponseHandler, and is named using
+// plugins.Named where implemented. Calls are handled concurrently, as within the proxy.
+func Serve(r io.Reader, w io.Writer, plugin interface{}) error {
+	name := fmt.Sprintf("%T", plugin)
+	if n, ok := plugin.(plugins.Named); ok {
+		name = n.Name()
+	}
+
+	hello := Message{Type: TypeHello, Version: ProtocolVersion, Name: name, Hooks: []string{}}
+	if _, ok := plugin.(plugins.RequestHandler); ok {
+		hello.Hooks = append(hello.Hooks, HookRequest)
+	}
+	if _, ok := plugin.(plugins.ResponseHandler); ok {
+		hello.Hooks = append(hello.Hooks, HookResponse)
+	}
+
+	var lock sync.Mutex
+	enc := json.NewEncoder(w)
+	send := func(m *Message) error {
+		lock.Lock()
+		defer lock.Unlock()
+		return enc.Encode(m)
+	}
+	if err := send(&hello); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		m := Message{}
+		if err := json.Unmarshal(line, &m); err != nil {
+			return fmt.Errorf("invalid message: %s", err)
+		}
+		if m.Type != TypeCall {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			send(handle(plugin, &m))
+		}()
+	}
+}
+
+// ServeStdio runs a plugin as an external plugin using stdin and stdout
+// Logging should be directed to stderr, as stdout is used by the protocol.
+func ServeStdio(plugin interface{}) error {
+	return Serve(os.Stdin, os.Stdout, plugin)
+}
+
+// handle calls a plugin hook, returning the result
+// Plugins are passed a flow reconstructed from the call so annotations are returned to the proxy.
+func handle(plugin interface{}, m *Message) (res *Message) {
+	res = &Message{Type: TypeResult, ID: m.ID}
+	defer func() {
+		if r := recover(); r != nil {
+			res = &Message{Type: TypeResult, ID: m.ID, Error: fmt.Sprintf("plugin panic: %v", r)}
+		}
+	}()
+
+	f, err := callFlow(m)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	header, body := http.Header{}, ""
+	if m.Header != nil && *m.Header != nil {
+		header = *m.Header
+	}
+	if m.Body != nil {
+		body = string(*m.Body)
+	}
+
+	req, isReq := plugin.(plugins.RequestHandler)
+	resp, isResp := plugin.(plugins.ResponseHandler)
+	switch {
+	case m.Hook == HookRequest && isReq:
+		header, body = req.ProcessRequest(f, header, body)
+	case m.Hook == HookResponse && isResp:
+		header, body = resp.ProcessResponse(f, header, body)
+	default:
+		res.Error = fmt.Sprintf("unsupported hook '%s'", m.Hook)
+		return res
+	}
+
+	b := []byte(body)
+	res.Header, res.Body = &header, &b
+	res.Annotations = f.Annotations()
+
+	return res
+}
+
+// callFlow creates a flow from call metadata
+func callFlow(m *Message) (*flow.Flow, error) {
+	info := m.Flow
+	if info == nil {
+		info = &FlowInfo{}
+	}
+
+	u, err := url.Parse(info.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %s", err)
+	}
+	req := &http.Request{Method: info.Method, URL: u, Host: u.Host, Header: http.Header{}}
+	if info.RequestHeader != nil {
+		req.Header = info.RequestHeader
+	}
+
+	f := flow.New(req)
+	f.ID = info.ID
+	if m.Hook == HookResponse {
+		f.Response = &http.Response{StatusCode: info.Status, Header: http.Header{}, Request: req}
+		if m.Header != nil && *m.Header != nil {
+			f.Response.Header = *m.Header
+		}
+	}
+
+	return f, nil
+}
@@ -0,0 +1,141 @@
+package external
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+	"github.com/ryankurte/evilproxy/lib/plugins"
+)
+
+// upper is a test plugin rewriting response bodies to upper case
+type upper struct {
+	delay time.Duration
+}
+
+func (u *upper) Name() string {
+	return "upper"
+}
+
+func (u *upper) ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	time.Sleep(u.delay)
+	if f, ok := ctx.(*flow.Flow); ok {
+		f.Annotate("upper", "rewrote "+f.Request.URL.Path)
+	}
+	header.Set("X-Upper", "1")
+	return header, strings.ToUpper(body)
+}
+
+// pipe creates a dialer serving the provided plugin in process
+func pipe(plugin interface{}, dials *int) Dialer {
+	return func() (io.ReadWriteCloser, error) {
+		*dials++
+		a, b := net.Pipe()
+		go func() {
+			Serve(b, b, plugin)
+			b.Close()
+		}()
+		return a, nil
+	}
+}
+
+func TestExternal(t *testing.T) {
+	newFlow := func() *flow.Flow {
+		f := flow.New(httptest.NewRequest("GET", "http://example.com/a", nil))
+		f.Response = &http.Response{StatusCode: 200}
+		return f
+	}
+
+	t.Run("Calls plugin hooks", func(t *testing.T) {
+		dials := 0
+		p, err := New(pipe(&upper{}, &dials), Options{Timeout: time.Second, Policy: PolicyOpen})
+		assert.Nil(t, err)
+		defer p.Close()
+		assert.Equal(t, "upper", p.Name())
+
+		f := newFlow()
+		header, body := p.ProcessResponse(f, http.Header{"Content-Type": {"text/plain"}}, "hello")
+		assert.Equal(t, "HELLO", body)
+		assert.Equal(t, "1", header.Get("X-Upper"))
+		assert.Equal(t, "text/plain", header.Get("Content-Type"))
+		assert.Equal(t, []flow.Annotation{{Source: "upper", Message: "rewrote /a"}}, f.Annotations())
+
+		// Hooks not implemented by the plugin are not called
+		header, body = p.ProcessRequest(f, http.Header{}, "hello")
+		assert.Equal(t, "hello", body)
+	})
+
+	t.Run("Applies failure policy", func(t *testing.T) {
+		dials := 0
+		p, err := New(pipe(&upper{delay: 200 * time.Millisecond}, &dials), Options{Timeout: 50 * time.Millisecond, Policy: PolicyOpen})
+		assert.Nil(t, err)
+		defer p.Close()
+
+		f := newFlow()
+		_, body := p.ProcessResponse(f, http.Header{}, "hello")
+		assert.Equal(t, "hello", body)
+		assert.Nil(t, f.Blocked())
+
+		p.options.Policy = PolicyClosed
+		f = newFlow()
+		_, body = p.ProcessResponse(f, http.Header{}, "hello")
+		assert.Equal(t, "hello", body)
+		assert.NotNil(t, f.Blocked())
+	})
+
+	t.Run("Reconnects failed plugins", func(t *testing.T) {
+		dials := 0
+		p, err := New(pipe(&upper{}, &dials), Options{Timeout: time.Second, Policy: PolicyOpen})
+		assert.Nil(t, err)
+		defer p.Close()
+
+		p.conn.close(errors.New("failed"))
+		p.lastDial = time.Time{}
+
+		_, body := p.ProcessResponse(newFlow(), http.Header{}, "hello")
+		assert.Equal(t, "HELLO", body)
+		assert.Equal(t, 2, dials)
+	})
+
+	t.Run("Closes plugins that do not read calls", func(t *testing.T) {
+		dial := func() (io.ReadWriteCloser, error) {
+			a, b := net.Pipe()
+			go json.NewEncoder(b).Encode(Message{Type: TypeHello, Version: ProtocolVersion, Name: "stuck", Hooks: []string{HookResponse}})
+			return a, nil
+		}
+		p, err := New(dial, Options{Timeout: 50 * time.Millisecond, Policy: PolicyClosed})
+		assert.Nil(t, err)
+		defer p.Close()
+
+		f := newFlow()
+		_, body := p.ProcessResponse(f, http.Header{}, "hello")
+		assert.Equal(t, "hello", body)
+		assert.NotNil(t, f.Blocked())
+		assert.Equal(t, ErrTimeout, p.conn.error())
+	})
+
+	t.Run("Serves registered plugins", func(t *testing.T) {
+		hsts, err := plugins.New("hsts", nil)
+		assert.Nil(t, err)
+
+		dials := 0
+		p, err := New(pipe(hsts, &dials), Options{Timeout: time.Second, Policy: PolicyOpen})
+		assert.Nil(t, err)
+		defer p.Close()
+		assert.Equal(t, "hsts", p.Name())
+
+		f := newFlow()
+		header, _ := p.ProcessResponse(f, http.Header{"Strict-Transport-Security": {"max-age=1"}}, "")
+		assert.Empty(t, header.Get("Strict-Transport-Security"))
+		assert.Len(t, f.Annotations(), 1)
+	})
+}
@@ -0,0 +1,519 @@
+package external
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+	"github.com/ryankurte/evilproxy/lib/plugins"
+)
+
+// Policy is the handling of flows where an external plugin call fails
+type Policy string
+
+// Failure policies
+const (
+	// PolicyOpen passes flows through unmodified
+	PolicyOpen Policy = "open"
+	// PolicyClosed blocks flows
+	PolicyClosed Policy = "closed"
+)
+
+// redialInterval is the minimum interval between attempts to reconnect to a failed plugin
+const redialInterval = time.Second
+
+var (
+	// ErrClosed is returned for calls in progress when the plugin connection is closed
+	ErrClosed = errors.New("external plugin connection closed")
+	// ErrTimeout is returned when a plugin does not respond within the configured timeout
+	ErrTimeout = errors.New("external plugin timed out")
+)
+
+// Dialer opens a connection to an external plugin
+type Dialer func() (io.ReadWriteCloser, error)
+
+// Options configures an external plugin
+type Options struct {
+	// Timeout is the time allowed for each call (and for the plugin hello on connection)
+	Timeout time.Duration
+	// Policy is the handling of flows where a call fails
+	Policy Policy
+}
+
+// Plugin calls an external plugin for each request and response
+// Failed plugins are reconnected (or restarted) on the next call.
+type Plugin struct {
+	log     logrus.FieldLogger
+	dial    Dialer
+	options Options
+	name    string
+	hooks   []string
+
+	lock     sync.Mutex
+	conn     *conn
+	lastDial time.Time
+	closed   bool
+}
+
+// New connects to an external plugin, waiting for the plugin hello
+func New(dial Dialer, options Options) (*Plugin, error) {
+	if options.Policy != PolicyOpen && options.Policy != PolicyClosed {
+		return nil, fmt.Errorf("invalid policy '%s' (must be open or closed)", options.Policy)
+	}
+
+	p := &Plugin{dial: dial, options: options}
+
+	c, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+	p.conn, p.name, p.hooks = c, c.hello.Name, c.hello.Hooks
+	p.log = logrus.StandardLogger().WithField("module", p.name)
+
+	return p, nil
+}
+
+// Address creates a dialer for a plugin address, either a socket (unix:/path or tcp:host:port)
+// or a command (with space separated arguments) run as a subprocess and connected via stdio.
+func Address(address string) (Dialer, error) {
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		return Socket("unix", strings.TrimPrefix(address, "unix:")), nil
+	case strings.HasPrefix(address, "tcp:"):
+		return Socket("tcp", strings.TrimPrefix(address, "tcp:")), nil
+	}
+
+	args := strings.Fields(address)
+	if len(args) == 0 {
+		return nil, errors.New("empty plugin command")
+	}
+	return Command(args[0], args[1:]...), nil
+}
+
+// Socket creates a dialer connecting to a plugin listening on a socket
+func Socket(network, address string) Dialer {
+	return func() (io.ReadWriteCloser, error) {
+		return net.Dial(network, address)
+	}
+}
+
+// Command creates a dialer starting a plugin subprocess, connected via stdin and stdout
+// Plugin stderr is passed through to the proxy stderr.
+func Command(name string, args ...string) Dialer {
+	return func() (io.ReadWriteCloser, error) {
+		cmd := exec.Command(name, args...)
+		cmd.Stderr = os.Stderr
+
+		w, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		r, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+
+		return &process{cmd: cmd, WriteCloser: w, Reader: r}, nil
+	}
+}
+
+// process adapts a subprocess to a connection, closing stdin and stopping the process on close
+type process struct {
+	cmd *exec.Cmd
+	io.WriteCloser
+	io.Reader
+}
+
+func (p *process) Close() error {
+	p.WriteCloser.Close()
+	p.cmd.Process.Kill()
+	return p.cmd.Wait()
+}
+
+// Name fetches the plugin name, as provided in the plugin hello
+func (p *Plugin) Name() string {
+	return p.name
+}
+
+// Hooks lists the hooks handled by the plugin, as provided in the plugin hello
+func (p *Plugin) Hooks() []string {
+	return append([]string{}, p.hooks...)
+}
+
+// Close closes the plugin connection, stopping subprocess plugins
+func (p *Plugin) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.conn != nil {
+		p.conn.close(ErrClosed)
+		p.conn = nil
+	}
+	p.closed = true
+	return nil
+}
+
+// ProcessRequest calls the plugin request hook
+func (p *Plugin) ProcessRequest(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	return p.call(ctx, HookRequest, header, body)
+}
+
+// ProcessResponse calls the plugin response hook
+func (p *Plugin) ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	return p.call(ctx, HookResponse, header, body)
+}
+
+func (p *Plugin) call(ctx interface{}, hook string, header http.Header, body string) (http.Header, string) {
+	if !p.implements(hook) {
+		return header, body
+	}
+
+	b := []byte(body)
+	res, err := p.send(&Message{
+		Type:   TypeCall,
+		Hook:   hook,
+		Flow:   newFlowInfo(ctx, hook == HookResponse),
+		Header: &header,
+		Body:   &b,
+	})
+	if err != nil {
+		p.log.WithField("hook", hook).Printf("call failed (fail %s): %s", p.options.Policy, err)
+		if f, ok := ctx.(*flow.Flow); ok {
+			f.Annotate(p.name, fmt.Sprintf("%s call failed: %s", hook, err))
+			if p.options.Policy == PolicyClosed {
+				f.Block(fmt.Errorf("blocked by external plugin %s: %s", p.name, err))
+			}
+		}
+		return header, body
+	}
+
+	if f, ok := ctx.(*flow.Flow); ok {
+		for _, a := range res.Annotations {
+			f.Annotate(a.Source, a.Message)
+		}
+	}
+	if res.Header != nil {
+		header = *res.Header
+		if header == nil {
+			header = http.Header{}
+		}
+	}
+	if res.Body != nil {
+		body = string(*res.Body)
+	}
+
+	return header, body
+}
+
+func (p *Plugin) implements(hook string) bool {
+	for _, h := range p.hooks {
+		if h == hook {
+			return true
+		}
+	}
+	return false
+}
+
+// send sends a call to the plugin, reconnecting if required
+func (p *Plugin) send(m *Message) (*Message, error) {
+	p.lock.Lock()
+	c := p.conn
+	if c == nil || c.closed() {
+		if p.closed || time.Since(p.lastDial) < redialInterval {
+			p.lock.Unlock()
+			return nil, ErrClosed
+		}
+		var err error
+		if c, err = p.connect(); err != nil {
+			p.lock.Unlock()
+			return nil, fmt.Errorf("reconnecting: %s", err)
+		}
+		p.log.Printf("reconnected")
+		p.conn = c
+	}
+	p.lock.Unlock()
+
+	res, err := c.call(m, p.options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+	return res, nil
+}
+
+// connect dials the plugin and waits for the hello
+func (p *Plugin) connect() (*conn, error) {
+	p.lastDial = time.Now()
+
+	rwc, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	c := newConn(rwc)
+	if err := c.waitHello(p.options.Timeout); err != nil {
+		c.close(err)
+		return nil, err
+	}
+	if p.name != "" && c.hello.Name != p.name {
+		c.close(ErrClosed)
+		return nil, fmt.Errorf("plugin name changed from '%s' to '%s'", p.name, c.hello.Name)
+	}
+
+	return c, nil
+}
+
+// conn is a connection to an external plugin, multiplexing concurrent calls
+type conn struct {
+	rwc   io.ReadWriteCloser
+	hello Message
+	ready chan struct{}
+
+	// Messages are written by a single writer, so calls may time out on blocked writes
+	writes chan *write
+	done   chan struct{}
+
+	lock    sync.Mutex
+	lastID  uint64
+	pending map[uint64]chan *Message
+	err     error
+}
+
+// write is a message to be written to the plugin, with the result of the write
+type write struct {
+	m   *Message
+	err chan error
+}
+
+func newConn(rwc io.ReadWriteCloser) *conn {
+	c := &conn{
+		rwc:     rwc,
+		ready:   make(chan struct{}),
+		writes:  make(chan *write),
+		done:    make(chan struct{}),
+		pending: make(map[uint64]chan *Message),
+	}
+	go c.read()
+	go c.write()
+	return c
+}
+
+// waitHello waits for the plugin hello
+func (c *conn) waitHello(timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	select {
+	case <-c.ready:
+	case <-expired:
+		return ErrTimeout
+	}
+
+	if err := c.error(); err != nil {
+		return err
+	}
+	if c.hello.Version != ProtocolVersion {
+		return fmt.Errorf("unsupported protocol version %d (expected %d)", c.hello.Version, ProtocolVersion)
+	}
+	if c.hello.Name == "" {
+		return errors.New("plugin hello missing name")
+	}
+	return nil
+}
+
+// read handles messages from the plugin until the connection is closed
+func (c *conn) read() {
+	r := bufio.NewReader(c.rwc)
+	hello := false
+	defer func() {
+		if !hello {
+			close(c.ready)
+		}
+	}()
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			c.close(ErrClosed)
+			return
+		}
+
+		m := Message{}
+		if err := json.Unmarshal(line, &m); err != nil {
+			c.close(fmt.Errorf("invalid message: %s", err))
+			return
+		}
+
+		switch {
+		case !hello && m.Type == TypeHello:
+			c.hello, hello = m, true
+			close(c.ready)
+		case !hello:
+			c.close(fmt.Errorf("expected hello, received '%s'", m.Type))
+			return
+		case m.Type == TypeResult:
+			c.lock.Lock()
+			ch, ok := c.pending[m.ID]
+			delete(c.pending, m.ID)
+			c.lock.Unlock()
+			if ok {
+				ch <- &m
+			}
+		}
+	}
+}
+
+// write sends messages to the plugin until the connection is closed
+func (c *conn) write() {
+	enc := json.NewEncoder(c.rwc)
+	for {
+		select {
+		case w := <-c.writes:
+			w.err <- enc.Encode(w.m)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// call sends a call and waits for the result
+// Where the call cannot be written within the timeout the connection is closed, as the plugin
+// is not reading messages.
+func (c *conn) call(m *Message, timeout time.Duration) (*Message, error) {
+	ch := make(chan *Message, 1)
+
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return nil, c.err
+	}
+	c.lastID++
+	m.ID = c.lastID
+	c.pending[m.ID] = ch
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, m.ID)
+		c.lock.Unlock()
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	w := &write{m: m, err: make(chan error, 1)}
+	select {
+	case c.writes <- w:
+	case <-c.done:
+		return nil, c.error()
+	case <-expired:
+		c.close(ErrTimeout)
+		return nil, ErrTimeout
+	}
+
+	select {
+	case err := <-w.err:
+		if err != nil {
+			c.close(err)
+			return nil, err
+		}
+	case <-expired:
+		c.close(ErrTimeout)
+		return nil, ErrTimeout
+	}
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return nil, c.error()
+		}
+		return res, nil
+	case <-expired:
+		return nil, ErrTimeout
+	}
+}
+
+// close closes the connection, failing any calls in progress
+func (c *conn) close(err error) {
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return
+	}
+	c.err = err
+	pending := c.pending
+	c.pending = make(map[uint64]chan *Message)
+	c.lock.Unlock()
+
+	for _, ch := range pending {
+		close(ch)
+	}
+	close(c.done)
+	c.rwc.Close()
+}
+
+func (c *conn) closed() bool {
+	return c.error() != nil
+}
+
+func (c *conn) error() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.err
+}
+
+func init() {
+	plugins.Register("external", func(params map[string]string) (interface{}, error) {
+		for k := range params {
+			if k != "address" && k != "timeout" && k != "policy" {
+				return nil, fmt.Errorf("unknown parameter '%s'", k)
+			}
+		}
+
+		dial, err := Address(params["address"])
+		if err != nil {
+			return nil, err
+		}
+		options := Options{Timeout: time.Second, Policy: PolicyOpen}
+		if t := params["timeout"]; t != "" {
+			if options.Timeout, err = time.ParseDuration(t); err != nil {
+				return nil, fmt.Errorf("invalid timeout: %s", err)
+			}
+		}
+		if p := params["policy"]; p != "" {
+			options.Policy = Policy(p)
+		}
+
+		plugin, err := New(dial, options)
+		if err != nil {
+			return nil, err
+		}
+		return plugin, nil
+	})
+}
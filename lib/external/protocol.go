@@ -0,0 +1,95 @@
+/**
+ * External package runs plugins out of process, over stdio or a socket
+ * This allows plugins to be written in other languages, or isolated from the proxy.
+ *
+ * Messages are JSON objects, one per line, with a type field:
+ *
+ *   hello   sent by the plugin on connection, with the plugin name, version and hooks
+ *           {"type":"hello","version":1,"name":"example","hooks":["request","response"]}
+ *   call    sent by the proxy for each hook call, with flow metadata, headers and body
+ *           {"type":"call","id":1,"hook":"response","flow":{"id":7,"method":"GET","url":"https://example.com/","status":200},
+ *            "header":{"Content-Type":["text/html"]},"body":"PGh0bWw+"}
+ *   result  sent by the plugin in reply to a call, with the same id
+ *           {"type":"result","id":1,"header":{"Content-Type":["text/plain"]},"body":"aGk=","annotations":[{"source":"example","message":"rewrote"}]}
+ *
+ * Bodies are base64 encoded. Result headers and bodies are optional, where omitted
+ * these are left unmodified, and a result with an error is handled as a failed call.
+ * Calls may be issued concurrently, so results can be sent in any order.
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package external
+
+import (
+	"net/http"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// ProtocolVersion is the version of the external plugin protocol
+const ProtocolVersion = 1
+
+// Message types
+const (
+	TypeHello  = "hello"
+	TypeCall   = "call"
+	TypeResult = "result"
+)
+
+// Hooks available to external plugins
+const (
+	HookRequest  = "request"
+	HookResponse = "response"
+)
+
+// Message is a single protocol message, fields are set according to the message type
+type Message struct {
+	Type string `json:"type"`
+	ID   uint64 `json:"id,omitempty"`
+
+	// Hello fields
+	Version int      `json:"version,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Hooks   []string `json:"hooks,omitempty"`
+
+	// Call fields
+	Hook string    `json:"hook,omitempty"`
+	Flow *FlowInfo `json:"flow,omitempty"`
+
+	// Call and result fields
+	Header *http.Header `json:"header,omitempty"`
+	Body   *[]byte      `json:"body,omitempty"`
+
+	// Result fields
+	Annotations []flow.Annotation `json:"annotations,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// FlowInfo describes the flow being processed by a call
+type FlowInfo struct {
+	ID     uint64 `json:"id"`
+	Method string `json:"method"`
+	URL    string `json:"url"`
+
+	// Response status and request headers, for response hook calls only
+	Status        int         `json:"status,omitempty"`
+	RequestHeader http.Header `json:"request_header,omitempty"`
+}
+
+// newFlowInfo creates flow metadata from a plugin context, where this is a flow
+func newFlowInfo(ctx interface{}, response bool) *FlowInfo {
+	f, ok := ctx.(*flow.Flow)
+	if !ok || f.Request == nil {
+		return &FlowInfo{}
+	}
+
+	info := &FlowInfo{ID: f.ID, Method: f.Request.Method, URL: f.Request.URL.String()}
+	if response {
+		info.RequestHeader = f.Request.Header
+		if f.Response != nil {
+			info.Status = f.Response.StatusCode
+		}
+	}
+	return info
+}
@@ -0,0 +1,90 @@
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// field is a flow field that may be used in expressions
+type field struct {
+	name string
+	get  func(r *flow.Record) string
+	// fold compares values case-insensitively for equality
+	fold bool
+}
+
+// fields are the available flow fields, request and response headers are available
+// as req.header.<name> and resp.header.<name>
+var fields = map[string]field{
+	"id":       {get: func(r *flow.Record) string { return strconv.FormatUint(r.ID, 10) }},
+	"method":   {get: func(r *flow.Record) string { return r.Method }, fold: true},
+	"url":      {get: func(r *flow.Record) string { return r.URL }},
+	"scheme":   {get: func(r *flow.Record) string { return parseURL(r).Scheme }, fold: true},
+	"host":     {get: func(r *flow.Record) string { return parseURL(r).Hostname() }, fold: true},
+	"port":     {get: func(r *flow.Record) string { return parseURL(r).Port() }},
+	"path":     {get: func(r *flow.Record) string { return parseURL(r).Path }},
+	"query":    {get: func(r *flow.Record) string { return parseURL(r).RawQuery }},
+	"proto":    {get: func(r *flow.Record) string { return r.Proto }},
+	"status":   {get: func(r *flow.Record) string { return strconv.Itoa(r.Status) }},
+	"duration": {get: func(r *flow.Record) string { return strconv.FormatInt(r.Duration, 10) }},
+	"error":    {get: func(r *flow.Record) string { return r.Error }},
+
+	"type":      {get: func(r *flow.Record) string { return mediaType(r.ResponseHeader.Get("Content-Type")) }, fold: true},
+	"size":      {get: func(r *flow.Record) string { return strconv.Itoa(len(r.ResponseBody)) }},
+	"req.type":  {get: func(r *flow.Record) string { return mediaType(r.RequestHeader.Get("Content-Type")) }, fold: true},
+	"req.size":  {get: func(r *flow.Record) string { return strconv.Itoa(len(r.RequestBody)) }},
+	"req.body":  {get: func(r *flow.Record) string { return r.RequestBody }},
+	"resp.body": {get: func(r *flow.Record) string { return r.ResponseBody }},
+}
+
+// Fields lists the available field names
+func Fields() []string {
+	names := make([]string, 0, len(fields)+2)
+	for n := range fields {
+		names = append(names, n)
+	}
+	return append(names, "req.header.<name>", "resp.header.<name>")
+}
+
+func lookupField(name string) (field, error) {
+	lower := strings.ToLower(name)
+
+	if f, ok := fields[lower]; ok {
+		f.name = lower
+		return f, nil
+	}
+
+	// Multiple header values are joined so any value may be matched
+	switch {
+	case strings.HasPrefix(lower, "req.header."):
+		key := http.CanonicalHeaderKey(name[len("req.header."):])
+		return field{name: lower, get: func(r *flow.Record) string {
+			return strings.Join(r.RequestHeader[key], ", ")
+		}}, nil
+	case strings.HasPrefix(lower, "resp.header."):
+		key := http.CanonicalHeaderKey(name[len("resp.header."):])
+		return field{name: lower, get: func(r *flow.Record) string {
+			return strings.Join(r.ResponseHeader[key], ", ")
+		}}, nil
+	}
+
+	return field{}, fmt.Errorf("unknown field '%s'", name)
+}
+
+func parseURL(r *flow.Record) *url.URL {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return &url.URL{}
+	}
+	return u
+}
+
+// mediaType strips parameters from a content type
+func mediaType(t string) string {
+	return strings.TrimSpace(strings.Split(t, ";")[0])
+}
@@ -0,0 +1,315 @@
+/**
+ * Filter package implements an expression language for selecting flows
+ * This is used wherever traffic is selected (admin API, exporters, breakpoints, plugin scopes)
+ *
+ * Expressions compare flow fields with values, and may be combined with && (and), || (or),
+ * ! (not) and parentheses. For example:
+ *
+ *   host ~ "api" && status >= 400 && resp.body contains "token"
+ *   method == POST && !(path ~ "^/static/")
+ *   status == 5xx || error
+ *
+ * Operators are == != ~ (regexp) !~ contains > >= < <=, a field without an operator
+ * matches when the field is non-empty (or non-zero). See fields.go for available fields.
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// Filter is a compiled filter expression
+type Filter struct {
+	expr string
+	root node
+}
+
+// Parse compiles a filter expression, an empty expression matches all flows
+func Parse(expr string) (*Filter, error) {
+	p := parser{lexer: lexer{input: expr}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind == tokEOF {
+		return &Filter{expr: expr}, nil
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected '%s'", p.tok.text)
+	}
+
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// MustParse compiles a filter expression, panicking on error
+func MustParse(expr string) *Filter {
+	f, err := Parse(expr)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// Match checks whether a flow record matches the filter, a nil filter matches all flows
+func (f *Filter) Match(r *flow.Record) bool {
+	if f == nil || f.root == nil {
+		return true
+	}
+	return f.root.eval(r)
+}
+
+// String returns the source expression
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+// MarshalText implements encoding.TextMarshaler so filters may be serialised as expressions
+func (f *Filter) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler so filters may be loaded from expressions
+func (f *Filter) UnmarshalText(text []byte) error {
+	parsed, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*f = *parsed
+	return nil
+}
+
+// Syntax tree
+
+type node interface {
+	eval(r *flow.Record) bool
+}
+
+type andNode struct{ left, right node }
+
+func (n *andNode) eval(r *flow.Record) bool { return n.left.eval(r) && n.right.eval(r) }
+
+type orNode struct{ left, right node }
+
+func (n *orNode) eval(r *flow.Record) bool { return n.left.eval(r) || n.right.eval(r) }
+
+type notNode struct{ inner node }
+
+func (n *notNode) eval(r *flow.Record) bool { return !n.inner.eval(r) }
+
+// existsNode matches when a field is non-empty
+type existsNode struct{ field field }
+
+func (n *existsNode) eval(r *flow.Record) bool {
+	v := n.field.get(r)
+	return v != "" && v != "0"
+}
+
+// compareNode compares a field with a value
+type compareNode struct {
+	field field
+	op    string
+	value string
+	num   float64
+	class string
+	exp   *regexp.Regexp
+}
+
+func (n *compareNode) eval(r *flow.Record) bool {
+	v := n.field.get(r)
+
+	switch n.op {
+	case "==":
+		return n.equals(v)
+	case "!=":
+		return !n.equals(v)
+	case "~":
+		return n.exp.MatchString(v)
+	case "!~":
+		return !n.exp.MatchString(v)
+	case "contains":
+		return strings.Contains(v, n.value)
+	}
+
+	// Ordered comparisons are numeric
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return false
+	}
+	switch n.op {
+	case ">":
+		return f > n.num
+	case ">=":
+		return f >= n.num
+	case "<":
+		return f < n.num
+	case "<=":
+		return f <= n.num
+	}
+	return false
+}
+
+func (n *compareNode) equals(v string) bool {
+	// Status classes (ie. 4xx) match any status in the class
+	if n.class != "" {
+		return len(v) == 3 && v[0] == n.class[0]
+	}
+	if n.field.fold {
+		return strings.EqualFold(v, n.value)
+	}
+	return v == n.value
+}
+
+// Parser
+
+type parser struct {
+	lexer
+	tok token
+}
+
+func (p *parser) next() error {
+	t, err := p.lex()
+	if err != nil {
+		return err
+	}
+	p.tok = t
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("filter: %s at position %d", fmt.Sprintf(format, args...), p.tok.pos+1)
+}
+
+// or := and ( "||" and )*
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.tok.kind == tokOr {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+
+	return left, nil
+}
+
+// and := unary ( "&&" unary )*
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.tok.kind == tokAnd {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+
+	return left, nil
+}
+
+// unary := "!" unary | "(" or ")" | comparison
+func (p *parser) parseUnary() (node, error) {
+	switch p.tok.kind {
+	case tokNot:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{inner}, nil
+
+	case tokLParen:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf("expected ')'")
+		}
+		return inner, p.next()
+	}
+
+	return p.parseComparison()
+}
+
+// comparison := field [ op value ]
+func (p *parser) parseComparison() (node, error) {
+	if p.tok.kind != tokWord {
+		return nil, p.errorf("expected field name")
+	}
+
+	f, err := lookupField(p.tok.text)
+	if err != nil {
+		return nil, p.errorf("%s", err)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tokOp {
+		return &existsNode{f}, nil
+	}
+	op := p.tok.text
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tokWord && p.tok.kind != tokString {
+		return nil, p.errorf("expected value after '%s'", op)
+	}
+	n := compareNode{field: f, op: op, value: p.tok.text}
+
+	switch op {
+	case "~", "!~":
+		if n.exp, err = regexp.Compile(n.value); err != nil {
+			return nil, p.errorf("invalid regexp: %s", err)
+		}
+	case ">", ">=", "<", "<=":
+		if n.num, err = strconv.ParseFloat(n.value, 64); err != nil {
+			return nil, p.errorf("'%s' requires a number", op)
+		}
+	case "==", "!=":
+		if f.name == "status" && statusClass.MatchString(strings.ToLower(n.value)) {
+			n.class = strings.ToLower(n.value)
+		}
+	}
+
+	return &n, p.next()
+}
+
+var statusClass = regexp.MustCompile(`^[1-5]xx$`)
@@ -0,0 +1,72 @@
+package filter
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+func TestFilter(t *testing.T) {
+	r := &flow.Record{
+		ID:             7,
+		Method:         "POST",
+		URL:            "https://api.example.com:8443/v1/login?next=%2F",
+		Proto:          "HTTP/1.1",
+		RequestHeader:  http.Header{"Authorization": {"Bearer abc"}, "Content-Type": {"application/json"}},
+		RequestBody:    `{"user":"admin"}`,
+		Status:         403,
+		ResponseHeader: http.Header{"Content-Type": {"application/json; charset=utf-8"}, "Set-Cookie": {"a=1", "b=2"}},
+		ResponseBody:   `{"error":"bad token"}`,
+		Duration:       120,
+	}
+
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{``, true},
+		{`host ~ "api" && status >= 400 && resp.body contains "token"`, true},
+		{`host == API.example.com`, true},
+		{`method == post and path == /v1/login`, true},
+		{`status == 4xx`, true},
+		{`status == 5xx || error`, false},
+		{`!(status < 400)`, true},
+		{`not error`, true},
+		{`type == application/json && req.type == "application/json"`, true},
+		{`req.header.authorization ~ "^Bearer "`, true},
+		{`resp.header.set-cookie contains "b=2"`, true},
+		{`req.header.x-missing`, false},
+		{`port == 8443 && scheme == https && query contains next`, true},
+		{`duration > 100 && duration <= 120 && id == 7 && size > 0`, true},
+		{`req.body ~ '"user":\s*"admin"'`, true},
+		{`host !~ "example" || status != 403`, false},
+		{`method == GET || (method == POST && host contains api)`, true},
+	}
+
+	for _, tt := range tests {
+		f, err := Parse(tt.expr)
+		if assert.Nil(t, err, tt.expr) {
+			assert.Equal(t, tt.match, f.Match(r), tt.expr)
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		`nope == 1`,
+		`status >= abc`,
+		`host ~ "("`,
+		`host ==`,
+		`(status == 200`,
+		`status == 200 )`,
+		`host == "unterminated`,
+		`&& host`,
+		`host $ 1`,
+	} {
+		_, err := Parse(expr)
+		assert.NotNil(t, err, expr)
+	}
+}
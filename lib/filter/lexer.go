@@ -0,0 +1,113 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokOp
+	tokAnd
+	tokOr
+	tokNot
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// lexer splits an expression into tokens
+type lexer struct {
+	input string
+	pos   int
+}
+
+func (l *lexer) lex() (token, error) {
+	for l.pos < len(l.input) && unicode.IsSpace(rune(l.input[l.pos])) {
+		l.pos++
+	}
+
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+
+	rest := l.input[l.pos:]
+	for _, s := range []struct {
+		text string
+		kind tokenKind
+	}{
+		{"&&", tokAnd}, {"||", tokOr}, {"==", tokOp}, {"!=", tokOp}, {"!~", tokOp},
+		{">=", tokOp}, {"<=", tokOp}, {">", tokOp}, {"<", tokOp}, {"~", tokOp},
+		{"!", tokNot}, {"(", tokLParen}, {")", tokRParen},
+	} {
+		if strings.HasPrefix(rest, s.text) {
+			l.pos += len(s.text)
+			return token{kind: s.kind, text: s.text, pos: start}, nil
+		}
+	}
+
+	if rest[0] == '"' || rest[0] == '\'' {
+		return l.lexString(rest[0])
+	}
+
+	for l.pos < len(l.input) && isWordChar(rune(l.input[l.pos])) {
+		l.pos++
+	}
+	if l.pos == start {
+		return token{}, fmt.Errorf("filter: unexpected character '%c' at position %d", l.input[start], start+1)
+	}
+
+	word := l.input[start:l.pos]
+	switch strings.ToLower(word) {
+	case "and":
+		return token{kind: tokAnd, text: word, pos: start}, nil
+	case "or":
+		return token{kind: tokOr, text: word, pos: start}, nil
+	case "not":
+		return token{kind: tokNot, text: word, pos: start}, nil
+	case "contains":
+		return token{kind: tokOp, text: "contains", pos: start}, nil
+	}
+
+	return token{kind: tokWord, text: word, pos: start}, nil
+}
+
+// lexString reads a quoted string, supporting backslash escapes of the quote and backslash
+// Other backslashes are retained so regular expressions (ie. "\d+") may be written directly.
+func (l *lexer) lexString(quote byte) (token, error) {
+	start := l.pos
+	l.pos++
+
+	var sb strings.Builder
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		switch {
+		case c == '\\' && l.pos+1 < len(l.input) && (l.input[l.pos+1] == quote || l.input[l.pos+1] == '\\'):
+			sb.WriteByte(l.input[l.pos+1])
+			l.pos += 2
+		case c == quote:
+			l.pos++
+			return token{kind: tokString, text: sb.String(), pos: start}, nil
+		default:
+			sb.WriteByte(c)
+			l.pos++
+		}
+	}
+
+	return token{}, fmt.Errorf("filter: unterminated string at position %d", start+1)
+}
+
+func isWordChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._-/:*?%+@", r)
+}
@@ -0,0 +1,51 @@
+package flow
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+)
+
+// Matcher selects flow records, see the filter package
+type Matcher interface {
+	Match(r *Record) bool
+}
+
+// LogExporter writes records of completed flows as JSON lines
+type LogExporter struct {
+	match  Matcher
+	bodies bool
+
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+// NewLogExporter creates an exporter writing flows selected by the matcher (nil for all flows)
+// Bodies are only included where enabled.
+func NewLogExporter(w io.Writer, match Matcher, bodies bool) *LogExporter {
+	return &LogExporter{
+		match:  match,
+		bodies: bodies,
+		enc:    json.NewEncoder(w),
+	}
+}
+
+// Record writes a completed flow if it matches the exporter filter
+func (e *LogExporter) Record(f *Flow) {
+	r := NewRecord(f)
+	if e.match != nil && !e.match.Match(r) {
+		return
+	}
+
+	if !e.bodies {
+		r.RequestBody, r.ResponseBody = "", ""
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if err := e.enc.Encode(r); err != nil {
+		log.Printf("Error exporting flow %d: %s", r.ID, err)
+	}
+}
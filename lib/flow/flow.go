@@ -0,0 +1,106 @@
+/**
+ * Flow package defines the context carried through the proxy for each request/response exchange
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package flow
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Flow tracks a single proxied request/response exchange
+// This is passed to plugins as the ctx argument of each hook
+type Flow struct {
+	ID       uint64
+	Started  time.Time
+	Request  *http.Request
+	Response *http.Response
+
+	// Header wire order, where known (see HeaderOrder)
+	RequestHeaderOrder  HeaderOrder
+	ResponseHeaderOrder HeaderOrder
+
+	// Processed bodies, these are not captured for streamed or upgraded responses
+	RequestBody  string
+	ResponseBody string
+
+	Finished time.Time
+	Error    error
+
+	lock        sync.Mutex
+	annotations []Annotation
+	blocked     error
+}
+
+// Annotation is a note attached to a flow by a plugin (ie. to record a modification)
+type Annotation struct {
+	Source  string `json:"source"`
+	Message string `json:"message"`
+}
+
+var lastID uint64
+
+// New creates a new flow for the provided request
+func New(req *http.Request) *Flow {
+	return &Flow{
+		ID:      atomic.AddUint64(&lastID, 1),
+		Started: time.Now(),
+		Request: req,
+
+		RequestHeaderOrder: HeaderOrderFromContext(req.Context()),
+	}
+}
+
+// Annotate attaches a note to the flow, this is safe for concurrent use by plugins
+func (f *Flow) Annotate(source, message string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.annotations = append(f.annotations, Annotation{Source: source, Message: message})
+}
+
+// Annotations fetches a copy of the notes attached to the flow
+func (f *Flow) Annotations() []Annotation {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]Annotation(nil), f.annotations...)
+}
+
+// Block marks the flow to be dropped by the proxy once the current processing stage completes
+// This allows plugins to fail closed where a flow cannot be safely processed.
+func (f *Flow) Block(reason error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.blocked == nil {
+		f.blocked = reason
+	}
+}
+
+// Blocked fetches the reason the flow was blocked, or nil if it has not been
+func (f *Flow) Blocked() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.blocked
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of the provided context carrying the provided flow
+func NewContext(ctx context.Context, f *Flow) context.Context {
+	return context.WithValue(ctx, contextKey{}, f)
+}
+
+// FromContext fetches the flow attached to a context, if one exists
+func FromContext(ctx context.Context) (*Flow, bool) {
+	f, ok := ctx.Value(contextKey{}).(*Flow)
+	return f, ok
+}
@@ -0,0 +1,205 @@
+package flow
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HAR is an HTTP Archive (v1.2) document, used to export flows to other tools
+// Only the fields required by the specification (and captured by the proxy) are populated.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+// HARLog is the root of a HAR document
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+// HARCreator identifies the application that created a HAR document
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HAREntry is a single request/response exchange
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            int64       `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+// HARRequest is a HAR request entry
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+// HARResponse is a HAR response entry
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+// HARNameValue is a HAR header, cookie or query parameter
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARPostData is a HAR request body
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+// HARContent is a HAR response body
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+}
+
+// HARTimings are HAR entry timings, only the total is captured so this is attributed to waiting
+type HARTimings struct {
+	Send    int64 `json:"send"`
+	Wait    int64 `json:"wait"`
+	Receive int64 `json:"receive"`
+}
+
+// NewHAR creates a HAR document from flow records
+func NewHAR(creator, version string, records []*Record) *HAR {
+	h := HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: creator, Version: version},
+		Entries: make([]HAREntry, 0, len(records)),
+	}}
+
+	for _, r := range records {
+		e := HAREntry{
+			StartedDateTime: r.Started.Format(time.RFC3339Nano),
+			Time:            r.Duration,
+			Timings:         HARTimings{Wait: r.Duration},
+			Comment:         r.Error,
+			Request: HARRequest{
+				Method:      r.Method,
+				URL:         r.URL,
+				HTTPVersion: r.Proto,
+				Cookies:     []HARNameValue{},
+				Headers:     harValues(r.RequestHeader),
+				QueryString: []HARNameValue{},
+				HeadersSize: -1,
+				BodySize:    len(r.RequestBody),
+			},
+			Response: HARResponse{
+				Status:      r.Status,
+				StatusText:  http.StatusText(r.Status),
+				HTTPVersion: r.Proto,
+				Cookies:     []HARNameValue{},
+				Headers:     harValues(r.ResponseHeader),
+				Content: HARContent{
+					Size:     len(r.ResponseBody),
+					MimeType: r.ResponseHeader.Get("Content-Type"),
+					Text:     r.ResponseBody,
+				},
+				RedirectURL: r.ResponseHeader.Get("Location"),
+				HeadersSize: -1,
+				BodySize:    len(r.ResponseBody),
+			},
+		}
+
+		if u, err := url.Parse(r.URL); err == nil {
+			e.Request.QueryString = harValues(u.Query())
+		}
+		if r.RequestBody != "" {
+			e.Request.PostData = &HARPostData{
+				MimeType: r.RequestHeader.Get("Content-Type"),
+				Text:     r.RequestBody,
+			}
+		}
+
+		h.Log.Entries = append(h.Log.Entries, e)
+	}
+
+	return &h
+}
+
+// Records converts HAR entries (ie. exported from a browser) into flow records
+// Entries are numbered in order, and HTTP/2 pseudo-headers are dropped.
+func (h *HAR) Records() []*Record {
+	records := make([]*Record, 0, len(h.Log.Entries))
+
+	for i, e := range h.Log.Entries {
+		r := Record{
+			ID:             uint64(i + 1),
+			Duration:       e.Time,
+			Method:         e.Request.Method,
+			URL:            e.Request.URL,
+			Proto:          e.Request.HTTPVersion,
+			RequestHeader:  harHeader(e.Request.Headers),
+			Status:         e.Response.Status,
+			ResponseHeader: harHeader(e.Response.Headers),
+			ResponseBody:   e.Response.Content.Text,
+			Error:          e.Comment,
+		}
+		r.Started, _ = time.Parse(time.RFC3339Nano, e.StartedDateTime)
+		if e.Request.PostData != nil {
+			r.RequestBody = e.Request.PostData.Text
+		}
+
+		records = append(records, &r)
+	}
+
+	return records
+}
+
+// harHeader converts HAR name / value pairs into a header
+func harHeader(values []HARNameValue) http.Header {
+	h := http.Header{}
+	for _, v := range values {
+		if !strings.HasPrefix(v.Name, ":") {
+			h.Add(v.Name, v.Value)
+		}
+	}
+	return h
+}
+
+// harValues converts a header or query map into sorted name / value pairs
+func harValues(m map[string][]string) []HARNameValue {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := []HARNameValue{}
+	for _, k := range keys {
+		for _, v := range m[k] {
+			values = append(values, HARNameValue{Name: k, Value: v})
+		}
+	}
+	return values
+}
@@ -0,0 +1,123 @@
+package flow
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// HeaderOrder records the wire order and casing of the header keys in an HTTP/1.x message
+// Keys are repeated for headers that appear more than once
+type HeaderOrder []string
+
+// maxHeadLength limits the size of message heads searched when peeking header order
+const maxHeadLength = 64 * 1024
+
+// ParseHeaderOrder parses the header order from a raw HTTP/1.x message head
+func ParseHeaderOrder(head []byte) HeaderOrder {
+	order := HeaderOrder{}
+
+	lines := strings.Split(strings.Replace(string(head), "\r\n", "\n", -1), "\n")
+	if len(lines) == 0 {
+		return order
+	}
+
+	// Skip the request / status line and any continuation lines
+	for _, line := range lines[1:] {
+		if line == "" {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		if i := strings.Index(line, ":"); i > 0 {
+			order = append(order, strings.TrimSpace(line[:i]))
+		}
+	}
+
+	return order
+}
+
+// PeekHeaderOrder parses the header order of the next message in a buffered reader without consuming it
+// This only blocks while the message head is incomplete, and returns nil if no head is found
+// within the reader buffer.
+func PeekHeaderOrder(r *bufio.Reader) (HeaderOrder, error) {
+	n := 1
+	for {
+		if b := r.Buffered(); b > n {
+			n = b
+		}
+
+		data, err := r.Peek(n)
+		if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+			return ParseHeaderOrder(data[:i]), nil
+		}
+		if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+			return ParseHeaderOrder(data[:i]), nil
+		}
+
+		if err == bufio.ErrBufferFull || n >= maxHeadLength {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		n = len(data) + 1
+	}
+}
+
+var headerValueReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// Write writes headers in the recorded order using the recorded key casing
+// Headers not found in the order (ie. those added by plugins) are written after these in sorted order.
+func (o HeaderOrder) Write(w io.Writer, header http.Header) error {
+	written := make(map[string]int)
+
+	for _, k := range o {
+		ck := http.CanonicalHeaderKey(k)
+		i := written[ck]
+		if i >= len(header[ck]) {
+			continue
+		}
+
+		if _, err := fmt.Fprintf(w, "%s: %s\r\n", k, headerValueReplacer.Replace(header[ck][i])); err != nil {
+			return err
+		}
+		written[ck] = i + 1
+	}
+
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range header[k][written[k]:] {
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", k, headerValueReplacer.Replace(v)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type headerOrderKey struct{}
+
+// WithHeaderOrder returns a copy of the provided context carrying a request header order
+// This is used by frontends to pass the incoming order to the flow created for the request
+func WithHeaderOrder(ctx context.Context, o HeaderOrder) context.Context {
+	return context.WithValue(ctx, headerOrderKey{}, o)
+}
+
+// HeaderOrderFromContext fetches the request header order attached to a context, if one exists
+func HeaderOrderFromContext(ctx context.Context) HeaderOrder {
+	o, _ := ctx.Value(headerOrderKey{}).(HeaderOrder)
+	return o
+}
@@ -0,0 +1,175 @@
+package flow
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Record is a serialisable snapshot of a completed flow
+type Record struct {
+	ID       uint64    `json:"id"`
+	Started  time.Time `json:"started"`
+	Duration int64     `json:"duration_ms"`
+
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	Proto          string      `json:"proto"`
+	RequestHeader  http.Header `json:"request_header"`
+	RequestBody    string      `json:"request_body,omitempty"`
+	Status         int         `json:"status,omitempty"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	ResponseBody   string      `json:"response_body,omitempty"`
+
+	// TLS connections between the client and proxy, and the proxy and upstream server
+	ClientTLS *TLSInfo `json:"client_tls,omitempty"`
+	ServerTLS *TLSInfo `json:"server_tls,omitempty"`
+
+	Annotations []Annotation `json:"annotations,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// NewRecord creates a record from a flow
+func NewRecord(f *Flow) *Record {
+	r := Record{
+		ID:       f.ID,
+		Started:  f.Started,
+		Duration: int64(f.Finished.Sub(f.Started) / time.Millisecond),
+
+		RequestBody:  f.RequestBody,
+		ResponseBody: f.ResponseBody,
+
+		Annotations: f.Annotations(),
+	}
+
+	if f.Request != nil {
+		r.Method = f.Request.Method
+		r.URL = f.Request.URL.String()
+		r.Proto = f.Request.Proto
+		r.RequestHeader = cloneHeader(f.Request.Header)
+		r.ClientTLS = NewTLSInfo(f.Request.TLS)
+	}
+	if f.Response != nil {
+		r.Status = f.Response.StatusCode
+		r.ResponseHeader = cloneHeader(f.Response.Header)
+		r.ServerTLS = NewTLSInfo(f.Response.TLS)
+	}
+	if f.Error != nil {
+		r.Error = f.Error.Error()
+	}
+
+	return &r
+}
+
+// size is the approximate memory used by captured bodies
+func (r *Record) size() int64 {
+	return int64(len(r.RequestBody) + len(r.ResponseBody))
+}
+
+// Store holds records of the most recently completed flows
+// This is bounded by both the number of records and the total size of captured bodies,
+// with the oldest records evicted first.
+type Store struct {
+	limit    int
+	maxBytes int64
+
+	lock        sync.RWMutex
+	records     []*Record
+	size        int64
+	subscribers map[chan *Record]struct{}
+}
+
+// NewStore creates a store holding up to limit records and maxBytes of bodies (zero for unlimited)
+func NewStore(limit int, maxBytes int64) *Store {
+	return &Store{
+		limit:       limit,
+		maxBytes:    maxBytes,
+		records:     make([]*Record, 0),
+		subscribers: make(map[chan *Record]struct{}),
+	}
+}
+
+// Subscribe registers for records as they are added to the store
+// Records are dropped for subscribers that are not keeping up, the returned
+// function must be called to unsubscribe.
+func (s *Store) Subscribe() (<-chan *Record, func()) {
+	ch := make(chan *Record, 64)
+
+	s.lock.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.lock.Unlock()
+
+	return ch, func() {
+		s.lock.Lock()
+		delete(s.subscribers, ch)
+		s.lock.Unlock()
+	}
+}
+
+// Record adds a completed flow to the store, evicting the oldest record when full
+func (s *Store) Record(f *Flow) {
+	s.Add(NewRecord(f))
+}
+
+// Add adds a record to the store (ie. when loaded from a session), evicting the oldest record when full
+func (s *Store) Add(r *Record) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.records = append(s.records, r)
+	s.size += r.size()
+
+	evict := 0
+	for len(s.records)-evict > 1 &&
+		((s.limit > 0 && len(s.records)-evict > s.limit) || (s.maxBytes > 0 && s.size > s.maxBytes)) {
+		s.size -= s.records[evict].size()
+		evict++
+	}
+	s.records = s.records[evict:]
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- r:
+		default:
+		}
+	}
+}
+
+// Records fetches the stored records, oldest first
+func (s *Store) Records() []*Record {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]*Record(nil), s.records...)
+}
+
+// Get fetches a stored record by flow ID
+func (s *Store) Get(id uint64) (*Record, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, r := range s.records {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// Clear removes all stored records
+func (s *Store) Clear() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.records = make([]*Record, 0)
+	s.size = 0
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
@@ -0,0 +1,51 @@
+package flow
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// TLSInfo is a serialisable summary of a TLS connection
+type TLSInfo struct {
+	Version            string   `json:"version"`
+	CipherSuite        string   `json:"cipher_suite"`
+	ServerName         string   `json:"server_name,omitempty"`
+	NegotiatedProtocol string   `json:"negotiated_protocol,omitempty"`
+	Resumed            bool     `json:"resumed,omitempty"`
+	Certificates       []string `json:"certificates,omitempty"`
+}
+
+// NewTLSInfo summarises a TLS connection state, returning nil for plain connections
+// Certificates lists the subjects of the peer certificate chain, leaf first.
+func NewTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	if state == nil {
+		return nil
+	}
+
+	info := TLSInfo{
+		Version:            tlsVersion(state.Version),
+		CipherSuite:        tls.CipherSuiteName(state.CipherSuite),
+		ServerName:         state.ServerName,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+		Resumed:            state.DidResume,
+	}
+	for _, c := range state.PeerCertificates {
+		info.Certificates = append(info.Certificates, c.Subject.String())
+	}
+
+	return &info
+}
+
+func tlsVersion(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
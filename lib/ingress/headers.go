@@ -0,0 +1,124 @@
+package ingress
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are hop-by-hop headers that are not forwarded by proxies (RFC 7230 section 6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes hop-by-hop headers, including any listed in the Connection header
+func removeHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				header.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		header.Del(k)
+	}
+}
+
+// Forwarding policies for proxy identifying headers
+const (
+	// PolicyPass forwards headers as received from the client
+	PolicyPass = "pass"
+	// PolicyAdd adds the proxy to headers as a standard proxy would
+	PolicyAdd = "add"
+	// PolicyStrip removes headers
+	PolicyStrip = "strip"
+	// PolicySpoof replaces headers with configured values
+	PolicySpoof = "spoof"
+)
+
+// ForwardPolicy configures how the Via, Forwarded and X-Forwarded-* headers are handled,
+// controlling whether the presence of the proxy is visible to upstream servers
+type ForwardPolicy struct {
+	// Via policy and value used when adding or spoofing
+	Via      string
+	ViaValue string
+	// Forwarded policy (applies to Forwarded and X-Forwarded-For/Proto/Host)
+	// and client address used when spoofing
+	Forwarded    string
+	ForwardedFor string
+}
+
+// DefaultForwardPolicy passes headers through unmodified
+var DefaultForwardPolicy = ForwardPolicy{Via: PolicyPass, ViaValue: "evpx", Forwarded: PolicyPass}
+
+// apply applies the forwarding policy to an outgoing request header
+func (p *ForwardPolicy) apply(header http.Header, req *http.Request) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	switch p.Via {
+	case PolicyAdd:
+		header.Add("Via", fmt.Sprintf("%d.%d %s", req.ProtoMajor, req.ProtoMinor, p.ViaValue))
+	case PolicyStrip:
+		header.Del("Via")
+	case PolicySpoof:
+		header.Set("Via", p.ViaValue)
+	}
+
+	switch p.Forwarded {
+	case PolicyAdd:
+		client, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			client = req.RemoteAddr
+		}
+
+		if prior := header.Get("X-Forwarded-For"); prior != "" {
+			client = prior + ", " + client
+		}
+		header.Set("X-Forwarded-For", client)
+		if header.Get("X-Forwarded-Proto") == "" {
+			header.Set("X-Forwarded-Proto", proto)
+		}
+		if header.Get("X-Forwarded-Host") == "" {
+			header.Set("X-Forwarded-Host", req.Host)
+		}
+		header.Add("Forwarded", forwardedElement(req.RemoteAddr, proto, req.Host))
+
+	case PolicyStrip:
+		for _, k := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host"} {
+			header.Del(k)
+		}
+
+	case PolicySpoof:
+		header.Set("X-Forwarded-For", p.ForwardedFor)
+		header.Set("X-Forwarded-Proto", proto)
+		header.Set("X-Forwarded-Host", req.Host)
+		header.Set("Forwarded", forwardedElement(p.ForwardedFor, proto, req.Host))
+	}
+}
+
+// forwardedElement builds a Forwarded header element (RFC 7239)
+func forwardedElement(addr, proto, host string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		addr = h
+	}
+
+	// IPv6 addresses must be bracketed and quoted
+	if strings.Contains(addr, ":") {
+		addr = fmt.Sprintf(`"[%s]"`, addr)
+	}
+
+	return fmt.Sprintf(`for=%s;proto=%s;host="%s"`, addr, proto, host)
+}
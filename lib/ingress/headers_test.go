@@ -0,0 +1,118 @@
+package ingress
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaders(t *testing.T) {
+
+	t.Run("Removes hop-by-hop headers", func(t *testing.T) {
+		header := http.Header{
+			"Connection":          {"keep-alive, X-Hop", " x-other "},
+			"Keep-Alive":          {"timeout=5"},
+			"Proxy-Authorization": {"Basic abc"},
+			"Proxy-Connection":    {"keep-alive"},
+			"Te":                  {"trailers"},
+			"Transfer-Encoding":   {"chunked"},
+			"Upgrade":             {"websocket"},
+			"X-Hop":               {"1"},
+			"X-Other":             {"2"},
+			"X-End":               {"3"},
+			"Accept":              {"*/*"},
+		}
+
+		removeHopHeaders(header)
+		assert.Equal(t, http.Header{"X-End": {"3"}, "Accept": {"*/*"}}, header)
+	})
+
+	t.Run("Ignores empty Connection tokens", func(t *testing.T) {
+		header := http.Header{"Connection": {", ,close"}, "X-End": {"1"}}
+
+		removeHopHeaders(header)
+		assert.Equal(t, http.Header{"X-End": {"1"}}, header)
+	})
+
+	t.Run("Removes Accept-Encoding unless preserving headers", func(t *testing.T) {
+		for _, preserve := range []bool{false, true} {
+			h := &HTTPFrontend{forwardPolicy: DefaultForwardPolicy, preserveHeaders: preserve}
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+
+			proxyReq, err := h.wrapRequest(req)
+			if assert.Nil(t, err) {
+				assert.Equal(t, preserve, proxyReq.Header.Get("Accept-Encoding") != "", "preserve: %t", preserve)
+			}
+		}
+	})
+}
+
+func TestForwardPolicy(t *testing.T) {
+	newRequest := func(tls *tls.ConnectionState) *http.Request {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = "10.0.0.2:1234"
+		req.TLS = tls
+		return req
+	}
+	prior := func() http.Header {
+		return http.Header{
+			"Via":              {"1.1 upstream"},
+			"Forwarded":        {"for=10.0.0.1"},
+			"X-Forwarded-For":  {"10.0.0.1"},
+			"X-Forwarded-Host": {"client.com"},
+		}
+	}
+
+	t.Run("Passes headers through", func(t *testing.T) {
+		header := prior()
+		DefaultForwardPolicy.apply(header, newRequest(nil))
+		assert.Equal(t, prior(), header)
+	})
+
+	t.Run("Adds the proxy to headers", func(t *testing.T) {
+		p := ForwardPolicy{Via: PolicyAdd, ViaValue: "evpx", Forwarded: PolicyAdd}
+		header := prior()
+		p.apply(header, newRequest(&tls.ConnectionState{}))
+
+		assert.Equal(t, []string{"1.1 upstream", "1.1 evpx"}, header["Via"])
+		assert.Equal(t, "10.0.0.1, 10.0.0.2", header.Get("X-Forwarded-For"))
+		assert.Equal(t, "https", header.Get("X-Forwarded-Proto"))
+		assert.Equal(t, "client.com", header.Get("X-Forwarded-Host"))
+		assert.Equal(t, []string{"for=10.0.0.1", `for=10.0.0.2;proto=https;host="example.com"`}, header["Forwarded"])
+	})
+
+	t.Run("Strips headers", func(t *testing.T) {
+		p := ForwardPolicy{Via: PolicyStrip, Forwarded: PolicyStrip}
+		header := prior()
+		header.Set("X-Forwarded-Proto", "http")
+		header.Set("Accept", "*/*")
+		p.apply(header, newRequest(nil))
+
+		assert.Equal(t, http.Header{"Accept": {"*/*"}}, header)
+	})
+
+	t.Run("Spoofs headers", func(t *testing.T) {
+		p := ForwardPolicy{Via: PolicySpoof, ViaValue: "1.1 cache", Forwarded: PolicySpoof, ForwardedFor: "2001:db8::1"}
+		header := prior()
+		p.apply(header, newRequest(nil))
+
+		assert.Equal(t, []string{"1.1 cache"}, header["Via"])
+		assert.Equal(t, []string{"2001:db8::1"}, header["X-Forwarded-For"])
+		assert.Equal(t, "http", header.Get("X-Forwarded-Proto"))
+		assert.Equal(t, "example.com", header.Get("X-Forwarded-Host"))
+		assert.Equal(t, []string{`for="[2001:db8::1]";proto=http;host="example.com"`}, header["Forwarded"])
+	})
+
+	t.Run("Applies policies independently", func(t *testing.T) {
+		p := ForwardPolicy{Via: PolicyStrip, Forwarded: PolicyPass}
+		header := prior()
+		p.apply(header, newRequest(nil))
+
+		assert.Empty(t, header["Via"])
+		assert.Equal(t, "10.0.0.1", header.Get("X-Forwarded-For"))
+	})
+}
@@ -1,14 +1,19 @@
 package ingress
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+	"github.com/ryankurte/evilproxy/lib/plugins"
 )
 
 // HTTPFrontend is a http proxy based frontend with bump-tls support
@@ -18,14 +23,39 @@ type HTTPFrontend struct {
 	bindAddress   string
 	srv           *http.Server
 	bumpTLS       *BumpTLS
+	http2         HTTP2Options
+
+	preserveHeaders bool
+	listener        net.Listener
+	forwardPolicy   ForwardPolicy
+	passthrough     Passthrough
+	upgrader        Upgrader
+}
+
+// Upgrader selects plain requests to be upgraded to HTTPS when forwarded upstream
+// ie. for hosts where links have been downgraded by the SSL strip plugin
+type Upgrader interface {
+	Upgrade(host string) bool
+}
+
+// HTTP2Options configures HTTP/2 support for bumped TLS connections
+type HTTP2Options struct {
+	// Enabled offers HTTP/2 to clients via ALPN
+	Enabled bool
+	// MatchUpstream only offers HTTP/2 to clients where the upstream server supports it
+	MatchUpstream bool
+	// ForwardPush re-creates server pushes for clients from upstream preload links,
+	// otherwise pushes are dropped (upstream pushes are always refused by the backend)
+	ForwardPush bool
 }
 
 // NewHTTPFrontend creates a new HTTP frontend
 func NewHTTPFrontend(address, port, certFile, keyFile, certDir string) (*HTTPFrontend, error) {
 	h := HTTPFrontend{
-		address:     address,
-		port:        port,
-		bindAddress: fmt.Sprintf("%s:%s", address, port),
+		address:       address,
+		port:          port,
+		bindAddress:   fmt.Sprintf("%s:%s", address, port),
+		forwardPolicy: DefaultForwardPolicy,
 	}
 
 	b, err := NewBumpTLS(certFile, keyFile, certDir)
@@ -42,6 +72,42 @@ func (h *HTTPFrontend) BindProxy(p Proxy) {
 	h.Proxy = p
 }
 
+// ConfigureHTTP2 sets HTTP/2 options for the frontend, this must be called prior to Run
+func (h *HTTPFrontend) ConfigureHTTP2(o HTTP2Options) {
+	h.http2 = o
+	h.bumpTLS.ConfigureHTTP2(o.Enabled, o.MatchUpstream)
+}
+
+// PreserveHeaders enables preservation of header wire order and casing, this must be called prior to Run
+// Connections are served by the frontend rather than the http.Server, and only HTTP/1.x is supported.
+func (h *HTTPFrontend) PreserveHeaders(enabled bool) {
+	h.preserveHeaders = enabled
+	if enabled && h.http2.Enabled {
+		log.Printf("HTTP/2 is not supported when preserving headers, disabling")
+		h.ConfigureHTTP2(HTTP2Options{})
+	}
+}
+
+// SetForwardPolicy sets the policy for proxy identifying headers on forwarded requests
+func (h *HTTPFrontend) SetForwardPolicy(p ForwardPolicy) {
+	h.forwardPolicy = p
+}
+
+// BindUpgrader binds an upgrader selecting plain requests to be forwarded upstream over HTTPS
+func (h *HTTPFrontend) BindUpgrader(u Upgrader) {
+	h.upgrader = u
+}
+
+// Passthrough fetches the hosts for which TLS connections are tunnelled rather than bumped
+func (h *HTTPFrontend) Passthrough() *Passthrough {
+	return &h.passthrough
+}
+
+// Certificates lists the certificates in the bump certificate cache
+func (h *HTTPFrontend) Certificates() []CertInfo {
+	return h.bumpTLS.Certificates()
+}
+
 // wrapRequest modifies the incoming request to meet core proxy requirements
 // ie. have a viable query string and body
 func (h *HTTPFrontend) wrapRequest(req *http.Request) (*http.Request, error) {
@@ -57,13 +123,73 @@ func (h *HTTPFrontend) wrapRequest(req *http.Request) (*http.Request, error) {
 		queryURI = "http://" + queryURI
 	}
 
+	// Upgrade plain requests to hosts that have been downgraded, dropping any default port
+	if req.TLS == nil && h.upgrader != nil && h.upgrader.Upgrade(host) {
+		rest := strings.TrimPrefix(queryURI, "http://")
+		end := strings.IndexAny(rest, "/?#")
+		if end < 0 {
+			end = len(rest)
+		}
+		if strings.HasSuffix(rest[:end], ":80") {
+			rest = rest[:end-len(":80")] + rest[end:]
+		}
+		queryURI = "https://" + rest
+	}
+
 	log.Printf("Request URI: %s", queryURI)
 
-	if req.Body == nil {
-		return http.NewRequest(req.Method, queryURI, nil)
+	var body io.Reader
+	if req.Body != nil {
+		body = req.Body
+	}
+
+	proxyReq, err := http.NewRequestWithContext(req.Context(), req.Method, queryURI, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Forward request trailers (these are populated once the body is consumed)
+	proxyReq.Trailer = req.Trailer
+
+	// Retain the client TLS state for capture, this is ignored by backends
+	proxyReq.TLS = req.TLS
+
+	// Forward end-to-end headers
+	for k, v := range req.Header {
+		proxyReq.Header[k] = append([]string(nil), v...)
+	}
+	removeHopHeaders(proxyReq.Header)
+
+	// Re-instate headers required for upgrades and trailers
+	if headerContainsToken(req.Header, "Connection", "upgrade") && req.Header.Get("Upgrade") != "" {
+		proxyReq.Header.Set("Connection", "Upgrade")
+		proxyReq.Header.Set("Upgrade", req.Header.Get("Upgrade"))
+	}
+	if headerContainsToken(req.Header, "Te", "trailers") {
+		proxyReq.Header.Set("Te", "trailers")
+	}
+
+	// Websocket compression is not negotiated so frames can be inspected
+	proxyReq.Header.Del("Sec-Websocket-Extensions")
+
+	// Accept-Encoding is removed so the backend negotiates (and decodes) compression,
+	// allowing plugins to operate on plain bodies. This is retained when preserving headers.
+	if !h.preserveHeaders {
+		proxyReq.Header.Del("Accept-Encoding")
 	}
 
-	return http.NewRequest(req.Method, queryURI, req.Body)
+	h.forwardPolicy.apply(proxyReq.Header, req)
+
+	return proxyReq, nil
+}
+
+// responseFlow fetches the flow attached to a proxied response, if one exists
+func responseFlow(resp *http.Response) *flow.Flow {
+	if resp.Request == nil {
+		return nil
+	}
+	f, _ := flow.FromContext(resp.Request.Context())
+	return f
 }
 
 // wrapResponse modifies the outgoing response as is expected by the client
@@ -98,16 +224,130 @@ func (h *HTTPFrontend) handler(wr http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Write processed response
+	// Switch protocols (ie. websockets) where required
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		h.handleUpgrade(wr, resp)
+		return
+	}
+
+	// Forward server pushes where enabled
+	if h.http2.ForwardPush {
+		if pusher, ok := wr.(http.Pusher); ok {
+			h.forwardPushes(pusher, req, resp)
+		}
+	}
+
+	// Write processed response, preserving header order where supported
+	removeHopHeaders(resp.Header)
 	for k, v := range resp.Header {
-		wr.Header().Set(k, v[0])
-		for i := 1; i < len(v); i++ {
-			wr.Header().Set(k, v[i])
+		for _, value := range v {
+			wr.Header().Add(k, value)
+		}
+	}
+	if s, ok := wr.(headerOrderSetter); ok {
+		if f := responseFlow(resp); f != nil {
+			s.SetHeaderOrder(f.ResponseHeaderOrder)
 		}
 	}
+
+	// Announce trailers, these are only available once the body has been read
+	// HTTP/1.1 trailers require chunked encoding, so any content length is removed
+	for k := range resp.Trailer {
+		wr.Header().Add("Trailer", k)
+	}
+	if len(resp.Trailer) > 0 {
+		wr.Header().Del("Content-Length")
+	}
+
+	// Streamed responses are flushed as data arrives, buffered responses are written as these are copied
 	wr.WriteHeader(resp.StatusCode)
-	io.Copy(wr, resp.Body)
+	var w io.Writer = wr
+	if isStreamed(resp) {
+		w = newFlushWriter(wr)
+	}
+	io.Copy(w, resp.Body)
 	resp.Body.Close()
+
+	for k, v := range resp.Trailer {
+		wr.Header()[k] = v
+	}
+}
+
+// forwardPushes issues server pushes to the client for resources the upstream
+// server has marked for preloading (ie. `Link: </app.js>; rel=preload`)
+func (h *HTTPFrontend) forwardPushes(pusher http.Pusher, req *http.Request, resp *http.Response) {
+	for _, target := range preloadLinks(resp.Header) {
+		opts := http.PushOptions{Header: http.Header{}}
+		for _, k := range []string{"Accept-Encoding", "Accept-Language", "Cookie", "User-Agent"} {
+			if v := req.Header.Get(k); v != "" {
+				opts.Header.Set(k, v)
+			}
+		}
+
+		// Clients may disable push, in which case pushes are not supported
+		err := pusher.Push(target, &opts)
+		if err == http.ErrNotSupported {
+			return
+		} else if err != nil {
+			log.Printf("Error forwarding push for %s: %s", target, err)
+			return
+		}
+	}
+}
+
+// preloadLinks fetches same-origin preload paths from response Link headers
+func preloadLinks(header http.Header) []string {
+	targets := []string{}
+	for _, v := range header["Link"] {
+		for _, link := range strings.Split(v, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+				continue
+			}
+
+			preload, nopush := false, false
+			for _, p := range parts[1:] {
+				switch strings.ToLower(strings.Replace(strings.TrimSpace(p), " ", "", -1)) {
+				case "rel=preload", `rel="preload"`:
+					preload = true
+				case "nopush":
+					nopush = true
+				}
+			}
+
+			if preload && !nopush {
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets
+}
+
+// isStreamed checks whether a response is streamed by the proxy rather than buffered, ie. gRPC,
+// server-sent events and those of unknown length (buffered responses always have a length)
+func isStreamed(resp *http.Response) bool {
+	t, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return resp.ContentLength < 0 || plugins.IsGRPC(resp.Header) || t == "text/event-stream"
+}
+
+// flushWriter flushes each write to the client so streamed responses are not delayed
+type flushWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	f, _ := w.(http.Flusher)
+	return &flushWriter{w: w, f: f}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+	return n, err
 }
 
 type singleListener struct {
@@ -154,8 +394,14 @@ func (h *HTTPFrontend) handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Tunnel passthrough hosts without interception
+	if h.passthrough.Matches(r.URL.Hostname()) {
+		h.tunnel(w, r, hj)
+		return
+	}
+
 	// Fetch a TLS configuration
-	config, err := h.bumpTLS.GetConfigByName(r.URL.Hostname())
+	config, err := h.bumpTLS.GetConfigByAddress(r.URL.Host)
 	if err != nil {
 		http.Error(w, "CONNECT error getting bumpTLS config", http.StatusInternalServerError)
 		log.Printf("CONNECT error getting bumpTLS config: %s", err)
@@ -173,6 +419,12 @@ func (h *HTTPFrontend) handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Serve the connection directly when preserving headers
+	if h.preserveHeaders {
+		go h.serveOrdered(tls.Server(conn, config))
+		return
+	}
+
 	// Build a single listener to bind the connection instance to the request
 	listener := newSingleListener(conn)
 
@@ -202,6 +454,12 @@ func (h *HTTPFrontend) Run() {
 	tlsConfig := ConfigTemplate.Clone()
 	tlsConfig.GetConfigForClient = h.bumpTLS.GetConfigForClient
 
+	// Advertising h2 here configures the server for HTTP/2 connections,
+	// the protocols offered to each client are set in the bumped configuration
+	if h.http2.Enabled {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+
 	srv := &http.Server{
 		Addr:      h.bindAddress,
 		Handler:   h,
@@ -210,21 +468,32 @@ func (h *HTTPFrontend) Run() {
 
 	log.Printf("Starting evilproxy at: http://%s", h.bindAddress)
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		h.handler(w, r)
-	})
+	h.srv = srv
+
+	l, err := net.Listen("tcp", h.bindAddress)
+	if err != nil {
+		log.Printf("Error starting listener: %s", err)
+		return
+	}
+	h.listener = l
+
+	if h.preserveHeaders {
+		go h.serveOrderedListener(l)
+		return
+	}
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
+		if err := srv.Serve(l); err != nil {
 			// cannot panic, because this probably is an intentional close
-			log.Printf("Httpserver: ListenAndServe() error: %s", err)
+			log.Printf("Httpserver: Serve() error: %s", err)
 		}
 	}()
-
-	h.srv = srv
 }
 
 // Stop shuts down the http frontend
 func (h *HTTPFrontend) Stop() {
-	h.srv.Shutdown(nil)
+	if h.listener != nil {
+		h.listener.Close()
+	}
+	h.srv.Shutdown(context.Background())
 }
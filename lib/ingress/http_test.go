@@ -0,0 +1,208 @@
+package ingress
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/core"
+)
+
+// transportBackend forwards requests with a transport (ie. that of a test server)
+type transportBackend struct {
+	t http.RoundTripper
+}
+
+func (b *transportBackend) Request(ctx interface{}, req *http.Request) (*http.Response, error) {
+	return b.t.RoundTrip(req)
+}
+
+// newTestFrontend starts a frontend on a random local port, forwarding requests with the provided backend
+// A certificate is created for 127.0.0.1 so bumped connections do not contact the upstream server.
+func newTestFrontend(t *testing.T, backend core.Backend, configure func(h *HTTPFrontend)) (*HTTPFrontend, *http.Transport) {
+	h, err := NewHTTPFrontend("127.0.0.1", "0", "", "", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := h.bumpTLS.initCert(&x509.Certificate{
+		SerialNumber: certTemplate.SerialNumber,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.bumpTLS.certs["127.0.0.1"] = cert
+
+	if configure != nil {
+		configure(h)
+	}
+
+	p := core.NewProxy(core.Options{})
+	p.BindBackend(backend)
+	h.BindProxy(p)
+	h.Run()
+	t.Cleanup(h.Stop)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(h.bumpTLS.ca.crt)
+	proxy, _ := url.Parse("http://" + h.listener.Addr().String())
+
+	return h, &http.Transport{
+		Proxy:             http.ProxyURL(proxy),
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: true,
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Link", "</app.js>; rel=preload")
+		w.Write([]byte(r.Proto))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	t.Run("Serves HTTP/2 to clients and forwards trailers", func(t *testing.T) {
+		_, tr := newTestFrontend(t, &transportBackend{upstream.Client().Transport}, func(h *HTTPFrontend) {
+			h.ConfigureHTTP2(HTTP2Options{Enabled: true, ForwardPush: true})
+		})
+
+		resp, err := (&http.Client{Transport: tr}).Get(upstream.URL)
+		assert.Nil(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+
+		assert.Equal(t, "HTTP/2.0", resp.Proto)
+		assert.Equal(t, "HTTP/2.0", string(body))
+		assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	})
+
+	t.Run("Serves HTTP/1.1 where disabled", func(t *testing.T) {
+		_, tr := newTestFrontend(t, &transportBackend{upstream.Client().Transport}, nil)
+
+		resp, err := (&http.Client{Transport: tr}).Get(upstream.URL)
+		assert.Nil(t, err)
+		ioutil.ReadAll(resp.Body)
+
+		assert.Equal(t, "HTTP/1.1", resp.Proto)
+		assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	})
+
+	t.Run("Matches the upstream protocol on the CONNECT port", func(t *testing.T) {
+		h1 := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}))
+		defer h1.Close()
+
+		_, tr := newTestFrontend(t, &transportBackend{&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}}, func(h *HTTPFrontend) {
+			h.ConfigureHTTP2(HTTP2Options{Enabled: true, MatchUpstream: true})
+		})
+		c := &http.Client{Transport: tr}
+
+		resp, err := c.Get(upstream.URL)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "HTTP/2.0", resp.Proto)
+
+		resp, err = c.Get(h1.URL)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "HTTP/1.1", resp.Proto)
+	})
+}
+
+// upgradeHosts upgrades requests to the listed hosts
+type upgradeHosts []string
+
+func (u upgradeHosts) Upgrade(host string) bool {
+	for _, h := range u {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWrapRequest(t *testing.T) {
+	h := &HTTPFrontend{forwardPolicy: DefaultForwardPolicy}
+	h.BindUpgrader(upgradeHosts{"example.com", "example.com:80", "example.com:8080"})
+
+	for _, c := range []struct {
+		url string
+		out string
+	}{
+		{"http://example.com/a?b", "https://example.com/a?b"},
+		{"http://example.com:80/a", "https://example.com/a"},
+		{"http://example.com:80", "https://example.com"},
+		{"http://example.com:8080/a", "https://example.com:8080/a"},
+		{"http://other.com:80/a", "http://other.com:80/a"},
+	} {
+		proxyReq, err := h.wrapRequest(httptest.NewRequest("GET", c.url, nil))
+		if assert.Nil(t, err, c.url) {
+			assert.Equal(t, c.out, proxyReq.URL.String(), c.url)
+		}
+	}
+}
+
+// staticProxy returns a fixed response
+type staticProxy struct {
+	resp *http.Response
+}
+
+func (p *staticProxy) HandleRequest(req *http.Request) (*http.Response, error) {
+	return p.resp, nil
+}
+
+func TestFlush(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		header  http.Header
+		length  int64
+		flushed bool
+	}{
+		{"buffered", http.Header{"Content-Type": {"text/html"}}, 4, false},
+		{"unknown length", http.Header{"Content-Type": {"application/json"}}, -1, true},
+		{"gRPC", http.Header{"Content-Type": {"application/grpc"}}, 4, true},
+		{"event stream", http.Header{"Content-Type": {"text/event-stream"}}, 4, true},
+	} {
+		h := &HTTPFrontend{forwardPolicy: DefaultForwardPolicy}
+		h.BindProxy(&staticProxy{&http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        c.header,
+			Body:          ioutil.NopCloser(strings.NewReader("body")),
+			ContentLength: c.length,
+		}})
+
+		w := httptest.NewRecorder()
+		h.handler(w, httptest.NewRequest("GET", "http://example.com/", nil))
+		assert.Equal(t, "body", w.Body.String(), c.name)
+		assert.Equal(t, c.flushed, w.Flushed, c.name)
+	}
+}
+
+func TestPreloadLinks(t *testing.T) {
+	header := http.Header{"Link": {
+		`</app.js>; rel=preload; as=script, </style.css>; rel="preload"`,
+		`</nopush.js>; rel=preload; nopush, <https://cdn.example.com/x.js>; rel=preload`,
+		`<//cdn.example.com/y.js>; rel=preload, </next>; rel=prefetch`,
+	}}
+
+	assert.Equal(t, []string{"/app.js", "/style.css"}, preloadLinks(header))
+}
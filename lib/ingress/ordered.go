@@ -0,0 +1,238 @@
+package ingress
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// headerOrderSetter is implemented by response writers that can preserve header order
+type headerOrderSetter interface {
+	SetHeaderOrder(order flow.HeaderOrder)
+}
+
+// serveOrdered serves HTTP/1.x requests on a connection, capturing the wire order and casing
+// of request headers and writing response headers in the order provided by the handler.
+// This is used in place of the http.Server when preserving headers, as that canonicalises
+// and sorts headers in both directions.
+func (h *HTTPFrontend) serveOrdered(conn net.Conn) {
+	defer conn.Close()
+
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TLS handshake error from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+	}
+
+	br := bufio.NewReaderSize(conn, 64*1024)
+
+	for {
+		order, err := flow.PeekHeaderOrder(br)
+		if err != nil {
+			return
+		}
+
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading request from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		req.RemoteAddr = conn.RemoteAddr().String()
+		req.TLS = tlsState
+		req = req.WithContext(flow.WithHeaderOrder(req.Context(), order))
+
+		w := newOrderedResponseWriter(conn, br, req)
+		h.ServeHTTP(w, req)
+		if w.hijacked {
+			return
+		}
+
+		if err := w.finish(); err != nil {
+			return
+		}
+
+		// Discard any unread request body before reading the next request
+		io.Copy(ioutil.Discard, req.Body)
+		req.Body.Close()
+
+		if w.closeAfter {
+			return
+		}
+	}
+}
+
+// orderedResponseWriter is an HTTP/1.x response writer that writes headers in a provided order
+type orderedResponseWriter struct {
+	conn net.Conn
+	br   *bufio.Reader
+	bw   *bufio.Writer
+	req  *http.Request
+
+	header http.Header
+	order  flow.HeaderOrder
+
+	wroteHeader bool
+	noBody      bool
+	body        io.Writer
+	chunked     io.WriteCloser
+
+	hijacked   bool
+	closeAfter bool
+}
+
+func newOrderedResponseWriter(conn net.Conn, br *bufio.Reader, req *http.Request) *orderedResponseWriter {
+	return &orderedResponseWriter{
+		conn:       conn,
+		br:         br,
+		bw:         bufio.NewWriter(conn),
+		req:        req,
+		header:     http.Header{},
+		closeAfter: req.Close,
+	}
+}
+
+// Header fetches the response header map
+func (w *orderedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// SetHeaderOrder sets the order in which response headers are written
+func (w *orderedResponseWriter) SetHeaderOrder(order flow.HeaderOrder) {
+	w.order = order
+}
+
+// WriteHeader writes the response head, selecting the body framing for the response
+func (w *orderedResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader || w.hijacked {
+		return
+	}
+	w.wroteHeader = true
+
+	header := cloneHeader(w.header)
+
+	// Select body framing
+	switch {
+	case code < 200 || code == http.StatusNoContent || code == http.StatusNotModified ||
+		w.req.Method == http.MethodHead:
+		w.noBody = true
+	case w.req.Method == http.MethodConnect && code < 300:
+		w.noBody = true
+	case header.Get("Content-Length") != "":
+		w.body = w.bw
+	case w.req.ProtoAtLeast(1, 1):
+		header.Set("Transfer-Encoding", "chunked")
+		w.chunked = httputil.NewChunkedWriter(w.bw)
+		w.body = w.chunked
+	default:
+		w.closeAfter = true
+		w.body = w.bw
+	}
+
+	if strings.EqualFold(header.Get("Connection"), "close") {
+		w.closeAfter = true
+	}
+
+	// Trailers are written after the body
+	for _, k := range header["Trailer"] {
+		header.Del(k)
+	}
+
+	fmt.Fprintf(w.bw, "HTTP/%d.%d %03d %s\r\n", w.req.ProtoMajor, w.req.ProtoMinor, code, http.StatusText(code))
+	w.order.Write(w.bw, header)
+	w.bw.WriteString("\r\n")
+}
+
+// Write writes response body data
+func (w *orderedResponseWriter) Write(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.noBody {
+		return 0, http.ErrBodyNotAllowed
+	}
+	return w.body.Write(p)
+}
+
+// Flush flushes buffered response data to the client
+func (w *orderedResponseWriter) Flush() {
+	if w.hijacked {
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.bw.Flush()
+}
+
+// Hijack takes over the underlying connection from the response writer
+func (w *orderedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	w.hijacked = true
+
+	if err := w.bw.Flush(); err != nil {
+		return nil, nil, err
+	}
+
+	return w.conn, bufio.NewReadWriter(w.br, bufio.NewWriter(w.conn)), nil
+}
+
+// finish completes the response, terminating the body and writing trailers where required
+func (w *orderedResponseWriter) finish() error {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.chunked != nil {
+		w.chunked.Close()
+
+		for _, k := range w.header["Trailer"] {
+			for _, v := range w.header[http.CanonicalHeaderKey(k)] {
+				fmt.Fprintf(w.bw, "%s: %s\r\n", k, v)
+			}
+		}
+		w.bw.WriteString("\r\n")
+	}
+
+	return w.bw.Flush()
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// serveOrderedListener accepts connections and serves them using serveOrdered
+func (h *HTTPFrontend) serveOrderedListener(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("Listener accept error: %s", err)
+			return
+		}
+		go h.serveOrdered(conn)
+	}
+}
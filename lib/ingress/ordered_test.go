@@ -0,0 +1,200 @@
+package ingress
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/core"
+)
+
+// rawExchange is a request and response as seen on the wire by the upstream server and the client
+type rawExchange struct {
+	upstreamHead string
+	upstreamReq  *http.Request
+	upstreamBody string
+
+	clientHead string
+	resp       *http.Response
+	body       string
+}
+
+// readHead reads a raw message head, returning this and a reader for the complete message
+func readHead(br *bufio.Reader) (string, *bufio.Reader, error) {
+	head := ""
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return head, nil, err
+		}
+		head += line
+		if line == "\r\n" {
+			return head, bufio.NewReader(io.MultiReader(strings.NewReader(head), br)), nil
+		}
+	}
+}
+
+// roundTrip sends a raw request (with the upstream address substituted for UPSTREAM) through a frontend
+// preserving headers, to an upstream server replying with a raw response
+func roundTrip(t *testing.T, request, response string) *rawExchange {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	x := &rawExchange{}
+	upstream := make(chan struct{})
+	go func() {
+		defer close(upstream)
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		head, r, err := readHead(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		x.upstreamHead = head
+		if x.upstreamReq, err = http.ReadRequest(r); err == nil {
+			body, _ := ioutil.ReadAll(x.upstreamReq.Body)
+			x.upstreamBody = string(body)
+		}
+		c.Write([]byte(response))
+	}()
+
+	h, _ := newTestFrontend(t, &core.RawBackend{}, func(h *HTTPFrontend) {
+		h.PreserveHeaders(true)
+	})
+
+	c, err := net.Dial("tcp", h.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c.Write([]byte(strings.Replace(request, "UPSTREAM", l.Addr().String(), -1)))
+
+	head, r, err := readHead(bufio.NewReader(c))
+	if err != nil {
+		t.Fatalf("error reading response: %s", err)
+	}
+	x.clientHead = head
+	if x.resp, err = http.ReadResponse(r, nil); err != nil {
+		t.Fatalf("error parsing response: %s", err)
+	}
+	body, err := ioutil.ReadAll(x.resp.Body)
+	assert.Nil(t, err)
+	x.body = string(body)
+
+	<-upstream
+	return x
+}
+
+func TestOrdered(t *testing.T) {
+
+	t.Run("Preserves header order and casing in both directions", func(t *testing.T) {
+		x := roundTrip(t,
+			"GET http://UPSTREAM/a HTTP/1.1\r\nhost: UPSTREAM\r\nx-Lower: 1\r\nAccept: */*\r\nCookie: a=1\r\nx-lower: 2\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nX-zeta: 1\r\nset-cookie: a=1\r\nContent-Length: 2\r\nSet-Cookie: b=2\r\nx-alpha: 2\r\n\r\nok")
+
+		assert.Contains(t, x.upstreamHead, "GET /a HTTP/1.1\r\nhost: "+x.upstreamReq.Host+"\r\nx-Lower: 1\r\nAccept: */*\r\nCookie: a=1\r\nx-lower: 2\r\n")
+		assert.Contains(t, x.clientHead, "X-zeta: 1\r\nset-cookie: a=1\r\nContent-Length: 2\r\nSet-Cookie: b=2\r\nx-alpha: 2\r\n")
+		assert.Equal(t, []string{"a=1", "b=2"}, x.resp.Header["Set-Cookie"])
+		assert.Equal(t, "ok", x.body)
+	})
+
+	t.Run("Does not add bodies to requests without them", func(t *testing.T) {
+		x := roundTrip(t,
+			"GET http://UPSTREAM/ HTTP/1.1\r\nHost: UPSTREAM\r\n\r\n",
+			"HTTP/1.1 204 No Content\r\n\r\n")
+
+		assert.NotContains(t, x.upstreamHead, "Content-Length")
+		assert.NotContains(t, x.upstreamHead, "Transfer-Encoding")
+		assert.Equal(t, 204, x.resp.StatusCode)
+		assert.Equal(t, "", x.body)
+	})
+
+	t.Run("Forwards chunked bodies", func(t *testing.T) {
+		x := roundTrip(t,
+			"POST http://UPSTREAM/ HTTP/1.1\r\nHost: UPSTREAM\r\nTransfer-Encoding: chunked\r\n\r\n3\r\none\r\n3\r\ntwo\r\n0\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nthree\r\n4\r\nfour\r\n0\r\n\r\n")
+
+		assert.Equal(t, "onetwo", x.upstreamBody)
+		assert.Contains(t, x.upstreamHead, "Content-Length: 6\r\n")
+		assert.Equal(t, "threefour", x.body)
+	})
+
+	t.Run("Forwards trailers", func(t *testing.T) {
+		x := roundTrip(t,
+			"POST http://UPSTREAM/ HTTP/1.1\r\nHost: UPSTREAM\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n3\r\none\r\n0\r\nX-Checksum: abc\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nTrailer: Grpc-Status\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\nGrpc-Status: 0\r\n\r\n")
+
+		assert.Equal(t, "one", x.upstreamBody)
+		assert.Equal(t, "abc", x.upstreamReq.Trailer.Get("X-Checksum"))
+		assert.Equal(t, "ok", x.body)
+		assert.Equal(t, "0", x.resp.Trailer.Get("Grpc-Status"))
+	})
+}
+
+func TestRawBackend(t *testing.T) {
+
+	t.Run("Times out waiting for responses", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		// The upstream server accepts connections but does not respond
+		go func() {
+			c, err := l.Accept()
+			if err == nil {
+				defer c.Close()
+				io.Copy(ioutil.Discard, c)
+			}
+		}()
+
+		b := &core.RawBackend{ResponseTimeout: 50 * time.Millisecond}
+		req, _ := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+
+		start := time.Now()
+		_, err = b.Request(nil, req)
+		assert.NotNil(t, err)
+		assert.True(t, time.Since(start) < time.Second)
+	})
+
+	t.Run("Times out TLS handshakes", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		go func() {
+			c, err := l.Accept()
+			if err == nil {
+				defer c.Close()
+				io.Copy(ioutil.Discard, c)
+			}
+		}()
+
+		b := &core.RawBackend{TLSTimeout: 50 * time.Millisecond}
+		req, _ := http.NewRequest("GET", "https://"+l.Addr().String()+"/", nil)
+
+		start := time.Now()
+		_, err = b.Request(nil, req)
+		assert.NotNil(t, err)
+		assert.True(t, time.Since(start) < time.Second)
+	})
+}
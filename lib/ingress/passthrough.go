@@ -0,0 +1,135 @@
+package ingress
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownPassthrough is returned when removing a passthrough host that does not exist
+var ErrUnknownPassthrough = errors.New("unknown passthrough host")
+
+// Passthrough holds host patterns for which TLS connections are tunnelled rather than bumped
+// This allows pinned or otherwise uninteresting hosts to function through the proxy.
+type Passthrough struct {
+	lock  sync.RWMutex
+	hosts []string
+}
+
+// Add adds a passthrough host pattern (see path.Match)
+func (p *Passthrough) Add(host string) error {
+	if _, err := path.Match(host, ""); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	host = strings.ToLower(host)
+	for _, h := range p.hosts {
+		if h == host {
+			return nil
+		}
+	}
+	p.hosts = append(p.hosts, host)
+
+	return nil
+}
+
+// Set replaces all passthrough host patterns, no patterns are changed if any are invalid
+func (p *Passthrough) Set(hosts []string) error {
+	patterns := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if _, err := path.Match(host, ""); err != nil {
+			return err
+		}
+		host = strings.ToLower(host)
+		found := false
+		for _, h := range patterns {
+			found = found || h == host
+		}
+		if !found {
+			patterns = append(patterns, host)
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.hosts = patterns
+
+	return nil
+}
+
+// Remove removes a passthrough host pattern
+func (p *Passthrough) Remove(host string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	host = strings.ToLower(host)
+	for i, h := range p.hosts {
+		if h == host {
+			p.hosts = append(p.hosts[:i], p.hosts[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrUnknownPassthrough
+}
+
+// Hosts fetches the current passthrough host patterns
+func (p *Passthrough) Hosts() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return append([]string{}, p.hosts...)
+}
+
+// Matches checks whether a host matches any passthrough pattern
+func (p *Passthrough) Matches(host string) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	host = strings.ToLower(host)
+	for _, h := range p.hosts {
+		if ok, _ := path.Match(h, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnel connects a CONNECT request directly to the upstream server without interception
+func (h *HTTPFrontend) tunnel(w http.ResponseWriter, r *http.Request, hj http.Hijacker) {
+	upstream, err := net.Dial("tcp", r.URL.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		log.Printf("CONNECT error dialing passthrough host: %s", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		upstream.Close()
+		log.Printf("CONNECT error hijacking connection: %s", err)
+		return
+	}
+
+	log.Printf("CONNECT passthrough to %s", r.URL.Host)
+
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.Close()
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		conn.Close()
+	}()
+}
@@ -13,9 +13,12 @@ import (
 	"log"
 	"math/big"
 	rnd "math/rand"
+	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,8 +27,28 @@ type BumpTLS struct {
 	outDir string
 	ca     *BumpCert
 	certs  map[string]*BumpCert
+
+	certsLock sync.Mutex
+
+	http2         bool
+	matchUpstream bool
+	alpn          map[string]alpnResult
+	alpnLock      sync.Mutex
+}
+
+// alpnResult is the protocol negotiated with an upstream server (empty where this failed)
+type alpnResult struct {
+	proto   string
+	expires time.Time
 }
 
+const (
+	// alpnTimeout is the time allowed to connect to upstream servers to check the negotiated protocol
+	alpnTimeout = 5 * time.Second
+	// alpnFailureTTL is the time for which failures to connect to upstream servers are cached
+	alpnFailureTTL = time.Minute
+)
+
 type BumpCert struct {
 	crt     *x509.Certificate
 	key     *rsa.PrivateKey
@@ -54,6 +77,7 @@ var ConfigTemplate = tls.Config{
 	PreferServerCipherSuites: true,
 	CipherSuites: []uint16{
 		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, // Required for HTTP/2 (RFC 7540 9.2.2)
 		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
 		tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
 		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
@@ -65,6 +89,7 @@ func NewBumpTLS(certFile, keyFile, outDir string) (*BumpTLS, error) {
 	b := BumpTLS{
 		outDir: outDir,
 		certs:  make(map[string]*BumpCert),
+		alpn:   make(map[string]alpnResult),
 	}
 
 	// Check if default exists
@@ -190,28 +215,85 @@ func (b *BumpTLS) loadCerts(dir string) error {
 			continue
 		}
 
+		b.certsLock.Lock()
 		b.certs[name] = cert
+		b.certsLock.Unlock()
 	}
 
 	return nil
 }
 
+// CertInfo describes a certificate in the bump certificate cache
+type CertInfo struct {
+	Name      string    `json:"name"`
+	Subject   string    `json:"subject"`
+	DNSNames  []string  `json:"dns_names"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Upstream  string    `json:"upstream_proto,omitempty"`
+}
+
+// Certificates lists the certificates in the bump certificate cache
+func (b *BumpTLS) Certificates() []CertInfo {
+	b.certsLock.Lock()
+	defer b.certsLock.Unlock()
+
+	// Protocols are recorded by upstream address, the first found for each host is reported
+	b.alpnLock.Lock()
+	protos := make(map[string]string)
+	for address, r := range b.alpn {
+		if host, _, err := net.SplitHostPort(address); err == nil && r.proto != "" && protos[host] == "" {
+			protos[host] = r.proto
+		}
+	}
+	b.alpnLock.Unlock()
+
+	info := make([]CertInfo, 0, len(b.certs))
+	for name, c := range b.certs {
+		info = append(info, CertInfo{
+			Name:      name,
+			Subject:   c.crt.Subject.CommonName,
+			DNSNames:  c.crt.DNSNames,
+			NotBefore: c.crt.NotBefore,
+			NotAfter:  c.crt.NotAfter,
+			Upstream:  protos[name],
+		})
+	}
+
+	sort.Slice(info, func(i, j int) bool { return info[i].Name < info[j].Name })
+
+	return info
+}
+
 // GetConfigForClient generates a configuration for the server the client is attempting to connect to
 func (b *BumpTLS) GetConfigForClient(info *tls.ClientHelloInfo) (*tls.Config, error) {
 	return b.GetConfigByName(info.ServerName)
 }
 
 // GetConfigByName generates a configuration for the server the client is attempting to connect to
+// The upstream server is assumed to be on the default HTTPS port, see GetConfigByAddress.
 func (b *BumpTLS) GetConfigByName(name string) (*tls.Config, error) {
+	return b.GetConfigByAddress(net.JoinHostPort(name, "443"))
+}
+
+// GetConfigByAddress generates a configuration for the server (host:port) the client is attempting to connect to
+func (b *BumpTLS) GetConfigByAddress(address string) (*tls.Config, error) {
+	name, port, err := net.SplitHostPort(address)
+	if err != nil {
+		name, port = address, "443"
+	}
+
 	cfg := ConfigTemplate.Clone()
-	var err error
 
 	serverName := strings.ToLower(name)
 
 	certFile, keyFile := fmt.Sprintf("%s/%s.crt", b.outDir, serverName), fmt.Sprintf("%s/%s.key", b.outDir, serverName)
 
 	// Load existing certificate if found
+	b.certsLock.Lock()
 	cert, ok := b.certs[serverName]
+	b.certsLock.Unlock()
+
 	if !ok {
 		log.Printf("BumpTLS.GetConfigByName generating certificate for server: %s", serverName)
 
@@ -230,7 +312,9 @@ func (b *BumpTLS) GetConfigByName(name string) (*tls.Config, error) {
 			return nil, err
 		}
 
+		b.certsLock.Lock()
 		b.certs[serverName] = cert
+		b.certsLock.Unlock()
 	}
 
 	tlsCert, err := tls.X509KeyPair(cert.crtData, cert.keyData)
@@ -240,10 +324,74 @@ func (b *BumpTLS) GetConfigByName(name string) (*tls.Config, error) {
 	}
 
 	cfg.Certificates = []tls.Certificate{tlsCert}
+	cfg.NextProtos = b.nextProtos(net.JoinHostPort(serverName, port))
 
 	return cfg, nil
 }
 
+// ConfigureHTTP2 enables HTTP/2 negotiation (via ALPN) with clients
+// If matchUpstream is set HTTP/2 is only offered where the upstream server also negotiates it
+func (b *BumpTLS) ConfigureHTTP2(enabled, matchUpstream bool) {
+	b.http2 = enabled
+	b.matchUpstream = matchUpstream
+}
+
+// nextProtos fetches the ALPN protocols to be offered to clients connecting to the server at the provided address
+func (b *BumpTLS) nextProtos(address string) []string {
+	if !b.http2 {
+		return []string{"http/1.1"}
+	}
+	if b.matchUpstream && b.upstreamProto(address) != "h2" {
+		return []string{"http/1.1"}
+	}
+	return []string{"h2", "http/1.1"}
+}
+
+// setUpstreamProto records the protocol negotiated with the upstream server at the provided address
+func (b *BumpTLS) setUpstreamProto(address, proto string) {
+	b.alpnLock.Lock()
+	defer b.alpnLock.Unlock()
+
+	b.alpn[address] = alpnResult{proto: proto}
+}
+
+// upstreamProto fetches the protocol negotiated with the upstream server at the provided address,
+// connecting to the server to find this if it is not already known. Failures to connect are cached
+// for alpnFailureTTL so unreachable servers do not delay each client connection.
+func (b *BumpTLS) upstreamProto(address string) string {
+	b.alpnLock.Lock()
+	result, ok := b.alpn[address]
+	b.alpnLock.Unlock()
+	if ok && (result.expires.IsZero() || time.Now().Before(result.expires)) {
+		return result.proto
+	}
+
+	name, _, err := net.SplitHostPort(address)
+	if err != nil {
+		name = address
+	}
+
+	// The certificate is not inspected here, only the ALPN result
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: alpnTimeout}, "tcp", address, &tls.Config{
+		ServerName:         name,
+		NextProtos:         []string{"h2", "http/1.1"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		log.Printf("BumpTLS.upstreamProto error: %s", err)
+		b.alpnLock.Lock()
+		b.alpn[address] = alpnResult{expires: time.Now().Add(alpnFailureTTL)}
+		b.alpnLock.Unlock()
+		return ""
+	}
+	defer conn.Close()
+
+	proto := conn.ConnectionState().NegotiatedProtocol
+	b.setUpstreamProto(address, proto)
+
+	return proto
+}
+
 // initServer creates a certificate for the requested
 func (b *BumpTLS) initServer(name string) (*BumpCert, error) {
 	template := certTemplate
@@ -256,6 +404,10 @@ func (b *BumpTLS) initServer(name string) (*BumpCert, error) {
 		return nil, err
 	}
 
+	if req.TLS != nil {
+		b.setUpstreamProto(net.JoinHostPort(strings.ToLower(name), "443"), req.TLS.NegotiatedProtocol)
+	}
+
 	if req.TLS != nil && len(req.TLS.PeerCertificates) > 1 {
 		peer := req.TLS.PeerCertificates[0]
 
@@ -0,0 +1,72 @@
+package ingress
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamProto(t *testing.T) {
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	h1 := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer h1.Close()
+
+	b, err := NewBumpTLS("", "", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Negotiates with upstream servers", func(t *testing.T) {
+		h2Addr := strings.TrimPrefix(h2.URL, "https://")
+		h1Addr := strings.TrimPrefix(h1.URL, "https://")
+
+		assert.Equal(t, "h2", b.upstreamProto(h2Addr))
+		assert.Equal(t, "http/1.1", b.upstreamProto(h1Addr))
+		assert.Equal(t, "h2", b.alpn[h2Addr].proto)
+	})
+
+	t.Run("Offers protocols to clients", func(t *testing.T) {
+		h2Addr := strings.TrimPrefix(h2.URL, "https://")
+		h1Addr := strings.TrimPrefix(h1.URL, "https://")
+
+		b.ConfigureHTTP2(false, false)
+		assert.Equal(t, []string{"http/1.1"}, b.nextProtos(h2Addr))
+
+		b.ConfigureHTTP2(true, false)
+		assert.Equal(t, []string{"h2", "http/1.1"}, b.nextProtos(h1Addr))
+
+		b.ConfigureHTTP2(true, true)
+		assert.Equal(t, []string{"h2", "http/1.1"}, b.nextProtos(h2Addr))
+		assert.Equal(t, []string{"http/1.1"}, b.nextProtos(h1Addr))
+	})
+
+	t.Run("Caches failures", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := l.Addr().String()
+		l.Close()
+
+		assert.Equal(t, "", b.upstreamProto(addr))
+		expires := b.alpn[addr].expires
+		assert.True(t, expires.After(time.Now()))
+
+		// Cached failures are not retried until these expire
+		assert.Equal(t, "", b.upstreamProto(addr))
+		assert.Equal(t, expires, b.alpn[addr].expires)
+
+		h2Addr := strings.TrimPrefix(h2.URL, "https://")
+		b.alpn[h2Addr] = alpnResult{expires: time.Now().Add(-time.Second)}
+		assert.Equal(t, "h2", b.upstreamProto(h2Addr))
+	})
+}
@@ -0,0 +1,377 @@
+package ingress
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryankurte/evilproxy/lib/plugins"
+)
+
+// WebSocketProxy interface optionally implemented by proxies to process websocket messages
+type WebSocketProxy interface {
+	ProcessWebSocket(ctx interface{}, msg *plugins.WebSocketMessage) []*plugins.WebSocketMessage
+}
+
+// WebSocket frame opcodes (RFC 6455 section 5.2)
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// wsMaxMessageSize limits the size of messages buffered by the proxy
+const wsMaxMessageSize = 32 * 1024 * 1024
+
+// wsMaxControlSize is the maximum payload length of control frames
+const wsMaxControlSize = 125
+
+// WebSocket close status codes (RFC 6455 section 7.4.1)
+const (
+	wsCloseProtocolError = 1002
+	wsCloseTooLarge      = 1009
+)
+
+// wsCloseTimeout is the time allowed for a peer to reply to a forwarded close frame,
+// after which both connections are closed
+var wsCloseTimeout = 5 * time.Second
+
+// isWebSocketUpgrade checks whether the provided headers request a websocket upgrade
+func isWebSocketUpgrade(header http.Header) bool {
+	return headerContainsToken(header, "Connection", "upgrade") &&
+		strings.EqualFold(header.Get("Upgrade"), "websocket")
+}
+
+// headerContainsToken checks whether a comma separated header contains the provided token
+func headerContainsToken(header http.Header, key, token string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(key)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsFrame is a single websocket frame
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// readFrame reads a websocket frame, removing any masking
+func readFrame(r io.Reader) (*wsFrame, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	f := wsFrame{
+		fin:    head[0]&0x80 != 0,
+		opcode: head[0] & 0x0f,
+	}
+	if head[0]&0x70 != 0 {
+		return nil, fmt.Errorf("websocket frame has unsupported reserved bits set (0x%x)", head[0]&0x70)
+	}
+
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	if length > wsMaxMessageSize {
+		return nil, fmt.Errorf("websocket frame length %d exceeds limit", length)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+
+	if masked {
+		for i := range f.payload {
+			f.payload[i] ^= mask[i%4]
+		}
+	}
+
+	return &f, nil
+}
+
+// closeFrame creates a close frame with the provided status code and reason
+func closeFrame(code uint16, reason string) *wsFrame {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	return &wsFrame{fin: true, opcode: wsOpClose, payload: append(payload, reason...)}
+}
+
+// writeFrame writes a websocket frame, masking it if required
+// (frames sent from client to server must be masked)
+func writeFrame(w io.Writer, f *wsFrame, masked bool) error {
+	buf := make([]byte, 0, len(f.payload)+14)
+
+	b0 := f.opcode
+	if f.fin {
+		b0 |= 0x80
+	}
+	buf = append(buf, b0)
+
+	var b1 byte
+	if masked {
+		b1 = 0x80
+	}
+
+	length := len(f.payload)
+	switch {
+	case length < 126:
+		buf = append(buf, b1|byte(length))
+	case length <= 0xffff:
+		buf = append(buf, b1|126, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(length))
+	default:
+		buf = append(buf, b1|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(length))
+	}
+
+	if !masked {
+		buf = append(buf, f.payload...)
+		_, err := w.Write(buf)
+		return err
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	buf = append(buf, mask[:]...)
+	for i, b := range f.payload {
+		buf = append(buf, b^mask[i%4])
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// wsPeer is one side of a relayed websocket connection
+type wsPeer struct {
+	r      io.Reader
+	w      io.Writer
+	c      io.Closer
+	masked bool
+	lock   sync.Mutex
+}
+
+func (p *wsPeer) write(f *wsFrame) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return writeFrame(p.w, f, p.masked)
+}
+
+// wsRelay relays websocket messages between a client and server, passing
+// complete data messages through the proxy for processing
+type wsRelay struct {
+	proxy  WebSocketProxy
+	ctx    interface{}
+	client *wsPeer
+	server *wsPeer
+}
+
+// peer fetches the peer a message in the provided direction is to be written to
+func (r *wsRelay) peer(d plugins.Direction) *wsPeer {
+	if d == plugins.ClientToServer {
+		return r.server
+	}
+	return r.client
+}
+
+// run relays messages until either side is closed
+// Where a close frame is forwarded, messages from the other side are relayed until it replies
+// with its own close frame (or wsCloseTimeout elapses) so the closing handshake completes.
+func (r *wsRelay) run() {
+	done := make(chan error, 2)
+
+	go func() { done <- r.pump(r.client, plugins.ClientToServer) }()
+	go func() { done <- r.pump(r.server, plugins.ServerToClient) }()
+
+	remaining := 1
+	err := <-done
+	if err == nil {
+		select {
+		case err = <-done:
+			remaining = 0
+		case <-time.After(wsCloseTimeout):
+			err = fmt.Errorf("timeout waiting for websocket close reply")
+		}
+	}
+	if err != nil && err != io.EOF {
+		log.Printf("WebSocket relay error: %s", err)
+	}
+
+	r.client.c.Close()
+	r.server.c.Close()
+	for ; remaining > 0; remaining-- {
+		<-done
+	}
+}
+
+// fail closes a peer with the provided status code after a protocol error
+func (r *wsRelay) fail(from *wsPeer, code uint16, format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	from.write(closeFrame(code, ""))
+	return err
+}
+
+// pump reads frames from a peer and forwards them in the provided direction
+// This returns nil once a close frame has been forwarded.
+func (r *wsRelay) pump(from *wsPeer, dir plugins.Direction) error {
+	var msg *plugins.WebSocketMessage
+
+	for {
+		f, err := readFrame(from.r)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case f.opcode >= wsOpClose:
+			// Control frames may be interleaved with fragments and are forwarded directly
+			if !f.fin || len(f.payload) > wsMaxControlSize {
+				return r.fail(from, wsCloseProtocolError, "invalid websocket control frame (opcode 0x%x)", f.opcode)
+			}
+			if err := r.peer(dir).write(f); err != nil {
+				return err
+			}
+			if f.opcode == wsOpClose {
+				return nil
+			}
+			continue
+
+		case (f.opcode == wsOpText || f.opcode == wsOpBinary) && msg != nil:
+			return r.fail(from, wsCloseProtocolError, "websocket data frame received within a fragmented message")
+
+		case f.opcode == wsOpText || f.opcode == wsOpBinary:
+			msg = &plugins.WebSocketMessage{Direction: dir, Type: int(f.opcode), Data: f.payload}
+
+		case f.opcode == wsOpContinuation && msg != nil:
+			if len(msg.Data)+len(f.payload) > wsMaxMessageSize {
+				return r.fail(from, wsCloseTooLarge, "websocket message exceeds size limit")
+			}
+			msg.Data = append(msg.Data, f.payload...)
+
+		default:
+			return r.fail(from, wsCloseProtocolError, "unexpected websocket opcode 0x%x", f.opcode)
+		}
+
+		if !f.fin {
+			continue
+		}
+
+		// Process complete messages and forward results
+		out := []*plugins.WebSocketMessage{msg}
+		if r.proxy != nil {
+			out = r.proxy.ProcessWebSocket(r.ctx, msg)
+		}
+		msg = nil
+
+		for _, m := range out {
+			// Plugins may only send data messages, other opcodes would corrupt the connection
+			if m.Type != wsOpText && m.Type != wsOpBinary {
+				log.Printf("Dropping websocket message with invalid type %d from plugin", m.Type)
+				continue
+			}
+			err := r.peer(m.Direction).write(&wsFrame{fin: true, opcode: byte(m.Type), payload: m.Data})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handleUpgrade completes a protocol switch with the client and relays the upgraded connection
+// Websocket connections are relayed frame by frame, other protocols are copied directly
+func (h *HTTPFrontend) handleUpgrade(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		http.Error(w, "Upgrade response body not writable", http.StatusBadGateway)
+		log.Printf("Upgrade error: response body is not writable")
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Upgrade webserver doesn't support hijacking", http.StatusInternalServerError)
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("Upgrade error hijacking connection: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	f := responseFlow(resp)
+
+	// Write the switching protocols response to the client
+	fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+	if f != nil {
+		f.ResponseHeaderOrder.Write(brw, resp.Header)
+	} else {
+		resp.Header.Write(brw)
+	}
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		log.Printf("Upgrade error writing response: %s", err)
+		return
+	}
+
+	if !isWebSocketUpgrade(resp.Header) {
+		go io.Copy(upstream, brw)
+		io.Copy(conn, upstream)
+		return
+	}
+
+	relay := wsRelay{
+		ctx:    f,
+		client: &wsPeer{r: brw.Reader, w: conn, c: conn},
+		server: &wsPeer{r: bufio.NewReader(upstream), w: upstream, c: upstream, masked: true},
+	}
+	if p, ok := h.Proxy.(WebSocketProxy); ok {
+		relay.proxy = p
+	}
+
+	relay.run()
+}
@@ -0,0 +1,258 @@
+package ingress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/plugins"
+)
+
+// wsUpper upper-cases text messages and echoes "echo" messages back to the sender
+// "invalid" messages are replaced with messages of invalid types, followed by a valid message.
+type wsUpper struct{}
+
+func (u *wsUpper) ProcessWebSocket(ctx interface{}, msg *plugins.WebSocketMessage) []*plugins.WebSocketMessage {
+	if string(msg.Data) == "invalid" {
+		out := []*plugins.WebSocketMessage{}
+		for _, typ := range []int{wsOpContinuation, wsOpClose, wsOpPing, 0x1f} {
+			out = append(out, &plugins.WebSocketMessage{Direction: msg.Direction, Type: typ, Data: []byte("x")})
+		}
+		return append(out, &plugins.WebSocketMessage{Direction: msg.Direction, Type: plugins.WebSocketText, Data: []byte("valid")})
+	}
+	if string(msg.Data) == "echo" {
+		reply := *msg
+		reply.Direction = plugins.ServerToClient
+		if msg.Direction == plugins.ServerToClient {
+			reply.Direction = plugins.ClientToServer
+		}
+		return []*plugins.WebSocketMessage{msg, &reply}
+	}
+	if msg.Type == plugins.WebSocketText {
+		msg.Data = bytes.ToUpper(msg.Data)
+	}
+	return []*plugins.WebSocketMessage{msg}
+}
+
+// newTestRelay creates a relay between in-memory connections, returning the client and server
+// ends and a channel closed once the relay exits
+func newTestRelay() (client, server net.Conn, done chan struct{}) {
+	client, relayClient := net.Pipe()
+	relayServer, server := net.Pipe()
+
+	r := wsRelay{
+		proxy:  &wsUpper{},
+		client: &wsPeer{r: relayClient, w: relayClient, c: relayClient},
+		server: &wsPeer{r: relayServer, w: relayServer, c: relayServer, masked: true},
+	}
+
+	done = make(chan struct{})
+	go func() {
+		r.run()
+		close(done)
+	}()
+
+	return client, server, done
+}
+
+func waitRelay(t *testing.T, done chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for relay to exit")
+	}
+}
+
+func TestWebSocketFrames(t *testing.T) {
+
+	t.Run("Encodes and parses frames", func(t *testing.T) {
+		for _, length := range []int{0, 125, 126, 0xffff, 0x10000} {
+			for _, masked := range []bool{false, true} {
+				payload := bytes.Repeat([]byte("a"), length)
+				buf := bytes.NewBuffer(nil)
+
+				err := writeFrame(buf, &wsFrame{fin: true, opcode: wsOpBinary, payload: payload}, masked)
+				assert.Nil(t, err)
+				assert.Equal(t, masked, buf.Bytes()[1]&0x80 != 0)
+
+				f, err := readFrame(buf)
+				assert.Nil(t, err)
+				assert.Equal(t, &wsFrame{fin: true, opcode: wsOpBinary, payload: payload}, f)
+				assert.Equal(t, 0, buf.Len())
+			}
+		}
+	})
+
+	t.Run("Unmasks frames", func(t *testing.T) {
+		mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+		// Masked "Hello" from RFC 6455 section 5.7
+		frame := append([]byte{0x81, 0x85}, mask...)
+		frame = append(frame, 0x7f, 0x9f, 0x4d, 0x51, 0x58)
+
+		f, err := readFrame(bytes.NewReader(frame))
+		assert.Nil(t, err)
+		assert.Equal(t, "Hello", string(f.payload))
+	})
+
+	t.Run("Masks frames with random keys", func(t *testing.T) {
+		a, b := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+		writeFrame(a, &wsFrame{fin: true, opcode: wsOpText, payload: []byte("Hello")}, true)
+		writeFrame(b, &wsFrame{fin: true, opcode: wsOpText, payload: []byte("Hello")}, true)
+
+		assert.NotContains(t, a.String(), "Hello")
+		assert.NotEqual(t, a.Bytes()[2:6], b.Bytes()[2:6])
+	})
+
+	t.Run("Parses fragment and opcode flags", func(t *testing.T) {
+		f, err := readFrame(bytes.NewReader([]byte{0x00, 0x01, 'a'}))
+		assert.Nil(t, err)
+		assert.Equal(t, &wsFrame{fin: false, opcode: wsOpContinuation, payload: []byte("a")}, f)
+	})
+
+	t.Run("Rejects invalid frames", func(t *testing.T) {
+		// Reserved bits (ie. compression) set
+		_, err := readFrame(bytes.NewReader([]byte{0xc1, 0x00}))
+		assert.NotNil(t, err)
+
+		// Length exceeding the message limit
+		frame := []byte{0x82, 0x7f, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(frame[2:], wsMaxMessageSize+1)
+		_, err = readFrame(bytes.NewReader(frame))
+		assert.NotNil(t, err)
+
+		// Truncated payload
+		_, err = readFrame(bytes.NewReader([]byte{0x81, 0x05, 'a'}))
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+	})
+}
+
+func TestWebSocketRelay(t *testing.T) {
+
+	t.Run("Reassembles fragmented messages with interleaved control frames", func(t *testing.T) {
+		client, server, done := newTestRelay()
+
+		go func() {
+			writeFrame(client, &wsFrame{fin: false, opcode: wsOpText, payload: []byte("hel")}, true)
+			writeFrame(client, &wsFrame{fin: true, opcode: wsOpPing, payload: []byte("ping")}, true)
+			writeFrame(client, &wsFrame{fin: true, opcode: wsOpContinuation, payload: []byte("lo")}, true)
+		}()
+
+		f, err := readFrame(server)
+		assert.Nil(t, err)
+		assert.Equal(t, &wsFrame{fin: true, opcode: wsOpPing, payload: []byte("ping")}, f)
+
+		f, err = readFrame(server)
+		assert.Nil(t, err)
+		assert.Equal(t, &wsFrame{fin: true, opcode: wsOpText, payload: []byte("HELLO")}, f)
+
+		client.Close()
+		waitRelay(t, done)
+	})
+
+	t.Run("Forwards injected messages in either direction", func(t *testing.T) {
+		client, server, done := newTestRelay()
+
+		go writeFrame(server, &wsFrame{fin: true, opcode: wsOpBinary, payload: []byte("echo")}, false)
+
+		f, err := readFrame(client)
+		assert.Nil(t, err)
+		assert.Equal(t, "echo", string(f.payload))
+
+		f, err = readFrame(server)
+		assert.Nil(t, err)
+		assert.Equal(t, &wsFrame{fin: true, opcode: wsOpBinary, payload: []byte("echo")}, f)
+
+		server.Close()
+		waitRelay(t, done)
+	})
+
+	t.Run("Drops messages of invalid types from plugins", func(t *testing.T) {
+		client, server, done := newTestRelay()
+
+		go writeFrame(client, &wsFrame{fin: true, opcode: wsOpText, payload: []byte("invalid")}, true)
+
+		f, err := readFrame(server)
+		assert.Nil(t, err)
+		assert.Equal(t, &wsFrame{fin: true, opcode: wsOpText, payload: []byte("valid")}, f)
+
+		client.Close()
+		waitRelay(t, done)
+	})
+
+	t.Run("Rejects data frames within fragmented messages", func(t *testing.T) {
+		client, server, done := newTestRelay()
+
+		go func() {
+			writeFrame(client, &wsFrame{fin: false, opcode: wsOpText, payload: []byte("one")}, true)
+			writeFrame(client, &wsFrame{fin: true, opcode: wsOpText, payload: []byte("two")}, true)
+		}()
+
+		f, err := readFrame(client)
+		assert.Nil(t, err)
+		assert.Equal(t, closeFrame(wsCloseProtocolError, ""), f)
+
+		// Neither message is forwarded and both connections are closed
+		_, err = readFrame(server)
+		assert.NotNil(t, err)
+		waitRelay(t, done)
+	})
+
+	t.Run("Rejects continuation frames without a message", func(t *testing.T) {
+		client, _, done := newTestRelay()
+
+		go writeFrame(client, &wsFrame{fin: true, opcode: wsOpContinuation, payload: []byte("a")}, true)
+
+		f, err := readFrame(client)
+		assert.Nil(t, err)
+		assert.Equal(t, closeFrame(wsCloseProtocolError, ""), f)
+		waitRelay(t, done)
+	})
+
+	t.Run("Completes the closing handshake", func(t *testing.T) {
+		client, server, done := newTestRelay()
+
+		go writeFrame(client, closeFrame(1000, "bye"), true)
+
+		f, err := readFrame(server)
+		assert.Nil(t, err)
+		assert.Equal(t, closeFrame(1000, "bye"), f)
+
+		// Messages sent before the server replies are still relayed, followed by the reply
+		go func() {
+			writeFrame(server, &wsFrame{fin: true, opcode: wsOpText, payload: []byte("late")}, false)
+			writeFrame(server, closeFrame(1000, ""), false)
+		}()
+
+		f, err = readFrame(client)
+		assert.Nil(t, err)
+		assert.Equal(t, "LATE", string(f.payload))
+
+		f, err = readFrame(client)
+		assert.Nil(t, err)
+		assert.Equal(t, closeFrame(1000, ""), f)
+
+		waitRelay(t, done)
+	})
+
+	t.Run("Closes connections where close frames are not answered", func(t *testing.T) {
+		timeout := wsCloseTimeout
+		wsCloseTimeout = 50 * time.Millisecond
+		defer func() { wsCloseTimeout = timeout }()
+
+		client, server, done := newTestRelay()
+
+		go writeFrame(server, closeFrame(1001, strings.Repeat("a", 10)), false)
+
+		f, err := readFrame(client)
+		assert.Nil(t, err)
+		assert.Equal(t, closeFrame(1001, strings.Repeat("a", 10)), f)
+
+		waitRelay(t, done)
+	})
+}
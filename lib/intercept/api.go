@@ -0,0 +1,117 @@
+package intercept
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ServeHTTP implements the interceptor control API
+//
+//	GET    /breakpoints               lists breakpoints
+//	POST   /breakpoints               adds a breakpoint (Breakpoint JSON)
+//	DELETE /breakpoints/{id}          removes a breakpoint
+//	GET    /paused                    lists paused flows
+//	GET    /paused/{id}               fetches a paused flow
+//	PUT    /paused/{id}               edits a paused flow (Edit JSON)
+//	POST   /paused/{id}/{forward|drop} forwards or drops a paused flow, applying any provided edit
+func (i *Interceptor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case parts[0] == "breakpoints" && len(parts) == 1:
+		i.handleBreakpoints(w, r)
+
+	case parts[0] == "breakpoints" && len(parts) == 2 && r.Method == http.MethodDelete:
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			http.Error(w, "invalid breakpoint ID", http.StatusBadRequest)
+			return
+		}
+		writeResult(w, nil, i.RemoveBreakpoint(id))
+
+	case parts[0] == "paused" && len(parts) == 1 && r.Method == http.MethodGet:
+		writeResult(w, i.Paused(), nil)
+
+	case parts[0] == "paused" && len(parts) >= 2:
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			http.Error(w, "invalid paused flow ID", http.StatusBadRequest)
+			return
+		}
+		i.handlePaused(w, r, id, parts[2:])
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (i *Interceptor) handleBreakpoints(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeResult(w, i.Breakpoints(), nil)
+
+	case http.MethodPost:
+		b := Breakpoint{}
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeResult(w, map[string]uint64{"id": i.AddBreakpoint(b)}, nil)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (i *Interceptor) handlePaused(w http.ResponseWriter, r *http.Request, id uint64, action []string) {
+	switch {
+	case len(action) == 0 && r.Method == http.MethodGet:
+		p, err := i.Get(id)
+		writeResult(w, p, err)
+
+	case len(action) == 0 && r.Method == http.MethodPut:
+		e := Edit{}
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeResult(w, nil, i.Edit(id, e))
+
+	case len(action) == 1 && r.Method == http.MethodPost:
+		// Edits may be provided with the action
+		if r.ContentLength != 0 {
+			e := Edit{}
+			if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := i.Edit(id, e); err != nil {
+				writeResult(w, nil, err)
+				return
+			}
+		}
+		writeResult(w, nil, i.Resume(id, Action(action[0])))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeResult writes a JSON result or error response
+func writeResult(w http.ResponseWriter, v interface{}, err error) {
+	if err == ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if v == nil {
+		v = map[string]string{"result": "ok"}
+	}
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,89 @@
+package intercept
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPI(t *testing.T) {
+	i := NewInterceptor(0, Drop)
+	srv := httptest.NewServer(i)
+	defer srv.Close()
+
+	call := func(method, path, body string, v interface{}) int {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if v != nil {
+			assert.Nil(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	t.Run("Adds and removes breakpoints", func(t *testing.T) {
+		created := map[string]uint64{}
+		assert.Equal(t, http.StatusOK, call("POST", "/breakpoints", `{"host":"*.example.com","request":true,"filter":"method == POST"}`, &created))
+
+		breakpoints := []Breakpoint{}
+		assert.Equal(t, http.StatusOK, call("GET", "/breakpoints", "", &breakpoints))
+		if assert.Len(t, breakpoints, 1) {
+			assert.Equal(t, created["id"], breakpoints[0].ID)
+			assert.Equal(t, "method == POST", breakpoints[0].Filter.String())
+		}
+
+		assert.Equal(t, http.StatusBadRequest, call("POST", "/breakpoints", `{"filter":"nope =="}`, nil))
+		assert.Equal(t, http.StatusOK, call("DELETE", fmt.Sprintf("/breakpoints/%d", created["id"]), "", nil))
+		assert.Equal(t, http.StatusNotFound, call("DELETE", fmt.Sprintf("/breakpoints/%d", created["id"]), "", nil))
+		assert.Empty(t, i.Breakpoints())
+	})
+
+	i.AddBreakpoint(Breakpoint{Request: true, Response: true})
+
+	t.Run("Edits and forwards paused flows", func(t *testing.T) {
+		done := interceptRequest(i, httptest.NewRequest("POST", "http://example.com/", strings.NewReader("body")), false)
+		id := waitPaused(t, i, 1)[0].ID
+
+		paused := []Paused{}
+		assert.Equal(t, http.StatusOK, call("GET", "/paused", "", &paused))
+		assert.Len(t, paused, 1)
+
+		assert.Equal(t, http.StatusOK, call("PUT", fmt.Sprintf("/paused/%d", id), `{"header":{"X-Edited":["1"]}}`, nil))
+		p := Paused{}
+		assert.Equal(t, http.StatusOK, call("GET", fmt.Sprintf("/paused/%d", id), "", &p))
+		assert.Equal(t, "1", p.Header.Get("X-Edited"))
+
+		// Edits may be provided with the action
+		assert.Equal(t, http.StatusOK, call("POST", fmt.Sprintf("/paused/%d/forward", id), `{"body":"edited"}`, nil))
+
+		r := waitResult(t, done)
+		assert.Nil(t, r.err)
+		assert.Equal(t, "edited", r.body)
+		assert.Equal(t, "1", r.req.Header.Get("X-Edited"))
+	})
+
+	t.Run("Drops paused flows", func(t *testing.T) {
+		done := interceptResponse(i, httptest.NewRequest("GET", "http://example.com/", nil), newTestResponse(200, "okay"), false)
+		id := waitPaused(t, i, 1)[0].ID
+
+		assert.Equal(t, http.StatusBadRequest, call("POST", fmt.Sprintf("/paused/%d/skip", id), "", nil))
+		assert.Equal(t, http.StatusOK, call("POST", fmt.Sprintf("/paused/%d/drop", id), "", nil))
+		assert.Equal(t, ErrDropped, waitResult(t, done).err)
+	})
+
+	t.Run("Rejects unknown and invalid flows", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, call("GET", "/paused/100", "", nil))
+		assert.Equal(t, http.StatusNotFound, call("POST", "/paused/100/forward", "", nil))
+		assert.Equal(t, http.StatusBadRequest, call("GET", "/paused/abc", "", nil))
+		assert.Equal(t, http.StatusBadRequest, call("PUT", "/paused/100", "{", nil))
+		assert.Equal(t, http.StatusNotFound, call("GET", "/unknown", "", nil))
+	})
+}
@@ -0,0 +1,503 @@
+/**
+ * Intercept package pauses flows matching breakpoints so they can be edited, forwarded or dropped
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package intercept
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryankurte/evilproxy/lib/filter"
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// Action is the action taken on a paused flow
+type Action string
+
+const (
+	// Forward continues a paused flow
+	Forward Action = "forward"
+	// Drop terminates a paused flow
+	Drop Action = "drop"
+)
+
+// Phase is the point in a flow at which it is paused
+type Phase string
+
+const (
+	// PhaseRequest pauses a flow before the request is sent upstream
+	PhaseRequest Phase = "request"
+	// PhaseResponse pauses a flow before the response is returned to the client
+	PhaseResponse Phase = "response"
+)
+
+// ErrDropped is returned when a paused flow is dropped
+var ErrDropped = errors.New("flow dropped by interceptor")
+
+// ErrNotFound is returned when a breakpoint or paused flow does not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrStreamed is returned when editing the body of a streamed request or response
+var ErrStreamed = errors.New("body of streamed flow cannot be edited")
+
+// Breakpoint matches flows to be paused
+// Host and Path are glob patterns (see path.Match), Filter is a filter expression
+// (see the filter package) evaluated against the flow so far, empty fields match everything
+type Breakpoint struct {
+	ID       uint64         `json:"id"`
+	Host     string         `json:"host,omitempty"`
+	Path     string         `json:"path,omitempty"`
+	Method   string         `json:"method,omitempty"`
+	Filter   *filter.Filter `json:"filter,omitempty"`
+	Request  bool           `json:"request"`
+	Response bool           `json:"response"`
+}
+
+// ParseBreakpoint parses a breakpoint from a comma separated list of key=value pairs
+// (ie. "host=*.example.com,path=/api/*,method=POST,phase=both")
+// A filter expression may be provided as the final field, this consumes the remainder of the string
+// (ie. "phase=response,filter=status >= 400 && type == application/json")
+func ParseBreakpoint(s string) (*Breakpoint, error) {
+	b := Breakpoint{Request: true}
+
+	pairs := strings.Split(s, ",")
+	for n, pair := range pairs {
+		if k := strings.TrimSpace(pair); strings.HasPrefix(k, "filter=") {
+			f, err := filter.Parse(strings.TrimPrefix(strings.Join(append([]string{k}, pairs[n+1:]...), ","), "filter="))
+			if err != nil {
+				return nil, err
+			}
+			b.Filter = f
+			break
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid breakpoint field: '%s'", pair)
+		}
+
+		switch k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]); k {
+		case "host":
+			b.Host = v
+		case "path":
+			b.Path = v
+		case "method":
+			b.Method = v
+		case "phase":
+			switch v {
+			case "request":
+				b.Request, b.Response = true, false
+			case "response":
+				b.Request, b.Response = false, true
+			case "both":
+				b.Request, b.Response = true, true
+			default:
+				return nil, fmt.Errorf("invalid breakpoint phase: '%s'", v)
+			}
+		default:
+			return nil, fmt.Errorf("unknown breakpoint field: '%s'", k)
+		}
+	}
+
+	return &b, nil
+}
+
+// Matches checks whether a breakpoint matches a request and the record of the flow so far
+func (b *Breakpoint) Matches(req *http.Request, r *flow.Record) bool {
+	if b.Method != "" && !strings.EqualFold(b.Method, req.Method) {
+		return false
+	}
+	if b.Host != "" {
+		if ok, _ := path.Match(strings.ToLower(b.Host), strings.ToLower(req.URL.Hostname())); !ok {
+			return false
+		}
+	}
+	if b.Path != "" {
+		if ok, _ := path.Match(b.Path, req.URL.Path); !ok {
+			return false
+		}
+	}
+	return b.Filter.Match(r)
+}
+
+// Paused is a paused request or response, this may be edited prior to forwarding
+// Streamed flows (ie. gRPC requests, and event stream, gRPC and upgrade responses) are paused
+// before the body is sent, so only the status and headers are available.
+type Paused struct {
+	ID     uint64      `json:"id"`
+	FlowID uint64      `json:"flow_id"`
+	Phase  Phase       `json:"phase"`
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+	Paused time.Time   `json:"paused"`
+
+	Streamed bool `json:"streamed,omitempty"`
+
+	action  chan Action
+	resumed bool
+}
+
+// Edit is an edit to a paused flow, nil / zero fields are not modified
+type Edit struct {
+	Method string      `json:"method,omitempty"`
+	URL    string      `json:"url,omitempty"`
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   *string     `json:"body,omitempty"`
+}
+
+// Interceptor pauses flows matching breakpoints until an operator forwards or drops them
+// Paused flows that are not acted on within the timeout have the default action applied.
+type Interceptor struct {
+	timeout       time.Duration
+	defaultAction Action
+
+	lock        sync.Mutex
+	breakpoints []*Breakpoint
+	paused      map[uint64]*Paused
+	lastID      uint64
+}
+
+// NewInterceptor creates an interceptor with the provided timeout (zero for none) and default action
+func NewInterceptor(timeout time.Duration, defaultAction Action) *Interceptor {
+	return &Interceptor{
+		timeout:       timeout,
+		defaultAction: defaultAction,
+		breakpoints:   make([]*Breakpoint, 0),
+		paused:        make(map[uint64]*Paused),
+	}
+}
+
+// AddBreakpoint adds a breakpoint, returning the breakpoint ID
+func (i *Interceptor) AddBreakpoint(b Breakpoint) uint64 {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.lastID++
+	b.ID = i.lastID
+	i.breakpoints = append(i.breakpoints, &b)
+
+	return b.ID
+}
+
+// RemoveBreakpoint removes a breakpoint by ID
+func (i *Interceptor) RemoveBreakpoint(id uint64) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	for n, b := range i.breakpoints {
+		if b.ID == id {
+			i.breakpoints = append(i.breakpoints[:n], i.breakpoints[n+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+// Breakpoints fetches a copy of the current breakpoints
+func (i *Interceptor) Breakpoints() []Breakpoint {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	breakpoints := make([]Breakpoint, len(i.breakpoints))
+	for n, b := range i.breakpoints {
+		breakpoints[n] = *b
+	}
+	return breakpoints
+}
+
+// Paused fetches a copy of the currently paused flows, excluding those that have been resumed
+func (i *Interceptor) Paused() []Paused {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	paused := make([]Paused, 0, len(i.paused))
+	for _, p := range i.paused {
+		if !p.resumed {
+			paused = append(paused, *p)
+		}
+	}
+	return paused
+}
+
+// Get fetches a copy of a paused flow by ID
+func (i *Interceptor) Get(id uint64) (*Paused, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	p, ok := i.paused[id]
+	if !ok || p.resumed {
+		return nil, ErrNotFound
+	}
+	c := *p
+	return &c, nil
+}
+
+// Edit modifies a paused flow, this remains paused until forwarded or dropped
+func (i *Interceptor) Edit(id uint64, e Edit) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	p, ok := i.paused[id]
+	if !ok || p.resumed {
+		return ErrNotFound
+	}
+	if e.Body != nil && p.Streamed {
+		return ErrStreamed
+	}
+
+	if e.Method != "" {
+		p.Method = e.Method
+	}
+	if e.URL != "" {
+		if _, err := url.Parse(e.URL); err != nil {
+			return err
+		}
+		p.URL = e.URL
+	}
+	if e.Status != 0 {
+		p.Status = e.Status
+	}
+	if e.Header != nil {
+		p.Header = e.Header
+	}
+	if e.Body != nil {
+		p.Body = *e.Body
+	}
+
+	return nil
+}
+
+// Resume forwards or drops a paused flow
+func (i *Interceptor) Resume(id uint64, a Action) error {
+	if a != Forward && a != Drop {
+		return fmt.Errorf("invalid action: '%s'", a)
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	p, ok := i.paused[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	// Only the first action on a paused flow is applied
+	if p.resumed {
+		return fmt.Errorf("flow %d has already been resumed", id)
+	}
+	p.resumed = true
+	p.action <- a
+
+	return nil
+}
+
+// match checks whether any breakpoint matches a request (and response) in the provided phase
+func (i *Interceptor) match(ctx interface{}, req *http.Request, resp *http.Response, phase Phase) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	var r *flow.Record
+	for _, b := range i.breakpoints {
+		if (phase == PhaseRequest && !b.Request) || (phase == PhaseResponse && !b.Response) {
+			continue
+		}
+		// Records are only built where required to evaluate filters
+		if b.Filter != nil && r == nil {
+			r = record(ctx, req, resp)
+		}
+		if b.Matches(req, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// record builds a record of the flow so far for evaluating breakpoint filters
+func record(ctx interface{}, req *http.Request, resp *http.Response) *flow.Record {
+	f := flow.Flow{Started: time.Now(), Request: req, Response: resp}
+	if c, ok := ctx.(*flow.Flow); ok {
+		f.ID, f.Started, f.Error = c.ID, c.Started, c.Error
+		f.RequestBody, f.ResponseBody = c.RequestBody, c.ResponseBody
+	}
+	f.Finished = time.Now()
+	return flow.NewRecord(&f)
+}
+
+// wait pauses a flow until it is acted on, times out, or the client goes away
+// This returns the (possibly edited) paused flow
+func (i *Interceptor) wait(req *http.Request, p *Paused) (*Paused, error) {
+	i.lock.Lock()
+	i.lastID++
+	p.ID = i.lastID
+	p.Paused = time.Now()
+	p.action = make(chan Action, 1)
+	i.paused[p.ID] = p
+	i.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if i.timeout > 0 {
+		t := time.NewTimer(i.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	var a Action
+	select {
+	case a = <-p.action:
+	case <-timeout:
+		a = i.defaultAction
+	case <-req.Context().Done():
+		a = Drop
+	}
+
+	i.lock.Lock()
+	delete(i.paused, p.ID)
+	c := *p
+	i.lock.Unlock()
+
+	if a == Drop {
+		return nil, ErrDropped
+	}
+	return &c, nil
+}
+
+// InterceptRequest pauses a request if it matches a breakpoint, applying any edits once forwarded
+// Streamed request bodies are not read, and are passed through unmodified once forwarded.
+func (i *Interceptor) InterceptRequest(ctx interface{}, req *http.Request, streamed bool) (*http.Request, error) {
+	if !i.match(ctx, req, nil, PhaseRequest) {
+		return req, nil
+	}
+
+	var body string
+	if !streamed {
+		var err error
+		if body, err = readBody(req.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	p, err := i.wait(req, &Paused{
+		FlowID:   flowID(ctx),
+		Phase:    PhaseRequest,
+		Method:   req.Method,
+		URL:      req.URL.String(),
+		Header:   cloneHeader(req.Header),
+		Body:     body,
+		Streamed: streamed,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Method = p.Method
+	if u.String() != req.URL.String() {
+		req.URL, req.Host = u, u.Host
+	}
+	req.Header = p.Header
+	if streamed {
+		return req, nil
+	}
+	req.Body = ioutil.NopCloser(strings.NewReader(p.Body))
+	req.ContentLength = int64(len(p.Body))
+	if f, ok := ctx.(*flow.Flow); ok {
+		f.RequestBody = p.Body
+	}
+
+	return req, nil
+}
+
+// InterceptResponse pauses a response if the request matches a breakpoint, applying any edits once forwarded
+// Streamed response bodies are not read, and are passed through unmodified once forwarded.
+func (i *Interceptor) InterceptResponse(ctx interface{}, req *http.Request, resp *http.Response, streamed bool) (*http.Response, error) {
+	if !i.match(ctx, req, resp, PhaseResponse) {
+		return resp, nil
+	}
+
+	var body string
+	if !streamed {
+		var err error
+		if body, err = readBody(resp.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	p, err := i.wait(req, &Paused{
+		FlowID:   flowID(ctx),
+		Phase:    PhaseResponse,
+		Method:   req.Method,
+		URL:      req.URL.String(),
+		Status:   resp.StatusCode,
+		Header:   cloneHeader(resp.Header),
+		Body:     body,
+		Streamed: streamed,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Status != resp.StatusCode {
+		resp.StatusCode = p.Status
+		resp.Status = fmt.Sprintf("%d %s", p.Status, http.StatusText(p.Status))
+	}
+	resp.Header = p.Header
+	if streamed {
+		return resp, nil
+	}
+	resp.Body = ioutil.NopCloser(strings.NewReader(p.Body))
+	resp.ContentLength = int64(len(p.Body))
+	if resp.Header.Get("Content-Length") != "" {
+		resp.Header.Set("Content-Length", strconv.Itoa(len(p.Body)))
+	}
+	if f, ok := ctx.(*flow.Flow); ok {
+		f.ResponseBody = p.Body
+	}
+
+	return resp, nil
+}
+
+func readBody(body io.ReadCloser) (string, error) {
+	if body == nil {
+		return "", nil
+	}
+	defer body.Close()
+
+	b, err := ioutil.ReadAll(body)
+	return string(b), err
+}
+
+func flowID(ctx interface{}) uint64 {
+	if f, ok := ctx.(*flow.Flow); ok {
+		return f.ID
+	}
+	return 0
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
@@ -0,0 +1,322 @@
+package intercept
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// waitPaused waits for the number of paused flows to reach n, returning these ordered by ID
+func waitPaused(t *testing.T, i *Interceptor, n int) []Paused {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if paused := i.Paused(); len(paused) == n {
+			if n == 2 && paused[0].ID > paused[1].ID {
+				paused[0], paused[1] = paused[1], paused[0]
+			}
+			return paused
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d paused flows", n)
+	return nil
+}
+
+// result is the outcome of an intercepted request or response
+type result struct {
+	req  *http.Request
+	resp *http.Response
+	body string
+	err  error
+}
+
+func interceptRequest(i *Interceptor, req *http.Request, streamed bool) chan result {
+	done := make(chan result, 1)
+	go func() {
+		req, err := i.InterceptRequest(flow.New(req), req, streamed)
+		r := result{req: req, err: err}
+		if err == nil {
+			b, _ := ioutil.ReadAll(req.Body)
+			r.body = string(b)
+		}
+		done <- r
+	}()
+	return done
+}
+
+func interceptResponse(i *Interceptor, req *http.Request, resp *http.Response, streamed bool) chan result {
+	done := make(chan result, 1)
+	go func() {
+		resp, err := i.InterceptResponse(flow.New(req), req, resp, streamed)
+		r := result{resp: resp, err: err}
+		if err == nil {
+			b, _ := ioutil.ReadAll(resp.Body)
+			r.body = string(b)
+		}
+		done <- r
+	}()
+	return done
+}
+
+func waitResult(t *testing.T, done chan result) result {
+	select {
+	case r := <-done:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for intercepted flow")
+	}
+	return result{}
+}
+
+func newTestResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode:    status,
+		Header:        http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"4"}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func TestBreakpoint(t *testing.T) {
+
+	t.Run("Parses breakpoints", func(t *testing.T) {
+		b, err := ParseBreakpoint("host=*.example.com, path=/api/*,method=POST,phase=both")
+		assert.Nil(t, err)
+		assert.Equal(t, &Breakpoint{Host: "*.example.com", Path: "/api/*", Method: "POST", Request: true, Response: true}, b)
+
+		b, err = ParseBreakpoint("phase=response,filter=status >= 400 || resp.body contains \"a,b\"")
+		assert.Nil(t, err)
+		assert.False(t, b.Request)
+		assert.True(t, b.Response)
+		assert.Equal(t, `status >= 400 || resp.body contains "a,b"`, b.Filter.String())
+
+		for _, s := range []string{"host", "phase=sometimes", "port=80", "filter=status >="} {
+			_, err := ParseBreakpoint(s)
+			assert.NotNil(t, err, s)
+		}
+	})
+
+	t.Run("Matches requests", func(t *testing.T) {
+		b, _ := ParseBreakpoint("host=*.example.com,path=/api/*,method=post")
+		req := httptest.NewRequest("POST", "http://API.example.com/api/login", nil)
+
+		assert.True(t, b.Matches(req, nil))
+		assert.False(t, b.Matches(httptest.NewRequest("GET", "http://api.example.com/api/login", nil), nil))
+		assert.False(t, b.Matches(httptest.NewRequest("POST", "http://example.com/api/login", nil), nil))
+		assert.False(t, b.Matches(httptest.NewRequest("POST", "http://api.example.com/static/app.js", nil), nil))
+	})
+
+	t.Run("Matches responses with filters", func(t *testing.T) {
+		i := NewInterceptor(0, Forward)
+		b, _ := ParseBreakpoint("phase=response,filter=status >= 400")
+		i.AddBreakpoint(*b)
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+
+		assert.False(t, i.match(nil, req, nil, PhaseRequest))
+		assert.False(t, i.match(nil, req, newTestResponse(200, "okay"), PhaseResponse))
+		assert.True(t, i.match(nil, req, newTestResponse(404, "gone"), PhaseResponse))
+	})
+}
+
+func TestInterceptor(t *testing.T) {
+
+	t.Run("Passes flows without matching breakpoints", func(t *testing.T) {
+		i := NewInterceptor(0, Forward)
+		i.AddBreakpoint(Breakpoint{Host: "other.com", Request: true, Response: true})
+
+		req := httptest.NewRequest("POST", "http://example.com/", strings.NewReader("body"))
+		r := waitResult(t, interceptRequest(i, req, false))
+		assert.Nil(t, r.err)
+		assert.Equal(t, "body", r.body)
+		assert.Empty(t, i.Paused())
+	})
+
+	t.Run("Applies edits to forwarded requests", func(t *testing.T) {
+		i := NewInterceptor(0, Drop)
+		i.AddBreakpoint(Breakpoint{Request: true})
+
+		done := interceptRequest(i, httptest.NewRequest("POST", "http://example.com/a", strings.NewReader("body")), false)
+		p := waitPaused(t, i, 1)[0]
+		assert.Equal(t, PhaseRequest, p.Phase)
+		assert.Equal(t, "http://example.com/a", p.URL)
+		assert.Equal(t, "body", p.Body)
+
+		edited := "edited"
+		assert.Nil(t, i.Edit(p.ID, Edit{Method: "PUT", URL: "http://other.com/b", Header: http.Header{"X-Edited": {"1"}}, Body: &edited}))
+		assert.Nil(t, i.Resume(p.ID, Forward))
+
+		r := waitResult(t, done)
+		assert.Nil(t, r.err)
+		assert.Equal(t, "PUT", r.req.Method)
+		assert.Equal(t, "other.com", r.req.Host)
+		assert.Equal(t, "/b", r.req.URL.Path)
+		assert.Equal(t, "1", r.req.Header.Get("X-Edited"))
+		assert.Equal(t, "edited", r.body)
+		assert.EqualValues(t, 6, r.req.ContentLength)
+
+		assert.Equal(t, ErrNotFound, i.Resume(p.ID, Forward))
+		assert.Equal(t, ErrNotFound, i.Edit(p.ID, Edit{}))
+	})
+
+	t.Run("Applies edits to forwarded responses", func(t *testing.T) {
+		i := NewInterceptor(0, Drop)
+		i.AddBreakpoint(Breakpoint{Response: true})
+
+		done := interceptResponse(i, httptest.NewRequest("GET", "http://example.com/", nil), newTestResponse(200, "okay"), false)
+		p := waitPaused(t, i, 1)[0]
+		assert.Equal(t, PhaseResponse, p.Phase)
+		assert.Equal(t, 200, p.Status)
+		assert.Equal(t, "okay", p.Body)
+
+		edited := "not found"
+		assert.Nil(t, i.Edit(p.ID, Edit{Status: 404, Body: &edited}))
+		assert.Nil(t, i.Resume(p.ID, Forward))
+
+		r := waitResult(t, done)
+		assert.Nil(t, r.err)
+		assert.Equal(t, 404, r.resp.StatusCode)
+		assert.Equal(t, "404 Not Found", r.resp.Status)
+		assert.Equal(t, "not found", r.body)
+		assert.Equal(t, "9", r.resp.Header.Get("Content-Length"))
+	})
+
+	t.Run("Passes streamed response bodies through", func(t *testing.T) {
+		i := NewInterceptor(0, Drop)
+		i.AddBreakpoint(Breakpoint{Response: true})
+
+		// The body is not complete, so reading this would block the flow from being paused
+		body, pw := io.Pipe()
+		resp := newTestResponse(200, "")
+		resp.Body = body
+
+		done := interceptResponse(i, httptest.NewRequest("GET", "http://example.com/events", nil), resp, true)
+		p := waitPaused(t, i, 1)[0]
+		assert.True(t, p.Streamed)
+		assert.Equal(t, "", p.Body)
+
+		edited := "edited"
+		assert.Equal(t, ErrStreamed, i.Edit(p.ID, Edit{Body: &edited}))
+		assert.Nil(t, i.Edit(p.ID, Edit{Header: http.Header{"X-Edited": {"1"}}}))
+		assert.Nil(t, i.Resume(p.ID, Forward))
+
+		pw.Write([]byte("data: 1\n\n"))
+		pw.Close()
+
+		r := waitResult(t, done)
+		assert.Nil(t, r.err)
+		assert.Equal(t, "1", r.resp.Header.Get("X-Edited"))
+		assert.Equal(t, "data: 1\n\n", r.body)
+	})
+
+	t.Run("Passes streamed request bodies through", func(t *testing.T) {
+		i := NewInterceptor(0, Drop)
+		i.AddBreakpoint(Breakpoint{Request: true})
+
+		body, pw := io.Pipe()
+		done := interceptRequest(i, httptest.NewRequest("POST", "http://example.com/grpc", body), true)
+		p := waitPaused(t, i, 1)[0]
+		assert.True(t, p.Streamed)
+		assert.Equal(t, "", p.Body)
+
+		edited := "edited"
+		assert.Equal(t, ErrStreamed, i.Edit(p.ID, Edit{Body: &edited}))
+		assert.Nil(t, i.Edit(p.ID, Edit{Header: http.Header{"X-Edited": {"1"}}}))
+		assert.Nil(t, i.Resume(p.ID, Forward))
+
+		pw.Write([]byte("message"))
+		pw.Close()
+
+		r := waitResult(t, done)
+		assert.Nil(t, r.err)
+		assert.Equal(t, "1", r.req.Header.Get("X-Edited"))
+		assert.Equal(t, "message", r.body)
+	})
+
+	t.Run("Pauses concurrent flows independently", func(t *testing.T) {
+		i := NewInterceptor(0, Drop)
+		i.AddBreakpoint(Breakpoint{Request: true})
+
+		first := interceptRequest(i, httptest.NewRequest("POST", "http://example.com/1", strings.NewReader("one")), false)
+		waitPaused(t, i, 1)
+		second := interceptRequest(i, httptest.NewRequest("POST", "http://example.com/2", strings.NewReader("two")), false)
+		paused := waitPaused(t, i, 2)
+
+		// Resuming the second flow does not affect the first
+		assert.Nil(t, i.Resume(paused[1].ID, Drop))
+		r := waitResult(t, second)
+		assert.Equal(t, ErrDropped, r.err)
+		assert.Equal(t, "http://example.com/1", waitPaused(t, i, 1)[0].URL)
+
+		assert.Nil(t, i.Resume(paused[0].ID, Forward))
+		r = waitResult(t, first)
+		assert.Nil(t, r.err)
+		assert.Equal(t, "one", r.body)
+	})
+
+	t.Run("Applies only the first action", func(t *testing.T) {
+		i := NewInterceptor(0, Drop)
+		i.AddBreakpoint(Breakpoint{Request: true})
+
+		done := interceptRequest(i, httptest.NewRequest("GET", "http://example.com/", nil), false)
+		p := waitPaused(t, i, 1)[0]
+
+		assert.NotNil(t, i.Resume(p.ID, Action("skip")))
+		assert.Nil(t, i.Resume(p.ID, Forward))
+		assert.NotNil(t, i.Resume(p.ID, Drop))
+
+		// Resumed flows are no longer listed or editable
+		assert.Empty(t, i.Paused())
+		assert.Equal(t, ErrNotFound, i.Edit(p.ID, Edit{}))
+
+		r := waitResult(t, done)
+		assert.Nil(t, r.err)
+	})
+
+	t.Run("Applies the default action on timeout", func(t *testing.T) {
+		for _, a := range []Action{Forward, Drop} {
+			i := NewInterceptor(20*time.Millisecond, a)
+			i.AddBreakpoint(Breakpoint{Request: true})
+
+			r := waitResult(t, interceptRequest(i, httptest.NewRequest("GET", "http://example.com/", nil), false))
+			if a == Forward {
+				assert.Nil(t, r.err)
+			} else {
+				assert.Equal(t, ErrDropped, r.err)
+			}
+			assert.Empty(t, i.Paused())
+		}
+	})
+
+	t.Run("Drops flows when the client goes away", func(t *testing.T) {
+		i := NewInterceptor(0, Forward)
+		i.AddBreakpoint(Breakpoint{Request: true})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := interceptRequest(i, httptest.NewRequest("GET", "http://example.com/", nil).WithContext(ctx), false)
+		waitPaused(t, i, 1)
+		cancel()
+
+		r := waitResult(t, done)
+		assert.Equal(t, ErrDropped, r.err)
+		assert.Empty(t, i.Paused())
+	})
+
+	t.Run("Manages breakpoints", func(t *testing.T) {
+		i := NewInterceptor(0, Forward)
+		a := i.AddBreakpoint(Breakpoint{Host: "a.com", Request: true})
+		b := i.AddBreakpoint(Breakpoint{Host: "b.com", Request: true})
+
+		assert.Nil(t, i.RemoveBreakpoint(a))
+		assert.Equal(t, ErrNotFound, i.RemoveBreakpoint(a))
+		assert.Equal(t, []Breakpoint{{ID: b, Host: "b.com", Request: true}}, i.Breakpoints())
+	})
+}
@@ -1,14 +1,31 @@
 package plugins
 
 import (
+	"fmt"
+
 	"github.com/sirupsen/logrus"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
 )
 
 // Plugin base. Plugin implementations should contain this for logging.
 type base struct {
 	logrus.FieldLogger
+	name string
 }
 
 func newBase(name string) base {
-	return base{logrus.New().WithField("module", name)}
+	return base{logrus.StandardLogger().WithField("module", name), name}
+}
+
+// Name fetches the plugin name, used to identify the plugin at runtime
+func (b base) Name() string {
+	return b.name
+}
+
+// annotate attaches a note to the flow being processed, this is retained with captured flows
+func (b base) annotate(ctx interface{}, format string, args ...interface{}) {
+	if f, ok := ctx.(*flow.Flow); ok {
+		f.Annotate(b.name, fmt.Sprintf(format, args...))
+	}
 }
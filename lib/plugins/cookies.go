@@ -0,0 +1,395 @@
+/**
+ * Cookies plugin manipulates cookie security attributes and logs cookie jars
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package plugins
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// Cookie attribute actions
+const (
+	CookieAdd   = "add"
+	CookieStrip = "strip"
+	// CookieSession removes expiry attributes so cookies are discarded with the session
+	CookieSession = "session"
+)
+
+// CookieRule modifies the attributes of cookies with matching names set by matching hosts
+// Empty patterns match all cookies and hosts, and empty actions leave attributes unchanged.
+type CookieRule struct {
+	// Names are cookie name patterns (see path.Match)
+	Names []string `json:"names,omitempty"`
+	// Hosts are request host patterns (see path.Match)
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Secure and HTTPOnly flags are added or stripped
+	Secure   string `json:"secure,omitempty"`
+	HTTPOnly string `json:"httponly,omitempty"`
+	// SameSite is stripped or set to none, lax or strict
+	// Note that clients reject SameSite=None cookies without the Secure flag.
+	SameSite string `json:"samesite,omitempty"`
+	// Domain and Path are stripped or set to the provided value
+	Domain string `json:"domain,omitempty"`
+	Path   string `json:"path,omitempty"`
+	// Expires is session to remove expiry, or a duration after which cookies expire
+	Expires string `json:"expires,omitempty"`
+}
+
+// ParseCookieRule parses a cookie rule from a comma separated list of key=value pairs, with multiple
+// patterns separated by '|' (ie. "name=session*|id,host=*.example.com,secure=strip,expires=24h")
+func ParseCookieRule(s string) (*CookieRule, error) {
+	rule := CookieRule{}
+
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid cookie rule field: '%s'", pair)
+		}
+
+		v := strings.TrimSpace(kv[1])
+		switch k := strings.TrimSpace(kv[0]); k {
+		case "name":
+			rule.Names = append(rule.Names, strings.Split(v, "|")...)
+		case "host":
+			rule.Hosts = append(rule.Hosts, strings.Split(v, "|")...)
+		case "secure":
+			rule.Secure = v
+		case "httponly":
+			rule.HTTPOnly = v
+		case "samesite":
+			rule.SameSite = v
+		case "domain":
+			rule.Domain = v
+		case "path":
+			rule.Path = v
+		case "expires":
+			rule.Expires = v
+		default:
+			return nil, fmt.Errorf("unknown cookie rule field: '%s'", k)
+		}
+	}
+
+	if err := rule.Validate(); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// Validate checks rule patterns and actions are well formed
+func (r *CookieRule) Validate() error {
+	for _, patterns := range [][]string{r.Names, r.Hosts} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid cookie rule pattern '%s': %s", p, err)
+			}
+		}
+	}
+	for _, v := range []string{r.Secure, r.HTTPOnly} {
+		if v != "" && v != CookieAdd && v != CookieStrip {
+			return fmt.Errorf("invalid cookie flag action '%s' (expected add or strip)", v)
+		}
+	}
+	switch strings.ToLower(r.SameSite) {
+	case "", CookieStrip, "none", "lax", "strict":
+	default:
+		return fmt.Errorf("invalid cookie samesite action '%s' (expected strip, none, lax or strict)", r.SameSite)
+	}
+	if r.Expires != "" && r.Expires != CookieSession {
+		if _, err := time.ParseDuration(r.Expires); err != nil {
+			return fmt.Errorf("invalid cookie expiry '%s' (expected session or a duration)", r.Expires)
+		}
+	}
+	return nil
+}
+
+// sameSiteValues are the canonical forms of SameSite values
+var sameSiteValues = map[string]string{"none": "None", "lax": "Lax", "strict": "Strict"}
+
+// matches checks whether a rule applies to a cookie set by a host
+func (r *CookieRule) matches(name, host string) bool {
+	return (len(r.Names) == 0 || matchAny(r.Names, name)) && (len(r.Hosts) == 0 || matchAny(r.Hosts, host))
+}
+
+// apply applies rule actions to a cookie
+func (r *CookieRule) apply(c *setCookie) {
+	for _, f := range []struct{ action, key string }{{r.Secure, "Secure"}, {r.HTTPOnly, "HttpOnly"}} {
+		switch f.action {
+		case CookieAdd:
+			c.set(f.key, "", false)
+		case CookieStrip:
+			c.del(f.key)
+		}
+	}
+
+	switch s := strings.ToLower(r.SameSite); s {
+	case "":
+	case CookieStrip:
+		c.del("SameSite")
+	default:
+		c.set("SameSite", sameSiteValues[s], true)
+	}
+
+	for _, a := range []struct{ action, key string }{{r.Domain, "Domain"}, {r.Path, "Path"}} {
+		switch a.action {
+		case "":
+		case CookieStrip:
+			c.del(a.key)
+		default:
+			c.set(a.key, a.action, true)
+		}
+	}
+
+	switch r.Expires {
+	case "":
+	case CookieSession:
+		c.del("Expires", "Max-Age")
+	default:
+		d, _ := time.ParseDuration(r.Expires)
+		c.set("Expires", time.Now().Add(d).UTC().Format(http.TimeFormat), true)
+		c.set("Max-Age", strconv.Itoa(int(d/time.Second)), true)
+	}
+}
+
+// Cookie jars are bounded, as hosts and cookie names are set by upstream servers
+const (
+	cookieMaxHosts   = 10000
+	cookieMaxPerHost = 1000
+)
+
+// Cookies plugin rewrites the security attributes of cookies set in responses using a list of rules,
+// and optionally logs the cookie jar for each host as cookies are set (jars are only kept where logging
+// is enabled). Set-Cookie headers are parsed so attributes not modified by a rule (and their order)
+// are retained.
+type Cookies struct {
+	base
+	rules []CookieRule
+	log   bool
+
+	lock sync.Mutex
+	jars map[string]map[string]string
+}
+
+// NewCookies creates a new instance of the cookies plugin
+func NewCookies(rules []CookieRule, log bool) *Cookies {
+	return &Cookies{
+		base:  newBase("cookies"),
+		rules: rules,
+		log:   log,
+		jars:  make(map[string]map[string]string),
+	}
+}
+
+// Jar fetches a copy of the cookies set by a host, this is empty where logging is not enabled
+func (c *Cookies) Jar(host string) map[string]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	jar := make(map[string]string, len(c.jars[host]))
+	for k, v := range c.jars[host] {
+		jar[k] = v
+	}
+	return jar
+}
+
+// ProcessResponse applies cookie rules to each Set-Cookie header, and records cookies in the host jar
+func (c *Cookies) ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	values := header["Set-Cookie"]
+	if len(values) == 0 {
+		return header, body
+	}
+
+	host := ""
+	if f, ok := ctx.(*flow.Flow); ok && f.Request != nil {
+		host = strings.ToLower(f.Request.URL.Hostname())
+	}
+
+	for i, v := range values {
+		cookie, ok := parseSetCookie(v)
+		if !ok {
+			continue
+		}
+
+		modified := false
+		for _, r := range c.rules {
+			if r.matches(cookie.name, host) {
+				r.apply(cookie)
+				modified = true
+			}
+		}
+		if modified {
+			values[i] = cookie.String()
+			if values[i] != v {
+				c.annotate(ctx, "rewrote cookie %s: %s", cookie.name, values[i])
+			}
+		}
+
+		if c.log {
+			c.record(host, cookie)
+		}
+	}
+
+	return header, body
+}
+
+// record updates the host jar with a cookie and logs the jar
+func (c *Cookies) record(host string, cookie *setCookie) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	jar, ok := c.jars[host]
+	if !ok {
+		// Evict an arbitrary host where full
+		if len(c.jars) >= cookieMaxHosts {
+			for k := range c.jars {
+				delete(c.jars, k)
+				break
+			}
+		}
+		jar = make(map[string]string)
+		c.jars[host] = jar
+	}
+
+	if cookie.expired() {
+		delete(jar, cookie.name)
+	} else {
+		// Evict an arbitrary cookie where full
+		if _, ok := jar[cookie.name]; !ok && len(jar) >= cookieMaxPerHost {
+			for k := range jar {
+				delete(jar, k)
+				break
+			}
+		}
+		jar[cookie.name] = cookie.value
+	}
+
+	names := make([]string, 0, len(jar))
+	for n := range jar {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = n + "=" + jar[n]
+	}
+	c.WithField("host", host).WithField("set", cookie.String()).Printf("cookie jar: %s", strings.Join(pairs, "; "))
+}
+
+// cookieTimeFormat is the (Netscape) expiry format commonly used in cookies, in addition to HTTP dates
+const cookieTimeFormat = "Mon, 02-Jan-2006 15:04:05 MST"
+
+// setCookie is a parsed Set-Cookie header value (RFC 6265 section 5.2)
+// Attributes are retained in order, including those that are unknown or repeated.
+type setCookie struct {
+	name, value string
+	attrs       []cookieAttr
+}
+
+type cookieAttr struct {
+	key, value string
+	hasValue   bool
+}
+
+// parseSetCookie parses a Set-Cookie header value, returning false where this should be ignored
+func parseSetCookie(s string) (*setCookie, bool) {
+	parts := strings.Split(s, ";")
+
+	nv := strings.SplitN(parts[0], "=", 2)
+	if len(nv) != 2 || strings.TrimSpace(nv[0]) == "" {
+		return nil, false
+	}
+	c := setCookie{name: strings.TrimSpace(nv[0]), value: strings.TrimSpace(nv[1])}
+
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		a := cookieAttr{key: strings.TrimSpace(kv[0])}
+		if a.key == "" {
+			continue
+		}
+		if len(kv) == 2 {
+			a.value, a.hasValue = strings.TrimSpace(kv[1]), true
+		}
+		c.attrs = append(c.attrs, a)
+	}
+
+	return &c, true
+}
+
+// get fetches the value of the last instance of an attribute, which takes precedence
+func (c *setCookie) get(key string) (string, bool) {
+	for i := len(c.attrs) - 1; i >= 0; i-- {
+		if strings.EqualFold(c.attrs[i].key, key) {
+			return c.attrs[i].value, true
+		}
+	}
+	return "", false
+}
+
+// del removes all instances of the provided attributes, returning whether any were removed
+func (c *setCookie) del(keys ...string) bool {
+	attrs := c.attrs[:0]
+	for _, a := range c.attrs {
+		if !containsFold(keys, a.key) {
+			attrs = append(attrs, a)
+		}
+	}
+	removed := len(attrs) != len(c.attrs)
+	c.attrs = attrs
+	return removed
+}
+
+// set replaces an attribute in place (removing repeats) or appends it where not present
+func (c *setCookie) set(key, value string, hasValue bool) {
+	for i, a := range c.attrs {
+		if strings.EqualFold(a.key, key) {
+			c.attrs[i] = cookieAttr{key: a.key, value: value, hasValue: hasValue}
+			rest := &setCookie{attrs: append([]cookieAttr(nil), c.attrs[i+1:]...)}
+			rest.del(key)
+			c.attrs = append(c.attrs[:i+1], rest.attrs...)
+			return
+		}
+	}
+	c.attrs = append(c.attrs, cookieAttr{key: key, value: value, hasValue: hasValue})
+}
+
+// expired checks whether a cookie is removed by the client
+func (c *setCookie) expired() bool {
+	if v, ok := c.get("Max-Age"); ok {
+		n, err := strconv.Atoi(v)
+		return err == nil && n <= 0
+	}
+	if v, ok := c.get("Expires"); ok {
+		t, err := http.ParseTime(v)
+		if err != nil {
+			t, err = time.Parse(cookieTimeFormat, v)
+		}
+		return err == nil && t.Before(time.Now())
+	}
+	return false
+}
+
+// String formats a cookie as a Set-Cookie header value
+func (c *setCookie) String() string {
+	parts := make([]string, 0, len(c.attrs)+1)
+	parts = append(parts, c.name+"="+c.value)
+	for _, a := range c.attrs {
+		if a.hasValue {
+			parts = append(parts, a.key+"="+a.value)
+		} else {
+			parts = append(parts, a.key)
+		}
+	}
+	return strings.Join(parts, "; ")
+}
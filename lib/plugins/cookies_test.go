@@ -0,0 +1,99 @@
+package plugins
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+func TestCookies(t *testing.T) {
+	t.Run("Parses rules", func(t *testing.T) {
+		r, err := ParseCookieRule("name=session*|id,host=*.example.com,secure=strip,samesite=None,expires=session")
+		assert.Nil(t, err)
+		assert.Equal(t, CookieRule{
+			Names: []string{"session*", "id"}, Hosts: []string{"*.example.com"},
+			Secure: CookieStrip, SameSite: "None", Expires: CookieSession,
+		}, *r)
+
+		for _, spec := range []string{"secure=remove", "samesite=sometimes", "expires=tomorrow", "name=[", "flavour=oat"} {
+			_, err := ParseCookieRule(spec)
+			assert.NotNil(t, err, spec)
+		}
+	})
+
+	t.Run("Parses and formats set-cookie values", func(t *testing.T) {
+		c, ok := parseSetCookie(" sid = a=b ;Path=/; secure;;HttpOnly ; Priority=High")
+		assert.True(t, ok)
+		assert.Equal(t, "sid", c.name)
+		assert.Equal(t, "a=b", c.value)
+		assert.Equal(t, "sid=a=b; Path=/; secure; HttpOnly; Priority=High", c.String())
+
+		c.set("Path", "/app", true)
+		c.set("SameSite", "Lax", true)
+		assert.True(t, c.del("SECURE"))
+		assert.Equal(t, "sid=a=b; Path=/app; HttpOnly; Priority=High; SameSite=Lax", c.String())
+
+		_, ok = parseSetCookie("noequals; Path=/")
+		assert.False(t, ok)
+	})
+
+	t.Run("Applies rules to matching cookies", func(t *testing.T) {
+		c := NewCookies([]CookieRule{
+			{Names: []string{"sess*"}, Secure: CookieStrip, HTTPOnly: CookieStrip, SameSite: "none", Domain: CookieStrip},
+			{Hosts: []string{"*.example.com"}, Path: "/", Expires: CookieSession},
+		}, false)
+
+		header := http.Header{"Set-Cookie": {
+			"session=1; Domain=example.com; Path=/app; Secure; HttpOnly; SameSite=Strict; Max-Age=3600",
+			"pref=dark; Expires=Wed, 21 Oct 2099 07:28:00 GMT",
+			"broken",
+		}}
+		f := flow.New(httptest.NewRequest("GET", "https://www.example.com/", nil))
+		header, _ = c.ProcessResponse(f, header, "")
+
+		assert.Equal(t, []string{"session=1; Path=/; SameSite=None", "pref=dark; Path=/", "broken"}, header["Set-Cookie"])
+		assert.Empty(t, c.Jar("www.example.com"))
+
+		f = flow.New(httptest.NewRequest("GET", "https://other.test/", nil))
+		header, _ = c.ProcessResponse(f, http.Header{"Set-Cookie": {"id=2; Max-Age=60; Secure"}}, "")
+		assert.Equal(t, []string{"id=2; Max-Age=60; Secure"}, header["Set-Cookie"])
+	})
+
+	t.Run("Removes expired cookies from jars", func(t *testing.T) {
+		c := NewCookies(nil, true)
+		f := flow.New(httptest.NewRequest("GET", "https://example.com/", nil))
+
+		c.ProcessResponse(f, http.Header{"Set-Cookie": {"a=1", "b=2"}}, "")
+		c.ProcessResponse(f, http.Header{"Set-Cookie": {"a=; Max-Age=0", "b=; Expires=Thu, 01-Jan-1970 00:00:00 GMT"}}, "")
+		assert.Empty(t, c.Jar("example.com"))
+	})
+
+	t.Run("Records bounded jars where logging is enabled", func(t *testing.T) {
+		c := NewCookies(nil, true)
+		f := flow.New(httptest.NewRequest("GET", "https://www.example.com/", nil))
+		c.ProcessResponse(f, http.Header{"Set-Cookie": {"session=1; Secure", "pref=dark"}}, "")
+		assert.Equal(t, map[string]string{"session": "1", "pref": "dark"}, c.Jar("www.example.com"))
+
+		// Jars are logged as each cookie is recorded
+		logger := logrus.New()
+		logger.Out = ioutil.Discard
+		c.FieldLogger = logger
+
+		for i := 0; i < cookieMaxPerHost+10; i++ {
+			c.record("www.example.com", &setCookie{name: strconv.Itoa(i), value: "1"})
+		}
+		assert.Len(t, c.Jar("www.example.com"), cookieMaxPerHost)
+
+		for i := 0; i < cookieMaxHosts+10; i++ {
+			c.record(strconv.Itoa(i)+".example.com", &setCookie{name: "a", value: "1"})
+		}
+		assert.Len(t, c.jars, cookieMaxHosts)
+	})
+}
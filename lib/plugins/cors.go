@@ -8,37 +8,238 @@ package plugins
 
 import (
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
 )
 
 const (
-	corsHeaderKey = "Access-Control-Allow-Origin"
+	corsHeaderKey        = "Access-Control-Allow-Origin"
+	corsCredentialsKey   = "Access-Control-Allow-Credentials"
+	corsMethodsKey       = "Access-Control-Allow-Methods"
+	corsHeadersKey       = "Access-Control-Allow-Headers"
+	corsExposeKey        = "Access-Control-Expose-Headers"
+	corsMaxAgeKey        = "Access-Control-Max-Age"
+	corsPrivateKey       = "Access-Control-Allow-Private-Network"
+	corsRequestMethodKey = "Access-Control-Request-Method"
+	corsRequestHeaderKey = "Access-Control-Request-Headers"
+	corsRequestPrivate   = "Access-Control-Request-Private-Network"
 )
 
+// CORSReflect allows the origin of each request
+const CORSReflect = "reflect"
+
+// CORSOptions configures the CORS plugin
+type CORSOptions struct {
+	// Origin allowed in responses, CORSReflect to allow the request origin, "*" or a specific origin
+	// An empty origin strips CORS headers from responses. Where credentials are allowed "*" is
+	// reflected, as clients reject wildcards for credentialed requests.
+	Origin string
+	// Credentials allows credentialed (ie. cookie bearing) requests
+	Credentials bool
+	// Methods and Headers allowed in preflight responses, where empty those requested are allowed
+	Methods []string
+	Headers []string
+	// Expose headers to scripts, where empty all response headers are exposed
+	Expose []string
+	// MaxAge for which preflight responses are cached by clients (0 to omit)
+	MaxAge time.Duration
+	// Preflight answers preflight requests directly rather than forwarding them upstream
+	Preflight bool
+}
+
+// DefaultCORSOptions allows all cross origin requests
+var DefaultCORSOptions = CORSOptions{
+	Origin:      CORSReflect,
+	Credentials: true,
+	MaxAge:      2 * time.Hour,
+	Preflight:   true,
+}
+
 // CORS plugin strips (or replaces) Cross Origin Resource Sharing (CORS) headers
+// Preflight requests are answered directly where enabled, allowing the requested method and headers
+// for the request origin, and CORS headers are added to (or replaced in) responses to cross origin
+// requests so all origins are allowed.
 type CORS struct {
 	base
-	value string
+	options CORSOptions
+}
+
+// NewCORS creates a new instance of the CORS plugin, allowing all cross origin requests
+func NewCORS() *CORS {
+	return NewCORSWithOptions(DefaultCORSOptions)
 }
 
-// NewCORS creates a new instance of the CORS plugin
-func NewCORS(value string) *CORS {
+// NewCORSWithOptions creates a new instance of the CORS plugin with the provided options
+func NewCORSWithOptions(options CORSOptions) *CORS {
 	return &CORS{
-		base:  newBase("cors"),
-		value: value,
+		base:    newBase("cors"),
+		options: options,
+	}
+}
+
+// Respond answers preflight requests
+func (c *CORS) Respond(ctx interface{}, req *http.Request) *http.Response {
+	if c.options.Origin == "" || !c.options.Preflight || !isPreflight(req) {
+		return nil
+	}
+
+	header := http.Header{}
+	c.allow(header, req, true)
+	header.Set("Content-Length", "0")
+
+	c.WithField("origin", req.Header.Get("Origin")).Printf("answered preflight for %s %s", req.Header.Get(corsRequestMethodKey), req.URL)
+	c.annotate(ctx, "answered preflight for %s from %s", req.Header.Get(corsRequestMethodKey), req.Header.Get("Origin"))
+
+	return &http.Response{
+		Status:     "204 No Content",
+		StatusCode: http.StatusNoContent,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       http.NoBody,
+		Request:    req,
 	}
 }
 
-// ProcessResponse strips CORS headers from proxied responses
+// ProcessResponse strips or rewrites CORS headers in proxied responses
 func (c *CORS) ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	if c.options.Origin == "" {
+		for _, k := range []string{corsHeaderKey, corsCredentialsKey, corsMethodsKey, corsHeadersKey, corsExposeKey, corsMaxAgeKey} {
+			if v := header.Get(k); v != "" {
+				header.Del(k)
+				c.annotate(ctx, "stripped %s: %s", k, v)
+			}
+		}
+		return header, body
+	}
+
+	f, ok := ctx.(*flow.Flow)
+	if !ok || f.Request == nil {
+		return header, body
+	}
+	req := f.Request
+
+	// Responses to same origin requests are unmodified, unless these already contain CORS headers
 	v := header.Get(corsHeaderKey)
-	if v != "" {
+	if req.Header.Get("Origin") == "" && v == "" {
+		return header, body
+	}
+
+	c.allow(header, req, isPreflight(req))
+	if o := header.Get(corsHeaderKey); o != v {
 		c.WithField(corsHeaderKey, v).Printf("rewriting header")
-		if c.value != "" {
-			header.Set(corsHeaderKey, c.value)
+		if v == "" {
+			c.annotate(ctx, "added %s: %s", corsHeaderKey, o)
 		} else {
-			header.Del(corsHeaderKey)
+			c.annotate(ctx, "rewrote %s: %s to %s", corsHeaderKey, v, o)
 		}
 	}
 
 	return header, body
 }
+
+// allow sets CORS headers allowing a request
+func (c *CORS) allow(header http.Header, req *http.Request, preflight bool) {
+	origin := req.Header.Get("Origin")
+	switch {
+	case c.options.Origin == CORSReflect, c.options.Origin == "*" && c.options.Credentials:
+		if origin == "" {
+			origin = "*"
+		}
+		header.Set(corsHeaderKey, origin)
+		addVary(header, "Origin")
+	default:
+		header.Set(corsHeaderKey, c.options.Origin)
+	}
+
+	if c.options.Credentials && header.Get(corsHeaderKey) != "*" {
+		header.Set(corsCredentialsKey, "true")
+	} else {
+		header.Del(corsCredentialsKey)
+	}
+
+	if !preflight {
+		expose := c.options.Expose
+		if len(expose) == 0 {
+			expose = exposable(header)
+		}
+		if len(expose) > 0 {
+			header.Set(corsExposeKey, strings.Join(expose, ", "))
+		}
+		return
+	}
+
+	methods := c.options.Methods
+	if len(methods) == 0 {
+		methods = []string{req.Header.Get(corsRequestMethodKey)}
+	}
+	header.Set(corsMethodsKey, strings.Join(methods, ", "))
+
+	if headers := c.options.Headers; len(headers) > 0 {
+		header.Set(corsHeadersKey, strings.Join(headers, ", "))
+	} else if h := req.Header.Get(corsRequestHeaderKey); h != "" {
+		header.Set(corsHeadersKey, h)
+	}
+
+	if strings.EqualFold(req.Header.Get(corsRequestPrivate), "true") {
+		header.Set(corsPrivateKey, "true")
+	}
+	if c.options.MaxAge > 0 {
+		header.Set(corsMaxAgeKey, strconv.Itoa(int(c.options.MaxAge/time.Second)))
+	}
+	addVary(header, corsRequestMethodKey, corsRequestHeaderKey)
+}
+
+// isPreflight checks whether a request is a CORS preflight
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Origin") != "" && req.Header.Get(corsRequestMethodKey) != ""
+}
+
+// corsUnexposed are response headers never exposed to scripts, as these are safelisted, describe the
+// connection (ie. hop-by-hop headers) or are only meaningful to clients
+var corsUnexposed = []string{
+	"Cache-Control", "Content-Language", "Content-Length", "Content-Type", "Expires", "Last-Modified", "Pragma",
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	"Set-Cookie", "Strict-Transport-Security", "Vary",
+}
+
+// exposable lists response headers that are not exposed to scripts by default
+// Headers named in Connection are hop-by-hop, so are also not exposed.
+func exposable(header http.Header) []string {
+	hop := []string{}
+	for _, v := range header["Connection"] {
+		for _, f := range strings.Split(v, ",") {
+			hop = append(hop, strings.TrimSpace(f))
+		}
+	}
+
+	names := []string{}
+	for k := range header {
+		if !strings.HasPrefix(k, "Access-Control-") && !containsFold(corsUnexposed, k) && !containsFold(hop, k) {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// addVary adds values to the Vary header where not already present
+func addVary(header http.Header, values ...string) {
+	existing := []string{}
+	for _, v := range header["Vary"] {
+		for _, f := range strings.Split(v, ",") {
+			existing = append(existing, strings.TrimSpace(f))
+		}
+	}
+	for _, v := range values {
+		if !containsFold(existing, v) && !containsFold(existing, "*") {
+			header.Add("Vary", v)
+			existing = append(existing, v)
+		}
+	}
+}
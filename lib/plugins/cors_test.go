@@ -0,0 +1,148 @@
+package plugins
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+func TestCORS(t *testing.T) {
+	origin := http.Header{"Origin": {"https://evil.example.com"}}
+	preflight := http.Header{
+		"Origin":                         {"https://evil.example.com"},
+		"Access-Control-Request-Method":  {"PUT"},
+		"Access-Control-Request-Headers": {"content-type, x-token"},
+	}
+
+	t.Run("Reflects request origins", func(t *testing.T) {
+		runResponseFixtures(t, NewCORS(), []fixture{{
+			name:    "replaces specific origin",
+			request: origin,
+			in:      message{http.Header{"Access-Control-Allow-Origin": {"https://example.com"}, "X-Token": {"a"}}, "{}"},
+			out: message{http.Header{
+				"Access-Control-Allow-Origin":      {"https://evil.example.com"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Access-Control-Expose-Headers":    {"X-Token"},
+				"Vary":                             {"Origin"},
+				"X-Token":                          {"a"},
+			}, "{}"},
+			annotated: true,
+		}, {
+			name:    "does not expose hop-by-hop headers",
+			request: origin,
+			in: message{http.Header{
+				"Connection": {"X-Hop"}, "X-Hop": {"1"}, "Trailer": {"X-Sum"},
+				"Strict-Transport-Security": {"max-age=1"}, "X-Token": {"a"},
+			}, "{}"},
+			out: message{http.Header{
+				"Access-Control-Allow-Origin":      {"https://evil.example.com"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Access-Control-Expose-Headers":    {"X-Token"},
+				"Vary":                             {"Origin"},
+				"Connection":                       {"X-Hop"},
+				"X-Hop":                            {"1"},
+				"Trailer":                          {"X-Sum"},
+				"Strict-Transport-Security":        {"max-age=1"},
+				"X-Token":                          {"a"},
+			}, "{}"},
+			annotated: true,
+		}, {
+			name:    "adds missing headers",
+			request: origin,
+			in:      message{http.Header{"Content-Type": {"application/json"}, "Vary": {"Accept-Encoding"}}, "{}"},
+			out: message{http.Header{
+				"Access-Control-Allow-Origin":      {"https://evil.example.com"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Content-Type":                     {"application/json"},
+				"Vary":                             {"Accept-Encoding", "Origin"},
+			}, "{}"},
+			annotated: true,
+		}, {
+			name:    "completes forwarded preflights",
+			method:  "OPTIONS",
+			request: preflight,
+			in:      message{http.Header{"Access-Control-Allow-Origin": {"https://example.com"}, "Access-Control-Allow-Methods": {"GET"}}, ""},
+			out: message{http.Header{
+				"Access-Control-Allow-Origin":      {"https://evil.example.com"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Access-Control-Allow-Methods":     {"PUT"},
+				"Access-Control-Allow-Headers":     {"content-type, x-token"},
+				"Access-Control-Max-Age":           {"7200"},
+				"Vary":                             {"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+			}, ""},
+			annotated: true,
+		}, {
+			name: "same origin requests",
+			in:   message{http.Header{"Content-Type": {"application/json"}}, "{}"},
+			out:  message{http.Header{"Content-Type": {"application/json"}}, "{}"},
+		}})
+	})
+
+	t.Run("Replaces allowed origins", func(t *testing.T) {
+		runResponseFixtures(t, NewCORSWithOptions(CORSOptions{Origin: "*"}), []fixture{{
+			name:      "specific origin",
+			in:        message{http.Header{"Access-Control-Allow-Origin": {"https://example.com"}}, "{}"},
+			out:       message{http.Header{"Access-Control-Allow-Origin": {"*"}}, "{}"},
+			annotated: true,
+		}, {
+			name:      "null origin",
+			in:        message{http.Header{"Access-Control-Allow-Origin": {"null"}, "Access-Control-Allow-Credentials": {"true"}}, ""},
+			out:       message{http.Header{"Access-Control-Allow-Origin": {"*"}}, ""},
+			annotated: true,
+		}})
+
+		// Wildcards are invalid for credentialed requests, so origins are reflected
+		runResponseFixtures(t, NewCORSWithOptions(CORSOptions{Origin: "*", Credentials: true}), []fixture{{
+			name:    "credentialed",
+			request: origin,
+			in:      message{http.Header{"Access-Control-Allow-Origin": {"*"}}, ""},
+			out: message{http.Header{
+				"Access-Control-Allow-Origin":      {"https://evil.example.com"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Vary":                             {"Origin"},
+			}, ""},
+			annotated: true,
+		}})
+	})
+
+	t.Run("Strips allowed origins", func(t *testing.T) {
+		runResponseFixtures(t, NewCORSWithOptions(CORSOptions{}), []fixture{{
+			name:    "specific origin",
+			request: origin,
+			in: message{http.Header{
+				"Access-Control-Allow-Origin":      {"https://example.com"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Vary":                             {"Origin"},
+			}, ""},
+			out:       message{http.Header{"Vary": {"Origin"}}, ""},
+			annotated: true,
+		}})
+	})
+
+	t.Run("Answers preflights", func(t *testing.T) {
+		c := NewCORSWithOptions(CORSOptions{Origin: CORSReflect, Credentials: true, Methods: []string{"GET", "PUT"}, MaxAge: time.Minute, Preflight: true})
+
+		req := httptest.NewRequest("OPTIONS", "http://api.example.com/items", nil)
+		req.Header = preflight
+		f := flow.New(req)
+
+		resp := c.Respond(f, req)
+		assert.NotNil(t, resp)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.Equal(t, "https://evil.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+		assert.Equal(t, "GET, PUT", resp.Header.Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "content-type, x-token", resp.Header.Get("Access-Control-Allow-Headers"))
+		assert.Equal(t, "60", resp.Header.Get("Access-Control-Max-Age"))
+		assert.Len(t, f.Annotations(), 1)
+
+		// Requests that are not preflights are forwarded
+		assert.Nil(t, c.Respond(nil, httptest.NewRequest("OPTIONS", "http://api.example.com/items", nil)))
+		assert.Nil(t, NewCORSWithOptions(CORSOptions{Origin: CORSReflect}).Respond(nil, req))
+	})
+}
@@ -0,0 +1,238 @@
+/**
+ * CSP plugin strips or relaxes Content Security Policies
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package plugins
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	cspHeaderKey           = "Content-Security-Policy"
+	cspReportOnlyHeaderKey = "Content-Security-Policy-Report-Only"
+)
+
+// CSP plugin strips or relaxes Content Security Policy (CSP) headers and <meta http-equiv> tags
+// Where no origins or nonce are configured policies are removed entirely. Otherwise the origins
+// and nonce are added to the script-src (and script-src-elem) directives, creating script-src from
+// default-src where required, so only script loading is relaxed. 'strict-dynamic' is removed where
+// no nonce is configured, as this disables origin based sources. Report-only policies and reporting
+// directives are always removed so modified pages are not reported.
+type CSP struct {
+	base
+	origins []string
+	nonce   string
+}
+
+// NewCSP creates a new instance of the CSP plugin
+// Origins (ie. https://evil.example.com) and the nonce may be empty to strip policies.
+func NewCSP(origins []string, nonce string) *CSP {
+	return &CSP{
+		base:    newBase("csp"),
+		origins: origins,
+		nonce:   nonce,
+	}
+}
+
+// ProcessResponse strips or relaxes CSP headers, and meta tags in HTML responses
+func (c *CSP) ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	if v := header.Get(cspReportOnlyHeaderKey); v != "" {
+		header.Del(cspReportOnlyHeaderKey)
+		c.annotate(ctx, "stripped %s: %s", cspReportOnlyHeaderKey, v)
+	}
+
+	if values := header[cspHeaderKey]; len(values) > 0 {
+		if c.strip() {
+			header.Del(cspHeaderKey)
+			c.WithField(cspHeaderKey, values).Printf("stripped")
+			c.annotate(ctx, "stripped %s: %s", cspHeaderKey, strings.Join(values, ", "))
+		} else {
+			relaxed := make([]string, len(values))
+			for i, v := range values {
+				relaxed[i] = c.relax(v)
+			}
+			header[cspHeaderKey] = relaxed
+			c.WithField(cspHeaderKey, relaxed).Printf("relaxed")
+			c.annotate(ctx, "relaxed %s: %s", cspHeaderKey, strings.Join(relaxed, ", "))
+		}
+	}
+
+	t, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if t == "text/html" || t == "application/xhtml+xml" {
+		if b, n := c.rewriteMeta(body); n > 0 {
+			body = b
+			c.annotate(ctx, "rewrote %d CSP meta tag(s)", n)
+		}
+	}
+
+	return header, body
+}
+
+func (c *CSP) strip() bool {
+	return len(c.origins) == 0 && c.nonce == ""
+}
+
+// rewriteMeta strips or relaxes CSP <meta http-equiv> tags, returning the number of tags modified
+// Documents are tokenized rather than matched so tags in scripts or comments are not affected.
+func (c *CSP) rewriteMeta(body string) (string, int) {
+	if !strings.Contains(strings.ToLower(body), "http-equiv") {
+		return body, 0
+	}
+
+	z := html.NewTokenizer(strings.NewReader(body))
+	out := bytes.NewBuffer(make([]byte, 0, len(body)))
+	n := 0
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			out.Write(z.Raw())
+			break
+		}
+		raw := append([]byte(nil), z.Raw()...)
+
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			out.Write(raw)
+			continue
+		}
+
+		t := z.Token()
+		if t.DataAtom != atom.Meta {
+			out.Write(raw)
+			continue
+		}
+
+		equiv, content := -1, -1
+		for i, a := range t.Attr {
+			switch strings.ToLower(a.Key) {
+			case "http-equiv":
+				equiv = i
+			case "content":
+				content = i
+			}
+		}
+		if equiv < 0 {
+			out.Write(raw)
+			continue
+		}
+
+		switch v := strings.ToLower(strings.TrimSpace(t.Attr[equiv].Val)); {
+		case v == strings.ToLower(cspReportOnlyHeaderKey), v == strings.ToLower(cspHeaderKey) && c.strip():
+			n++
+		case v == strings.ToLower(cspHeaderKey) && content >= 0:
+			t.Attr[content].Val = c.relax(t.Attr[content].Val)
+			out.WriteString(t.String())
+			n++
+		default:
+			out.Write(raw)
+		}
+	}
+
+	return out.String(), n
+}
+
+// cspDirective is a single policy directive, with a name and source list
+type cspDirective struct {
+	name   string
+	values []string
+}
+
+// relax adds the configured sources to script directives in a serialized policy list
+func (c *CSP) relax(policies string) string {
+	list := strings.Split(policies, ",")
+	for i, p := range list {
+		list[i] = c.relaxPolicy(p)
+	}
+	return strings.Join(list, ", ")
+}
+
+func (c *CSP) relaxPolicy(policy string) string {
+	directives := make([]*cspDirective, 0)
+	find := func(name string) *cspDirective {
+		for _, d := range directives {
+			if d.name == name {
+				return d
+			}
+		}
+		return nil
+	}
+
+	for _, s := range strings.Split(policy, ";") {
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		// Reporting would disclose modified pages, and only the first of any repeated directive applies
+		if name == "report-uri" || name == "report-to" || find(name) != nil {
+			continue
+		}
+		directives = append(directives, &cspDirective{name: name, values: fields[1:]})
+	}
+
+	// Script sources fall back to default-src, which is copied so other resource types are unaffected
+	if find("script-src") == nil {
+		d := find("default-src")
+		if d == nil {
+			return c.format(directives)
+		}
+		directives = append(directives, &cspDirective{name: "script-src", values: append([]string{}, d.values...)})
+	}
+
+	for _, name := range []string{"script-src", "script-src-elem"} {
+		if d := find(name); d != nil {
+			d.values = c.relaxSources(d.values)
+		}
+	}
+
+	return c.format(directives)
+}
+
+// relaxSources adds the configured origins and nonce to a source list
+func (c *CSP) relaxSources(values []string) []string {
+	out := make([]string, 0, len(values)+len(c.origins)+1)
+	for _, v := range values {
+		switch strings.ToLower(v) {
+		case "'none'":
+			continue
+		case "'strict-dynamic'":
+			if c.nonce == "" {
+				continue
+			}
+		}
+		out = append(out, v)
+	}
+
+	add := append([]string{}, c.origins...)
+	if c.nonce != "" {
+		add = append(add, "'nonce-"+c.nonce+"'")
+	}
+	for _, a := range add {
+		found := false
+		for _, v := range out {
+			found = found || strings.EqualFold(v, a)
+		}
+		if !found {
+			out = append(out, a)
+		}
+	}
+
+	return out
+}
+
+func (c *CSP) format(directives []*cspDirective) string {
+	parts := make([]string, len(directives))
+	for i, d := range directives {
+		parts[i] = strings.Join(append([]string{d.name}, d.values...), " ")
+	}
+	return strings.Join(parts, "; ")
+}
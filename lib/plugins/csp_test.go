@@ -0,0 +1,55 @@
+package plugins
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSP(t *testing.T) {
+	html := http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+
+	t.Run("Strips policies", func(t *testing.T) {
+		c := NewCSP(nil, "")
+		header := http.Header{
+			"Content-Type":                        {"text/html"},
+			"Content-Security-Policy":             {"default-src 'self'"},
+			"Content-Security-Policy-Report-Only": {"default-src 'none'"},
+		}
+		body := `<head><META http-equiv="Content-Security-Policy" content="script-src 'self'"><title>a</title></head>` +
+			`<script>var s = '<meta http-equiv="Content-Security-Policy">';</script>`
+
+		header, body = c.ProcessResponse(nil, header, body)
+		assert.Empty(t, header.Get("Content-Security-Policy"))
+		assert.Empty(t, header.Get("Content-Security-Policy-Report-Only"))
+		assert.Equal(t, `<head><title>a</title></head><script>var s = '<meta http-equiv="Content-Security-Policy">';</script>`, body)
+	})
+
+	t.Run("Relaxes script sources", func(t *testing.T) {
+		c := NewCSP([]string{"https://evil.example.com"}, "")
+
+		tests := []struct{ in, out string }{
+			{"script-src 'self'; img-src *", "script-src 'self' https://evil.example.com; img-src *"},
+			{"default-src 'self'; report-uri /csp", "default-src 'self'; script-src 'self' https://evil.example.com"},
+			{"script-src 'none'", "script-src https://evil.example.com"},
+			{"script-src 'nonce-abc' 'strict-dynamic'; report-to csp", "script-src 'nonce-abc' https://evil.example.com"},
+			{"img-src 'self'", "img-src 'self'"},
+			{"script-src 'self', default-src 'none'", "script-src 'self' https://evil.example.com, default-src 'none'; script-src https://evil.example.com"},
+		}
+		for _, test := range tests {
+			header, _ := c.ProcessResponse(nil, http.Header{"Content-Security-Policy": {test.in}}, "")
+			assert.Equal(t, test.out, header.Get("Content-Security-Policy"), test.in)
+		}
+	})
+
+	t.Run("Adds nonces", func(t *testing.T) {
+		c := NewCSP(nil, "evil")
+
+		header, _ := c.ProcessResponse(nil, http.Header{"Content-Security-Policy": {"script-src 'sha256-abc' 'strict-dynamic'"}}, "")
+		assert.Equal(t, "script-src 'sha256-abc' 'strict-dynamic' 'nonce-evil'", header.Get("Content-Security-Policy"))
+
+		_, body := c.ProcessResponse(nil, html, `<meta http-equiv="content-security-policy" content="script-src 'self'"/>`)
+		assert.Equal(t, `<meta http-equiv="content-security-policy" content="script-src &#39;self&#39; &#39;nonce-evil&#39;"/>`, body)
+	})
+}
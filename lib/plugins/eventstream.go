@@ -0,0 +1,184 @@
+/**
+ * EventStream defines plugin hooks for inspecting and re-writing Server-Sent Events
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+// Event is a single server-sent event (see https://html.spec.whatwg.org/multipage/server-sent-events.html)
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry string
+
+	// dispatch marks parsed events containing data fields, as these are dispatched
+	// to clients even where the data is empty
+	dispatch bool
+}
+
+// EventStreamHandler interface implemented by plugins to inspect and re-write server-sent events
+// Handlers return the events to be sent in place of the provided event, this may be empty
+// to drop the event or contain additional events to inject them into the stream.
+type EventStreamHandler interface {
+	ProcessEvent(ctx interface{}, ev *Event) []*Event
+}
+
+// Bytes serialises an event into the event stream format
+// Data fields are only written for events with data, as clients dispatch any event containing
+// data fields while those with only an ID or retry time update the stream state.
+func (e *Event) Bytes() []byte {
+	buf := bytes.NewBuffer(nil)
+
+	if e.ID != "" {
+		buf.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		buf.WriteString("event: " + e.Event + "\n")
+	}
+	if e.Retry != "" {
+		buf.WriteString("retry: " + e.Retry + "\n")
+	}
+	if e.Data != "" || e.dispatch {
+		for _, line := range strings.Split(e.Data, "\n") {
+			buf.WriteString("data: " + line + "\n")
+		}
+	}
+	buf.WriteString("\n")
+
+	return buf.Bytes()
+}
+
+// eventStreamReader parses events from an upstream event stream and
+// passes them through handlers before they are read by the client
+type eventStreamReader struct {
+	ctx      interface{}
+	handlers []EventStreamHandler
+	upstream io.ReadCloser
+	r        *bufio.Reader
+	pending  []byte
+	skipLF   bool
+}
+
+// Read reads processed event stream data, this blocks until an event is available
+func (s *eventStreamReader) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+
+	return n, nil
+}
+
+// Close closes the upstream event stream
+func (s *eventStreamReader) Close() error {
+	return s.upstream.Close()
+}
+
+// next reads the next event (or comment) from the stream and processes it
+// Comments (ie. keep-alives) are forwarded immediately without processing
+func (s *eventStreamReader) next() error {
+	ev := Event{}
+	data := []string{}
+	seen := false
+
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			// Any incomplete event is discarded, as per the specification
+			return err
+		}
+
+		if line == "" {
+			if !seen {
+				continue
+			}
+			break
+		}
+
+		if strings.HasPrefix(line, ":") {
+			s.pending = append(s.pending, []byte(line+"\n\n")...)
+			if !seen {
+				return nil
+			}
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "id":
+			ev.ID = value
+		case "event":
+			ev.Event = value
+		case "data":
+			data = append(data, value)
+		case "retry":
+			ev.Retry = value
+		default:
+			continue
+		}
+		seen = true
+	}
+	ev.Data = strings.Join(data, "\n")
+	ev.dispatch = len(data) > 0
+
+	events := []*Event{&ev}
+	for _, h := range s.handlers {
+		out := make([]*Event, 0, len(events))
+		for _, e := range events {
+			out = append(out, h.ProcessEvent(s.ctx, e)...)
+		}
+		events = out
+	}
+
+	for _, e := range events {
+		s.pending = append(s.pending, e.Bytes()...)
+	}
+
+	return nil
+}
+
+// readLine reads a line terminated by CRLF, LF or CR
+func (s *eventStreamReader) readLine() (string, error) {
+	line := []byte{}
+
+	for {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		// A LF directly following a CR completes the previous line
+		skipLF := s.skipLF
+		s.skipLF = false
+
+		switch b {
+		case '\n':
+			if skipLF {
+				continue
+			}
+			return string(line), nil
+		case '\r':
+			s.skipLF = true
+			return string(line), nil
+		default:
+			line = append(line, b)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package plugins
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eventRecorder records events, upper-casing data and dropping or duplicating events by name
+type eventRecorder struct {
+	events []Event
+}
+
+func (r *eventRecorder) ProcessEvent(ctx interface{}, ev *Event) []*Event {
+	r.events = append(r.events, *ev)
+	switch ev.Event {
+	case "drop":
+		return []*Event{}
+	case "dup":
+		return []*Event{ev, {Event: "injected", Data: "extra"}}
+	}
+	ev.Data = strings.ToUpper(ev.Data)
+	return []*Event{ev}
+}
+
+func processStream(t *testing.T, stream string) (string, []Event) {
+	pm := PluginManager{}
+	r := &eventRecorder{}
+	pm.Bind(r)
+
+	out, err := ioutil.ReadAll(pm.ProcessEventStream(nil, ioutil.NopCloser(strings.NewReader(stream))))
+	assert.Nil(t, err)
+	return string(out), r.events
+}
+
+func TestEventStream(t *testing.T) {
+
+	t.Run("Parses events", func(t *testing.T) {
+		out, events := processStream(t, "id: 1\nevent: update\nretry: 1000\ndata: one\ndata:two\n\n")
+
+		assert.Equal(t, []Event{{ID: "1", Event: "update", Retry: "1000", Data: "one\ntwo", dispatch: true}}, events)
+		assert.Equal(t, "id: 1\nevent: update\nretry: 1000\ndata: ONE\ndata: TWO\n\n", out)
+	})
+
+	t.Run("Handles CRLF and CR line endings", func(t *testing.T) {
+		out, events := processStream(t, "data: a\r\n\r\ndata: b\r\rdata: c\n\n")
+
+		assert.Len(t, events, 3)
+		assert.Equal(t, "data: A\n\ndata: B\n\ndata: C\n\n", out)
+	})
+
+	t.Run("Forwards comments without processing", func(t *testing.T) {
+		out, events := processStream(t, ": keep-alive\n\ndata: a\n: within event\n\n")
+
+		assert.Len(t, events, 1)
+		assert.Equal(t, ": keep-alive\n\n: within event\n\ndata: A\n\n", out)
+	})
+
+	t.Run("Ignores unknown fields", func(t *testing.T) {
+		out, events := processStream(t, "foo: bar\ndata: a\n\nfoo: bar\n\n")
+
+		assert.Len(t, events, 1)
+		assert.Equal(t, "data: A\n\n", out)
+	})
+
+	t.Run("Does not add data to events without data", func(t *testing.T) {
+		out, events := processStream(t, "id: 5\n\nretry: 3000\n\ndata\n\n")
+
+		assert.Equal(t, []Event{{ID: "5"}, {Retry: "3000"}, {dispatch: true}}, events)
+		assert.Equal(t, "id: 5\n\nretry: 3000\n\ndata: \n\n", out)
+	})
+
+	t.Run("Drops and injects events", func(t *testing.T) {
+		out, _ := processStream(t, "event: drop\ndata: a\n\nevent: dup\ndata: b\n\n")
+
+		assert.Equal(t, "event: dup\ndata: b\n\nevent: injected\ndata: extra\n\n", out)
+	})
+
+	t.Run("Discards incomplete events", func(t *testing.T) {
+		out, events := processStream(t, "data: a\n\ndata: incomplete\n")
+
+		assert.Len(t, events, 1)
+		assert.Equal(t, "data: A\n\n", out)
+	})
+
+	t.Run("Passes events as they arrive", func(t *testing.T) {
+		pm := PluginManager{}
+		pm.Bind(&eventRecorder{})
+
+		r, w := io.Pipe()
+		s := pm.ProcessEventStream(nil, r)
+		go w.Write([]byte("data: first\n\ndata: sec"))
+
+		buf := make([]byte, 64)
+		n, err := s.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "data: FIRST\n\n", string(buf[:n]))
+
+		w.Close()
+		s.Close()
+	})
+
+	t.Run("Serialises events", func(t *testing.T) {
+		assert.Equal(t, "event: a\ndata: one\ndata: two\n\n", string((&Event{Event: "a", Data: "one\ntwo"}).Bytes()))
+		assert.Equal(t, "id: 1\n\n", string((&Event{ID: "1"}).Bytes()))
+	})
+}
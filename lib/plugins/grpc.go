@@ -0,0 +1,234 @@
+/**
+ * gRPC defines message framing and plugin hooks for gRPC requests and responses
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// grpcHeaderLength is the length of the gRPC message prefix (compressed flag + length)
+const grpcHeaderLength = 5
+
+// grpcMaxMessageSize is the largest (decompressed) message processed by plugins, matching the default
+// gRPC receive limit. Larger streamed messages are passed through unprocessed as these arrive.
+const grpcMaxMessageSize = 4 * 1024 * 1024
+
+// GRPCMessage is a single length-prefixed gRPC message
+type GRPCMessage struct {
+	Direction Direction
+	// Method is the full gRPC method path (ie. /package.Service/Method)
+	Method string
+	// Compressed indicates the message is compressed on the wire,
+	// Data is always provided to and accepted from handlers uncompressed
+	Compressed bool
+	Data       []byte
+}
+
+// GRPCHandler interface implemented by plugins to inspect and re-write gRPC messages
+// Handlers return the messages to be sent in place of the provided message, this may be empty
+// to drop the message or contain additional messages to inject them into the stream.
+type GRPCHandler interface {
+	ProcessGRPCMessage(ctx interface{}, msg *GRPCMessage) []*GRPCMessage
+}
+
+// GRPCTrailerHandler interface implemented by plugins to inspect and re-write gRPC status trailers
+// (ie. Grpc-Status and Grpc-Message)
+type GRPCTrailerHandler interface {
+	ProcessGRPCTrailer(ctx interface{}, method string, trailer http.Header) http.Header
+}
+
+// IsGRPC checks whether the provided headers describe a gRPC request or response
+func IsGRPC(header http.Header) bool {
+	t := header.Get("Content-Type")
+	return t == "application/grpc" || strings.HasPrefix(t, "application/grpc+") ||
+		strings.HasPrefix(t, "application/grpc;")
+}
+
+// ParseGRPCMessages splits a gRPC body into messages
+func ParseGRPCMessages(body []byte) ([]*GRPCMessage, error) {
+	msgs := []*GRPCMessage{}
+
+	for len(body) > 0 {
+		if len(body) < grpcHeaderLength {
+			return nil, fmt.Errorf("truncated gRPC message header (%d bytes)", len(body))
+		}
+
+		length := binary.BigEndian.Uint32(body[1:grpcHeaderLength])
+		if uint64(len(body)-grpcHeaderLength) < uint64(length) {
+			return nil, fmt.Errorf("truncated gRPC message (expected %d bytes, found %d)", length, len(body)-grpcHeaderLength)
+		}
+
+		msgs = append(msgs, &GRPCMessage{
+			Compressed: body[0]&0x01 != 0,
+			Data:       body[grpcHeaderLength : grpcHeaderLength+length],
+		})
+
+		body = body[grpcHeaderLength+length:]
+	}
+
+	return msgs, nil
+}
+
+// EncodeGRPCMessages joins messages into a gRPC body
+func EncodeGRPCMessages(msgs []*GRPCMessage) []byte {
+	buf := bytes.NewBuffer(nil)
+
+	for _, m := range msgs {
+		head := make([]byte, grpcHeaderLength)
+		if m.Compressed {
+			head[0] = 0x01
+		}
+		binary.BigEndian.PutUint32(head[1:], uint32(len(m.Data)))
+
+		buf.Write(head)
+		buf.Write(m.Data)
+	}
+
+	return buf.Bytes()
+}
+
+// grpcStreamReader parses messages from a gRPC body and passes
+// them through handlers before they are read by the peer
+type grpcStreamReader struct {
+	ctx      interface{}
+	handlers []GRPCHandler
+	dir      Direction
+	method   string
+	encoding string
+	upstream io.ReadCloser
+	r        *bufio.Reader
+	pending  []byte
+	// remaining is the length of an oversized message still to be passed through
+	remaining int64
+}
+
+// Read reads processed gRPC messages, this blocks until a message is available
+func (s *grpcStreamReader) Read(p []byte) (int, error) {
+	if len(s.pending) == 0 && s.remaining > 0 {
+		return s.passthrough(p)
+	}
+
+	for len(s.pending) == 0 {
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+
+	return n, nil
+}
+
+// Close closes the upstream gRPC body
+func (s *grpcStreamReader) Close() error {
+	return s.upstream.Close()
+}
+
+// next reads the next message from the stream and processes it
+func (s *grpcStreamReader) next() error {
+	head := make([]byte, grpcHeaderLength)
+	if _, err := io.ReadFull(s.r, head); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("truncated gRPC message header")
+		}
+		return err
+	}
+
+	length := binary.BigEndian.Uint32(head[1:])
+	if length > grpcMaxMessageSize {
+		s.pending, s.remaining = head, int64(length)
+		return nil
+	}
+
+	raw := make([]byte, grpcHeaderLength+int(length))
+	copy(raw, head)
+	if _, err := io.ReadFull(s.r, raw[grpcHeaderLength:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("truncated gRPC message: %s", err)
+	}
+
+	msg := &GRPCMessage{
+		Compressed: head[0]&0x01 != 0,
+		Data:       append([]byte(nil), raw[grpcHeaderLength:]...),
+	}
+	msgs, err := processGRPCMessages(s.ctx, s.handlers, s.dir, s.method, s.encoding, []*GRPCMessage{msg})
+	if err != nil {
+		s.pending = raw
+		return nil
+	}
+
+	s.pending = EncodeGRPCMessages(msgs)
+	return nil
+}
+
+// passthrough reads the body of an oversized message from the stream without processing
+func (s *grpcStreamReader) passthrough(p []byte) (int, error) {
+	if int64(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+
+	n, err := s.r.Read(p)
+	s.remaining -= int64(n)
+	if err == io.EOF && s.remaining > 0 {
+		return n, fmt.Errorf("truncated gRPC message: %s", io.ErrUnexpectedEOF)
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// grpcDecompress decompresses a message using the provided grpc-encoding
+// Messages decompressing to more than the maximum message size are rejected.
+func grpcDecompress(encoding string, data []byte) ([]byte, error) {
+	if encoding != "gzip" {
+		return nil, fmt.Errorf("unsupported grpc-encoding: '%s'", encoding)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	out, err := ioutil.ReadAll(io.LimitReader(r, grpcMaxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > grpcMaxMessageSize {
+		return nil, fmt.Errorf("decompressed gRPC message exceeds %d bytes", grpcMaxMessageSize)
+	}
+	return out, nil
+}
+
+// grpcCompress compresses a message using the provided grpc-encoding
+func grpcCompress(encoding string, data []byte) ([]byte, error) {
+	if encoding != "gzip" {
+		return nil, fmt.Errorf("unsupported grpc-encoding: '%s'", encoding)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
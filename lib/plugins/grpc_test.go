@@ -0,0 +1,142 @@
+package plugins
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type grpcRewriter struct{}
+
+func (g *grpcRewriter) ProcessGRPCMessage(ctx interface{}, msg *GRPCMessage) []*GRPCMessage {
+	if string(msg.Data) == "drop" {
+		return []*GRPCMessage{}
+	}
+	msg.Data = append(msg.Data, '!')
+	return []*GRPCMessage{msg}
+}
+
+func TestGRPC(t *testing.T) {
+
+	t.Run("Parses and encodes messages", func(t *testing.T) {
+		msgs := []*GRPCMessage{{Data: []byte("one")}, {Data: []byte{}}, {Compressed: true, Data: []byte("three")}}
+
+		parsed, err := ParseGRPCMessages(EncodeGRPCMessages(msgs))
+		assert.Nil(t, err)
+		assert.EqualValues(t, msgs, parsed)
+	})
+
+	t.Run("Rejects truncated messages", func(t *testing.T) {
+		body := EncodeGRPCMessages([]*GRPCMessage{{Data: []byte("message")}})
+
+		_, err := ParseGRPCMessages(body[:3])
+		assert.NotNil(t, err)
+		_, err = ParseGRPCMessages(body[:len(body)-1])
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Processes messages through handlers", func(t *testing.T) {
+		pm := PluginManager{}
+		pm.Bind(&grpcRewriter{})
+
+		header := http.Header{}
+		header.Set("Grpc-Encoding", "gzip")
+
+		compressed, err := grpcCompress("gzip", []byte("two"))
+		assert.Nil(t, err)
+
+		body := EncodeGRPCMessages([]*GRPCMessage{{Data: []byte("one")}, {Data: []byte("drop")}, {Compressed: true, Data: compressed}})
+		out := pm.ProcessGRPC(nil, ClientToServer, "/test.Service/Method", header, string(body))
+
+		msgs, err := ParseGRPCMessages([]byte(out))
+		assert.Nil(t, err)
+		assert.Len(t, msgs, 2)
+		assert.Equal(t, "one!", string(msgs[0].Data))
+
+		decompressed, err := grpcDecompress("gzip", msgs[1].Data)
+		assert.Nil(t, err)
+		assert.Equal(t, "two!", string(decompressed))
+	})
+
+	t.Run("Processes streamed messages as they arrive", func(t *testing.T) {
+		pm := PluginManager{}
+		pm.Bind(&grpcRewriter{})
+
+		r, w := io.Pipe()
+		s := pm.ProcessGRPCStream(nil, ServerToClient, "/test.Service/Stream", http.Header{}, r)
+
+		// Each message is passed on without waiting for the end of the stream
+		go w.Write(EncodeGRPCMessages([]*GRPCMessage{{Data: []byte("drop")}, {Data: []byte("one")}}))
+		buf := make([]byte, 64)
+		n, err := s.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, EncodeGRPCMessages([]*GRPCMessage{{Data: []byte("one!")}}), buf[:n])
+
+		// Messages that cannot be decompressed are passed unmodified
+		raw := EncodeGRPCMessages([]*GRPCMessage{{Compressed: true, Data: []byte("invalid")}})
+		go w.Write(raw)
+		n, err = s.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, raw, buf[:n])
+
+		// Truncated messages are reported as errors
+		go func() {
+			w.Write(EncodeGRPCMessages([]*GRPCMessage{{Data: []byte("truncated")}})[:8])
+			w.Close()
+		}()
+		_, err = s.Read(buf)
+		assert.NotNil(t, err)
+		assert.NotEqual(t, io.EOF, err)
+	})
+
+	t.Run("Passes oversized streamed messages through unprocessed", func(t *testing.T) {
+		pm := PluginManager{}
+		pm.Bind(&grpcRewriter{})
+
+		// The length is read before the message, so this is passed on without being allocated
+		large := EncodeGRPCMessages([]*GRPCMessage{{Data: bytes.Repeat([]byte("a"), grpcMaxMessageSize+1)}})
+		body := append(append([]byte(nil), large...), EncodeGRPCMessages([]*GRPCMessage{{Data: []byte("one")}})...)
+		s := pm.ProcessGRPCStream(nil, ServerToClient, "/test.Service/Stream", http.Header{}, ioutil.NopCloser(bytes.NewReader(body)))
+
+		out, err := ioutil.ReadAll(s)
+		assert.Nil(t, err)
+		assert.Equal(t, append(large, EncodeGRPCMessages([]*GRPCMessage{{Data: []byte("one!")}})...), out)
+
+		// Truncated oversized messages are reported as errors
+		s = pm.ProcessGRPCStream(nil, ServerToClient, "/test.Service/Stream", http.Header{}, ioutil.NopCloser(bytes.NewReader(large[:1024])))
+		_, err = ioutil.ReadAll(s)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Rejects messages decompressing beyond the maximum size", func(t *testing.T) {
+		compressed, err := grpcCompress("gzip", make([]byte, grpcMaxMessageSize+1))
+		assert.Nil(t, err)
+		_, err = grpcDecompress("gzip", compressed)
+		assert.NotNil(t, err)
+
+		compressed, err = grpcCompress("gzip", make([]byte, grpcMaxMessageSize))
+		assert.Nil(t, err)
+		data, err := grpcDecompress("gzip", compressed)
+		assert.Nil(t, err)
+		assert.Len(t, data, grpcMaxMessageSize)
+	})
+
+	t.Run("Decodes raw protobuf messages", func(t *testing.T) {
+		nested := protowire.AppendTag(nil, 1, protowire.VarintType)
+		nested = protowire.AppendVarint(nested, 150)
+
+		data := protowire.AppendTag(nil, 1, protowire.BytesType)
+		data = protowire.AppendString(data, "\xff\xfe")
+		data = protowire.AppendTag(data, 2, protowire.BytesType)
+		data = protowire.AppendBytes(data, nested)
+
+		decoded, err := DecodeProtobufRaw(data)
+		assert.Nil(t, err)
+		assert.Equal(t, "1: 0xfffe\n2 {\n  1: 150\n}\n", decoded)
+	})
+}
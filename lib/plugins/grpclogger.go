@@ -0,0 +1,56 @@
+/**
+ * GRPCLogger logs decoded gRPC messages for analysis
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package plugins
+
+import (
+	"net/http"
+)
+
+// GRPCLogger plugin logs gRPC messages and status
+// Messages are decoded using the provided registry where possible, falling back to raw decoding
+type GRPCLogger struct {
+	base
+	registry *ProtoRegistry
+}
+
+// NewGRPCLogger creates a new gRPC logger instance, registry may be nil
+func NewGRPCLogger(registry *ProtoRegistry) *GRPCLogger {
+	return &GRPCLogger{
+		base:     newBase("grpc"),
+		registry: registry,
+	}
+}
+
+// ProcessGRPCMessage logs a gRPC message
+func (g *GRPCLogger) ProcessGRPCMessage(ctx interface{}, msg *GRPCMessage) []*GRPCMessage {
+	log := g.WithField("method", msg.Method).WithField("direction", msg.Direction.String())
+
+	if g.registry != nil {
+		js, err := g.registry.Decode(msg.Method, msg.Direction, msg.Data)
+		if err == nil {
+			log.Printf("message: %s", js)
+			return []*GRPCMessage{msg}
+		}
+		log.Debugf("descriptor decoding failed: %s", err)
+	}
+
+	raw, err := DecodeProtobufRaw(msg.Data)
+	if err != nil {
+		log.Printf("message (undecodable, %d bytes): %x", len(msg.Data), msg.Data)
+	} else {
+		log.Printf("message:\n%s", raw)
+	}
+
+	return []*GRPCMessage{msg}
+}
+
+// ProcessGRPCTrailer logs gRPC call status
+func (g *GRPCLogger) ProcessGRPCTrailer(ctx interface{}, method string, trailer http.Header) http.Header {
+	g.WithField("method", method).WithField("status", trailer.Get("Grpc-Status")).
+		Printf("complete: %s", trailer.Get("Grpc-Message"))
+	return trailer
+}
@@ -0,0 +1,157 @@
+/**
+ * Guards isolate plugin failures and record per-plugin timing
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package plugins
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// PluginStats are processing statistics for a bound plugin
+// Calls are counted for each hook called (within the plugin scope), including those that panic.
+type PluginStats struct {
+	Calls   uint64  `json:"calls"`
+	Panics  uint64  `json:"panics"`
+	TotalMs float64 `json:"total_ms"`
+	MeanMs  float64 `json:"mean_ms"`
+	MaxMs   float64 `json:"max_ms"`
+}
+
+type pluginStats struct {
+	lock   sync.Mutex
+	calls  uint64
+	panics uint64
+	total  time.Duration
+	max    time.Duration
+}
+
+func (s *pluginStats) record(d time.Duration, panicked bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.calls++
+	if panicked {
+		s.panics++
+	}
+	s.total += d
+	if d > s.max {
+		s.max = d
+	}
+}
+
+func (s *pluginStats) snapshot() PluginStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	stats := PluginStats{Calls: s.calls, Panics: s.panics, TotalMs: ms(s.total), MaxMs: ms(s.max)}
+	if s.calls > 0 {
+		stats.MeanMs = ms(s.total / time.Duration(s.calls))
+	}
+	return stats
+}
+
+// guard times a plugin hook call and recovers from panics, which are logged and recorded against the flow
+// Where a hook panics the fallback is called to restore the hook inputs as outputs, though changes
+// made in place (ie. to headers) prior to the panic are retained.
+type guard struct {
+	name  string
+	stats *pluginStats
+}
+
+func (g *guard) done(ctx interface{}, hook string, start time.Time, fallback func()) {
+	r := recover()
+	g.stats.record(time.Since(start), r != nil)
+	if r == nil {
+		return
+	}
+
+	fallback()
+
+	logrus.StandardLogger().WithField("module", g.name).WithField("hook", hook).
+		Printf("plugin panic: %v\n%s", r, debug.Stack())
+	if f, ok := ctx.(*flow.Flow); ok {
+		f.Annotate(g.name, fmt.Sprintf("panic in %s hook: %v", hook, r))
+	}
+}
+
+type guardedRequest struct {
+	*guard
+	RequestHandler
+}
+
+func (g *guardedRequest) ProcessRequest(ctx interface{}, header http.Header, body string) (h http.Header, b string) {
+	defer g.done(ctx, "request", time.Now(), func() { h, b = header, body })
+	return g.RequestHandler.ProcessRequest(ctx, header, body)
+}
+
+type guardedResponse struct {
+	*guard
+	ResponseHandler
+}
+
+func (g *guardedResponse) ProcessResponse(ctx interface{}, header http.Header, body string) (h http.Header, b string) {
+	defer g.done(ctx, "response", time.Now(), func() { h, b = header, body })
+	return g.ResponseHandler.ProcessResponse(ctx, header, body)
+}
+
+type guardedWebSocket struct {
+	*guard
+	WebSocketHandler
+}
+
+func (g *guardedWebSocket) ProcessWebSocket(ctx interface{}, msg *WebSocketMessage) (out []*WebSocketMessage) {
+	defer g.done(ctx, "websocket", time.Now(), func() { out = []*WebSocketMessage{msg} })
+	return g.WebSocketHandler.ProcessWebSocket(ctx, msg)
+}
+
+type guardedGRPC struct {
+	*guard
+	GRPCHandler
+}
+
+func (g *guardedGRPC) ProcessGRPCMessage(ctx interface{}, msg *GRPCMessage) (out []*GRPCMessage) {
+	defer g.done(ctx, "grpc", time.Now(), func() { out = []*GRPCMessage{msg} })
+	return g.GRPCHandler.ProcessGRPCMessage(ctx, msg)
+}
+
+type guardedGRPCTrailer struct {
+	*guard
+	GRPCTrailerHandler
+}
+
+func (g *guardedGRPCTrailer) ProcessGRPCTrailer(ctx interface{}, method string, trailer http.Header) (out http.Header) {
+	defer g.done(ctx, "grpc-trailer", time.Now(), func() { out = trailer })
+	return g.GRPCTrailerHandler.ProcessGRPCTrailer(ctx, method, trailer)
+}
+
+type guardedEventStream struct {
+	*guard
+	EventStreamHandler
+}
+
+func (g *guardedEventStream) ProcessEvent(ctx interface{}, ev *Event) (out []*Event) {
+	defer g.done(ctx, "event-stream", time.Now(), func() { out = []*Event{ev} })
+	return g.EventStreamHandler.ProcessEvent(ctx, ev)
+}
+
+type guardedResponder struct {
+	*guard
+	Responder
+}
+
+func (g *guardedResponder) Respond(ctx interface{}, req *http.Request) (resp *http.Response) {
+	defer g.done(ctx, "respond", time.Now(), func() { resp = nil })
+	return g.Responder.Respond(ctx, req)
+}
@@ -0,0 +1,74 @@
+package plugins
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// message is a header and body passed to or returned from a plugin hook
+type message struct {
+	header http.Header
+	body   string
+}
+
+// fixture is a table driven plugin test case
+// Fixture inputs are copied so these may be shared between plugins.
+type fixture struct {
+	name string
+	// method, url and headers of the request for the flow passed to the plugin (defaults to GET http://example.com/)
+	method, url string
+	request     http.Header
+	// in is passed to the hook and the result compared to out
+	in, out message
+	// annotated checks whether the plugin recorded a modification against the flow
+	annotated bool
+}
+
+// runRequestFixtures passes fixtures through a request handler
+func runRequestFixtures(t *testing.T, h RequestHandler, fixtures []fixture) {
+	runFixtures(t, fixtures, h.ProcessRequest)
+}
+
+// runResponseFixtures passes fixtures through a response handler
+func runResponseFixtures(t *testing.T, h ResponseHandler, fixtures []fixture) {
+	runFixtures(t, fixtures, h.ProcessResponse)
+}
+
+func runFixtures(t *testing.T, fixtures []fixture, hook func(ctx interface{}, header http.Header, body string) (http.Header, string)) {
+	for _, fx := range fixtures {
+		t.Run(fx.name, func(t *testing.T) {
+			method, url := fx.method, fx.url
+			if method == "" {
+				method = "GET"
+			}
+			if url == "" {
+				url = "http://example.com/"
+			}
+			req := httptest.NewRequest(method, url, nil)
+			for k, v := range fx.request {
+				req.Header[k] = v
+			}
+			f := flow.New(req)
+
+			header, body := hook(f, cloneHeader(fx.in.header), fx.in.body)
+
+			assert.Equal(t, cloneHeader(fx.out.header), cloneHeader(header), "header")
+			assert.Equal(t, fx.out.body, body, "body")
+			assert.Equal(t, fx.annotated, len(f.Annotations()) > 0, "annotated")
+		})
+	}
+}
+
+// cloneHeader copies a header, with nil headers returned as empty
+func cloneHeader(h http.Header) http.Header {
+	out := http.Header{}
+	for k, v := range h {
+		out[k] = append([]string(nil), v...)
+	}
+	return out
+}
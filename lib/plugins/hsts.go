@@ -22,6 +22,7 @@ func (s *HSTS) ProcessResponse(ctx interface{}, header http.Header, body string)
 	if v != "" {
 		s.WithField("hstsKey", v).Printf("stripped")
 		header.Del(hstsKey)
+		s.annotate(ctx, "stripped %s: %s", hstsKey, v)
 	}
 
 	return header, body
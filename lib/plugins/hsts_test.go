@@ -0,0 +1,28 @@
+package plugins
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHSTS(t *testing.T) {
+	runResponseFixtures(t, NewHSTS(), []fixture{{
+		name:      "strips header",
+		in:        message{http.Header{"Strict-Transport-Security": {"max-age=31536000; includeSubDomains; preload"}, "X-Other": {"a"}}, "body"},
+		out:       message{http.Header{"X-Other": {"a"}}, "body"},
+		annotated: true,
+	}, {
+		name:      "strips repeated headers",
+		in:        message{http.Header{"Strict-Transport-Security": {"max-age=0", "max-age=31536000"}}, ""},
+		out:       message{http.Header{}, ""},
+		annotated: true,
+	}, {
+		name: "without header",
+		in:   message{http.Header{"Content-Type": {"text/html"}}, "Strict-Transport-Security: max-age=1"},
+		out:  message{http.Header{"Content-Type": {"text/html"}}, "Strict-Transport-Security: max-age=1"},
+	}, {
+		name: "empty header",
+		in:   message{http.Header{"Strict-Transport-Security": {""}}, ""},
+		out:  message{http.Header{"Strict-Transport-Security": {""}}, ""},
+	}})
+}
@@ -0,0 +1,212 @@
+/**
+ * Inject plugin inserts content (ie. script tags) into HTML responses
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package plugins
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// InjectAnchor is the position in a document at which content is injected
+type InjectAnchor string
+
+// Injection anchors
+const (
+	InjectHeadEnd   InjectAnchor = "head-end"
+	InjectBodyStart InjectAnchor = "body-start"
+	InjectBodyEnd   InjectAnchor = "body-end"
+)
+
+// DefaultInjectPath is the path at which injected assets are served
+const DefaultInjectPath = "/__evpx/inject.js"
+
+// Inject plugin inserts content into HTML documents at an anchor, before </head>, after <body>
+// or before </body>. Documents are tokenized so anchors in scripts, comments or attributes are
+// ignored, and where the anchor is not found (ie. where tags are implied) content is appended.
+// Responses without html, head or body tags (ie. fragments) are not modified.
+//
+// A local asset may be served at a path on every host, so injected content can reference it
+// from the same origin. Where a nonce is set this is added to injected script tags, for use with
+// the CSP plugin. Inject runs in the post-response phase, after plugins stripping CSP and SRI.
+type Inject struct {
+	base
+	content string
+	anchor  InjectAnchor
+
+	path  string
+	asset string
+}
+
+// NewInject creates a new instance of the inject plugin
+func NewInject(content string, anchor InjectAnchor, nonce string) (*Inject, error) {
+	switch anchor {
+	case InjectHeadEnd, InjectBodyStart, InjectBodyEnd:
+	default:
+		return nil, fmt.Errorf("unknown anchor '%s'", anchor)
+	}
+
+	if nonce != "" {
+		content = addNonce(content, nonce)
+	}
+
+	return &Inject{
+		base:    newBase("inject"),
+		content: content,
+		anchor:  anchor,
+	}, nil
+}
+
+// Serve serves a local file at the provided path (on all hosts), the file is read on each request
+func (i *Inject) Serve(path, file string) {
+	i.path, i.asset = path, file
+}
+
+// DefaultScope limits injection to HTML responses
+func (i *Inject) DefaultScope() Scope {
+	return Scope{Types: []string{"text/html", "application/xhtml+xml"}}
+}
+
+// DefaultOrder places injection after other response plugins
+func (i *Inject) DefaultOrder() Order {
+	return Order{Phases: []Phase{PhasePostResponse}}
+}
+
+// Respond serves the injected asset
+func (i *Inject) Respond(ctx interface{}, req *http.Request) *http.Response {
+	if i.asset == "" || req.URL.Path != i.path {
+		return nil
+	}
+
+	resp := &http.Response{
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Request:    req,
+	}
+
+	data, err := ioutil.ReadFile(i.asset)
+	if err != nil {
+		i.WithField("asset", i.asset).Printf("error reading asset: %s", err)
+		resp.StatusCode, resp.Status = http.StatusNotFound, "404 Not Found"
+		data = []byte{}
+	} else {
+		resp.StatusCode, resp.Status = http.StatusOK, "200 OK"
+		t := mime.TypeByExtension(filepath.Ext(i.asset))
+		if t == "" {
+			t = "application/octet-stream"
+		}
+		resp.Header.Set("Content-Type", t)
+		resp.Header.Set("Cache-Control", "no-store")
+		i.annotate(ctx, "served %s", i.asset)
+	}
+
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	resp.ContentLength = int64(len(data))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	return resp
+}
+
+// ProcessResponse injects content into HTML responses
+func (i *Inject) ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	t, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if t != "text/html" && t != "application/xhtml+xml" {
+		return header, body
+	}
+
+	if b, ok := i.inject(body); ok {
+		body = b
+		i.annotate(ctx, "injected %d bytes at %s", len(i.content), i.anchor)
+	}
+
+	return header, body
+}
+
+// inject inserts content at the anchor, returning false where the body is not a document
+func (i *Inject) inject(body string) (string, bool) {
+	z := html.NewTokenizer(strings.NewReader(body))
+	out := bytes.NewBuffer(make([]byte, 0, len(body)+len(i.content)))
+	document, injected := false, false
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			out.Write(z.Raw())
+			break
+		}
+		raw := append([]byte(nil), z.Raw()...)
+
+		if tt != html.StartTagToken && tt != html.EndTagToken {
+			out.Write(raw)
+			continue
+		}
+
+		name, _ := z.TagName()
+		a := atom.Lookup(name)
+		document = document || a == atom.Html || a == atom.Head || a == atom.Body
+
+		switch {
+		case injected:
+		case i.anchor == InjectHeadEnd && (tt == html.EndTagToken && a == atom.Head || tt == html.StartTagToken && a == atom.Body),
+			i.anchor == InjectBodyEnd && tt == html.EndTagToken && a == atom.Body:
+			out.WriteString(i.content)
+			injected = true
+		case i.anchor == InjectBodyStart && tt == html.StartTagToken && a == atom.Body:
+			out.Write(raw)
+			out.WriteString(i.content)
+			injected = true
+			continue
+		}
+		out.Write(raw)
+	}
+
+	if !document {
+		return body, false
+	}
+	if !injected {
+		out.WriteString(i.content)
+	}
+
+	return out.String(), true
+}
+
+// addNonce adds a nonce attribute to script tags in the provided content
+func addNonce(content, nonce string) string {
+	z := html.NewTokenizer(strings.NewReader(content))
+	out := bytes.NewBuffer(nil)
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			out.Write(z.Raw())
+			break
+		}
+		raw := append([]byte(nil), z.Raw()...)
+
+		if tt == html.StartTagToken {
+			t := z.Token()
+			if t.DataAtom == atom.Script {
+				t.Attr = append(t.Attr, html.Attribute{Key: "nonce", Val: nonce})
+				out.WriteString(t.String())
+				continue
+			}
+		}
+		out.Write(raw)
+	}
+
+	return out.String()
+}
@@ -0,0 +1,80 @@
+package plugins
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInject(t *testing.T) {
+	html := http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+	doc := `<html><head><title>a</title><script>var s = "</head><body>";</script></head><body><p>b</p></body></html>`
+
+	t.Run("Injects at anchors", func(t *testing.T) {
+		tests := []struct {
+			anchor InjectAnchor
+			out    string
+		}{
+			{InjectHeadEnd, `<html><head><title>a</title><script>var s = "</head><body>";</script>X</head><body><p>b</p></body></html>`},
+			{InjectBodyStart, `<html><head><title>a</title><script>var s = "</head><body>";</script></head><body>X<p>b</p></body></html>`},
+			{InjectBodyEnd, `<html><head><title>a</title><script>var s = "</head><body>";</script></head><body><p>b</p>X</body></html>`},
+		}
+		for _, test := range tests {
+			i, err := NewInject("X", test.anchor, "")
+			assert.Nil(t, err)
+			_, body := i.ProcessResponse(nil, html, doc)
+			assert.Equal(t, test.out, body, string(test.anchor))
+		}
+
+		_, err := NewInject("X", "head-start", "")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Handles implied and missing tags", func(t *testing.T) {
+		i, _ := NewInject("X", InjectHeadEnd, "")
+
+		_, body := i.ProcessResponse(nil, html, `<html><title>a</title><body>b</body></html>`)
+		assert.Equal(t, `<html><title>a</title>X<body>b</body></html>`, body)
+
+		_, body = i.ProcessResponse(nil, html, `<html><title>a</title>`)
+		assert.Equal(t, `<html><title>a</title>X`, body)
+
+		_, body = i.ProcessResponse(nil, html, `<p>fragment</p>`)
+		assert.Equal(t, `<p>fragment</p>`, body)
+
+		_, body = i.ProcessResponse(nil, http.Header{"Content-Type": {"application/json"}}, `"<head></head>"`)
+		assert.Equal(t, `"<head></head>"`, body)
+	})
+
+	t.Run("Adds nonces to scripts", func(t *testing.T) {
+		i, _ := NewInject(`<script src="/x.js"></script><img src="/y.png">`, InjectBodyEnd, "abc")
+		_, body := i.ProcessResponse(nil, html, `<body></body>`)
+		assert.Equal(t, `<body><script src="/x.js" nonce="abc"></script><img src="/y.png"></body>`, body)
+	})
+
+	t.Run("Serves assets", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "inject")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		file := filepath.Join(dir, "x.js")
+		assert.Nil(t, ioutil.WriteFile(file, []byte("alert(1)"), 0644))
+
+		i, _ := NewInject("X", InjectHeadEnd, "")
+		i.Serve(DefaultInjectPath, file)
+
+		assert.Nil(t, i.Respond(nil, httptest.NewRequest("GET", "http://example.com/index.html", nil)))
+
+		resp := i.Respond(nil, httptest.NewRequest("GET", "http://example.com"+DefaultInjectPath, nil))
+		assert.NotNil(t, resp)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Content-Type"), "javascript")
+		data, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "alert(1)", string(data))
+	})
+}
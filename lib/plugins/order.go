@@ -0,0 +1,156 @@
+/**
+ * Ordering of plugins within the processing chain
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package plugins
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Phase is a stage of request or response processing in which a plugin may be placed
+type Phase string
+
+// Processing phases, plugins without a phase run between the pre and post phases
+const (
+	PhasePreRequest   Phase = "pre-request"
+	PhasePostRequest  Phase = "post-request"
+	PhasePreResponse  Phase = "pre-response"
+	PhasePostResponse Phase = "post-response"
+)
+
+// Order positions a plugin in the processing order
+// Request hooks run in the pre-request phase, then without a phase, then in the post-request phase,
+// and response hooks (including event stream and gRPC trailer hooks) likewise. Within a phase
+// plugins run by priority (lowest first) and then in binding order (see PluginManager.Reorder).
+// Websocket and gRPC message hooks are ordered by priority only.
+type Order struct {
+	Phases   []Phase `json:"phases,omitempty"`
+	Priority int     `json:"priority"`
+}
+
+// Ordered interface implemented by plugins to provide a default order
+type Ordered interface {
+	DefaultOrder() Order
+}
+
+// ParseOrder parses an order from comma separated key=value pairs
+// Keys are priority and phase, with multiple phases separated by |
+// (ie. priority=-10,phase=pre-request|post-response).
+func ParseOrder(spec string) (*Order, error) {
+	o := Order{}
+
+	for _, kv := range strings.Split(spec, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid order field '%s' (expected key=value)", kv)
+		}
+
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch key {
+		case "priority":
+			p, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid priority '%s'", value)
+			}
+			o.Priority = p
+		case "phase":
+			for _, v := range strings.Split(value, "|") {
+				o.Phases = append(o.Phases, Phase(strings.TrimSpace(v)))
+			}
+		default:
+			return nil, fmt.Errorf("unknown order key '%s'", key)
+		}
+	}
+
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+// Validate checks that phases are known, and that no plugin is placed both before and after other plugins
+func (o *Order) Validate() error {
+	for _, p := range o.Phases {
+		switch p {
+		case PhasePreRequest, PhasePostRequest, PhasePreResponse, PhasePostResponse:
+		default:
+			return fmt.Errorf("unknown phase '%s'", p)
+		}
+	}
+	if o.has(PhasePreRequest) && o.has(PhasePostRequest) {
+		return fmt.Errorf("plugins may not run in both %s and %s phases", PhasePreRequest, PhasePostRequest)
+	}
+	if o.has(PhasePreResponse) && o.has(PhasePostResponse) {
+		return fmt.Errorf("plugins may not run in both %s and %s phases", PhasePreResponse, PhasePostResponse)
+	}
+	return nil
+}
+
+// IsDefault checks whether an order is the default, without phases or priority
+func (o *Order) IsDefault() bool {
+	return o == nil || (len(o.Phases) == 0 && o.Priority == 0)
+}
+
+// String formats an order in the format accepted by ParseOrder
+func (o *Order) String() string {
+	fields := []string{fmt.Sprintf("priority=%d", o.Priority)}
+	if len(o.Phases) > 0 {
+		phases := make([]string, len(o.Phases))
+		for i, p := range o.Phases {
+			phases[i] = string(p)
+		}
+		fields = append(fields, "phase="+strings.Join(phases, "|"))
+	}
+	return strings.Join(fields, ",")
+}
+
+func (o *Order) has(phase Phase) bool {
+	for _, p := range o.Phases {
+		if p == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// hook kinds, used to select the phases applicable to a hook
+const (
+	orderRequest = iota
+	orderResponse
+	orderMessage
+)
+
+// tier fetches the position of a plugin phase for the provided hook kind, 0 (pre), 1 (none) or 2 (post)
+func (o *Order) tier(kind int) int {
+	switch {
+	case kind == orderRequest && o.has(PhasePreRequest), kind == orderResponse && o.has(PhasePreResponse):
+		return 0
+	case kind == orderRequest && o.has(PhasePostRequest), kind == orderResponse && o.has(PhasePostResponse):
+		return 2
+	default:
+		return 1
+	}
+}
+
+// ordered sorts plugin entries for the provided hook kind, retaining binding order where equal
+func ordered(entries []*pluginEntry, kind int) []*pluginEntry {
+	sorted := append([]*pluginEntry{}, entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].order, sorted[j].order
+		if ta, tb := a.tier(kind), b.tier(kind); ta != tb {
+			return ta < tb
+		}
+		return a.Priority < b.Priority
+	})
+	return sorted
+}
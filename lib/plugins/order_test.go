@@ -0,0 +1,66 @@
+package plugins
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// panicker panics on every response
+type panicker struct{ base }
+
+func (p *panicker) ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	panic("failed")
+}
+
+func TestOrder(t *testing.T) {
+	t.Run("Parses orders", func(t *testing.T) {
+		o, err := ParseOrder("priority=-5,phase=pre-request|post-response")
+		assert.Nil(t, err)
+		assert.Equal(t, Order{Priority: -5, Phases: []Phase{PhasePreRequest, PhasePostResponse}}, *o)
+		assert.Equal(t, "priority=-5,phase=pre-request|post-response", o.String())
+
+		for _, spec := range []string{"priority=x", "phase=during", "phase=pre-response|post-response", "weight=1"} {
+			_, err := ParseOrder(spec)
+			assert.NotNil(t, err, spec)
+		}
+	})
+
+	t.Run("Orders by phase, priority and binding order", func(t *testing.T) {
+		pm := PluginManager{}
+		for _, n := range []string{"a", "b", "c", "d"} {
+			pm.Bind(&tagger{newBase(n)})
+		}
+		assert.Nil(t, pm.SetOrder("a", Order{Phases: []Phase{PhasePostResponse}}))
+		assert.Nil(t, pm.SetOrder("c", Order{Priority: -1}))
+		assert.Nil(t, pm.SetOrder("d", Order{Phases: []Phase{PhasePreResponse}, Priority: 10}))
+
+		_, body := pm.ProcessResponse(nil, http.Header{}, "")
+		assert.Equal(t, "dcba", body)
+
+		assert.NotNil(t, pm.SetOrder("a", Order{Phases: []Phase{"during"}}))
+		assert.Equal(t, ErrUnknownPlugin, pm.SetOrder("e", Order{}))
+	})
+
+	t.Run("Recovers from plugin panics", func(t *testing.T) {
+		pm := PluginManager{}
+		pm.Bind(&tagger{newBase("a")})
+		pm.Bind(&panicker{newBase("panicker")})
+		pm.Bind(&tagger{newBase("b")})
+
+		f := flow.New(httptest.NewRequest("GET", "http://example.com", nil))
+		_, body := pm.ProcessResponse(f, http.Header{}, "")
+		assert.Equal(t, "ab", body)
+		assert.Equal(t, []flow.Annotation{{Source: "panicker", Message: "panic in response hook: failed"}}, f.Annotations())
+
+		info := pm.Plugins()
+		assert.Equal(t, uint64(1), info[0].Stats.Calls)
+		assert.Equal(t, uint64(0), info[0].Stats.Panics)
+		assert.Equal(t, uint64(1), info[1].Stats.Calls)
+		assert.Equal(t, uint64(1), info[1].Stats.Panics)
+	})
+}
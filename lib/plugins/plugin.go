@@ -8,7 +8,12 @@
 package plugins
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"sync"
 )
 
 // RequestHandler interface implemented by plugins to re-write requests
@@ -21,34 +26,541 @@ type ResponseHandler interface {
 	ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string)
 }
 
+// Responder interface implemented by plugins to respond to requests in place of the upstream server
+// Responders return nil for requests that should be forwarded.
+type Responder interface {
+	Respond(ctx interface{}, req *http.Request) *http.Response
+}
+
+// Named interface implemented by plugins to provide a name for runtime control
+type Named interface {
+	Name() string
+}
+
+// PluginInfo describes a plugin bound to the PluginManager
+type PluginInfo struct {
+	Name    string      `json:"name"`
+	Enabled bool        `json:"enabled"`
+	Hooks   []string    `json:"hooks"`
+	Scope   *Scope      `json:"scope,omitempty"`
+	Order   *Order      `json:"order,omitempty"`
+	Stats   PluginStats `json:"stats"`
+}
+
+// ErrUnknownPlugin is returned when a plugin name does not match a bound plugin
+var ErrUnknownPlugin = errors.New("unknown plugin")
+
+type pluginEntry struct {
+	name    string
+	handler interface{}
+	enabled bool
+	scope   *Scope
+	order   *Order
+	stats   *pluginStats
+}
+
 // PluginManager wraps plugin types and calls each sequentially when the appropriate method is called
+// Plugins may be enabled, disabled and reordered while requests are being processed, the
+// handler lists are rebuilt on each change so in-flight calls use a consistent snapshot.
+// Each plugin call is timed, and panics are recovered so a failing plugin does not affect others.
 type PluginManager struct {
-	RequestHandlers  []RequestHandler
-	ResponseHandlers []ResponseHandler
+	requestHandlers   []RequestHandler
+	responseHandlers  []ResponseHandler
+	webSocketHandlers []WebSocketHandler
+	grpcHandlers      []GRPCHandler
+	grpcTrailers      []GRPCTrailerHandler
+
+	eventStreamHandlers []EventStreamHandler
+	responders          []Responder
+
+	lock    sync.RWMutex
+	entries []*pluginEntry
 }
 
 // Bind attaches a plugin to the PluginManager
+// Plugins are named using the Named interface where implemented, otherwise by type,
+// and are scoped using the Scoped interface where implemented.
 func (pm *PluginManager) Bind(handler interface{}) {
-	if r, ok := handler.(RequestHandler); ok {
-		pm.RequestHandlers = append(pm.RequestHandlers, r)
+	scope := Scope{}
+	if s, ok := handler.(Scoped); ok {
+		scope = s.DefaultScope()
+	}
+	pm.BindScoped(handler, scope)
+}
+
+// BindScoped attaches a plugin to the PluginManager, processing only flows within the provided scope
+// Plugins are ordered using the Ordered interface where implemented.
+func (pm *PluginManager) BindScoped(handler interface{}, scope Scope) {
+	order := Order{}
+	if o, ok := handler.(Ordered); ok {
+		order = o.DefaultOrder()
+	}
+
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	name := fmt.Sprintf("%T", handler)
+	if n, ok := handler.(Named); ok {
+		name = n.Name()
 	}
-	if r, ok := handler.(ResponseHandler); ok {
-		pm.ResponseHandlers = append(pm.ResponseHandlers, r)
+
+	// Names must be unique for runtime control
+	unique := name
+	for i := 2; pm.find(unique) != nil; i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
 	}
+
+	pm.entries = append(pm.entries, &pluginEntry{
+		name:    unique,
+		handler: handler,
+		enabled: true,
+		scope:   &scope,
+		order:   &order,
+		stats:   &pluginStats{},
+	})
+	pm.rebuild()
+}
+
+// Plugins lists the bound plugins in binding order, handlers are called in this order within each phase and priority
+func (pm *PluginManager) Plugins() []PluginInfo {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+
+	info := make([]PluginInfo, len(pm.entries))
+	for i, e := range pm.entries {
+		info[i] = PluginInfo{Name: e.name, Enabled: e.enabled, Hooks: hooks(e.handler), Stats: e.stats.snapshot()}
+		if !e.scope.IsEmpty() {
+			info[i].Scope = e.scope
+		}
+		if !e.order.IsDefault() {
+			info[i].Order = e.order
+		}
+	}
+	return info
+}
+
+// Plugin fetches a bound plugin by name
+func (pm *PluginManager) Plugin(name string) (interface{}, error) {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+
+	e := pm.find(name)
+	if e == nil {
+		return nil, ErrUnknownPlugin
+	}
+	return e.handler, nil
+}
+
+// SetEnabled enables or disables a bound plugin by name
+func (pm *PluginManager) SetEnabled(name string, enabled bool) error {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	e := pm.find(name)
+	if e == nil {
+		return ErrUnknownPlugin
+	}
+	e.enabled = enabled
+	pm.rebuild()
+
+	return nil
+}
+
+// SetScope sets the scope of a bound plugin by name
+func (pm *PluginManager) SetScope(name string, scope Scope) error {
+	if err := scope.Validate(); err != nil {
+		return err
+	}
+
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	e := pm.find(name)
+	if e == nil {
+		return ErrUnknownPlugin
+	}
+	e.scope = &scope
+	pm.rebuild()
+
+	return nil
+}
+
+// SetOrder sets the phases and priority of a bound plugin by name
+func (pm *PluginManager) SetOrder(name string, order Order) error {
+	if err := order.Validate(); err != nil {
+		return err
+	}
+
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	e := pm.find(name)
+	if e == nil {
+		return ErrUnknownPlugin
+	}
+	e.order = &order
+	pm.rebuild()
+
+	return nil
+}
+
+// Reorder sets the binding order of bound plugins, which applies within each phase and priority
+// Plugins not included in the provided names retain their relative order after those listed
+func (pm *PluginManager) Reorder(names []string) error {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	entries := make([]*pluginEntry, 0, len(pm.entries))
+	for _, n := range names {
+		e := pm.find(n)
+		if e == nil {
+			return fmt.Errorf("%s: '%s'", ErrUnknownPlugin, n)
+		}
+		for _, o := range entries {
+			if o == e {
+				return fmt.Errorf("duplicate plugin: '%s'", n)
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	for _, e := range pm.entries {
+		listed := false
+		for _, o := range entries {
+			listed = listed || o == e
+		}
+		if !listed {
+			entries = append(entries, e)
+		}
+	}
+
+	pm.entries = entries
+	pm.rebuild()
+
+	return nil
+}
+
+// Swap replaces the bound plugins with those bound to another PluginManager, returning
+// the previously bound plugins that are no longer bound so these may be released.
+// This is used to reload the plugin chain, in-flight calls complete with the previous plugins.
+func (pm *PluginManager) Swap(other *PluginManager) []interface{} {
+	other.lock.RLock()
+	entries := append([]*pluginEntry{}, other.entries...)
+	other.lock.RUnlock()
+
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	removed := []interface{}{}
+	for _, e := range pm.entries {
+		bound := false
+		for _, n := range entries {
+			bound = bound || n.handler == e.handler
+		}
+		if !bound {
+			removed = append(removed, e.handler)
+		}
+	}
+
+	pm.entries = entries
+	pm.rebuild()
+
+	return removed
+}
+
+func (pm *PluginManager) find(name string) *pluginEntry {
+	for _, e := range pm.entries {
+		if e.name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// rebuild regenerates handler lists from enabled plugins, this must be called with the lock held
+// Handlers are sorted by phase and priority, wrapped to time calls and recover from panics,
+// and (where plugins have a scope) wrapped so they are only called for flows in scope.
+func (pm *PluginManager) rebuild() {
+	pm.requestHandlers, pm.responseHandlers = nil, nil
+	pm.webSocketHandlers, pm.grpcHandlers, pm.grpcTrailers = nil, nil, nil
+	pm.eventStreamHandlers, pm.responders = nil, nil
+
+	enabled := make([]*pluginEntry, 0, len(pm.entries))
+	for _, e := range pm.entries {
+		if e.enabled {
+			enabled = append(enabled, e)
+		}
+	}
+
+	for _, e := range ordered(enabled, orderRequest) {
+		if r, ok := e.handler.(RequestHandler); ok {
+			r = &guardedRequest{e.guard(), r}
+			if !e.scope.IsEmpty() {
+				r = &scopedRequest{e.scope, r}
+			}
+			pm.requestHandlers = append(pm.requestHandlers, r)
+		}
+		if r, ok := e.handler.(Responder); ok {
+			r = &guardedResponder{e.guard(), r}
+			if !e.scope.IsEmpty() {
+				r = &scopedResponder{e.scope, r}
+			}
+			pm.responders = append(pm.responders, r)
+		}
+	}
+
+	for _, e := range ordered(enabled, orderResponse) {
+		scoped := !e.scope.IsEmpty()
+
+		if r, ok := e.handler.(ResponseHandler); ok {
+			r = &guardedResponse{e.guard(), r}
+			if scoped {
+				r = &scopedResponse{e.scope, r}
+			}
+			pm.responseHandlers = append(pm.responseHandlers, r)
+		}
+		if r, ok := e.handler.(GRPCTrailerHandler); ok {
+			r = &guardedGRPCTrailer{e.guard(), r}
+			if scoped {
+				r = &scopedGRPCTrailer{e.scope, r}
+			}
+			pm.grpcTrailers = append(pm.grpcTrailers, r)
+		}
+		if r, ok := e.handler.(EventStreamHandler); ok {
+			r = &guardedEventStream{e.guard(), r}
+			if scoped {
+				r = &scopedEventStream{e.scope, r}
+			}
+			pm.eventStreamHandlers = append(pm.eventStreamHandlers, r)
+		}
+	}
+
+	for _, e := range ordered(enabled, orderMessage) {
+		scoped := !e.scope.IsEmpty()
+
+		if r, ok := e.handler.(WebSocketHandler); ok {
+			r = &guardedWebSocket{e.guard(), r}
+			if scoped {
+				r = &scopedWebSocket{e.scope, r}
+			}
+			pm.webSocketHandlers = append(pm.webSocketHandlers, r)
+		}
+		if r, ok := e.handler.(GRPCHandler); ok {
+			r = &guardedGRPC{e.guard(), r}
+			if scoped {
+				r = &scopedGRPC{e.scope, r}
+			}
+			pm.grpcHandlers = append(pm.grpcHandlers, r)
+		}
+	}
+}
+
+func (e *pluginEntry) guard() *guard {
+	return &guard{name: e.name, stats: e.stats}
+}
+
+// Hooked interface implemented by plugins that only handle a subset of the hooks they implement
+// (ie. external plugins), to list the hooks handled.
+type Hooked interface {
+	Hooks() []string
+}
+
+// hooks lists the processing hooks implemented by a plugin
+func hooks(handler interface{}) []string {
+	if h, ok := handler.(Hooked); ok {
+		return h.Hooks()
+	}
+	hooks := []string{}
+	if _, ok := handler.(RequestHandler); ok {
+		hooks = append(hooks, "request")
+	}
+	if _, ok := handler.(ResponseHandler); ok {
+		hooks = append(hooks, "response")
+	}
+	if _, ok := handler.(WebSocketHandler); ok {
+		hooks = append(hooks, "websocket")
+	}
+	if _, ok := handler.(GRPCHandler); ok {
+		hooks = append(hooks, "grpc")
+	}
+	if _, ok := handler.(GRPCTrailerHandler); ok {
+		hooks = append(hooks, "grpc-trailer")
+	}
+	if _, ok := handler.(EventStreamHandler); ok {
+		hooks = append(hooks, "event-stream")
+	}
+	if _, ok := handler.(Responder); ok {
+		hooks = append(hooks, "respond")
+	}
+	return hooks
 }
 
 // ProcessRequest processes a request header through the bound plugins
 func (pm *PluginManager) ProcessRequest(ctx interface{}, header http.Header, body string) (http.Header, string) {
-	for _, h := range pm.RequestHandlers {
+	pm.lock.RLock()
+	handlers := pm.requestHandlers
+	pm.lock.RUnlock()
+
+	for _, h := range handlers {
 		header, body = h.ProcessRequest(ctx, header, body)
 	}
 	return header, body
 }
 
+// Respond fetches a response from the first bound plugin responding to a request
+// This returns nil where the request should be forwarded to the upstream server.
+func (pm *PluginManager) Respond(ctx interface{}, req *http.Request) *http.Response {
+	pm.lock.RLock()
+	handlers := pm.responders
+	pm.lock.RUnlock()
+
+	for _, h := range handlers {
+		if resp := h.Respond(ctx, req); resp != nil {
+			return resp
+		}
+	}
+	return nil
+}
+
 // ProcessResponse processes a response header through bound plugins
 func (pm *PluginManager) ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string) {
-	for _, h := range pm.ResponseHandlers {
+	pm.lock.RLock()
+	handlers := pm.responseHandlers
+	pm.lock.RUnlock()
+
+	for _, h := range handlers {
 		header, body = h.ProcessResponse(ctx, header, body)
 	}
 	return header, body
 }
+
+// ProcessWebSocket processes a websocket message through bound plugins
+// Each handler is called with every message output by the previous handler
+func (pm *PluginManager) ProcessWebSocket(ctx interface{}, msg *WebSocketMessage) []*WebSocketMessage {
+	pm.lock.RLock()
+	handlers := pm.webSocketHandlers
+	pm.lock.RUnlock()
+
+	msgs := []*WebSocketMessage{msg}
+	for _, h := range handlers {
+		out := make([]*WebSocketMessage, 0, len(msgs))
+		for _, m := range msgs {
+			out = append(out, h.ProcessWebSocket(ctx, m)...)
+		}
+		msgs = out
+	}
+	return msgs
+}
+
+// ProcessGRPC processes each message in a gRPC body through bound plugins
+// Bodies that cannot be parsed (or decompressed) are returned unmodified
+func (pm *PluginManager) ProcessGRPC(ctx interface{}, dir Direction, method string, header http.Header, body string) string {
+	pm.lock.RLock()
+	handlers := pm.grpcHandlers
+	pm.lock.RUnlock()
+
+	if len(handlers) == 0 {
+		return body
+	}
+
+	msgs, err := ParseGRPCMessages([]byte(body))
+	if err != nil {
+		return body
+	}
+
+	msgs, err = processGRPCMessages(ctx, handlers, dir, method, header.Get("Grpc-Encoding"), msgs)
+	if err != nil {
+		return body
+	}
+
+	return string(EncodeGRPCMessages(msgs))
+}
+
+// ProcessGRPCStream wraps a gRPC body to process each message through bound plugins as it arrives,
+// so streaming calls are not buffered. Messages that cannot be decompressed are passed unmodified.
+func (pm *PluginManager) ProcessGRPCStream(ctx interface{}, dir Direction, method string, header http.Header, body io.ReadCloser) io.ReadCloser {
+	pm.lock.RLock()
+	handlers := pm.grpcHandlers
+	pm.lock.RUnlock()
+
+	if len(handlers) == 0 {
+		return body
+	}
+
+	return &grpcStreamReader{
+		ctx:      ctx,
+		handlers: handlers,
+		dir:      dir,
+		method:   method,
+		encoding: header.Get("Grpc-Encoding"),
+		upstream: body,
+		r:        bufio.NewReader(body),
+	}
+}
+
+// processGRPCMessages passes messages through gRPC handlers, decompressing and re-compressing these
+// An error is returned where messages cannot be decompressed.
+func processGRPCMessages(ctx interface{}, handlers []GRPCHandler, dir Direction, method, encoding string, msgs []*GRPCMessage) ([]*GRPCMessage, error) {
+	var err error
+	for _, m := range msgs {
+		m.Direction, m.Method = dir, method
+		if m.Compressed {
+			if m.Data, err = grpcDecompress(encoding, m.Data); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, h := range handlers {
+		out := make([]*GRPCMessage, 0, len(msgs))
+		for _, m := range msgs {
+			out = append(out, h.ProcessGRPCMessage(ctx, m)...)
+		}
+		msgs = out
+	}
+
+	// Messages are re-compressed where possible, the per-message flag
+	// allows any that cannot be to be sent uncompressed
+	for _, m := range msgs {
+		if m.Compressed {
+			data, err := grpcCompress(encoding, m.Data)
+			if err != nil {
+				m.Compressed = false
+				continue
+			}
+			m.Data = data
+		}
+	}
+
+	return msgs, nil
+}
+
+// ProcessGRPCTrailer processes gRPC status trailers through bound plugins
+func (pm *PluginManager) ProcessGRPCTrailer(ctx interface{}, method string, trailer http.Header) http.Header {
+	pm.lock.RLock()
+	handlers := pm.grpcTrailers
+	pm.lock.RUnlock()
+
+	for _, h := range handlers {
+		trailer = h.ProcessGRPCTrailer(ctx, method, trailer)
+	}
+	return trailer
+}
+
+// ProcessEventStream wraps an event stream body to process each event through bound plugins
+func (pm *PluginManager) ProcessEventStream(ctx interface{}, body io.ReadCloser) io.ReadCloser {
+	pm.lock.RLock()
+	handlers := pm.eventStreamHandlers
+	pm.lock.RUnlock()
+
+	if len(handlers) == 0 {
+		return body
+	}
+
+	return &eventStreamReader{
+		ctx:      ctx,
+		handlers: handlers,
+		upstream: body,
+		r:        bufio.NewReader(body),
+	}
+}
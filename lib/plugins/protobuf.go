@@ -0,0 +1,207 @@
+/**
+ * Protobuf provides decoding of gRPC message payloads for logging and re-writing
+ * Messages may be decoded as raw wire-format fields or using compiled descriptor sets
+ * (ie. from `protoc --include_imports --descriptor_set_out=api.pb api.proto`)
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package plugins
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// DecodeProtobufRaw decodes protobuf wire-format data without a schema
+// Output is in the style of `protoc --decode_raw`, length delimited fields are shown
+// as nested messages where they parse as such, otherwise as strings or bytes.
+func DecodeProtobufRaw(data []byte) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := decodeRaw(buf, data, 0); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func decodeRaw(buf *bytes.Buffer, data []byte, depth int) error {
+	indent := strings.Repeat("  ", depth)
+
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fmt.Fprintf(buf, "%s%d: %d\n", indent, num, v)
+			data = data[n:]
+
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fmt.Fprintf(buf, "%s%d: 0x%08x\n", indent, num, v)
+			data = data[n:]
+
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fmt.Fprintf(buf, "%s%d: 0x%016x\n", indent, num, v)
+			data = data[n:]
+
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+
+			// Attempt to decode as a nested message, falling back to string / bytes
+			nested := bytes.NewBuffer(nil)
+			if len(v) > 0 && decodeRaw(nested, v, depth+1) == nil {
+				fmt.Fprintf(buf, "%s%d {\n%s%s}\n", indent, num, nested.String(), indent)
+			} else if utf8.Valid(v) {
+				fmt.Fprintf(buf, "%s%d: %q\n", indent, num, v)
+			} else {
+				fmt.Fprintf(buf, "%s%d: 0x%x\n", indent, num, v)
+			}
+
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d (field %d)", typ, num)
+		}
+	}
+
+	return nil
+}
+
+// ProtoRegistry decodes and encodes gRPC messages using loaded protobuf descriptors
+type ProtoRegistry struct {
+	files *protoregistry.Files
+	types *protoregistry.Types
+}
+
+// LoadProtoDescriptors loads compiled FileDescriptorSets from the provided files
+// Sets should be compiled with --include_imports so dependencies can be resolved
+func LoadProtoDescriptors(files ...string) (*ProtoRegistry, error) {
+	set := descriptorpb.FileDescriptorSet{}
+
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		s := descriptorpb.FileDescriptorSet{}
+		if err := proto.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("error parsing descriptor set %s: %s", f, err)
+		}
+
+		set.File = append(set.File, s.File...)
+	}
+
+	reg, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, err
+	}
+
+	// Message types are registered to resolve Any fields
+	types := &protoregistry.Types{}
+	reg.RangeFiles(func(f protoreflect.FileDescriptor) bool {
+		registerMessages(types, f.Messages())
+		return true
+	})
+
+	return &ProtoRegistry{files: reg, types: types}, nil
+}
+
+// registerMessages registers message types (including nested types) with a type registry
+func registerMessages(types *protoregistry.Types, msgs protoreflect.MessageDescriptors) {
+	for i := 0; i < msgs.Len(); i++ {
+		types.RegisterMessage(dynamicpb.NewMessageType(msgs.Get(i)))
+		registerMessages(types, msgs.Get(i).Messages())
+	}
+}
+
+// messageType fetches the message type for a gRPC method path in the provided direction
+func (r *ProtoRegistry) messageType(method string, dir Direction) (protoreflect.MessageDescriptor, error) {
+	parts := strings.Split(strings.TrimPrefix(method, "/"), "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid gRPC method: '%s'", method)
+	}
+
+	d, err := r.files.FindDescriptorByName(protoreflect.FullName(parts[0]))
+	if err != nil {
+		return nil, err
+	}
+	svc, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not a service", parts[0])
+	}
+
+	m := svc.Methods().ByName(protoreflect.Name(parts[1]))
+	if m == nil {
+		return nil, fmt.Errorf("method '%s' not found in service '%s'", parts[1], parts[0])
+	}
+
+	if dir == ClientToServer {
+		return m.Input(), nil
+	}
+	return m.Output(), nil
+}
+
+// Decode decodes a gRPC message to JSON
+func (r *ProtoRegistry) Decode(method string, dir Direction, data []byte) (string, error) {
+	t, err := r.messageType(method, dir)
+	if err != nil {
+		return "", err
+	}
+
+	m := dynamicpb.NewMessage(t)
+	if err := proto.Unmarshal(data, m); err != nil {
+		return "", err
+	}
+
+	js, err := protojson.MarshalOptions{Resolver: r.types}.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	return string(js), nil
+}
+
+// Encode encodes a gRPC message from JSON
+func (r *ProtoRegistry) Encode(method string, dir Direction, js string) ([]byte, error) {
+	t, err := r.messageType(method, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	m := dynamicpb.NewMessage(t)
+	if err := (protojson.UnmarshalOptions{Resolver: r.types}).Unmarshal([]byte(js), m); err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(m)
+}
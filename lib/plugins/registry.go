@@ -0,0 +1,226 @@
+/**
+ * Registry of plugin types, used to create plugins by name from configuration
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package plugins
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Factory creates a plugin instance from string parameters
+type Factory func(params map[string]string) (interface{}, error)
+
+var (
+	registryLock sync.RWMutex
+	factories    = map[string]Factory{}
+)
+
+// Register adds a plugin type to the registry, replacing any existing type with the same name
+func Register(name string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	factories[name] = factory
+}
+
+// Types lists the registered plugin types
+func Types() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	types := make([]string, 0, len(factories))
+	for name := range factories {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// New creates a plugin of a registered type
+func New(name string, params map[string]string) (interface{}, error) {
+	registryLock.RLock()
+	factory, ok := factories[name]
+	registryLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown plugin type '%s' (available: %s)", name, strings.Join(Types(), ", "))
+	}
+	if params == nil {
+		params = map[string]string{}
+	}
+	return factory(params)
+}
+
+// checkParams ensures only known parameters are provided to a factory
+func checkParams(params map[string]string, known ...string) error {
+	for k := range params {
+		found := false
+		for _, n := range known {
+			found = found || k == n
+		}
+		if !found {
+			return fmt.Errorf("unknown parameter '%s'", k)
+		}
+	}
+	return nil
+}
+
+func init() {
+	Register("hsts", func(params map[string]string) (interface{}, error) {
+		if err := checkParams(params); err != nil {
+			return nil, err
+		}
+		return NewHSTS(), nil
+	})
+	Register("cors", func(params map[string]string) (interface{}, error) {
+		if err := checkParams(params, "value", "credentials", "methods", "headers", "expose", "max-age", "preflight"); err != nil {
+			return nil, err
+		}
+		options := DefaultCORSOptions
+		if v, ok := params["value"]; ok {
+			options.Origin = v
+		}
+		for k, p := range map[string]*bool{"credentials": &options.Credentials, "preflight": &options.Preflight} {
+			if v := params[k]; v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s parameter: %s", k, err)
+				}
+				*p = b
+			}
+		}
+		for k, p := range map[string]*[]string{"methods": &options.Methods, "headers": &options.Headers, "expose": &options.Expose} {
+			if v := params[k]; v != "" {
+				*p = strings.Split(v, ",")
+			}
+		}
+		if m := params["max-age"]; m != "" {
+			d, err := time.ParseDuration(m)
+			if err != nil {
+				return nil, fmt.Errorf("invalid max-age: %s", err)
+			}
+			options.MaxAge = d
+		}
+		return NewCORSWithOptions(options), nil
+	})
+	Register("cookies", func(params map[string]string) (interface{}, error) {
+		if err := checkParams(params, "rules", "log"); err != nil {
+			return nil, err
+		}
+		var rules []CookieRule
+		if r := params["rules"]; r != "" {
+			for _, spec := range strings.Split(r, ";") {
+				rule, err := ParseCookieRule(spec)
+				if err != nil {
+					return nil, err
+				}
+				rules = append(rules, *rule)
+			}
+		}
+		log := false
+		if l := params["log"]; l != "" {
+			var err error
+			if log, err = strconv.ParseBool(l); err != nil {
+				return nil, fmt.Errorf("invalid log parameter: %s", err)
+			}
+		}
+		return NewCookies(rules, log), nil
+	})
+	Register("csp", func(params map[string]string) (interface{}, error) {
+		if err := checkParams(params, "origins", "nonce"); err != nil {
+			return nil, err
+		}
+		var origins []string
+		if o := params["origins"]; o != "" {
+			origins = strings.Split(o, ",")
+		}
+		return NewCSP(origins, params["nonce"]), nil
+	})
+	Register("inject", func(params map[string]string) (interface{}, error) {
+		if err := checkParams(params, "content", "anchor", "nonce", "asset", "path"); err != nil {
+			return nil, err
+		}
+		anchor, path := InjectHeadEnd, DefaultInjectPath
+		if a := params["anchor"]; a != "" {
+			anchor = InjectAnchor(a)
+		}
+		if p := params["path"]; p != "" {
+			path = p
+		}
+		content := params["content"]
+		if content == "" && params["asset"] != "" {
+			content = fmt.Sprintf(`<script src="%s"></script>`, path)
+		}
+		if content == "" {
+			return nil, fmt.Errorf("content or asset parameter required")
+		}
+		inject, err := NewInject(content, anchor, params["nonce"])
+		if err != nil {
+			return nil, err
+		}
+		if a := params["asset"]; a != "" {
+			inject.Serve(path, a)
+		}
+		return inject, nil
+	})
+	Register("sri", func(params map[string]string) (interface{}, error) {
+		if err := checkParams(params, "mode"); err != nil {
+			return nil, err
+		}
+		mode := SRIStrip
+		switch m := SRIMode(params["mode"]); m {
+		case "", SRIStrip:
+		case SRIRecompute:
+			mode = m
+		default:
+			return nil, fmt.Errorf("unknown mode '%s' (expected strip or recompute)", m)
+		}
+		return NewSRI(mode), nil
+	})
+	Register("grpc", func(params map[string]string) (interface{}, error) {
+		if err := checkParams(params, "descriptors"); err != nil {
+			return nil, err
+		}
+		var registry *ProtoRegistry
+		if d := params["descriptors"]; d != "" {
+			var err error
+			if registry, err = LoadProtoDescriptors(strings.Split(d, ",")...); err != nil {
+				return nil, fmt.Errorf("loading protobuf descriptors: %s", err)
+			}
+		}
+		return NewGRPCLogger(registry), nil
+	})
+	Register("script", func(params map[string]string) (interface{}, error) {
+		if err := checkParams(params, "file", "timeout", "memory"); err != nil {
+			return nil, err
+		}
+		limits := DefaultScriptLimits
+		if t := params["timeout"]; t != "" {
+			d, err := time.ParseDuration(t)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timeout: %s", err)
+			}
+			limits.Timeout = d
+		}
+		if m := params["memory"]; m != "" {
+			n, err := strconv.Atoi(m)
+			if err != nil {
+				return nil, fmt.Errorf("invalid memory limit: %s", err)
+			}
+			limits.MaxMemory = n
+		}
+		script, err := NewScript(params["file"], limits)
+		if err != nil {
+			return nil, err
+		}
+		return script, nil
+	})
+}
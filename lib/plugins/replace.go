@@ -1,8 +1,228 @@
 /**
- * Replace plugin replaces / overwrites resources based on a command line definition
- * TODO: implement this
+ * Replace plugin replaces / overwrites resources based on a set of rules
+ * Rules may be defined on the command line or managed at runtime
  *
  * Copyright 2017 Ryan Kurte
  */
 
 package plugins
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// ReplaceRule replaces content in requests or responses matching the rule
+// Host and Path are glob patterns (see path.Match), empty fields match everything.
+// Where Header is set the rule applies to values of that header, otherwise to the body.
+// An empty Match overwrites the entire body (or header) with Replace.
+type ReplaceRule struct {
+	ID      uint64 `json:"id"`
+	Host    string `json:"host,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Request bool   `json:"request"`
+	Header  string `json:"header,omitempty"`
+	Match   string `json:"match,omitempty"`
+	Replace string `json:"replace"`
+
+	exp *regexp.Regexp
+}
+
+// ErrUnknownRule is returned when a rule ID does not match an existing rule
+var ErrUnknownRule = errors.New("unknown rule")
+
+// ParseReplaceRule parses a response body rule from a match expression and replacement separated
+// by => (ie. "https?://example\.com=>https://example.org"), or for rules without this, by the last
+// colon (ie. "https?://secure:insecure"), in which case the replacement may not contain a colon.
+func ParseReplaceRule(s string) (*ReplaceRule, error) {
+	i, n := strings.Index(s, "=>"), 2
+	if i < 0 {
+		i, n = strings.LastIndex(s, ":"), 1
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("invalid replacement '%s' (expected match=>replacement)", s)
+	}
+
+	rule := ReplaceRule{Match: s[:i], Replace: s[i+n:]}
+	if _, err := regexp.Compile(rule.Match); err != nil {
+		return nil, fmt.Errorf("invalid match expression: %s", err)
+	}
+
+	return &rule, nil
+}
+
+// Replace plugin applies replacement rules to requests and responses
+type Replace struct {
+	base
+
+	lock   sync.RWMutex
+	rules  []*ReplaceRule
+	lastID uint64
+}
+
+// NewReplace creates a new instance of the replace plugin
+func NewReplace() *Replace {
+	return &Replace{
+		base:  newBase("replace"),
+		rules: make([]*ReplaceRule, 0),
+	}
+}
+
+// AddRule adds a replacement rule, returning the rule ID
+func (r *Replace) AddRule(rule ReplaceRule) (uint64, error) {
+	if rule.Match != "" {
+		exp, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return 0, fmt.Errorf("invalid match expression: %s", err)
+		}
+		rule.exp = exp
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.lastID++
+	rule.ID = r.lastID
+	rules := make([]*ReplaceRule, 0, len(r.rules)+1)
+	r.rules = append(append(rules, r.rules...), &rule)
+
+	return rule.ID, nil
+}
+
+// SetRules replaces all replacement rules, no rules are changed if any are invalid
+func (r *Replace) SetRules(rules []ReplaceRule) error {
+	compiled := make([]*ReplaceRule, len(rules))
+	for i := range rules {
+		rule := rules[i]
+		if rule.Match != "" {
+			exp, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return fmt.Errorf("invalid match expression: %s", err)
+			}
+			rule.exp = exp
+		}
+		compiled[i] = &rule
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, rule := range compiled {
+		r.lastID++
+		rule.ID = r.lastID
+	}
+	r.rules = compiled
+
+	return nil
+}
+
+// RemoveRule removes a replacement rule by ID
+func (r *Replace) RemoveRule(id uint64) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// Rules are copied rather than modified in place as processing uses a snapshot
+	for i, rule := range r.rules {
+		if rule.ID == id {
+			rules := make([]*ReplaceRule, 0, len(r.rules)-1)
+			r.rules = append(append(rules, r.rules[:i]...), r.rules[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrUnknownRule
+}
+
+// Rules fetches a copy of the current replacement rules
+func (r *Replace) Rules() []ReplaceRule {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	rules := make([]ReplaceRule, len(r.rules))
+	for i, rule := range r.rules {
+		rules[i] = *rule
+	}
+	return rules
+}
+
+// ProcessRequest applies request replacement rules
+func (r *Replace) ProcessRequest(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	return r.apply(ctx, true, header, body)
+}
+
+// ProcessResponse applies response replacement rules
+func (r *Replace) ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	return r.apply(ctx, false, header, body)
+}
+
+func (r *Replace) apply(ctx interface{}, request bool, header http.Header, body string) (http.Header, string) {
+	r.lock.RLock()
+	rules := r.rules
+	r.lock.RUnlock()
+
+	for _, rule := range rules {
+		if rule.Request != request || !rule.matches(ctx) {
+			continue
+		}
+
+		if rule.Header == "" {
+			if replaced := rule.replace(body); replaced != body {
+				body = replaced
+				r.annotate(ctx, "rule %d modified body", rule.ID)
+			}
+			continue
+		}
+
+		values := header[http.CanonicalHeaderKey(rule.Header)]
+		if len(values) == 0 && rule.exp == nil {
+			header.Set(rule.Header, rule.Replace)
+			r.annotate(ctx, "rule %d set header %s", rule.ID, rule.Header)
+		}
+		for i, v := range values {
+			if replaced := rule.replace(v); replaced != v {
+				values[i] = replaced
+				r.annotate(ctx, "rule %d modified header %s", rule.ID, rule.Header)
+			}
+		}
+	}
+
+	return header, body
+}
+
+// matches checks whether a rule applies to the request for a flow
+func (rule *ReplaceRule) matches(ctx interface{}) bool {
+	if rule.Host == "" && rule.Path == "" {
+		return true
+	}
+
+	f, ok := ctx.(*flow.Flow)
+	if !ok || f.Request == nil {
+		return false
+	}
+
+	if rule.Host != "" {
+		if ok, _ := path.Match(strings.ToLower(rule.Host), strings.ToLower(f.Request.URL.Hostname())); !ok {
+			return false
+		}
+	}
+	if rule.Path != "" {
+		if ok, _ := path.Match(rule.Path, f.Request.URL.Path); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule *ReplaceRule) replace(s string) string {
+	if rule.exp == nil {
+		return rule.Replace
+	}
+	return rule.exp.ReplaceAllString(s, rule.Replace)
+}
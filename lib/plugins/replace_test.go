@@ -0,0 +1,53 @@
+package plugins
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReplaceRule(t *testing.T) {
+	tests := []struct {
+		s     string
+		match string
+		repl  string
+	}{
+		{`https?://example\.com=>https://example.org`, `https?://example\.com`, `https://example.org`},
+		{`a=>b=>c`, `a`, `b=>c`},
+		{`https?://secure:insecure`, `https?://secure`, `insecure`},
+		{`remove:`, `remove`, ``},
+		{`=>overwrite`, ``, `overwrite`},
+	}
+
+	for _, tt := range tests {
+		rule, err := ParseReplaceRule(tt.s)
+		if assert.Nil(t, err, tt.s) {
+			assert.Equal(t, &ReplaceRule{Match: tt.match, Replace: tt.repl}, rule, tt.s)
+		}
+	}
+
+	for _, s := range []string{"nothing", "([a-z]=>b"} {
+		_, err := ParseReplaceRule(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	r := NewReplace()
+
+	// Rules are applied in order, so later rules see the output of earlier ones
+	var rules []ReplaceRule
+	for _, s := range []string{"https://=>http://", "http://secure=>http://insecure"} {
+		rule, err := ParseReplaceRule(s)
+		assert.Nil(t, err)
+		rules = append(rules, *rule)
+	}
+	assert.Nil(t, r.SetRules(rules))
+
+	runResponseFixtures(t, r, []fixture{{
+		name:      "Applies rules in order",
+		in:        message{body: `<a href="https://secure.example.com">`},
+		out:       message{body: `<a href="http://insecure.example.com">`},
+		annotated: true,
+	}})
+}
@@ -0,0 +1,301 @@
+package plugins
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ryankurte/evilproxy/lib/filter"
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// Scope limits the flows processed by a plugin, empty fields match everything
+// Hosts, Paths and Types are glob patterns (see path.Match, ie. "*.example.com", "/api/*", "text/*"),
+// Status entries are codes or classes (ie. "404", "5xx"), and Filter is a filter expression
+// (see the filter package) evaluated against the flow so far.
+// Types and Status only apply to hooks processing responses.
+type Scope struct {
+	Hosts   []string       `json:"hosts,omitempty"`
+	Paths   []string       `json:"paths,omitempty"`
+	Methods []string       `json:"methods,omitempty"`
+	Types   []string       `json:"types,omitempty"`
+	Status  []string       `json:"status,omitempty"`
+	Filter  *filter.Filter `json:"filter,omitempty"`
+}
+
+// Scoped interface implemented by plugins that provide a default scope
+type Scoped interface {
+	DefaultScope() Scope
+}
+
+// ParseScope parses a scope from a comma separated list of key=value pairs, with multiple
+// values separated by '|' (ie. "host=*.example.com|example.com,type=text/html,status=2xx")
+// A filter expression may be provided as the final field, this consumes the remainder of the string.
+func ParseScope(s string) (*Scope, error) {
+	scope := Scope{}
+
+	pairs := strings.Split(s, ",")
+	for n, pair := range pairs {
+		if k := strings.TrimSpace(pair); strings.HasPrefix(k, "filter=") {
+			f, err := filter.Parse(strings.TrimPrefix(strings.Join(append([]string{k}, pairs[n+1:]...), ","), "filter="))
+			if err != nil {
+				return nil, err
+			}
+			scope.Filter = f
+			break
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid scope field: '%s'", pair)
+		}
+
+		values := strings.Split(strings.TrimSpace(kv[1]), "|")
+		switch k := strings.TrimSpace(kv[0]); k {
+		case "host":
+			scope.Hosts = append(scope.Hosts, values...)
+		case "path":
+			scope.Paths = append(scope.Paths, values...)
+		case "method":
+			scope.Methods = append(scope.Methods, values...)
+		case "type":
+			scope.Types = append(scope.Types, values...)
+		case "status":
+			scope.Status = append(scope.Status, values...)
+		default:
+			return nil, fmt.Errorf("unknown scope field: '%s'", k)
+		}
+	}
+
+	if err := scope.Validate(); err != nil {
+		return nil, err
+	}
+	return &scope, nil
+}
+
+// Validate checks scope patterns are well formed
+func (s *Scope) Validate() error {
+	for _, patterns := range [][]string{s.Hosts, s.Paths, s.Types} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid scope pattern '%s': %s", p, err)
+			}
+		}
+	}
+	for _, st := range s.Status {
+		if !statusPattern(st) {
+			return fmt.Errorf("invalid scope status '%s'", st)
+		}
+	}
+	return nil
+}
+
+// IsEmpty checks whether a scope matches all flows
+func (s *Scope) IsEmpty() bool {
+	return s == nil || (len(s.Hosts) == 0 && len(s.Paths) == 0 && len(s.Methods) == 0 &&
+		len(s.Types) == 0 && len(s.Status) == 0 && s.Filter == nil)
+}
+
+// String formats a scope in the form accepted by ParseScope
+func (s *Scope) String() string {
+	fields := []string{}
+	for _, f := range []struct {
+		key    string
+		values []string
+	}{
+		{"host", s.Hosts}, {"path", s.Paths}, {"method", s.Methods}, {"type", s.Types}, {"status", s.Status},
+	} {
+		if len(f.values) > 0 {
+			fields = append(fields, f.key+"="+strings.Join(f.values, "|"))
+		}
+	}
+	if s.Filter != nil {
+		fields = append(fields, "filter="+s.Filter.String())
+	}
+	return strings.Join(fields, ",")
+}
+
+// Matches checks whether a flow is in scope, response criteria are only checked where response is set
+// Scopes that are not empty never match where no flow is available.
+func (s *Scope) Matches(ctx interface{}, response bool) bool {
+	if s.IsEmpty() {
+		return true
+	}
+
+	f, ok := ctx.(*flow.Flow)
+	if !ok || f.Request == nil {
+		return false
+	}
+	req := f.Request
+
+	if len(s.Hosts) > 0 && !matchAny(s.Hosts, strings.ToLower(req.URL.Hostname())) {
+		return false
+	}
+	if len(s.Paths) > 0 && !matchAny(s.Paths, req.URL.Path) {
+		return false
+	}
+	if len(s.Methods) > 0 && !containsFold(s.Methods, req.Method) {
+		return false
+	}
+
+	if response {
+		if f.Response == nil {
+			return false
+		}
+		if len(s.Types) > 0 {
+			t, _, _ := mime.ParseMediaType(f.Response.Header.Get("Content-Type"))
+			if !matchAny(s.Types, t) {
+				return false
+			}
+		}
+		if len(s.Status) > 0 && !matchStatus(s.Status, f.Response.StatusCode) {
+			return false
+		}
+	}
+
+	if s.Filter != nil {
+		resp := f.Response
+		if !response {
+			resp = nil
+		}
+		return s.Filter.Match(flow.NewRecord(&flow.Flow{
+			ID:           f.ID,
+			Started:      f.Started,
+			Request:      req,
+			Response:     resp,
+			RequestBody:  f.RequestBody,
+			ResponseBody: f.ResponseBody,
+		}))
+	}
+
+	return true
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), strings.ToLower(s)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// statusPattern checks whether a status is a code or class (ie. 4xx)
+func statusPattern(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	if strings.HasSuffix(strings.ToLower(s), "xx") {
+		return s[0] >= '1' && s[0] <= '5'
+	}
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func matchStatus(patterns []string, status int) bool {
+	code := strconv.Itoa(status)
+	for _, p := range patterns {
+		if p == code || (strings.HasSuffix(strings.ToLower(p), "xx") && p[0] == code[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Scoped handler wrappers, these are bound in place of plugins with a scope
+
+type scopedRequest struct {
+	scope *Scope
+	RequestHandler
+}
+
+func (s *scopedRequest) ProcessRequest(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	if !s.scope.Matches(ctx, false) {
+		return header, body
+	}
+	return s.RequestHandler.ProcessRequest(ctx, header, body)
+}
+
+type scopedResponse struct {
+	scope *Scope
+	ResponseHandler
+}
+
+func (s *scopedResponse) ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	if !s.scope.Matches(ctx, true) {
+		return header, body
+	}
+	return s.ResponseHandler.ProcessResponse(ctx, header, body)
+}
+
+type scopedWebSocket struct {
+	scope *Scope
+	WebSocketHandler
+}
+
+func (s *scopedWebSocket) ProcessWebSocket(ctx interface{}, msg *WebSocketMessage) []*WebSocketMessage {
+	if !s.scope.Matches(ctx, false) {
+		return []*WebSocketMessage{msg}
+	}
+	return s.WebSocketHandler.ProcessWebSocket(ctx, msg)
+}
+
+type scopedGRPC struct {
+	scope *Scope
+	GRPCHandler
+}
+
+func (s *scopedGRPC) ProcessGRPCMessage(ctx interface{}, msg *GRPCMessage) []*GRPCMessage {
+	if !s.scope.Matches(ctx, msg.Direction == ServerToClient) {
+		return []*GRPCMessage{msg}
+	}
+	return s.GRPCHandler.ProcessGRPCMessage(ctx, msg)
+}
+
+type scopedGRPCTrailer struct {
+	scope *Scope
+	GRPCTrailerHandler
+}
+
+func (s *scopedGRPCTrailer) ProcessGRPCTrailer(ctx interface{}, method string, trailer http.Header) http.Header {
+	if !s.scope.Matches(ctx, true) {
+		return trailer
+	}
+	return s.GRPCTrailerHandler.ProcessGRPCTrailer(ctx, method, trailer)
+}
+
+type scopedEventStream struct {
+	scope *Scope
+	EventStreamHandler
+}
+
+func (s *scopedEventStream) ProcessEvent(ctx interface{}, ev *Event) []*Event {
+	if !s.scope.Matches(ctx, true) {
+		return []*Event{ev}
+	}
+	return s.EventStreamHandler.ProcessEvent(ctx, ev)
+}
+
+type scopedResponder struct {
+	scope *Scope
+	Responder
+}
+
+func (s *scopedResponder) Respond(ctx interface{}, req *http.Request) *http.Response {
+	if !s.scope.Matches(ctx, false) {
+		return nil
+	}
+	return s.Responder.Respond(ctx, req)
+}
@@ -0,0 +1,77 @@
+package plugins
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// tagger appends its name to processed bodies
+type tagger struct{ base }
+
+func (t *tagger) ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	return header, body + t.name
+}
+
+func TestScope(t *testing.T) {
+	newFlow := func(method, url string, status int, contentType string) *flow.Flow {
+		f := flow.New(httptest.NewRequest(method, url, nil))
+		f.Response = &http.Response{StatusCode: status, Header: http.Header{"Content-Type": {contentType}}}
+		return f
+	}
+
+	scope, err := ParseScope("host=*.example.com|example.com,type=text/*,status=2xx|404,filter=path ~ \"^/a\" || method == POST")
+	assert.Nil(t, err)
+
+	tests := []struct {
+		flow     *flow.Flow
+		response bool
+		match    bool
+	}{
+		{newFlow("GET", "http://www.example.com/a", 200, "text/html; charset=utf-8"), true, true},
+		{newFlow("GET", "http://example.com/a", 404, "text/plain"), true, true},
+		{newFlow("POST", "http://example.com/b", 200, "text/plain"), true, true},
+		{newFlow("GET", "http://example.com/b", 200, "text/plain"), true, false},
+		{newFlow("GET", "http://other.com/a", 200, "text/html"), true, false},
+		{newFlow("GET", "http://example.com/a", 500, "text/html"), true, false},
+		{newFlow("GET", "http://example.com/a", 200, "image/png"), true, false},
+		{newFlow("GET", "http://example.com/a", 200, "image/png"), false, true},
+	}
+
+	for i, test := range tests {
+		assert.Equal(t, test.match, scope.Matches(test.flow, test.response), "test %d", i)
+	}
+
+	assert.Equal(t, `host=*.example.com|example.com,type=text/*,status=2xx|404,filter=path ~ "^/a" || method == POST`, scope.String())
+
+	_, err = ParseScope("status=6xx")
+	assert.NotNil(t, err)
+	_, err = ParseScope("colour=blue")
+	assert.NotNil(t, err)
+}
+
+func TestPluginManagerScope(t *testing.T) {
+	pm := PluginManager{}
+	pm.Bind(&tagger{newBase("a")})
+	pm.BindScoped(&tagger{newBase("b")}, Scope{Hosts: []string{"b.com"}})
+
+	f := flow.New(httptest.NewRequest("GET", "http://a.com/", nil))
+	f.Response = &http.Response{StatusCode: 200, Header: http.Header{}}
+	_, body := pm.ProcessResponse(f, http.Header{}, "")
+	assert.Equal(t, "a", body)
+
+	assert.Nil(t, pm.SetScope("b", Scope{}))
+	_, body = pm.ProcessResponse(f, http.Header{}, "")
+	assert.Equal(t, "ab", body)
+
+	assert.Equal(t, ErrUnknownPlugin, pm.SetScope("c", Scope{}))
+	assert.NotNil(t, pm.SetScope("a", Scope{Paths: []string{"["}}))
+
+	// Plugins may provide default scopes
+	pm.Bind(NewSRI(SRIStrip))
+	assert.Equal(t, []string{"text/html", "application/xhtml+xml", "application/javascript", "text/javascript", "application/x-javascript"}, pm.Plugins()[2].Scope.Types)
+}
@@ -0,0 +1,517 @@
+/**
+ * Script plugin runs Lua scripts against requests and responses
+ * This allows one-off rewrites without rebuilding the proxy.
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+const (
+	scriptRequestHook  = "onRequest"
+	scriptResponseHook = "onResponse"
+
+	// scriptCheckInterval is the minimum interval between checks for script modifications
+	scriptCheckInterval = time.Second
+
+	// scriptSlotSize is the approximate size of a Lua stack slot, used to bound stack growth
+	scriptSlotSize = 16
+
+	// scriptMemoryInterval is the interval between checks of the memory held by a running script
+	scriptMemoryInterval = time.Millisecond
+)
+
+// ScriptLimits bounds the resources available to each script hook call
+// Scripts exceeding a limit are stopped and the flow passed through unmodified.
+type ScriptLimits struct {
+	// Timeout is the time allowed for each hook call (and for loading the script)
+	Timeout time.Duration
+	// MaxMemory bounds (in bytes) the Lua stack and the strings and tables held by a script, not including
+	// the flow passed to hooks (0 for unlimited). This is checked periodically while scripts run, so may be
+	// briefly exceeded by up to the allocations made between checks.
+	MaxMemory int
+}
+
+// DefaultScriptLimits are the limits applied to scripts where not otherwise configured
+var DefaultScriptLimits = ScriptLimits{Timeout: 100 * time.Millisecond, MaxMemory: 64 << 20}
+
+// Script plugin calls the onRequest and onResponse functions defined by a Lua script
+// Hooks are called with a flow table containing the id, method, url, host, path, headers,
+// body and (for responses) status, where changes to headers and body are applied to the flow.
+// Headers are tables of canonical names to strings, or lists of strings where repeated.
+//
+//	function onResponse(flow)
+//	  flow.headers["X-Frame-Options"] = nil
+//	  flow.body = string.gsub(flow.body, "https://", "http://")
+//	  annotate("rewrote links")
+//	end
+//
+// Scripts run in a sandbox with the base, string, table and math libraries only,
+// and are reloaded when modified.
+type Script struct {
+	base
+	path   string
+	limits ScriptLimits
+
+	lock     sync.Mutex
+	checked  time.Time
+	modified time.Time
+	program  *scriptProgram
+}
+
+// scriptProgram is a compiled script with a pool of states in which it has been run
+// States are not safe for concurrent use, so each hook call takes a state from the pool.
+type scriptProgram struct {
+	proto  *lua.FunctionProto
+	limits ScriptLimits
+	log    logrus.FieldLogger
+	pool   sync.Pool
+}
+
+// NewScript loads a script plugin from the provided file, named for the file (ie. rewrite.lua as rewrite)
+func NewScript(path string, limits ScriptLimits) (*Script, error) {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	s := &Script{
+		base:   newBase(name),
+		path:   path,
+		limits: limits,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ProcessRequest calls the script onRequest hook
+func (s *Script) ProcessRequest(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	return s.call(ctx, scriptRequestHook, header, body)
+}
+
+// ProcessResponse calls the script onResponse hook
+func (s *Script) ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	return s.call(ctx, scriptResponseHook, header, body)
+}
+
+// load compiles the script and runs it in a new state, this must be called with the lock held
+func (s *Script) load() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	src, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(string(src)), s.path)
+	if err != nil {
+		return fmt.Errorf("parsing script: %s", err)
+	}
+	proto, err := lua.Compile(chunk, s.path)
+	if err != nil {
+		return fmt.Errorf("compiling script: %s", err)
+	}
+
+	p := &scriptProgram{proto: proto, limits: s.limits, log: s.FieldLogger}
+	L, err := p.newState()
+	if err != nil {
+		return err
+	}
+	p.pool.Put(L)
+
+	s.program, s.modified, s.checked = p, info.ModTime(), time.Now()
+
+	return nil
+}
+
+// current fetches the current program, reloading the script where it has been modified
+// Errors loading a modified script are logged and the previous program retained.
+func (s *Script) current() *scriptProgram {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if time.Since(s.checked) < scriptCheckInterval {
+		return s.program
+	}
+	s.checked = time.Now()
+
+	info, err := os.Stat(s.path)
+	if err != nil || info.ModTime().Equal(s.modified) {
+		return s.program
+	}
+
+	if err := s.load(); err != nil {
+		s.modified = info.ModTime()
+		s.WithField("path", s.path).Printf("error reloading script: %s", err)
+		return s.program
+	}
+	s.WithField("path", s.path).Printf("reloaded script")
+
+	return s.program
+}
+
+func (s *Script) call(ctx interface{}, hook string, header http.Header, body string) (http.Header, string) {
+	p := s.current()
+
+	L, err := p.get()
+	if err != nil {
+		s.Printf("error creating script state: %s", err)
+		return header, body
+	}
+
+	fn := L.GetGlobal(hook)
+	if fn.Type() != lua.LTFunction {
+		p.pool.Put(L)
+		return header, body
+	}
+
+	f, _ := ctx.(*flow.Flow)
+	L.SetGlobal("annotate", L.NewFunction(func(L *lua.LState) int {
+		s.annotate(ctx, "%s", L.CheckString(1))
+		return 0
+	}))
+
+	t := scriptFlow(L, f, hook == scriptResponseHook, header, body)
+	if err := p.run(L, fn, t); err != nil {
+		// States are discarded following errors as these may have been stopped mid-execution
+		s.WithField("hook", hook).Printf("script error: %s", err)
+		s.annotate(ctx, "%s error: %s", hook, err)
+		return header, body
+	}
+	p.pool.Put(L)
+
+	if h, ok := t.RawGetString("headers").(*lua.LTable); ok {
+		header = scriptHeader(h)
+	} else {
+		header = http.Header{}
+	}
+	if b, ok := t.RawGetString("body").(lua.LString); ok {
+		body = string(b)
+	} else {
+		body = ""
+	}
+
+	return header, body
+}
+
+// get fetches a state from the pool, creating one if required
+func (p *scriptProgram) get() (*lua.LState, error) {
+	if L, ok := p.pool.Get().(*lua.LState); ok {
+		return L, nil
+	}
+	return p.newState()
+}
+
+// newState creates a sandboxed state and runs the script to define hooks
+func (p *scriptProgram) newState() (*lua.LState, error) {
+	opts := lua.Options{SkipOpenLibs: true, MinimizeStackMemory: true}
+	if p.limits.MaxMemory > 0 {
+		opts.RegistrySize, opts.RegistryMaxSize = 1024, p.limits.MaxMemory/scriptSlotSize
+	}
+	L := lua.NewState(opts)
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	// Remove functions providing access to the filesystem or loading code
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	// Bound functions able to build large strings from small inputs
+	str := L.GetGlobal(lua.StringLibName).(*lua.LTable)
+	str.RawSetString("rep", L.NewFunction(p.stringRep))
+	tab := L.GetGlobal(lua.TabLibName).(*lua.LTable)
+	concat := tab.RawGetString("concat").(*lua.LFunction)
+	tab.RawSetString("concat", L.NewFunction(func(L *lua.LState) int {
+		n := concat.GFunction(L)
+		if s := L.Get(-1); p.limits.MaxMemory > 0 && s.Type() == lua.LTString && len(s.String()) > p.limits.MaxMemory {
+			L.RaiseError("%s", errScriptMemory)
+		}
+		return n
+	}))
+
+	L.SetGlobal("log", L.NewFunction(func(L *lua.LState) int {
+		args := make([]string, L.GetTop())
+		for i := range args {
+			args[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+		p.log.Printf("%s", strings.Join(args, " "))
+		return 0
+	}))
+
+	if err := p.run(L, L.NewFunctionFromProto(p.proto)); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("running script: %s", err)
+	}
+
+	return L, nil
+}
+
+// run calls a function within the configured time and memory limits
+func (p *scriptProgram) run(L *lua.LState, fn lua.LValue, args ...lua.LValue) error {
+	var ctx context.Context = context.Background()
+	if p.limits.Timeout > 0 {
+		c, cancel := context.WithTimeout(ctx, p.limits.Timeout)
+		defer cancel()
+		ctx = c
+	}
+	if p.limits.MaxMemory > 0 {
+		m := newScriptMemory(ctx, L, p.limits.MaxMemory, args)
+		defer m.stop()
+		ctx = m
+	}
+	if p.limits.Timeout > 0 || p.limits.MaxMemory > 0 {
+		L.SetContext(ctx)
+		defer L.RemoveContext()
+	}
+
+	return L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, args...)
+}
+
+// stringRep implements string.rep, limited to the memory limit
+func (p *scriptProgram) stringRep(L *lua.LState) int {
+	s, n := L.CheckString(1), L.CheckInt(2)
+	if n > 0 && p.limits.MaxMemory > 0 && len(s) > 0 && n > p.limits.MaxMemory/len(s) {
+		L.RaiseError("%s", errScriptMemory)
+	}
+	if n <= 0 {
+		L.Push(lua.LString(""))
+	} else {
+		L.Push(lua.LString(strings.Repeat(s, n)))
+	}
+	return 1
+}
+
+// errScriptMemory is raised in scripts exceeding the memory limit
+var errScriptMemory = errors.New("memory limit exceeded")
+
+// closedChan is returned by scriptMemory.Done once the memory limit has been exceeded
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// scriptMemory is a context limiting the memory held by a running script
+// The VM calls Done before each instruction, which measures the state once the check flag is
+// set by a ticker, so checks run in the VM goroutine without slowing every instruction.
+type scriptMemory struct {
+	context.Context
+	L     *lua.LState
+	limit int
+
+	check  int32
+	next   time.Time
+	err    error
+	ticker *time.Ticker
+	done   chan struct{}
+}
+
+func newScriptMemory(ctx context.Context, L *lua.LState, limit int, args []lua.LValue) *scriptMemory {
+	m := &scriptMemory{
+		Context: ctx,
+		L:       L,
+		// Arguments are already held by the proxy, so are not counted against the limit
+		limit:  limit + scriptMeasure(args, -1),
+		ticker: time.NewTicker(scriptMemoryInterval),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		for {
+			select {
+			case <-m.ticker.C:
+				atomic.StoreInt32(&m.check, 1)
+			case <-m.done:
+				return
+			}
+		}
+	}()
+
+	return m
+}
+
+func (m *scriptMemory) stop() {
+	m.ticker.Stop()
+	close(m.done)
+}
+
+// Done measures the state where a check is due, returning a closed channel when over the limit
+func (m *scriptMemory) Done() <-chan struct{} {
+	if m.err == nil && atomic.LoadInt32(&m.check) != 0 {
+		m.measure()
+	}
+	if m.err != nil {
+		return closedChan
+	}
+	return m.Context.Done()
+}
+
+func (m *scriptMemory) Err() error {
+	if m.err != nil {
+		return m.err
+	}
+	return m.Context.Err()
+}
+
+// measure walks the globals and the locals of running functions, skipping checks for the
+// duration of the last walk so large states are not measured continuously
+func (m *scriptMemory) measure() {
+	atomic.StoreInt32(&m.check, 0)
+	now := time.Now()
+	if now.Before(m.next) {
+		return
+	}
+
+	values := []lua.LValue{m.L.G.Global, m.L.G.Registry}
+	for level := 0; ; level++ {
+		dbg, ok := m.L.GetStack(level)
+		if !ok {
+			break
+		}
+		for n := 1; ; n++ {
+			name, v := m.L.GetLocal(dbg, n)
+			if name == "" {
+				break
+			}
+			values = append(values, v)
+		}
+	}
+
+	if scriptMeasure(values, m.limit) > m.limit {
+		m.err = errScriptMemory
+	}
+	m.next = time.Now().Add(time.Since(now))
+}
+
+// scriptMeasure estimates the memory held by the provided values and those reachable from them,
+// stopping once the limit is exceeded (where the limit is not negative)
+func scriptMeasure(values []lua.LValue, limit int) int {
+	size := 0
+	seen := map[interface{}]bool{}
+
+	for len(values) > 0 && (limit < 0 || size <= limit) {
+		v := values[len(values)-1]
+		values = values[:len(values)-1]
+		size += scriptSlotSize
+
+		switch v := v.(type) {
+		case lua.LString:
+			// Strings share storage where copied, so are counted once
+			if p := unsafe.StringData(string(v)); p != nil && !seen[p] {
+				seen[p] = true
+				size += len(v)
+			}
+		case *lua.LTable:
+			if seen[v] {
+				continue
+			}
+			seen[v] = true
+			v.ForEach(func(key, value lua.LValue) {
+				values = append(values, key, value)
+			})
+			if v.Metatable != nil {
+				values = append(values, v.Metatable)
+			}
+		case *lua.LFunction:
+			if seen[v] {
+				continue
+			}
+			seen[v] = true
+			for _, uv := range v.Upvalues {
+				values = append(values, uv.Value())
+			}
+		case *lua.LUserData:
+			if v.Metatable != nil {
+				values = append(values, v.Metatable)
+			}
+		}
+	}
+
+	return size
+}
+
+// scriptFlow creates the flow table passed to hooks
+func scriptFlow(L *lua.LState, f *flow.Flow, response bool, header http.Header, body string) *lua.LTable {
+	t := L.NewTable()
+
+	if f != nil && f.Request != nil {
+		t.RawSetString("id", lua.LNumber(f.ID))
+		t.RawSetString("method", lua.LString(f.Request.Method))
+		t.RawSetString("url", lua.LString(f.Request.URL.String()))
+		t.RawSetString("host", lua.LString(f.Request.URL.Hostname()))
+		t.RawSetString("path", lua.LString(f.Request.URL.Path))
+	}
+	if response && f != nil && f.Response != nil {
+		t.RawSetString("status", lua.LNumber(f.Response.StatusCode))
+	}
+
+	h := L.NewTable()
+	for name, values := range header {
+		if len(values) == 1 {
+			h.RawSetString(name, lua.LString(values[0]))
+			continue
+		}
+		list := L.NewTable()
+		for _, v := range values {
+			list.Append(lua.LString(v))
+		}
+		h.RawSetString(name, list)
+	}
+	t.RawSetString("headers", h)
+	t.RawSetString("body", lua.LString(body))
+
+	return t
+}
+
+// scriptHeader converts a headers table returned from a hook
+func scriptHeader(t *lua.LTable) http.Header {
+	header := http.Header{}
+	t.ForEach(func(k, v lua.LValue) {
+		name := http.CanonicalHeaderKey(k.String())
+		switch v := v.(type) {
+		case lua.LString, lua.LNumber:
+			header.Add(name, v.String())
+		case *lua.LTable:
+			v.ForEach(func(_, e lua.LValue) {
+				header.Add(name, e.String())
+			})
+		}
+	})
+	return header
+}
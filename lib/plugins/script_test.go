@@ -0,0 +1,159 @@
+package plugins
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuin/gopher-lua"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+const testScript = `
+function onRequest(flow)
+  flow.headers["X-Script"] = flow.method .. " " .. flow.path
+end
+
+function onResponse(flow)
+  if flow.status == 200 then
+    flow.headers["Strict-Transport-Security"] = nil
+    flow.body = string.gsub(flow.body, "https://", "http://")
+    annotate("rewrote links")
+  end
+end
+`
+
+func TestScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "evpx-script")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, src string) string {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, ioutil.WriteFile(path, []byte(src), 0600))
+		return path
+	}
+
+	limits := ScriptLimits{Timeout: 200 * time.Millisecond, MaxMemory: 1 << 20}
+
+	t.Run("Rewrites flows", func(t *testing.T) {
+		s, err := NewScript(write("rewrite.lua", testScript), limits)
+		assert.Nil(t, err)
+		assert.Equal(t, "rewrite", s.Name())
+
+		f := flow.New(httptest.NewRequest("GET", "http://example.com/a", nil))
+		header, _ := s.ProcessRequest(f, http.Header{"Accept": {"text/html"}}, "")
+		assert.Equal(t, "GET /a", header.Get("X-Script"))
+		assert.Equal(t, "text/html", header.Get("Accept"))
+
+		f.Response = &http.Response{StatusCode: 200}
+		header, body := s.ProcessResponse(f, http.Header{"Strict-Transport-Security": {"max-age=1"}, "Set-Cookie": {"a=1", "b=2"}}, `<a href="https://example.com">`)
+		assert.Equal(t, `<a href="http://example.com">`, body)
+		assert.Empty(t, header.Get("Strict-Transport-Security"))
+		assert.Equal(t, []string{"a=1", "b=2"}, header["Set-Cookie"])
+		assert.Equal(t, []flow.Annotation{{Source: "rewrite", Message: "rewrote links"}}, f.Annotations())
+	})
+
+	t.Run("Rejects invalid scripts", func(t *testing.T) {
+		_, err := NewScript(write("invalid.lua", "function onRequest("), limits)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Sandboxes scripts", func(t *testing.T) {
+		s, err := NewScript(write("sandbox.lua", `
+function onRequest(flow)
+  flow.body = tostring(io == nil and os == nil and dofile == nil and require == nil)
+end`), limits)
+		assert.Nil(t, err)
+
+		_, body := s.ProcessRequest(nil, http.Header{}, "")
+		assert.Equal(t, "true", body)
+	})
+
+	t.Run("Enforces limits", func(t *testing.T) {
+		s, err := NewScript(write("limits.lua", `
+function onRequest(flow)
+  while true do end
+end
+function onResponse(flow)
+  flow.body = string.rep("x", 2 * 1024 * 1024)
+end`), limits)
+		assert.Nil(t, err)
+
+		start := time.Now()
+		_, body := s.ProcessRequest(nil, http.Header{}, "unmodified")
+		assert.Equal(t, "unmodified", body)
+		assert.True(t, time.Since(start) < time.Second)
+
+		_, body = s.ProcessResponse(nil, http.Header{}, "unmodified")
+		assert.Equal(t, "unmodified", body)
+	})
+
+	t.Run("Enforces memory limits on tables and strings", func(t *testing.T) {
+		// The timeout exceeds the test deadline, so scripts must be stopped by the memory limit
+		s, err := NewScript(write("memory.lua", `
+function onRequest(flow)
+  local t = {}
+  while true do t[#t + 1] = "entry " .. #t end
+end
+function onResponse(flow)
+  local s = "x"
+  while true do s = s .. s end
+end
+function overflow()
+  return string.rep("xxxxxxxx", 2 ^ 61)
+end`), ScriptLimits{Timeout: 10 * time.Second, MaxMemory: 1 << 20})
+		assert.Nil(t, err)
+
+		for _, call := range []func(interface{}, http.Header, string) (http.Header, string){s.ProcessRequest, s.ProcessResponse} {
+			f := flow.New(httptest.NewRequest("GET", "http://example.com/", nil))
+			start := time.Now()
+			_, body := call(f, http.Header{}, "unmodified")
+			assert.Equal(t, "unmodified", body)
+			assert.True(t, time.Since(start) < 2*time.Second)
+			assert.Contains(t, f.Annotations()[0].Message, "memory limit exceeded")
+		}
+
+		L, err := s.current().get()
+		assert.Nil(t, err)
+		err = L.CallByParam(lua.P{Fn: L.GetGlobal("overflow"), Protect: true})
+		assert.Contains(t, err.Error(), "memory limit exceeded")
+	})
+
+	t.Run("Does not count flows against memory limits", func(t *testing.T) {
+		s, err := NewScript(write("flow.lua", `
+function onResponse(flow)
+  local copies = {}
+  for i = 1, 100000 do copies[i % 100 + 1] = flow.body end
+  flow.headers["X-Length"] = tostring(#copies[1])
+end`), ScriptLimits{Timeout: 5 * time.Second, MaxMemory: 1 << 20})
+		assert.Nil(t, err)
+
+		header, _ := s.ProcessResponse(nil, http.Header{}, strings.Repeat("a", 2<<20))
+		assert.Equal(t, "2097152", header.Get("X-Length"))
+	})
+
+	t.Run("Reloads modified scripts", func(t *testing.T) {
+		path := write("reload.lua", `function onRequest(flow) flow.body = "first" end`)
+		s, err := NewScript(path, limits)
+		assert.Nil(t, err)
+
+		_, body := s.ProcessRequest(nil, http.Header{}, "")
+		assert.Equal(t, "first", body)
+
+		write("reload.lua", `function onRequest(flow) flow.body = "second" end`)
+		modified := time.Now().Add(time.Minute)
+		assert.Nil(t, os.Chtimes(path, modified, modified))
+		s.checked = time.Time{}
+
+		_, body = s.ProcessRequest(nil, http.Header{}, "")
+		assert.Equal(t, "second", body)
+	})
+}
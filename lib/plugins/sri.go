@@ -7,29 +7,445 @@
 package plugins
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// SRIMode selects how integrity attributes are handled
+type SRIMode string
+
+// SRI modes
+const (
+	// SRIStrip removes integrity attributes
+	SRIStrip SRIMode = "strip"
+	// SRIRecompute substitutes hashes of resources as modified by plugins
+	SRIRecompute SRIMode = "recompute"
+)
+
+const (
+	sriSHA256 = "sha256"
+	sriSHA384 = "sha384"
+	sriSHA512 = "sha512"
 )
 
+// sriHashes creates hashes for supported integrity algorithms
+var sriHashes = map[string]func() hash.Hash{
+	sriSHA256: sha256.New,
+	sriSHA384: sha512.New384,
+	sriSHA512: sha512.New,
+}
+
+// sriJSExp matches string literals containing only integrity metadata, where these are assigned to
+// integrity properties (ie. `s.integrity = "sha384-..."`) or set as integrity attributes
+// (ie. `s.setAttribute('integrity', "sha384-...")`). The literal is the second submatch.
+var sriJSExp = func() *regexp.Regexp {
+	quotes := `["'` + "`" + `]`
+	meta := `sha(?:256|384|512)-[A-Za-z0-9+/=_-]+(?:\?[^\s"'` + "`" + `]*)?`
+	list := meta + `(?:\s+` + meta + `)*`
+	target := `(\bintegrity` + quotes + `?\s*[=:]\s*|\bsetAttribute\(\s*` + quotes + `integrity` + quotes + `\s*,\s*)`
+	literal := `("\s*` + list + `\s*"|'\s*` + list + `\s*'|` + "`" + `\s*` + list + `\s*` + "`" + `)`
+	return regexp.MustCompile(target + literal)
+}()
+
 const (
-	sha256 = "sha256"
-	sha384 = "sha384"
-	sha512 = "sha512"
+	// sriCacheSize is the number of resource digests retained for recomputing hashes
+	sriCacheSize = 1024
+	// sriFetchTimeout is the time allowed to fetch the resources of a document that have not been seen
+	sriFetchTimeout = 10 * time.Second
+	// sriFetchConcurrency is the number of resources fetched at once for a document
+	sriFetchConcurrency = 8
 )
 
-var sriExp = regexp.MustCompile(`(integrity\=\"[a-z0-9A-Z\-\+\/]+"[\n\r\s]*)`)
+// Fetcher makes requests through the proxy, including plugin processing
+type Fetcher interface {
+	HandleRequest(req *http.Request) (*http.Response, error)
+}
+
+// sriFetchKey marks requests made by the SRI plugin, so these do not cause further fetches
+type sriFetchKey struct{}
 
-// SRI plugin strips SRI tags from http response bodies
+// SRI plugin strips or recomputes SubResource Integrity (SRI) attributes in responses
+// HTML documents are tokenized so integrity attributes are located regardless of quoting, and
+// string literals containing only integrity metadata (ie. where integrity is set via JS) in
+// scripts are emptied, as the resources these refer to are unknown.
+//
+// In recompute mode hashes are substituted with those of the resource as output by the proxy, so
+// resources modified by other plugins are loaded. Digests are recorded as resources pass through
+// the plugin, and resources that have not been seen are fetched concurrently through the proxy
+// where a fetcher is bound. Integrity attributes are stripped for resources that could not be
+// fetched within the deadline for the document.
 type SRI struct {
+	base
+	mode         SRIMode
+	fetcher      Fetcher
+	fetchTimeout time.Duration
+
+	lock  sync.Mutex
+	cache map[string]sriDigests
+}
+
+// sriDigests are base64 encoded resource digests by algorithm
+type sriDigests map[string]string
+
+// NewSRI creates a new instance of the SRI plugin
+func NewSRI(mode SRIMode) *SRI {
+	return &SRI{
+		base:         newBase("sri"),
+		mode:         mode,
+		fetchTimeout: sriFetchTimeout,
+		cache:        make(map[string]sriDigests),
+	}
+}
+
+// BindFetcher binds a fetcher used to request unseen resources when recomputing hashes
+func (s *SRI) BindFetcher(f Fetcher) {
+	s.fetcher = f
 }
 
-// NewSRI creates a new instance of the SRI strip plugin
-func NewSRI() *SRI {
-	return &SRI{}
+// DefaultScope limits the SRI plugin to markup and scripts, as well as stylesheets when recomputing
+func (s *SRI) DefaultScope() Scope {
+	types := []string{"text/html", "application/xhtml+xml", "application/javascript", "text/javascript", "application/x-javascript"}
+	if s.mode == SRIRecompute {
+		types = append(types, "text/css")
+	}
+	return Scope{Types: types}
 }
 
-// ProcessResponse removes HSTS headers from a proxied response
+// DefaultOrder places the SRI plugin after others, so hashes are computed from modified resources
+func (s *SRI) DefaultOrder() Order {
+	return Order{Phases: []Phase{PhasePostResponse}}
+}
+
+// ProcessResponse strips or recomputes integrity attributes, and records resource digests
 func (s *SRI) ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string) {
-	body = string(sriExp.ReplaceAll([]byte(body), []byte{}))
+	t, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	switch t {
+	case "text/html", "application/xhtml+xml":
+		if b, n := s.rewriteHTML(ctx, body); n > 0 {
+			body = b
+			if s.mode == SRIRecompute {
+				s.annotate(ctx, "recomputed %d integrity attribute(s)", n)
+			} else {
+				s.annotate(ctx, "stripped %d integrity attribute(s)", n)
+			}
+		}
+		return header, body
+	case "application/javascript", "text/javascript", "application/x-javascript":
+		if b, n := stripScriptIntegrity(body); n > 0 {
+			body = b
+			s.annotate(ctx, "emptied %d integrity string(s) in script", n)
+		}
+	}
+
+	if s.mode == SRIRecompute {
+		if f, ok := ctx.(*flow.Flow); ok && f.Request != nil {
+			s.record(f.Request.URL.String(), digest(body))
+		}
+	}
+
 	return header, body
 }
+
+// rewriteHTML strips or recomputes integrity attributes, returning the number of attributes modified
+func (s *SRI) rewriteHTML(ctx interface{}, body string) (string, int) {
+	lower := strings.ToLower(body)
+	if !strings.Contains(lower, "integrity") && !strings.Contains(lower, "sha") {
+		return body, 0
+	}
+
+	var page *url.URL
+	f, _ := ctx.(*flow.Flow)
+	if f != nil && f.Request != nil {
+		page = f.Request.URL
+	}
+
+	z := html.NewTokenizer(strings.NewReader(body))
+	out := bytes.NewBuffer(make([]byte, 0, len(body)))
+	n := 0
+	inScript := false
+
+	// Recomputed attributes are written once resources have been fetched, so the document
+	// is split into parts with the tags for these substituted once complete
+	parts := []string{}
+	pending := []sriPending{}
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			out.Write(z.Raw())
+			break
+		}
+		raw := append([]byte(nil), z.Raw()...)
+
+		switch tt {
+		case html.TextToken:
+			// Inline script text is passed raw by the tokenizer
+			if inScript {
+				if b, c := stripScriptIntegrity(string(raw)); c > 0 {
+					out.WriteString(b)
+					n += c
+					continue
+				}
+			}
+			out.Write(raw)
+			continue
+		case html.EndTagToken:
+			if name, _ := z.TagName(); atom.Lookup(name) == atom.Script {
+				inScript = false
+			}
+			out.Write(raw)
+			continue
+		case html.StartTagToken, html.SelfClosingTagToken:
+		default:
+			out.Write(raw)
+			continue
+		}
+
+		t := z.Token()
+		if t.DataAtom == atom.Script && tt == html.StartTagToken {
+			inScript = true
+		}
+		if t.DataAtom == atom.Base && page != nil {
+			for _, a := range t.Attr {
+				if strings.EqualFold(a.Key, "href") {
+					if u, err := page.Parse(strings.TrimSpace(a.Val)); err == nil {
+						page = u
+					}
+				}
+			}
+		}
+
+		integrity, ref := -1, ""
+		for i, a := range t.Attr {
+			switch strings.ToLower(a.Key) {
+			case "integrity":
+				integrity = i
+			case "src":
+				if t.DataAtom == atom.Script {
+					ref = strings.TrimSpace(a.Val)
+				}
+			case "href":
+				if t.DataAtom == atom.Link {
+					ref = strings.TrimSpace(a.Val)
+				}
+			}
+		}
+		if integrity < 0 {
+			out.Write(raw)
+			continue
+		}
+
+		if s.mode == SRIRecompute && page != nil && ref != "" {
+			if u, err := page.Parse(ref); err == nil {
+				parts = append(parts, out.String(), "")
+				out.Reset()
+				pending = append(pending, sriPending{part: len(parts) - 1, raw: string(raw), token: t, integrity: integrity, url: u})
+				continue
+			}
+		}
+
+		t.Attr = append(t.Attr[:integrity], t.Attr[integrity+1:]...)
+		out.WriteString(t.String())
+		n++
+	}
+
+	if len(pending) == 0 {
+		return out.String(), n
+	}
+
+	urls := make([]*url.URL, len(pending))
+	for i, p := range pending {
+		urls[i] = p.url
+	}
+	s.fetch(f, urls)
+
+	for _, p := range pending {
+		t := p.token
+		value := s.recompute(p.url, t.Attr[p.integrity].Val)
+		if value == t.Attr[p.integrity].Val {
+			parts[p.part] = p.raw
+			continue
+		}
+		if value == "" {
+			t.Attr = append(t.Attr[:p.integrity], t.Attr[p.integrity+1:]...)
+		} else {
+			t.Attr[p.integrity].Val = value
+		}
+		parts[p.part] = t.String()
+		n++
+	}
+
+	return strings.Join(parts, "") + out.String(), n
+}
+
+// sriPending is a tag with an integrity attribute to be recomputed
+type sriPending struct {
+	part      int
+	raw       string
+	token     html.Token
+	integrity int
+	url       *url.URL
+}
+
+// recompute creates integrity metadata for a resource using the algorithms of the existing metadata
+// This returns an empty string where the resource digest has not been recorded.
+func (s *SRI) recompute(u *url.URL, existing string) string {
+	s.lock.Lock()
+	digests, ok := s.cache[u.String()]
+	s.lock.Unlock()
+	if !ok {
+		return ""
+	}
+
+	algorithms := []string{}
+	for _, m := range strings.Fields(existing) {
+		alg := strings.ToLower(strings.SplitN(m, "-", 2)[0])
+		if _, ok := sriHashes[alg]; ok && !containsFold(algorithms, alg) {
+			algorithms = append(algorithms, alg)
+		}
+	}
+	if len(algorithms) == 0 {
+		algorithms = append(algorithms, sriSHA384)
+	}
+
+	values := make([]string, len(algorithms))
+	for i, alg := range algorithms {
+		values[i] = alg + "-" + digests[alg]
+	}
+	return strings.Join(values, " ")
+}
+
+// fetch concurrently fetches and records the digests of resources that are not cached
+// This returns once all resources have been fetched, or the fetch timeout has elapsed.
+func (s *SRI) fetch(f *flow.Flow, urls []*url.URL) {
+	// Resources are not fetched for requests made by the plugin, avoiding recursion
+	if s.fetcher == nil || f == nil || f.Request.Context().Value(sriFetchKey{}) != nil {
+		return
+	}
+
+	unseen := map[string]*url.URL{}
+	s.lock.Lock()
+	for _, u := range urls {
+		if _, ok := s.cache[u.String()]; !ok {
+			unseen[u.String()] = u
+		}
+	}
+	s.lock.Unlock()
+	if len(unseen) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), sriFetchKey{}, true), s.fetchTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, sriFetchConcurrency)
+	for _, u := range unseen {
+		wg.Add(1)
+		go func(u *url.URL) {
+			defer wg.Done()
+			select {
+			case limit <- struct{}{}:
+				defer func() { <-limit }()
+				s.fetchResource(ctx, f, u)
+			case <-ctx.Done():
+			}
+		}(u)
+	}
+
+	// Fetches that do not complete are cancelled, where the fetcher ignores this
+	// their results are recorded for later documents
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.Printf("timeout fetching resources, integrity attributes for these are stripped")
+	}
+}
+
+// fetchResource fetches a resource through the proxy, recording the resource digests
+func (s *SRI) fetchResource(ctx context.Context, f *flow.Flow, u *url.URL) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return
+	}
+	if ua := f.Request.Header.Get("User-Agent"); ua != "" {
+		req.Header.Set("User-Agent", ua)
+	}
+
+	resp, err := s.fetcher.HandleRequest(req)
+	if err != nil {
+		s.WithField("url", u.String()).Printf("error fetching resource: %s", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		s.WithField("url", u.String()).Printf("error fetching resource: %v (status %d)", err, resp.StatusCode)
+		return
+	}
+
+	s.record(u.String(), digest(string(body)))
+}
+
+// record caches resource digests, evicting an arbitrary entry where the cache is full
+func (s *SRI) record(u string, digests sriDigests) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.cache[u]; !ok && len(s.cache) >= sriCacheSize {
+		for k := range s.cache {
+			delete(s.cache, k)
+			break
+		}
+	}
+	s.cache[u] = digests
+}
+
+// digest computes resource digests for each supported algorithm
+func digest(body string) sriDigests {
+	digests := make(sriDigests, len(sriHashes))
+	for alg, h := range sriHashes {
+		d := h()
+		d.Write([]byte(body))
+		digests[alg] = base64.StdEncoding.EncodeToString(d.Sum(nil))
+	}
+	return digests
+}
+
+// stripScriptIntegrity empties integrity metadata literals set as integrity properties or attributes in a script
+func stripScriptIntegrity(script string) (string, int) {
+	if !strings.Contains(script, "integrity") {
+		return script, 0
+	}
+	n := 0
+	script = sriJSExp.ReplaceAllStringFunc(script, func(m string) string {
+		n++
+		literal := sriJSExp.FindStringSubmatch(m)[2]
+		return fmt.Sprintf("%s%c%c", strings.TrimSuffix(m, literal), literal[0], literal[0])
+	})
+	return script, n
+}
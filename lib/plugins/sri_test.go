@@ -1,8 +1,12 @@
 package plugins
 
 import (
+	"io/ioutil"
+	"net/http"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -20,13 +24,220 @@ var testHTML = `
 </html>
 `
 
+var htmlHeader = http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+var jsHeader = http.Header{"Content-Type": {"application/javascript"}}
+
+// fetcher returns fixed resource bodies by URL, counting requests
+// Where release is set requests wait until this is closed, which happens once barrier requests are in flight.
+type fetcher struct {
+	bodies  map[string]string
+	release chan struct{}
+	barrier int
+
+	lock      sync.Mutex
+	requests  int
+	cancelled int
+}
+
+func (f *fetcher) HandleRequest(req *http.Request) (*http.Response, error) {
+	f.lock.Lock()
+	f.requests++
+	if f.barrier > 0 && f.requests == f.barrier {
+		close(f.release)
+	}
+	f.lock.Unlock()
+
+	if f.release != nil {
+		select {
+		case <-f.release:
+		case <-req.Context().Done():
+			f.lock.Lock()
+			f.cancelled++
+			f.lock.Unlock()
+			return nil, req.Context().Err()
+		}
+	}
+
+	body, ok := f.bodies[req.URL.String()]
+	if !ok {
+		return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+}
+
 func TestSRI(t *testing.T) {
+	t.Run("Strips integrity attributes", func(t *testing.T) {
+		runResponseFixtures(t, NewSRI(SRIStrip), []fixture{{
+			name: "multi-line script tag",
+			in:   message{htmlHeader, testHTML},
+			out: message{htmlHeader, strings.Replace(testHTML, `<script src="https://example.com/example-framework.js"
+        integrity="sha384-oqVuAfXRKap7fdgcCY5uykM6+R9GqQ8K/uxy9rx7HNQlGYl1kPzQho1wx4JwY8wC"
+        crossorigin="anonymous">`, `<script src="https://example.com/example-framework.js" crossorigin="anonymous">`, 1)},
+			annotated: true,
+		}, {
+			name:      "double quoted",
+			in:        message{htmlHeader, `<script src="/a.js" integrity="sha256-abc="></script>`},
+			out:       message{htmlHeader, `<script src="/a.js"></script>`},
+			annotated: true,
+		}, {
+			name:      "single quoted",
+			in:        message{htmlHeader, `<link rel='stylesheet' href='/a.css' integrity='sha512-a+b/c=='>`},
+			out:       message{htmlHeader, `<link rel="stylesheet" href="/a.css">`},
+			annotated: true,
+		}, {
+			name:      "unquoted",
+			in:        message{htmlHeader, `<script src=/a.js integrity=sha384-abc></script>`},
+			out:       message{htmlHeader, `<script src="/a.js"></script>`},
+			annotated: true,
+		}, {
+			name:      "upper case with multiple hashes",
+			in:        message{htmlHeader, `<SCRIPT SRC="/a.js" INTEGRITY="sha256-abc sha512-def"></SCRIPT>`},
+			out:       message{htmlHeader, `<script src="/a.js"></SCRIPT>`},
+			annotated: true,
+		}, {
+			name:      "self closing",
+			in:        message{htmlHeader, `<link href="/a.css" integrity="sha256-abc"/>`},
+			out:       message{htmlHeader, `<link href="/a.css"/>`},
+			annotated: true,
+		}, {
+			name: "comments and text",
+			in:   message{htmlHeader, `<!-- <script integrity="sha256-abc"> --><p>integrity="sha256-abc"</p>`},
+			out:  message{htmlHeader, `<!-- <script integrity="sha256-abc"> --><p>integrity="sha256-abc"</p>`},
+		}, {
+			name:      "set in inline script",
+			in:        message{htmlHeader, `<script>s.integrity = "sha384-abc"; s.setAttribute('integrity', 'sha256-a sha512-b');</script>`},
+			out:       message{htmlHeader, `<script>s.integrity = ""; s.setAttribute('integrity', '');</script>`},
+			annotated: true,
+		}, {
+			name:      "set in script response",
+			in:        message{jsHeader, "s.integrity = `sha256-abc`; var x = 'sha256 is a hash';"},
+			out:       message{jsHeader, "s.integrity = ``; var x = 'sha256 is a hash';"},
+			annotated: true,
+		}, {
+			name:      "set in fetch options",
+			in:        message{jsHeader, `fetch(u, {integrity: 'sha256-abc'}); fetch(v, {"integrity":"sha256-abc"});`},
+			out:       message{jsHeader, `fetch(u, {integrity: ''}); fetch(v, {"integrity":""});`},
+			annotated: true,
+		}, {
+			name: "metadata not set as integrity",
+			in:   message{jsHeader, `var h = "sha256-abc"; if (s.integrity == 'sha256-abc') { s.setAttribute('data-hash', 'sha256-abc'); }`},
+			out:  message{jsHeader, `var h = "sha256-abc"; if (s.integrity == 'sha256-abc') { s.setAttribute('data-hash', 'sha256-abc'); }`},
+		}, {
+			name: "without integrity",
+			in:   message{htmlHeader, `<script src="/a.js"></script>`},
+			out:  message{htmlHeader, `<script src="/a.js"></script>`},
+		}, {
+			name: "other content types",
+			in:   message{http.Header{"Content-Type": {"text/plain"}}, `<script integrity="sha256-abc"></script>`},
+			out:  message{http.Header{"Content-Type": {"text/plain"}}, `<script integrity="sha256-abc"></script>`},
+		}, {
+			name: "without content type",
+			in:   message{nil, `<script integrity="sha256-abc"></script>`},
+			out:  message{nil, `<script integrity="sha256-abc"></script>`},
+		}})
+	})
+
+	t.Run("Recomputes integrity attributes", func(t *testing.T) {
+		modified := "alert('modified')"
+		d := digest(modified)
 
-	sri := NewSRIPlugin()
+		f := &fetcher{bodies: map[string]string{"http://example.com/static/a.js": modified}}
+		sri := NewSRI(SRIRecompute)
+		sri.BindFetcher(f)
 
-	t.Run("Parses and locates SRI tags", func(t *testing.T) {
-		replaced := sri.HandleResponseBody([]byte(testHTML))
-		assert.False(t, strings.Contains(string(replaced), "integrity"))
+		// Resources passing through the plugin are recorded
+		runResponseFixtures(t, sri, []fixture{{
+			name: "records resources",
+			url:  "http://example.com/b.js",
+			in:   message{jsHeader, modified},
+			out:  message{jsHeader, modified},
+		}})
+
+		runResponseFixtures(t, sri, []fixture{{
+			name:      "fetches unseen resources",
+			url:       "http://example.com/page/",
+			in:        message{htmlHeader, `<base href="/static/"><script src="a.js" integrity="sha256-abc sha512-def"></script>`},
+			out:       message{htmlHeader, `<base href="/static/"><script src="a.js" integrity="sha256-` + d[sriSHA256] + ` sha512-` + d[sriSHA512] + `"></script>`},
+			annotated: true,
+		}, {
+			name:      "uses recorded resources",
+			url:       "http://example.com/page/",
+			in:        message{htmlHeader, `<script src='../b.js' integrity='sha384-abc'></script><script src=/static/a.js integrity=sha256-abc></script>`},
+			out:       message{htmlHeader, `<script src="../b.js" integrity="sha384-` + d[sriSHA384] + `"></script><script src="/static/a.js" integrity="sha256-` + d[sriSHA256] + `"></script>`},
+			annotated: true,
+		}, {
+			name: "retains matching hashes",
+			in:   message{htmlHeader, `<script src="/b.js" integrity="sha384-` + d[sriSHA384] + `"></script>`},
+			out:  message{htmlHeader, `<script src="/b.js" integrity="sha384-` + d[sriSHA384] + `"></script>`},
+		}, {
+			name:      "strips unavailable resources",
+			in:        message{htmlHeader, `<script src="/missing.js" integrity="sha384-abc"></script><script integrity="sha384-abc">1</script>`},
+			out:       message{htmlHeader, `<script src="/missing.js"></script><script>1</script>`},
+			annotated: true,
+		}})
+
+		assert.Equal(t, 2, f.requests)
+	})
+
+	t.Run("Fetches resources concurrently", func(t *testing.T) {
+		d := digest("a")
+		// Requests are not released until all are in flight, so are stripped if fetched sequentially
+		f := &fetcher{bodies: map[string]string{}, release: make(chan struct{}), barrier: 4}
+		in, out := "", ""
+		for _, name := range []string{"a", "b", "c", "d"} {
+			f.bodies["http://example.com/"+name+".js"] = "a"
+			in += `<script src="/` + name + `.js" integrity="sha256-abc"></script>`
+			out += `<script src="/` + name + `.js" integrity="sha256-` + d[sriSHA256] + `"></script>`
+		}
+
+		sri := NewSRI(SRIRecompute)
+		sri.BindFetcher(f)
+
+		runResponseFixtures(t, sri, []fixture{{
+			name:      "recomputes all resources",
+			in:        message{htmlHeader, in},
+			out:       message{htmlHeader, out},
+			annotated: true,
+		}})
+		assert.Equal(t, 4, f.requests)
+		assert.Equal(t, 0, f.cancelled)
 	})
 
+	t.Run("Strips integrity attributes for resources not fetched in time", func(t *testing.T) {
+		// Requests are never released, so are cancelled once the fetch timeout expires
+		f := &fetcher{bodies: map[string]string{"http://example.com/a.js": "a"}, release: make(chan struct{})}
+		sri := NewSRI(SRIRecompute)
+		sri.BindFetcher(f)
+		sri.fetchTimeout = 50 * time.Millisecond
+
+		runResponseFixtures(t, sri, []fixture{{
+			name:      "strips slow resources",
+			in:        message{htmlHeader, `<script src="/a.js" integrity="sha256-abc"></script>`},
+			out:       message{htmlHeader, `<script src="/a.js"></script>`},
+			annotated: true,
+		}})
+
+		// Requests are cancelled in the background once processing continues
+		assert.Eventually(t, func() bool {
+			f.lock.Lock()
+			defer f.lock.Unlock()
+			return f.cancelled == 1
+		}, time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("Processes all script types in scope", func(t *testing.T) {
+		for _, mode := range []SRIMode{SRIStrip, SRIRecompute} {
+			sri := NewSRI(mode)
+			for _, typ := range []string{"application/javascript", "text/javascript", "application/x-javascript"} {
+				header := http.Header{"Content-Type": {typ}}
+				assert.True(t, containsFold(sri.DefaultScope().Types, typ), typ)
+				runResponseFixtures(t, sri, []fixture{{
+					name:      typ,
+					in:        message{header, `s.integrity = "sha384-abc";`},
+					out:       message{header, `s.integrity = "";`},
+					annotated: true,
+				}})
+			}
+		}
+	})
 }
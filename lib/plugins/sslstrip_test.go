@@ -0,0 +1,89 @@
+package plugins
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+func TestSSLStrip(t *testing.T) {
+	html := http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+
+	t.Run("Downgrades redirects and records hosts", func(t *testing.T) {
+		s := NewSSLStrip()
+
+		header, _ := s.ProcessResponse(nil, http.Header{"Location": {"HTTPS://Example.com:8443/login?next=/"}}, "")
+		assert.Equal(t, "http://Example.com:8443/login?next=/", header.Get("Location"))
+
+		header, _ = s.ProcessResponse(nil, http.Header{"Location": {"/relative"}}, "")
+		assert.Equal(t, "/relative", header.Get("Location"))
+
+		assert.True(t, s.Upgrade("example.com:8443"))
+		assert.False(t, s.Upgrade("example.com"))
+		assert.Equal(t, []string{"example.com:8443"}, s.Hosts())
+	})
+
+	t.Run("Downgrades links and form actions", func(t *testing.T) {
+		s := NewSSLStrip()
+
+		body := `<a href="https://a.example.com/x">a</a><form action='https://b.example.com/login'><button formaction=https://c.example.com/>` +
+			`<img src="https://d.example.com/i.png"><script>var u = "https://e.example.com";</script>`
+		_, body = s.ProcessResponse(nil, html, body)
+		assert.Equal(t, `<a href="http://a.example.com/x">a</a><form action="http://b.example.com/login"><button formaction="http://c.example.com/">`+
+			`<img src="https://d.example.com/i.png"><script>var u = "https://e.example.com";</script>`, body)
+		assert.Equal(t, []string{"a.example.com", "b.example.com", "c.example.com"}, s.Hosts())
+	})
+
+	t.Run("Removes secure cookie flags for downgraded hosts", func(t *testing.T) {
+		s := NewSSLStrip()
+		s.ProcessResponse(nil, http.Header{"Location": {"https://example.com/"}}, "")
+
+		cookies := func() http.Header {
+			return http.Header{"Set-Cookie": {"a=1; Path=/; Secure; HttpOnly", "b=2; SameSite=None; secure", "c=3; SameSite=Lax"}}
+		}
+
+		f := flow.New(httptest.NewRequest("GET", "https://example.com/", nil))
+		header, _ := s.ProcessResponse(f, cookies(), "")
+		assert.Equal(t, []string{"a=1; Path=/; HttpOnly", "b=2", "c=3; SameSite=Lax"}, header["Set-Cookie"])
+
+		f = flow.New(httptest.NewRequest("GET", "https://other.example.com/", nil))
+		header, _ = s.ProcessResponse(f, cookies(), "")
+		assert.Equal(t, cookies(), header)
+	})
+
+	t.Run("Restores request origins", func(t *testing.T) {
+		s := NewSSLStrip()
+		s.ProcessResponse(nil, http.Header{"Location": {"https://example.com/"}}, "")
+
+		header, _ := s.ProcessRequest(nil, http.Header{"Origin": {"http://example.com"}, "Referer": {"http://other.example.com/"}}, "")
+		assert.Equal(t, "https://example.com", header.Get("Origin"))
+		assert.Equal(t, "http://other.example.com/", header.Get("Referer"))
+	})
+
+	t.Run("Matches hosts without default ports", func(t *testing.T) {
+		s := NewSSLStrip()
+		s.ProcessResponse(nil, http.Header{"Location": {"https://Example.com:443/"}}, "")
+		s.ProcessResponse(nil, http.Header{"Location": {"https://other.com/"}}, "")
+
+		assert.Equal(t, []string{"example.com", "other.com"}, s.Hosts())
+		for _, host := range []string{"example.com", "EXAMPLE.com:80", "example.com:443", "other.com:80"} {
+			assert.True(t, s.Upgrade(host), host)
+		}
+		assert.False(t, s.Upgrade("example.com:8080"))
+	})
+
+	t.Run("Bounds recorded hosts", func(t *testing.T) {
+		s := NewSSLStrip()
+		for i := 0; i <= sslStripMaxHosts; i++ {
+			s.strip(fmt.Sprintf("https://%d.example.com/", i))
+		}
+
+		assert.Len(t, s.Hosts(), sslStripMaxHosts)
+		assert.True(t, s.Upgrade(fmt.Sprintf("%d.example.com", sslStripMaxHosts)))
+	})
+}
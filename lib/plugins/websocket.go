@@ -0,0 +1,44 @@
+/**
+ * WebSocket defines plugin hooks for inspecting and re-writing websocket messages
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package plugins
+
+// Direction indicates which way a message is travelling through the proxy
+type Direction int
+
+const (
+	// ClientToServer messages are sent by the client to the upstream server
+	ClientToServer Direction = iota
+	// ServerToClient messages are sent by the upstream server to the client
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToServer {
+		return "client->server"
+	}
+	return "server->client"
+}
+
+// WebSocket message types (these match the RFC 6455 frame opcodes)
+const (
+	WebSocketText   = 1
+	WebSocketBinary = 2
+)
+
+// WebSocketMessage is a complete (defragmented) websocket data message
+type WebSocketMessage struct {
+	Direction Direction
+	Type      int
+	Data      []byte
+}
+
+// WebSocketHandler interface implemented by plugins to inspect and re-write websocket messages
+// Handlers return the messages to be sent in place of the provided message, this may be empty
+// to drop the message, or contain additional messages (in either direction) to inject them.
+type WebSocketHandler interface {
+	ProcessWebSocket(ctx interface{}, msg *WebSocketMessage) []*WebSocketMessage
+}
@@ -0,0 +1,155 @@
+package replay
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Attack is the strategy for combining wordlists with payload positions
+type Attack string
+
+const (
+	// Sniper mutates one position at a time with each word from a single wordlist
+	Sniper Attack = "sniper"
+	// Ram (battering ram) places the same word at every position
+	Ram Attack = "ram"
+	// Pitchfork iterates a wordlist per position in parallel
+	Pitchfork Attack = "pitchfork"
+	// Cluster (cluster bomb) tries every combination of a wordlist per position
+	Cluster Attack = "cluster"
+)
+
+// Payload is a set of values for each position of a template
+type Payload struct {
+	Values []string
+	// Label describes the payload for display
+	Label string
+}
+
+// LoadWordlist loads a wordlist file, with one word per line
+// Empty lines and lines starting with '#' are ignored.
+func LoadWordlist(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	words := []string{}
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		if w := strings.TrimRight(s.Text(), "\r"); w != "" && !strings.HasPrefix(w, "#") {
+			words = append(words, w)
+		}
+	}
+	return words, s.Err()
+}
+
+// Count returns the number of payloads generated by an attack
+func (a Attack) Count(positions int, wordlists [][]string) int {
+	switch a {
+	case Sniper:
+		return positions * len(wordlists[0])
+	case Ram:
+		return len(wordlists[0])
+	case Pitchfork:
+		n := len(wordlists[0])
+		for _, w := range wordlists[1:] {
+			if len(w) < n {
+				n = len(w)
+			}
+		}
+		return n
+	case Cluster:
+		n := 1
+		for _, w := range wordlists {
+			n *= len(w)
+		}
+		return n
+	}
+	return 0
+}
+
+// Validate checks that the number of wordlists is appropriate for an attack
+func (a Attack) Validate(positions int, wordlists [][]string) error {
+	switch a {
+	case Sniper, Ram:
+		if len(wordlists) != 1 {
+			return fmt.Errorf("%s attacks require a single wordlist", a)
+		}
+	case Pitchfork, Cluster:
+		if len(wordlists) != positions {
+			return fmt.Errorf("%s attacks require a wordlist per position (%d positions, %d wordlists)", a, positions, len(wordlists))
+		}
+	default:
+		return fmt.Errorf("unknown attack type '%s'", a)
+	}
+	if positions == 0 {
+		return fmt.Errorf("no payload positions are marked")
+	}
+	return nil
+}
+
+// Generate calls fn with each payload for an attack, stopping if fn returns false
+// Values for positions that are not mutated are taken from the defaults.
+func (a Attack) Generate(defaults []string, wordlists [][]string, fn func(p Payload) bool) {
+	values := func() []string { return append([]string(nil), defaults...) }
+
+	switch a {
+	case Sniper:
+		for pos := range defaults {
+			for _, w := range wordlists[0] {
+				v := values()
+				v[pos] = w
+				if !fn(Payload{Values: v, Label: fmt.Sprintf("%d:%s", pos, w)}) {
+					return
+				}
+			}
+		}
+
+	case Ram:
+		for _, w := range wordlists[0] {
+			v := values()
+			for pos := range v {
+				v[pos] = w
+			}
+			if !fn(Payload{Values: v, Label: w}) {
+				return
+			}
+		}
+
+	case Pitchfork:
+		for i := 0; i < a.Count(len(defaults), wordlists); i++ {
+			v := values()
+			for pos := range v {
+				v[pos] = wordlists[pos][i]
+			}
+			if !fn(Payload{Values: v, Label: strings.Join(v, ",")}) {
+				return
+			}
+		}
+
+	case Cluster:
+		// Indices are incremented as an odometer, with the last position changing fastest
+		index := make([]int, len(defaults))
+		for n := a.Count(len(defaults), wordlists); n > 0; n-- {
+			v := values()
+			for pos := range v {
+				v[pos] = wordlists[pos][index[pos]]
+			}
+			if !fn(Payload{Values: v, Label: strings.Join(v, ",")}) {
+				return
+			}
+
+			for pos := len(index) - 1; pos >= 0; pos-- {
+				index[pos]++
+				if index[pos] < len(wordlists[pos]) {
+					break
+				}
+				index[pos] = 0
+			}
+		}
+	}
+}
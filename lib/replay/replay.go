@@ -0,0 +1,91 @@
+/**
+ * Replay package resends captured requests, optionally mutating marked positions
+ * with payloads from wordlists (intruder-style) and summarising differing responses
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/ryankurte/evilproxy/lib/core"
+	"github.com/ryankurte/evilproxy/lib/flow"
+	"github.com/ryankurte/evilproxy/lib/session"
+)
+
+// Sender sends requests, this is implemented by core.Proxy to apply the plugin chain
+type Sender interface {
+	HandleRequest(req *http.Request) (*http.Response, error)
+}
+
+// BackendSender sends requests directly via a backend, without the plugin chain
+type BackendSender struct {
+	Backend core.Backend
+}
+
+// HandleRequest sends a request via the backend
+func (b *BackendSender) HandleRequest(req *http.Request) (*http.Response, error) {
+	return b.Backend.Request(flow.New(req), req)
+}
+
+// Load loads flow records from a session, HAR or JSON (see the admin API export) file
+func Load(path string) ([]*flow.Record, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch trimmed := bytes.TrimSpace(data); {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		records := []*flow.Record{}
+		err := json.Unmarshal(trimmed, &records)
+		return records, err
+
+	case isSession(trimmed):
+		s, err := session.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return s.Records, nil
+	}
+
+	h := flow.HAR{}
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, err
+	}
+	return h.Records(), nil
+}
+
+// isSession checks whether a file starts with a session header
+func isSession(data []byte) bool {
+	line, _ := bufio.NewReader(bytes.NewReader(data)).ReadBytes('\n')
+	h := session.Header{}
+	return json.Unmarshal(line, &h) == nil && h.Format == session.Format
+}
+
+// NewRequest creates a request from a flow record
+func NewRequest(r *flow.Record) (*http.Request, error) {
+	req, err := http.NewRequest(r.Method, r.URL, strings.NewReader(r.RequestBody))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range r.RequestHeader {
+		req.Header[k] = append([]string(nil), v...)
+	}
+	// Lengths are recomputed as bodies may be mutated
+	req.Header.Del("Content-Length")
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+
+	return req, nil
+}
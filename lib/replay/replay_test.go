@@ -0,0 +1,116 @@
+package replay
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+func TestTemplate(t *testing.T) {
+	r := &flow.Record{
+		ID:            1,
+		Method:        "POST",
+		URL:           "http://example.com/users/§1§?q=a",
+		RequestHeader: http.Header{"Cookie": {"session=abc"}},
+		RequestBody:   `{"role":"§user§"}`,
+	}
+
+	tpl, err := NewTemplate(r, DefaultMarker, regexp.MustCompile(`session=(\w+)`))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1", "abc", "user"}, tpl.Defaults())
+
+	out := tpl.Render([]string{"2", "xyz", "admin"})
+	assert.Equal(t, "http://example.com/users/2?q=a", out.URL)
+	assert.Equal(t, "session=xyz", out.RequestHeader.Get("Cookie"))
+	assert.Equal(t, `{"role":"admin"}`, out.RequestBody)
+	assert.Equal(t, "http://example.com/users/§1§?q=a", r.URL)
+
+	r.RequestBody = "§open"
+	_, err = NewTemplate(r, DefaultMarker)
+	assert.NotNil(t, err)
+}
+
+func TestAttacks(t *testing.T) {
+	defaults := []string{"a", "b"}
+
+	tests := []struct {
+		attack    Attack
+		wordlists [][]string
+		payloads  [][]string
+	}{
+		{Sniper, [][]string{{"1", "2"}}, [][]string{{"1", "b"}, {"2", "b"}, {"a", "1"}, {"a", "2"}}},
+		{Ram, [][]string{{"1", "2"}}, [][]string{{"1", "1"}, {"2", "2"}}},
+		{Pitchfork, [][]string{{"1", "2", "3"}, {"x", "y"}}, [][]string{{"1", "x"}, {"2", "y"}}},
+		{Cluster, [][]string{{"1", "2"}, {"x", "y"}}, [][]string{{"1", "x"}, {"1", "y"}, {"2", "x"}, {"2", "y"}}},
+	}
+
+	for _, test := range tests {
+		assert.Nil(t, test.attack.Validate(len(defaults), test.wordlists))
+		assert.Equal(t, len(test.payloads), test.attack.Count(len(defaults), test.wordlists), string(test.attack))
+
+		payloads := [][]string{}
+		test.attack.Generate(defaults, test.wordlists, func(p Payload) bool {
+			payloads = append(payloads, p.Values)
+			return true
+		})
+		assert.Equal(t, test.payloads, payloads, string(test.attack))
+	}
+
+	assert.NotNil(t, Pitchfork.Validate(2, [][]string{{"1"}}))
+	assert.NotNil(t, Sniper.Validate(0, [][]string{{"1"}}))
+}
+
+type echoSender struct{}
+
+func (s *echoSender) HandleRequest(req *http.Request) (*http.Response, error) {
+	body, _ := ioutil.ReadAll(req.Body)
+	w := httptest.NewRecorder()
+	if strings.Contains(string(body), "admin") {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	w.WriteString(string(body))
+	return w.Result(), nil
+}
+
+func TestRun(t *testing.T) {
+	records := []*flow.Record{
+		{ID: 1, Method: "POST", URL: "http://example.com/", RequestBody: "role=§user§"},
+		{ID: 2, Method: "GET", URL: "http://example.com/", Status: 200, ResponseBody: ""},
+	}
+	plan := Plan{Marker: DefaultMarker, Attack: Sniper, Wordlists: [][]string{{"guest", "admin"}}}
+
+	n, err := plan.Count(records)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+
+	ctx := context.Background()
+	results := NewRunner(&echoSender{}, 2, 0).Run(ctx, plan.Jobs(ctx, records), nil)
+	assert.Len(t, results, 4)
+	assert.True(t, results[0].Baseline)
+	assert.Equal(t, "0:admin", results[2].Label)
+
+	s := Summarise(results, records, 0)
+	assert.Equal(t, 4, s.Total)
+	assert.Len(t, s.Differing, 2)
+	assert.Equal(t, http.StatusForbidden, s.Differing[1].Status)
+
+	// Without marks or wordlists flows are resent verbatim, including markers
+	plan = Plan{Marker: DefaultMarker}
+	n, err = plan.Count(records)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	results = NewRunner(&echoSender{}, 1, 0).Run(ctx, plan.Jobs(ctx, records), nil)
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, "", results[0].Label)
+		assert.Equal(t, len("role=§user§"), results[0].Length)
+	}
+}
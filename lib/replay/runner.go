@@ -0,0 +1,258 @@
+package replay
+
+import (
+	"context"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// Job is a request to be sent
+type Job struct {
+	// Source is the flow the request was derived from
+	Source *flow.Record
+	// Request is the (possibly mutated) request to send
+	Request *flow.Record
+	// Label describes the payload, this is empty for plain replays
+	Label string
+	// Baseline marks unmutated requests sent for comparison with payloads
+	Baseline bool
+}
+
+// Result is the outcome of a job
+type Result struct {
+	Index    int           `json:"index"`
+	FlowID   uint64        `json:"flow_id"`
+	Label    string        `json:"label,omitempty"`
+	Baseline bool          `json:"baseline,omitempty"`
+	Status   int           `json:"status"`
+	Length   int           `json:"length"`
+	Words    int           `json:"words"`
+	Lines    int           `json:"lines"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Plan generates jobs for replaying flows
+// Flows with marked positions are sent unmutated as a baseline, followed by each payload
+// of the attack, flows without positions are replayed as captured. Without marks or wordlists
+// flows are not parsed for positions, so are resent verbatim (including any markers).
+type Plan struct {
+	Marker    string
+	Marks     []*regexp.Regexp
+	Attack    Attack
+	Wordlists [][]string
+}
+
+// verbatim checks whether flows are resent as captured, without templating
+func (p *Plan) verbatim() bool {
+	return len(p.Marks) == 0 && len(p.Wordlists) == 0
+}
+
+// Count validates the plan for the provided flows, returning the number of jobs generated
+func (p *Plan) Count(records []*flow.Record) (int, error) {
+	if p.verbatim() {
+		return len(records), nil
+	}
+
+	n := 0
+	for _, r := range records {
+		t, err := NewTemplate(r, p.Marker, p.Marks...)
+		if err != nil {
+			return 0, err
+		}
+		if t.Positions() == 0 || len(p.Wordlists) == 0 {
+			n++
+			continue
+		}
+		if err := p.Attack.Validate(t.Positions(), p.Wordlists); err != nil {
+			return 0, err
+		}
+		n += 1 + p.Attack.Count(t.Positions(), p.Wordlists)
+	}
+	return n, nil
+}
+
+// Jobs generates jobs for the provided flows until complete or the context is cancelled
+// Plans should be validated with Count prior to generating jobs.
+func (p *Plan) Jobs(ctx context.Context, records []*flow.Record) <-chan Job {
+	jobs := make(chan Job)
+
+	go func() {
+		defer close(jobs)
+
+		send := func(j Job) bool {
+			select {
+			case jobs <- j:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for _, r := range records {
+			if p.verbatim() {
+				if !send(Job{Source: r, Request: r}) {
+					return
+				}
+				continue
+			}
+
+			t, err := NewTemplate(r, p.Marker, p.Marks...)
+			if err != nil {
+				return
+			}
+
+			if t.Positions() == 0 || len(p.Wordlists) == 0 {
+				if !send(Job{Source: r, Request: t.Render(t.Defaults())}) {
+					return
+				}
+				continue
+			}
+
+			if !send(Job{Source: r, Request: t.Render(t.Defaults()), Label: "baseline", Baseline: true}) {
+				return
+			}
+
+			ok := true
+			p.Attack.Generate(t.Defaults(), p.Wordlists, func(payload Payload) bool {
+				ok = send(Job{Source: r, Request: t.Render(payload.Values), Label: payload.Label})
+				return ok
+			})
+			if !ok {
+				return
+			}
+		}
+	}()
+
+	return jobs
+}
+
+// Runner sends jobs with bounded concurrency and rate
+type Runner struct {
+	sender      Sender
+	concurrency int
+	rate        float64
+}
+
+// NewRunner creates a runner sending up to concurrency requests at once, at up to rate
+// requests per second (zero for unlimited)
+func NewRunner(sender Sender, concurrency int, rate float64) *Runner {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Runner{sender: sender, concurrency: concurrency, rate: rate}
+}
+
+// Run sends jobs until complete or the context is cancelled, returning results in job order
+// The progress callback (if provided) is called as each job completes.
+func (r *Runner) Run(ctx context.Context, jobs <-chan Job, progress func(Result)) []Result {
+	var limit <-chan time.Time
+	if r.rate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / r.rate))
+		defer t.Stop()
+		limit = t.C
+	}
+
+	type indexed struct {
+		Job
+		index int
+	}
+	queue := make(chan indexed)
+	go func() {
+		defer close(queue)
+		i := 0
+		for j := range jobs {
+			select {
+			case queue <- indexed{j, i}:
+				i++
+			case <-ctx.Done():
+				// Drain the job source so the generator exits
+				for range jobs {
+				}
+				return
+			}
+		}
+	}()
+
+	lock := sync.Mutex{}
+	results := []Result{}
+	wg := sync.WaitGroup{}
+
+	for w := 0; w < r.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				if limit != nil {
+					select {
+					case <-limit:
+					case <-ctx.Done():
+						continue
+					}
+				}
+				if ctx.Err() != nil {
+					continue
+				}
+
+				res := r.send(ctx, j.Job)
+				res.Index = j.index
+
+				lock.Lock()
+				results = append(results, res)
+				if progress != nil {
+					progress(res)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(a, b int) bool { return results[a].Index < results[b].Index })
+	return results
+}
+
+// send sends a single job and measures the response
+func (r *Runner) send(ctx context.Context, j Job) Result {
+	res := Result{FlowID: j.Source.ID, Label: j.Label, Baseline: j.Baseline}
+	start := time.Now()
+
+	req, err := NewRequest(j.Request)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	resp, err := r.sender.HandleRequest(req.WithContext(ctx))
+	if err != nil {
+		res.Error = err.Error()
+		res.Duration = time.Since(start)
+		return res
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	res.Duration = time.Since(start)
+	if err != nil {
+		res.Error = err.Error()
+	}
+
+	res.Status = resp.StatusCode
+	res.Length, res.Words, res.Lines = measure(string(body))
+
+	return res
+}
+
+// measure returns the length, word and line counts of a body
+func measure(body string) (int, int, int) {
+	if body == "" {
+		return 0, 0, 0
+	}
+	return len(body), len(strings.Fields(body)), strings.Count(body, "\n") + 1
+}
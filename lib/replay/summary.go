@@ -0,0 +1,146 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// maxExamples is the number of example payloads listed for each response group
+const maxExamples = 3
+
+// Signature identifies similar responses
+type Signature struct {
+	Status int    `json:"status"`
+	Length int    `json:"length"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Group is a set of results with the same response signature
+type Group struct {
+	Signature
+	Count    int      `json:"count"`
+	Examples []string `json:"examples"`
+}
+
+// Summary summarises the results of a replay
+type Summary struct {
+	Total  int `json:"total"`
+	Errors int `json:"errors"`
+
+	// Groups of similar responses, least common first
+	Groups []Group `json:"groups"`
+	// Differing results, where these differ from the baseline for the flow
+	Differing []Result `json:"differing"`
+}
+
+// Summarise groups results and finds those differing from the baseline for each flow
+// The baseline is the unmutated request where payloads were sent, or the captured
+// response for plain replays. Lengths within the tolerance (in bytes) are considered equal.
+func Summarise(results []Result, sources []*flow.Record, tolerance int) *Summary {
+	s := Summary{Total: len(results), Groups: []Group{}, Differing: []Result{}}
+
+	baselines := make(map[uint64]Signature)
+	for _, r := range sources {
+		length, _, _ := measure(r.ResponseBody)
+		baselines[r.ID] = Signature{Status: r.Status, Length: length, Error: r.Error}
+	}
+	for _, r := range results {
+		if r.Baseline {
+			baselines[r.FlowID] = r.Signature()
+		}
+	}
+
+	groups := make(map[Signature]*Group)
+	for _, r := range results {
+		if r.Error != "" {
+			s.Errors++
+		}
+
+		sig := r.Signature()
+		g, ok := groups[sig]
+		if !ok {
+			g = &Group{Signature: sig, Examples: []string{}}
+			groups[sig] = g
+		}
+		g.Count++
+		if len(g.Examples) < maxExamples {
+			g.Examples = append(g.Examples, r.describe())
+		}
+
+		if b, ok := baselines[r.FlowID]; ok && !r.Baseline && !sig.similar(b, tolerance) {
+			s.Differing = append(s.Differing, r)
+		}
+	}
+
+	for _, g := range groups {
+		s.Groups = append(s.Groups, *g)
+	}
+	sort.Slice(s.Groups, func(a, b int) bool {
+		if s.Groups[a].Count != s.Groups[b].Count {
+			return s.Groups[a].Count < s.Groups[b].Count
+		}
+		return s.Groups[a].Status < s.Groups[b].Status
+	})
+
+	return &s
+}
+
+// Signature returns the response signature for a result
+func (r *Result) Signature() Signature {
+	return Signature{Status: r.Status, Length: r.Length, Error: r.Error}
+}
+
+func (r *Result) describe() string {
+	if r.Label == "" {
+		return fmt.Sprintf("#%d", r.FlowID)
+	}
+	return fmt.Sprintf("#%d %s", r.FlowID, r.Label)
+}
+
+// similar checks whether signatures match, within the length tolerance
+func (s Signature) similar(o Signature, tolerance int) bool {
+	diff := s.Length - o.Length
+	if diff < 0 {
+		diff = -diff
+	}
+	return s.Status == o.Status && s.Error == o.Error && diff <= tolerance
+}
+
+func (s Signature) String() string {
+	if s.Error != "" {
+		return "error: " + s.Error
+	}
+	return fmt.Sprintf("%d %dB", s.Status, s.Length)
+}
+
+// Write writes a readable summary
+func (s *Summary) Write(w io.Writer) {
+	fmt.Fprintf(w, "Sent %d requests (%d errors)\n\n", s.Total, s.Errors)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESPONSE\tCOUNT\tEXAMPLES")
+	for _, g := range s.Groups {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", g.Signature, g.Count, strings.Join(g.Examples, ", "))
+	}
+	tw.Flush()
+
+	if len(s.Differing) == 0 {
+		fmt.Fprintln(w, "\nNo responses differ from the baseline")
+		return
+	}
+
+	fmt.Fprintf(w, "\n%d response(s) differ from the baseline:\n\n", len(s.Differing))
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FLOW\tPAYLOAD\tSTATUS\tLENGTH\tWORDS\tLINES\tTIME\tERROR")
+	for _, r := range s.Differing {
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%d\t%d\t%dms\t%s\n",
+			r.FlowID, r.Label, r.Status, r.Length, r.Words, r.Lines, r.Duration/time.Millisecond, r.Error)
+	}
+	tw.Flush()
+}
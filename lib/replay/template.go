@@ -0,0 +1,150 @@
+package replay
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+// DefaultMarker delimits payload positions in requests (ie. "id=§123§")
+const DefaultMarker = "§"
+
+// segment is a literal section of a templated string, or a position (where pos >= 0)
+type segment struct {
+	text string
+	pos  int
+}
+
+// templated is a string containing payload positions
+type templated []segment
+
+// Template is a request with marked payload positions in the URL, header values and body
+// Positions are numbered from zero in the order they occur, and retain the marked text as
+// a default value for use where a position is not being mutated.
+type Template struct {
+	source *flow.Record
+
+	url      templated
+	header   map[string][]templated
+	body     templated
+	defaults []string
+}
+
+// NewTemplate creates a template from a flow record, with positions delimited by the marker
+// Positions may also be marked by regular expressions, where the first capture group (or the
+// entire match where there are no groups) of each match is marked.
+func NewTemplate(r *flow.Record, marker string, marks ...*regexp.Regexp) (*Template, error) {
+	t := Template{
+		source: r,
+		header: make(map[string][]templated),
+	}
+
+	parse := func(name, s string) (templated, error) {
+		for _, exp := range marks {
+			s = mark(s, marker, exp)
+		}
+		parts := strings.Split(s, marker)
+		if len(parts)%2 == 0 {
+			return nil, fmt.Errorf("unterminated payload marker in %s", name)
+		}
+
+		tpl := make(templated, 0, len(parts))
+		for i, p := range parts {
+			if i%2 == 0 {
+				tpl = append(tpl, segment{text: p, pos: -1})
+				continue
+			}
+			tpl = append(tpl, segment{text: p, pos: len(t.defaults)})
+			t.defaults = append(t.defaults, p)
+		}
+		return tpl, nil
+	}
+
+	var err error
+	if t.url, err = parse("url", r.URL); err != nil {
+		return nil, err
+	}
+
+	// Headers are parsed in a stable order so positions are consistent
+	keys := make([]string, 0, len(r.RequestHeader))
+	for k := range r.RequestHeader {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range r.RequestHeader[k] {
+			tpl, err := parse("header "+k, v)
+			if err != nil {
+				return nil, err
+			}
+			t.header[k] = append(t.header[k], tpl)
+		}
+	}
+
+	if t.body, err = parse("body", r.RequestBody); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// mark wraps matches of an expression in markers
+func mark(s, marker string, exp *regexp.Regexp) string {
+	var sb strings.Builder
+	last := 0
+
+	for _, m := range exp.FindAllStringSubmatchIndex(s, -1) {
+		start, end := m[0], m[1]
+		if len(m) > 2 && m[2] >= 0 {
+			start, end = m[2], m[3]
+		}
+		sb.WriteString(s[last:start])
+		sb.WriteString(marker + s[start:end] + marker)
+		last = end
+	}
+	sb.WriteString(s[last:])
+
+	return sb.String()
+}
+
+// Positions returns the number of payload positions
+func (t *Template) Positions() int {
+	return len(t.defaults)
+}
+
+// Defaults returns the marked values of each position
+func (t *Template) Defaults() []string {
+	return append([]string(nil), t.defaults...)
+}
+
+// Render creates a flow record with the provided value at each position
+func (t *Template) Render(values []string) *flow.Record {
+	r := *t.source
+	r.URL = t.url.render(values)
+	r.RequestBody = t.body.render(values)
+
+	r.RequestHeader = make(http.Header, len(t.header))
+	for k, tpls := range t.header {
+		for _, tpl := range tpls {
+			r.RequestHeader[k] = append(r.RequestHeader[k], tpl.render(values))
+		}
+	}
+
+	return &r
+}
+
+func (tpl templated) render(values []string) string {
+	var sb strings.Builder
+	for _, s := range tpl {
+		if s.pos < 0 {
+			sb.WriteString(s.text)
+		} else {
+			sb.WriteString(values[s.pos])
+		}
+	}
+	return sb.String()
+}
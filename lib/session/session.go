@@ -0,0 +1,201 @@
+/**
+ * Session package persists captured flows so proxy sessions may be reopened for analysis
+ *
+ * Sessions are append-only JSON lines files, a header line identifying the format
+ * followed by one flow record per line (with full bodies, TLS metadata and annotations).
+ * Records are flushed as flows complete, so sessions remain readable if the proxy exits
+ * uncleanly.
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+const (
+	// Format identifies session files
+	Format = "evilproxy-session"
+	// FormatVersion is the current session format version
+	FormatVersion = 1
+)
+
+// ErrInvalidSession is returned when a file is not a session
+var ErrInvalidSession = errors.New("not an evilproxy session file")
+
+// Header is the first line of a session file
+type Header struct {
+	Format        string    `json:"format"`
+	FormatVersion int       `json:"format_version"`
+	Version       string    `json:"version"`
+	Created       time.Time `json:"created"`
+}
+
+// Writer appends completed flows to a session file
+type Writer struct {
+	lock sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// Create opens a session file for writing, appending to the session if the file already exists
+// A truncated final record in an existing session is discarded so new records are not appended to it.
+func Create(path, version string) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := Writer{file: file, enc: json.NewEncoder(file)}
+
+	// Check existing sessions match the current format, or write a new header
+	if _, err := readHeader(bufio.NewReader(file)); err == io.EOF {
+		err = w.enc.Encode(Header{Format: Format, FormatVersion: FormatVersion, Version: version, Created: time.Now()})
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	} else if err != nil {
+		file.Close()
+		return nil, err
+	} else if err := truncatePartial(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+// truncatePartial truncates a file to the end of the last complete line
+func truncatePartial(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4096)
+	for end := info.Size(); end > 0; {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		n, err := file.ReadAt(buf[:end-start], start)
+		if err != nil {
+			return err
+		}
+
+		i := bytes.LastIndexByte(buf[:n], '\n')
+		if i < 0 {
+			end = start
+			continue
+		}
+		if start+int64(i)+1 == info.Size() {
+			return nil
+		}
+		log.Printf("Discarding truncated record at end of %s", file.Name())
+		return file.Truncate(start + int64(i) + 1)
+	}
+
+	// The header is complete but not terminated, as this has been read
+	_, err = file.Write([]byte{'\n'})
+	return err
+}
+
+// Record appends a completed flow to the session
+func (w *Writer) Record(f *flow.Flow) {
+	r := flow.NewRecord(f)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := w.enc.Encode(r); err != nil {
+		log.Printf("Error writing flow %d to session: %s", r.ID, err)
+	}
+}
+
+// Close closes the session file
+func (w *Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.file.Close()
+}
+
+// Session is a session loaded from a file
+type Session struct {
+	Header
+	Records []*flow.Record
+}
+
+// Open loads a session file
+// A truncated final record (ie. where the proxy exited while writing) is ignored.
+func Open(path string) (*Session, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+
+	h, err := readHeader(r)
+	if err == io.EOF {
+		return nil, ErrInvalidSession
+	} else if err != nil {
+		return nil, err
+	}
+
+	s := Session{Header: *h, Records: make([]*flow.Record, 0)}
+	for n := 2; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Ignoring truncated record at %s:%d", path, n)
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		rec := flow.Record{}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("invalid record at %s:%d: %s", path, n, err)
+		}
+		s.Records = append(s.Records, &rec)
+	}
+
+	return &s, nil
+}
+
+// readHeader reads and validates a session header, returning io.EOF for empty files
+func readHeader(r *bufio.Reader) (*Header, error) {
+	line, err := r.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		return nil, io.EOF
+	} else if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	h := Header{}
+	if err := json.Unmarshal(line, &h); err != nil || h.Format != Format {
+		return nil, ErrInvalidSession
+	}
+	if h.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("unsupported session format version %d", h.FormatVersion)
+	}
+
+	return &h, nil
+}
@@ -0,0 +1,77 @@
+package session
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+)
+
+func TestSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "evpx-session")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.jsonl")
+
+	record := func(w *Writer, url string) {
+		f := flow.New(httptest.NewRequest("POST", url, nil))
+		f.RequestBody = "request"
+		f.ResponseBody = "response"
+		f.Annotate("test", "annotated")
+		w.Record(f)
+	}
+
+	w, err := Create(path, "test")
+	assert.Nil(t, err)
+	record(w, "http://example.com/a")
+	assert.Nil(t, w.Close())
+
+	// Re-opening appends to the existing session
+	w, err = Create(path, "test")
+	assert.Nil(t, err)
+	record(w, "http://example.com/b")
+	assert.Nil(t, w.Close())
+
+	s, err := Open(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "test", s.Version)
+	assert.Len(t, s.Records, 2)
+	assert.Equal(t, "http://example.com/b", s.Records[1].URL)
+	assert.Equal(t, "response", s.Records[1].ResponseBody)
+	assert.Equal(t, []flow.Annotation{{Source: "test", Message: "annotated"}}, s.Records[1].Annotations)
+
+	// Truncated records are ignored
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.Nil(t, err)
+	file.WriteString(`{"id":3,"method":"GE`)
+	file.Close()
+
+	s, err = Open(path)
+	assert.Nil(t, err)
+	assert.Len(t, s.Records, 2)
+
+	// Truncated records are discarded when appending to the session
+	w, err = Create(path, "test")
+	assert.Nil(t, err)
+	record(w, "http://example.com/c")
+	assert.Nil(t, w.Close())
+
+	s, err = Open(path)
+	assert.Nil(t, err)
+	if assert.Len(t, s.Records, 3) {
+		assert.Equal(t, "http://example.com/c", s.Records[2].URL)
+	}
+
+	// Other files are rejected
+	other := filepath.Join(dir, "other.txt")
+	assert.Nil(t, ioutil.WriteFile(other, []byte("hello\n"), 0600))
+	_, err = Open(other)
+	assert.Equal(t, ErrInvalidSession, err)
+	_, err = Create(other, "test")
+	assert.Equal(t, ErrInvalidSession, err)
+}
@@ -0,0 +1,609 @@
+/**
+ * TUI package provides a terminal interface for inspecting and intercepting flows
+ *
+ * Copyright 2018 Ryan Kurte
+ */
+
+package tui
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+
+	"github.com/ryankurte/evilproxy/lib/filter"
+	"github.com/ryankurte/evilproxy/lib/flow"
+	"github.com/ryankurte/evilproxy/lib/intercept"
+)
+
+const help = "[::b]/[::-] filter  [::b]tab[::-] pane  [::b]i[::-] intercept  [::b]b[::-] breakpoint  [::b]c[::-] clear breakpoints  " +
+	"[::b]e[::-] edit  [::b]f[::-] forward  [::b]d[::-] drop  [::b]q[::-] quit"
+
+// maxFlows is the number of flows retained in the list
+const maxFlows = 5000
+
+// TUI is a terminal interface displaying flows from a flow store
+// Where an interceptor is bound, paused flows may be edited, forwarded or dropped.
+type TUI struct {
+	store       *flow.Store
+	interceptor *intercept.Interceptor
+
+	app      *tview.Application
+	pages    *tview.Pages
+	lists    *tview.Pages
+	list     *tview.Table
+	paused   *tview.Table
+	request  *tview.TextView
+	response *tview.TextView
+	filter   *tview.InputField
+	log      *tview.TextView
+	status   *tview.TextView
+
+	records     []*flow.Record
+	shown       []*flow.Record
+	pausedFlows []intercept.Paused
+	match       *filter.Filter
+	intercept   bool
+	redraw      chan struct{}
+}
+
+// NewTUI creates a terminal interface for the provided store and (optional) interceptor
+func NewTUI(store *flow.Store, interceptor *intercept.Interceptor) *TUI {
+	t := TUI{
+		store:       store,
+		interceptor: interceptor,
+		app:         tview.NewApplication(),
+		records:     store.Records(),
+		redraw:      make(chan struct{}, 1),
+	}
+
+	t.list = tview.NewTable().SetSelectable(true, false).SetFixed(1, 0)
+	t.list.SetBorder(true).SetTitle(" Flows ")
+	t.list.SetSelectionChangedFunc(func(row, col int) {
+		if !t.intercept {
+			t.showFlow(row)
+		}
+	})
+
+	t.paused = tview.NewTable().SetSelectable(true, false).SetFixed(1, 0)
+	t.paused.SetBorder(true)
+	t.paused.SetSelectionChangedFunc(func(row, col int) {
+		if t.intercept {
+			t.showPaused(row)
+		}
+	})
+
+	t.request = tview.NewTextView().SetWrap(true)
+	t.request.SetBorder(true).SetTitle(" Request ")
+	t.response = tview.NewTextView().SetWrap(true)
+	t.response.SetBorder(true).SetTitle(" Response ")
+
+	t.filter = tview.NewInputField().SetLabel("Filter: ").SetPlaceholder(`host ~ "api" && status >= 400`)
+	t.filter.SetDoneFunc(t.applyFilter)
+
+	// Log writes may occur on any goroutine (including the UI), so redraws are requested
+	// rather than performed directly
+	t.log = tview.NewTextView().SetMaxLines(500).ScrollToEnd()
+	t.log.SetBorder(true).SetTitle(" Log ")
+	t.log.SetChangedFunc(func() {
+		select {
+		case t.redraw <- struct{}{}:
+		default:
+		}
+	})
+
+	t.status = tview.NewTextView().SetDynamicColors(true).SetText(help)
+
+	t.lists = tview.NewPages().
+		AddPage("flows", t.list, true, true).
+		AddPage("intercept", t.paused, true, false)
+
+	detail := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(t.request, 0, 1, false).
+		AddItem(t.response, 0, 1, false)
+
+	main := tview.NewFlex().
+		AddItem(t.lists, 0, 1, true).
+		AddItem(detail, 0, 1, false)
+
+	root := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(t.filter, 1, 0, false).
+		AddItem(main, 0, 1, true).
+		AddItem(t.log, 6, 0, false).
+		AddItem(t.status, 1, 0, false)
+
+	// Dialogs are added as pages over the main layout
+	t.pages = tview.NewPages().AddPage("main", root, true, true)
+
+	t.app.SetRoot(t.pages, true).SetFocus(t.list)
+	t.app.SetInputCapture(t.handleKey)
+
+	t.renderFlows()
+	t.renderPaused()
+
+	return &t
+}
+
+// Writer fetches a writer for log output, this should be used in place of stderr while running
+func (t *TUI) Writer() io.Writer {
+	return t.log
+}
+
+// Run runs the terminal interface until the user quits
+func (t *TUI) Run() error {
+	records, unsubscribe := t.store.Subscribe()
+	defer unsubscribe()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		// Paused flows are polled as the interceptor does not provide notifications
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case r := <-records:
+				t.app.QueueUpdateDraw(func() { t.addFlow(r) })
+			case <-t.redraw:
+				t.app.Draw()
+			case <-ticker.C:
+				if t.interceptor != nil {
+					t.app.QueueUpdateDraw(t.renderPaused)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return t.app.Run()
+}
+
+// Stop stops the terminal interface
+func (t *TUI) Stop() {
+	t.app.Stop()
+}
+
+// handleKey handles global key bindings, these are not applied while editing text
+func (t *TUI) handleKey(ev *tcell.EventKey) *tcell.EventKey {
+	switch t.app.GetFocus().(type) {
+	case *tview.InputField, *tview.TextArea:
+		return ev
+	}
+
+	if ev.Key() == tcell.KeyTab {
+		t.cycleFocus()
+		return nil
+	}
+	if ev.Key() != tcell.KeyRune {
+		return ev
+	}
+
+	switch ev.Rune() {
+	case 'q':
+		t.app.Stop()
+	case '/':
+		t.app.SetFocus(t.filter)
+	case 'i':
+		t.toggleIntercept()
+	case 'b':
+		t.promptBreakpoint()
+	case 'c':
+		t.clearBreakpoints()
+	case 'e':
+		t.editPaused()
+	case 'f':
+		t.resumePaused(intercept.Forward)
+	case 'd':
+		t.resumePaused(intercept.Drop)
+	default:
+		return ev
+	}
+	return nil
+}
+
+// cycleFocus moves focus between the list and detail panes
+func (t *TUI) cycleFocus() {
+	switch t.app.GetFocus() {
+	case t.request:
+		t.app.SetFocus(t.response)
+	case t.response:
+		t.focusList()
+	default:
+		t.app.SetFocus(t.request)
+	}
+}
+
+// Flow list
+
+func (t *TUI) applyFilter(key tcell.Key) {
+	if key == tcell.KeyEnter {
+		f, err := filter.Parse(t.filter.GetText())
+		if err != nil {
+			t.filter.SetLabel("Filter (" + err.Error() + "): ")
+			return
+		}
+		t.filter.SetLabel("Filter: ")
+		t.match = f
+		t.renderFlows()
+	}
+
+	t.focusList()
+}
+
+// focusList focuses the currently displayed list
+func (t *TUI) focusList() {
+	if t.intercept {
+		t.app.SetFocus(t.paused)
+	} else {
+		t.app.SetFocus(t.list)
+	}
+}
+
+func (t *TUI) addFlow(r *flow.Record) {
+	// Evict the oldest flow once full, keeping the selection on the same flow
+	if len(t.records) >= maxFlows {
+		evicted := t.records[0]
+		t.records = t.records[1:]
+		if len(t.shown) > 0 && t.shown[0] == evicted {
+			t.shown = t.shown[1:]
+			row, column := t.list.GetSelection()
+			t.list.RemoveRow(1)
+			if row > 1 {
+				t.list.Select(row-1, column)
+			}
+		}
+	}
+	t.records = append(t.records, r)
+
+	if t.match.Match(r) {
+		// Follow new flows when the last flow is selected
+		row, _ := t.list.GetSelection()
+		follow := row == len(t.shown)
+
+		t.shown = append(t.shown, r)
+		t.setFlowRow(len(t.shown), r)
+
+		if follow {
+			t.list.Select(len(t.shown), 0)
+		}
+	}
+}
+
+func (t *TUI) renderFlows() {
+	t.list.Clear()
+	for i, h := range []string{"#", "Method", "Host", "Path", "Status", "Type", "Size", "Time"} {
+		t.list.SetCell(0, i, tview.NewTableCell(h).SetSelectable(false).SetAttributes(tcell.AttrBold))
+	}
+
+	t.shown = t.shown[:0]
+	for _, r := range t.records {
+		if t.match.Match(r) {
+			t.shown = append(t.shown, r)
+			t.setFlowRow(len(t.shown), r)
+		}
+	}
+
+	t.list.Select(len(t.shown), 0)
+}
+
+func (t *TUI) setFlowRow(row int, r *flow.Record) {
+	u, _ := url.Parse(r.URL)
+	path, host := r.URL, ""
+	if u != nil {
+		path, host = u.RequestURI(), u.Host
+	}
+
+	status := strconv.Itoa(r.Status)
+	color := tcell.ColorDefault
+	switch {
+	case r.Error != "":
+		status, color = "error", tcell.ColorRed
+	case r.Status >= 500:
+		color = tcell.ColorRed
+	case r.Status >= 400:
+		color = tcell.ColorYellow
+	case r.Status >= 300:
+		color = tcell.ColorBlue
+	}
+
+	cells := []string{
+		strconv.FormatUint(r.ID, 10),
+		r.Method,
+		host,
+		path,
+		status,
+		strings.Split(r.ResponseHeader.Get("Content-Type"), ";")[0],
+		strconv.Itoa(len(r.ResponseBody)),
+		fmt.Sprintf("%dms", r.Duration),
+	}
+	for i, c := range cells {
+		cell := tview.NewTableCell(tview.Escape(c)).SetTextColor(color)
+		if i == 3 {
+			cell.SetMaxWidth(60).SetExpansion(1)
+		}
+		t.list.SetCell(row, i, cell)
+	}
+}
+
+func (t *TUI) showFlow(row int) {
+	if row < 1 || row > len(t.shown) {
+		return
+	}
+	r := t.shown[row-1]
+
+	t.request.SetText(formatMessage(fmt.Sprintf("%s %s %s", r.Method, r.URL, r.Proto), r.RequestHeader, r.RequestBody)).ScrollToBeginning()
+	if r.Error != "" {
+		t.response.SetText(formatNotes(r) + r.Error)
+		return
+	}
+	t.response.SetText(formatNotes(r) + formatMessage(fmt.Sprintf("%s %d", r.Proto, r.Status), r.ResponseHeader, r.ResponseBody)).ScrollToBeginning()
+}
+
+// formatNotes formats the upstream TLS connection and plugin annotations for a flow
+func formatNotes(r *flow.Record) string {
+	lines := []string{}
+	if r.ServerTLS != nil {
+		lines = append(lines, fmt.Sprintf("# %s %s %s", r.ServerTLS.Version, r.ServerTLS.CipherSuite, r.ServerTLS.NegotiatedProtocol))
+	}
+	for _, a := range r.Annotations {
+		lines = append(lines, fmt.Sprintf("# %s: %s", a.Source, a.Message))
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n\n"
+}
+
+// Intercept controls
+
+func (t *TUI) toggleIntercept() {
+	if t.interceptor == nil {
+		fmt.Fprintln(t.log, "Interception is not enabled")
+		return
+	}
+
+	t.intercept = !t.intercept
+	if t.intercept {
+		t.lists.SwitchToPage("intercept")
+		t.renderPaused()
+	} else {
+		t.lists.SwitchToPage("flows")
+	}
+	t.focusList()
+}
+
+func (t *TUI) renderPaused() {
+	if t.interceptor == nil {
+		return
+	}
+
+	paused := t.interceptor.Paused()
+	sort.Slice(paused, func(i, j int) bool { return paused[i].ID < paused[j].ID })
+
+	breakpoints := []string{}
+	for _, b := range t.interceptor.Breakpoints() {
+		breakpoints = append(breakpoints, formatBreakpoint(b))
+	}
+	if len(breakpoints) == 0 {
+		breakpoints = append(breakpoints, "none")
+	}
+	t.paused.SetTitle(fmt.Sprintf(" Intercept (%d paused, breakpoints: %s) ", len(paused), tview.Escape(strings.Join(breakpoints, "; "))))
+
+	// Retain the selected flow where possible
+	row, _ := t.paused.GetSelection()
+	selected := uint64(0)
+	if row >= 1 && row <= len(t.pausedFlows) {
+		selected = t.pausedFlows[row-1].ID
+	}
+
+	t.pausedFlows = paused
+	t.paused.Clear()
+	for i, h := range []string{"#", "Flow", "Phase", "Method", "URL", "Status", "Waiting"} {
+		t.paused.SetCell(0, i, tview.NewTableCell(h).SetSelectable(false).SetAttributes(tcell.AttrBold))
+	}
+
+	row = 0
+	for i, p := range paused {
+		status := ""
+		if p.Phase == intercept.PhaseResponse {
+			status = strconv.Itoa(p.Status)
+		}
+		cells := []string{
+			strconv.FormatUint(p.ID, 10),
+			strconv.FormatUint(p.FlowID, 10),
+			string(p.Phase),
+			p.Method,
+			p.URL,
+			status,
+			time.Since(p.Paused).Truncate(time.Second).String(),
+		}
+		for j, c := range cells {
+			t.paused.SetCell(i+1, j, tview.NewTableCell(tview.Escape(c)))
+		}
+		if p.ID == selected {
+			row = i + 1
+		}
+	}
+
+	if row == 0 && len(paused) > 0 {
+		row = 1
+	}
+	t.paused.Select(row, 0)
+}
+
+func (t *TUI) selectedPaused() *intercept.Paused {
+	if !t.intercept {
+		return nil
+	}
+	row, _ := t.paused.GetSelection()
+	if row < 1 || row > len(t.pausedFlows) {
+		return nil
+	}
+	return &t.pausedFlows[row-1]
+}
+
+func (t *TUI) showPaused(row int) {
+	if row < 1 || row > len(t.pausedFlows) {
+		return
+	}
+	p := t.pausedFlows[row-1]
+
+	if p.Phase == intercept.PhaseRequest {
+		t.request.SetText(formatMessage(fmt.Sprintf("%s %s", p.Method, p.URL), p.Header, p.Body))
+		t.response.SetText("")
+		return
+	}
+	t.request.SetText(fmt.Sprintf("%s %s", p.Method, p.URL))
+	t.response.SetText(formatMessage(fmt.Sprintf("%d %s", p.Status, http.StatusText(p.Status)), p.Header, p.Body))
+}
+
+func (t *TUI) resumePaused(a intercept.Action) {
+	p := t.selectedPaused()
+	if p == nil {
+		return
+	}
+
+	if err := t.interceptor.Resume(p.ID, a); err != nil {
+		fmt.Fprintf(t.log, "Error resuming flow %d: %s\n", p.FlowID, err)
+	}
+	t.renderPaused()
+}
+
+// editPaused opens an editor for the body of the selected paused flow, ctrl-s saves and escape cancels
+func (t *TUI) editPaused() {
+	p := t.selectedPaused()
+	if p == nil {
+		return
+	}
+	if p.Streamed {
+		fmt.Fprintf(t.log, "Body of streamed %s for flow %d cannot be edited\n", p.Phase, p.FlowID)
+		return
+	}
+	id := p.ID
+
+	editor := tview.NewTextArea().SetText(p.Body, false)
+	editor.SetBorder(true).SetTitle(fmt.Sprintf(" Edit %s body for flow %d (ctrl-s save, esc cancel) ", p.Phase, p.FlowID))
+	editor.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		switch ev.Key() {
+		case tcell.KeyCtrlS:
+			body := editor.GetText()
+			if err := t.interceptor.Edit(id, intercept.Edit{Body: &body}); err != nil {
+				fmt.Fprintf(t.log, "Error editing flow: %s\n", err)
+			}
+		case tcell.KeyEscape:
+		default:
+			return ev
+		}
+		t.pages.RemovePage("edit")
+		t.app.SetFocus(t.paused)
+		t.renderPaused()
+		return nil
+	})
+
+	t.pages.AddPage("edit", modal(editor, 100, 30), true, true)
+	t.app.SetFocus(editor)
+}
+
+// promptBreakpoint prompts for a breakpoint definition (see intercept.ParseBreakpoint)
+func (t *TUI) promptBreakpoint() {
+	if t.interceptor == nil {
+		fmt.Fprintln(t.log, "Interception is not enabled")
+		return
+	}
+
+	input := tview.NewInputField().SetLabel("Breakpoint: ").SetPlaceholder("host=*.example.com,path=/api/*,method=POST,phase=both")
+	input.SetBorder(true)
+	input.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEnter {
+			b, err := intercept.ParseBreakpoint(input.GetText())
+			if err != nil {
+				fmt.Fprintf(t.log, "Error adding breakpoint: %s\n", err)
+			} else {
+				t.interceptor.AddBreakpoint(*b)
+			}
+		}
+		t.pages.RemovePage("breakpoint")
+		t.focusList()
+		t.renderPaused()
+	})
+
+	t.pages.AddPage("breakpoint", modal(input, 80, 3), true, true)
+	t.app.SetFocus(input)
+}
+
+func (t *TUI) clearBreakpoints() {
+	if t.interceptor == nil {
+		return
+	}
+	for _, b := range t.interceptor.Breakpoints() {
+		t.interceptor.RemoveBreakpoint(b.ID)
+	}
+	t.renderPaused()
+}
+
+// Helpers
+
+// modal centres a primitive with the provided size
+func modal(p tview.Primitive, width, height int) tview.Primitive {
+	return tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(p, height, 1, true).
+			AddItem(nil, 0, 1, false), width, 1, true).
+		AddItem(nil, 0, 1, false)
+}
+
+func formatMessage(first string, header map[string][]string, body string) string {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	lines := []string{first}
+	for _, k := range keys {
+		for _, v := range header[k] {
+			lines = append(lines, k+": "+v)
+		}
+	}
+
+	return strings.Join(lines, "\n") + "\n\n" + body
+}
+
+func formatBreakpoint(b intercept.Breakpoint) string {
+	fields := []string{}
+	if b.Host != "" {
+		fields = append(fields, "host="+b.Host)
+	}
+	if b.Path != "" {
+		fields = append(fields, "path="+b.Path)
+	}
+	if b.Method != "" {
+		fields = append(fields, "method="+b.Method)
+	}
+	switch {
+	case b.Request && b.Response:
+		fields = append(fields, "phase=both")
+	case b.Response:
+		fields = append(fields, "phase=response")
+	}
+	if b.Filter != nil {
+		fields = append(fields, "filter="+b.Filter.String())
+	}
+	if len(fields) == 0 {
+		return "*"
+	}
+	return strings.Join(fields, ",")
+}
@@ -0,0 +1,262 @@
+package tui
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ryankurte/evilproxy/lib/flow"
+	"github.com/ryankurte/evilproxy/lib/intercept"
+)
+
+// testTUI is a terminal interface running on a simulated screen
+type testTUI struct {
+	*TUI
+	screen tcell.SimulationScreen
+}
+
+func newTestTUI(t *testing.T, store *flow.Store, interceptor *intercept.Interceptor) *testTUI {
+	ui := &testTUI{TUI: NewTUI(store, interceptor), screen: tcell.NewSimulationScreen("")}
+	ui.app.SetScreen(ui.screen)
+	ui.screen.SetSize(160, 40)
+
+	done := make(chan error, 1)
+	go func() { done <- ui.Run() }()
+	t.Cleanup(func() {
+		ui.Stop()
+		<-done
+	})
+
+	// Updates are only applied once running, at which point the store subscription exists
+	ui.eventually(t, "running", func() bool { return true })
+
+	return ui
+}
+
+// eventually waits for a condition, evaluated on the UI goroutine, to be met
+func (ui *testTUI) eventually(t *testing.T, msg string, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		result := make(chan bool, 1)
+		ui.app.QueueUpdate(func() { result <- cond() })
+		select {
+		case ok := <-result:
+			if ok {
+				return
+			}
+		case <-time.After(time.Until(deadline)):
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %s", msg)
+}
+
+// keys types the provided text, with \n sent as enter
+func (ui *testTUI) keys(s string) {
+	for _, r := range s {
+		if r == '\n' {
+			ui.screen.InjectKey(tcell.KeyEnter, 0, tcell.ModNone)
+		} else {
+			ui.screen.InjectKey(tcell.KeyRune, r, tcell.ModNone)
+		}
+	}
+}
+
+// shown fetches the URLs of the flows shown in the list
+func (ui *testTUI) shown() []string {
+	urls := []string{}
+	for _, r := range ui.TUI.shown {
+		urls = append(urls, r.URL)
+	}
+	return urls
+}
+
+// pausedRequest sends a request to the interceptor, returning the forwarded body (or error) once resumed
+func pausedRequest(i *intercept.Interceptor, url, body string) chan string {
+	done := make(chan string, 1)
+	go func() {
+		req := httptest.NewRequest("POST", url, strings.NewReader(body))
+		req, err := i.InterceptRequest(flow.New(req), req, false)
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		done <- string(b)
+	}()
+	return done
+}
+
+func waitDone(t *testing.T, done chan string) string {
+	select {
+	case s := <-done:
+		return s
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for paused flow")
+	}
+	return ""
+}
+
+func waitPaused(t *testing.T, i *intercept.Interceptor, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for len(i.Paused()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %d paused flows", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	store := flow.NewStore(10, 0)
+	for i, status := range []int{200, 404, 500} {
+		store.Add(&flow.Record{ID: uint64(i + 1), Method: "GET", URL: "http://example.com/" + http.StatusText(status), Status: status})
+	}
+	ui := newTestTUI(t, store, nil)
+
+	t.Run("Filters flows from the filter bar", func(t *testing.T) {
+		ui.keys("/status >= 400\n")
+		ui.eventually(t, "filtered flows", func() bool { return len(ui.TUI.shown) == 2 })
+		ui.eventually(t, "list focus", func() bool { return ui.app.GetFocus() == ui.list })
+		assert.Equal(t, []string{"http://example.com/Not Found", "http://example.com/Internal Server Error"}, ui.shown())
+	})
+
+	t.Run("Filters new flows", func(t *testing.T) {
+		store.Add(&flow.Record{ID: 4, Method: "GET", URL: "http://example.com/OK", Status: 200})
+		store.Add(&flow.Record{ID: 5, Method: "GET", URL: "http://example.com/Bad Gateway", Status: 502})
+
+		ui.eventually(t, "new flows", func() bool { return len(ui.records) == 5 })
+		assert.Equal(t, "http://example.com/Bad Gateway", ui.shown()[2])
+		assert.Len(t, ui.shown(), 3)
+	})
+
+	t.Run("Reports invalid filters", func(t *testing.T) {
+		ui.keys("/ &&\n")
+		ui.eventually(t, "filter error", func() bool { return strings.HasPrefix(ui.TUI.filter.GetLabel(), "Filter (") })
+		assert.Len(t, ui.shown(), 3)
+	})
+
+	// The filter bar retains focus after an error so the filter may be corrected
+	t.Run("Clears filters", func(t *testing.T) {
+		ui.eventually(t, "filter focus", func() bool { return ui.app.GetFocus() == ui.TUI.filter })
+		for range "status >= 400 &&" {
+			ui.screen.InjectKey(tcell.KeyBackspace2, 0, tcell.ModNone)
+		}
+		ui.keys("\n")
+		ui.eventually(t, "all flows", func() bool { return len(ui.TUI.shown) == 5 })
+		ui.eventually(t, "filter label", func() bool { return ui.TUI.filter.GetLabel() == "Filter: " })
+	})
+
+	t.Run("Reports that interception is not enabled", func(t *testing.T) {
+		ui.keys("i")
+		ui.eventually(t, "log message", func() bool {
+			return strings.Contains(ui.log.GetText(false), "Interception is not enabled")
+		})
+	})
+}
+
+func TestEviction(t *testing.T) {
+	ui := newTestTUI(t, flow.NewStore(10, 0), nil)
+
+	// Flows are added on the UI goroutine
+	ui.eventually(t, "full list", func() bool {
+		for i := 1; i <= maxFlows; i++ {
+			ui.records = append(ui.records, &flow.Record{ID: uint64(i), Method: "GET", URL: "http://example.com/", Status: 200})
+		}
+		ui.renderFlows()
+		ui.list.Select(3, 0)
+		return true
+	})
+
+	t.Run("Removes the oldest flow once full", func(t *testing.T) {
+		ui.eventually(t, "evicted flow", func() bool {
+			ui.addFlow(&flow.Record{ID: maxFlows + 1, Method: "GET", URL: "http://example.com/", Status: 200})
+			return true
+		})
+		ui.eventually(t, "list rows", func() bool {
+			row, _ := ui.list.GetSelection()
+			return len(ui.records) == maxFlows && len(ui.TUI.shown) == maxFlows &&
+				ui.list.GetRowCount() == maxFlows+1 && ui.list.GetCell(1, 0).Text == "2" &&
+				ui.list.GetCell(maxFlows, 0).Text == strconv.Itoa(maxFlows+1) && row == 2
+		})
+	})
+}
+
+func TestIntercept(t *testing.T) {
+	i := intercept.NewInterceptor(0, intercept.Drop)
+	ui := newTestTUI(t, flow.NewStore(10, 0), i)
+
+	t.Run("Adds breakpoints", func(t *testing.T) {
+		ui.keys("bphase=request\n")
+		ui.eventually(t, "breakpoint", func() bool { return len(i.Breakpoints()) == 1 })
+		assert.True(t, i.Breakpoints()[0].Request)
+	})
+
+	ui.keys("i")
+	ui.eventually(t, "intercept list", func() bool { return ui.intercept && ui.app.GetFocus() == ui.paused })
+
+	t.Run("Forwards and drops paused flows", func(t *testing.T) {
+		first := pausedRequest(i, "http://example.com/first", "one")
+		waitPaused(t, i, 1)
+		second := pausedRequest(i, "http://example.com/second", "two")
+		waitPaused(t, i, 2)
+
+		// The first paused flow is selected
+		ui.eventually(t, "paused flows", func() bool { return len(ui.pausedFlows) == 2 })
+		ui.keys("f")
+		assert.Equal(t, "one", waitDone(t, first))
+
+		ui.eventually(t, "paused flows", func() bool { return len(ui.pausedFlows) == 1 })
+		ui.keys("d")
+		assert.Equal(t, intercept.ErrDropped.Error(), waitDone(t, second))
+		ui.eventually(t, "paused flows", func() bool { return len(ui.pausedFlows) == 0 })
+	})
+
+	t.Run("Edits paused flows", func(t *testing.T) {
+		done := pausedRequest(i, "http://example.com/", "body")
+		waitPaused(t, i, 1)
+		ui.eventually(t, "paused flows", func() bool { return len(ui.pausedFlows) == 1 })
+
+		// The editor cursor starts at the beginning of the body
+		ui.keys("e")
+		ui.eventually(t, "editor", func() bool { return ui.pages.HasPage("edit") })
+		ui.keys("new ")
+		ui.screen.InjectKey(tcell.KeyCtrlS, 0, tcell.ModCtrl)
+		ui.eventually(t, "editor closed", func() bool { return !ui.pages.HasPage("edit") && ui.app.GetFocus() == ui.paused })
+
+		ui.keys("f")
+		assert.Equal(t, "new body", waitDone(t, done))
+	})
+
+	t.Run("Does not edit streamed responses", func(t *testing.T) {
+		i.AddBreakpoint(intercept.Breakpoint{Response: true})
+
+		body, pw := io.Pipe()
+		defer pw.Close()
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: body}
+		req := httptest.NewRequest("GET", "http://example.com/events", nil)
+		go i.InterceptResponse(flow.New(req), req, resp, true)
+		waitPaused(t, i, 1)
+		ui.eventually(t, "paused flows", func() bool { return len(ui.pausedFlows) == 1 })
+
+		ui.keys("e")
+		ui.eventually(t, "log message", func() bool { return strings.Contains(ui.log.GetText(false), "cannot be edited") })
+		ui.eventually(t, "no editor", func() bool { return !ui.pages.HasPage("edit") })
+
+		ui.keys("d")
+		waitPaused(t, i, 0)
+	})
+
+	t.Run("Clears breakpoints", func(t *testing.T) {
+		ui.keys("c")
+		ui.eventually(t, "no breakpoints", func() bool { return len(i.Breakpoints()) == 0 })
+	})
+}